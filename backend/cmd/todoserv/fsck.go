@@ -0,0 +1,48 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"todolist/internal/db"
+)
+
+// fsck implements the "fsck" subcommand, which checks the integrity of the
+// database and finds records referring to missing ones, optionally repairing
+// them.
+func fsck(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("fsck", flag.ExitOnError)
+	path := fs.String("db", defaultDB, "path to an SQLite database or a postgres:// DSN")
+	kind := fs.String("store", "", "kind of store: sqlite or postgres; chosen by the -db DSN if empty")
+	repair := fs.Bool("repair", false, "remove orphaned records, move orphaned items to the top level and hand unclaimed lists over to the users of their owners' names")
+	fs.Parse(args)
+
+	store, err := db.NewDB(ctx, db.Options{Store: *kind, DSN: *path, SkipMigrations: true})
+	if err != nil {
+		return err
+	}
+	defer store.Close(ctx)
+
+	if *repair {
+		repaired, err := store.Repair(ctx)
+		if err != nil {
+			return err
+		}
+		for _, note := range repaired {
+			fmt.Println(note)
+		}
+	}
+
+	problems, err := store.Check(ctx)
+	if err != nil {
+		return err
+	}
+	for _, problem := range problems {
+		fmt.Println(problem)
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("found %d problems", len(problems))
+	}
+	fmt.Println("no problems found")
+	return nil
+}
@@ -5,22 +5,71 @@ import (
 	"flag"
 	"log/slog"
 	"os"
+	"strings"
+	"time"
 	"todolist/internal/api"
-	"todolist/internal/conv"
 	"todolist/internal/db"
+	"todolist/internal/sse"
 
-	"github.com/gofrs/uuid"
 	"github.com/phsym/console-slog"
 )
 
-func main() {
-	path := flag.String("db", "/tmp/db.bin", "path to database")
-	flag.Parse()
+const defaultDB = "/tmp/db.bin"
 
+func main() {
 	logger := slog.New(console.NewHandler(os.Stdout, &console.HandlerOptions{Level: slog.LevelDebug}))
 	ctx := context.Background()
 
-	store, err := db.NewDB(ctx, db.Options{DSN: *path})
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		err := migrate(ctx, os.Args[2:])
+		if err != nil {
+			logger.Error("migration failed", "error", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == "fsck" {
+		err := fsck(ctx, os.Args[2:])
+		if err != nil {
+			logger.Error("check failed", "error", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	path := flag.String("db", defaultDB, "path to an SQLite database, or a postgres:// or memory: DSN")
+	kind := flag.String("store", "", "kind of store: sqlite, postgres or memory; chosen by the -db DSN if empty")
+	retention := flag.Duration("event-retention", 24*time.Hour, "how long events are kept for reconnecting clients, 0 keeps them forever")
+	trashRetention := flag.Duration("trash-retention", 30*24*time.Hour, "how long deleted lists and items can be restored, 0 keeps them forever")
+	historyRetention := flag.Duration("history-retention", 90*24*time.Hour, "how long revisions are kept and can be undone, 0 keeps them forever")
+	queue := flag.Int("sse-queue", sse.DefaultOptions.QueueSize, "number of events queued for a client before -sse-policy applies")
+	policy := flag.String("sse-policy", sse.DefaultOptions.Policy.String(), "what to do when a client's queue is full: disconnect, drop-oldest (and send a reset event) or coalesce")
+	writeTimeout := flag.Duration("sse-write-timeout", sse.DefaultOptions.WriteTimeout, "how long writing an event to a client may take")
+	heartbeat := flag.Duration("sse-heartbeat", sse.DefaultOptions.Heartbeat, "interval of heartbeats sent to idle clients, 0 disables them")
+	retry := flag.Duration("sse-retry", sse.DefaultOptions.Retry, "time clients are told to wait before reconnecting")
+	sessionLifetime := flag.Duration("session-lifetime", 30*24*time.Hour, "how long a login lasts")
+	secureCookies := flag.Bool("secure-cookies", false, "only send session cookies over HTTPS")
+	textCompaction := flag.Duration("text-compaction", 10*time.Second, "how often collaboratively edited texts are stored")
+	presenceTTL := flag.Duration("presence-ttl", 30*time.Second, "how long the cursor and selection of a client are shown unless refreshed")
+	origins := flag.String("allowed-origins", "http://localhost:8080,http://localhost:3000", "comma separated origins of the web clients allowed to make requests with their users' credentials")
+	metricsToken := flag.String("metrics-token", "", "bearer token required to read /metrics, which is not served if empty")
+	flag.Parse()
+
+	events := sse.Options{
+		QueueSize:    *queue,
+		WriteTimeout: *writeTimeout,
+		Heartbeat:    *heartbeat,
+		Retry:        *retry,
+	}
+	var err error
+	events.Policy, err = sse.ParsePolicy(*policy)
+	if err != nil {
+		logger.Error("invalid -sse-policy", "error", err)
+		os.Exit(2)
+	}
+
+	store, err := db.Open(ctx, db.Options{Store: *kind, DSN: *path})
 	if err != nil {
 		logger.Error("failed to create database", "error", err)
 		return
@@ -29,65 +78,134 @@ func main() {
 
 	lists, err := store.GetTodoLists(ctx)
 	if err != nil {
-		logger.Error("failed to query database", "error", err)
+		logger.Error("failed to get todo lists", "error", err)
+		return
+	}
+
+	for _, list := range lists {
+		logger.Info("todo list", list.ID.String(), *list.Name)
+	}
+
+	go compactEvents(ctx, logger, store, *retention)
+	go purgeSessions(ctx, logger, store)
+	go purgeTrash(ctx, logger, store, *trashRetention)
+	go purgeHistory(ctx, logger, store, *historyRetention)
+
+	service := api.New(ctx, logger, store, api.Options{
+		Events:          events,
+		SessionLifetime: *sessionLifetime,
+		SecureCookies:   *secureCookies,
+		TextCompaction:  *textCompaction,
+		PresenceTTL:     *presenceTTL,
+		AllowedOrigins:  strings.Split(*origins, ","),
+		MetricsToken:    *metricsToken,
+	})
+	service.Run()
+}
+
+// compactEvents periodically removes events older than the retention from the
+// event log, together with the record of operations synced before then.
+// Clients that reconnect after that receive a full snapshot.
+func compactEvents(ctx context.Context, logger *slog.Logger, store db.Store, retention time.Duration) {
+	if retention <= 0 {
 		return
 	}
 
-	if len(lists) == 0 {
-		// Add some sample data for the project
-		id, err := uuid.NewV4()
+	ticker := time.NewTicker(max(retention/24, time.Minute))
+	defer ticker.Stop()
+
+	for {
+		removed, err := store.CompactEvents(ctx, time.Now().Add(-retention))
 		if err != nil {
-			logger.Error("failed to create sample data", "error", err)
-			return
+			logger.Error("failed to compact events", "error", err)
+		} else if removed > 0 {
+			logger.Info("compacted events", "removed", removed)
 		}
 
-		ida, err := uuid.NewV4()
+		removed, err = store.RemoveOperations(ctx, time.Now().Add(-retention))
 		if err != nil {
-			logger.Error("failed to create sample data", "error", err)
+			logger.Error("failed to remove synced operations", "error", err)
+		} else if removed > 0 {
+			logger.Info("removed synced operations", "removed", removed)
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
 			return
 		}
+	}
+}
 
-		idb, err := uuid.NewV4()
+// purgeSessions periodically removes expired logins.
+func purgeSessions(ctx context.Context, logger *slog.Logger, store db.Store) {
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+
+	for {
+		removed, err := store.RemoveExpiredSessions(ctx, time.Now())
 		if err != nil {
-			logger.Error("failed to create sample data", "error", err)
-			return
+			logger.Error("failed to purge sessions", "error", err)
+		} else if removed > 0 {
+			logger.Info("purged sessions", "removed", removed)
 		}
 
-		sample := db.TodoList{
-			ID:    &id,
-			Owner: conv.Pointer("Jonas"),
-			Name:  conv.Pointer("Shopping list, Sunday"),
-			Items: []db.TodoItem{
-				{
-					ID:     &ida,
-					Text:   conv.Pointer("Salad"),
-					Marked: conv.Pointer(false),
-				},
-				{
-					ID:     &idb,
-					Text:   conv.Pointer("Potatoes"),
-					Marked: conv.Pointer(true),
-				},
-			},
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
 		}
+	}
+}
+
+// purgeTrash periodically removes the lists and items that were deleted
+// longer than the retention ago, after which they can no longer be restored.
+func purgeTrash(ctx context.Context, logger *slog.Logger, store db.Store, retention time.Duration) {
+	if retention <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(max(retention/24, time.Minute))
+	defer ticker.Stop()
 
-		err = store.AddTodoList(ctx, sample)
+	for {
+		removed, err := store.PurgeDeleted(ctx, time.Now().Add(-retention))
 		if err != nil {
-			logger.Error("failed to create sample data", "error", err)
+			logger.Error("failed to purge trash", "error", err)
+		} else if removed > 0 {
+			logger.Info("purged trash", "removed", removed)
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
 			return
 		}
 	}
+}
 
-	lists, err = store.GetTodoLists(ctx)
-	if err != nil {
-		logger.Error("failed to get todo lists", "error", err)
+// purgeHistory periodically removes the revisions made longer than the
+// retention ago, after which they can no longer be undone.
+func purgeHistory(ctx context.Context, logger *slog.Logger, store db.Store, retention time.Duration) {
+	if retention <= 0 {
 		return
 	}
 
-	for _, list := range lists {
-		logger.Info("todo list", list.ID.String(), *list.Name)
-	}
+	ticker := time.NewTicker(max(retention/24, time.Minute))
+	defer ticker.Stop()
 
-	service := api.New(ctx, logger, store)
-	service.Run()
+	for {
+		removed, err := store.PurgeHistory(ctx, time.Now().Add(-retention))
+		if err != nil {
+			logger.Error("failed to purge history", "error", err)
+		} else if removed > 0 {
+			logger.Info("purged history", "removed", removed)
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
 }
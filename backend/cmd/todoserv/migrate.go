@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+	"todolist/internal/db"
+)
+
+// migrate implements the "migrate" subcommand, which applies pending schema
+// migrations or lists their state without starting the server.
+func migrate(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("migrate", flag.ExitOnError)
+	path := fs.String("db", defaultDB, "path to an SQLite database or a postgres:// DSN")
+	kind := fs.String("store", "", "kind of store: sqlite or postgres; chosen by the -db DSN if empty")
+	status := fs.Bool("status", false, "only show the migration status")
+	fs.Parse(args)
+
+	store, err := db.NewDB(ctx, db.Options{Store: *kind, DSN: *path, SkipMigrations: true})
+	if err != nil {
+		return err
+	}
+	defer store.Close(ctx)
+
+	if !*status {
+		applied, err := store.Migrate(ctx)
+		for _, m := range applied {
+			fmt.Printf("applied %d: %s\n", m.Version, m.Name)
+			for _, note := range m.Notes {
+				fmt.Printf("  %s\n", note)
+			}
+		}
+		if err != nil {
+			return err
+		}
+		if len(applied) == 0 {
+			fmt.Println("database is up to date")
+		}
+		return nil
+	}
+
+	states, err := store.Migrations(ctx)
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "VERSION\tNAME\tAPPLIED")
+	for _, state := range states {
+		applied := "pending"
+		if state.AppliedAt != nil {
+			applied = state.AppliedAt.Local().Format(time.RFC3339)
+		}
+		fmt.Fprintf(w, "%d\t%s\t%s\n", state.Version, state.Name, applied)
+	}
+	return w.Flush()
+}
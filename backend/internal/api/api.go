@@ -1,38 +1,104 @@
 package api
 
 import (
+	"bytes"
 	"context"
+	"crypto/subtle"
 	"encoding/json"
+	"errors"
 	"io"
 	"log/slog"
 	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/go-chi/chi/middleware"
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/cors"
 	"github.com/gofrs/uuid"
 
+	"todolist/internal/conv"
 	"todolist/internal/db"
+	"todolist/internal/presence"
 	"todolist/internal/sse"
 )
 
 const (
-	tokenList = "listID"
-	tokenItem = "itemID"
+	tokenList     = "listID"
+	tokenItem     = "itemID"
+	tokenRevision = "revisionID"
+	tokenUser     = "user"
+	tokenRole     = "role"
+	tokenFrozen   = "frozen"
 )
 
 type api struct {
-	store  *db.DB
-	logger *slog.Logger
-	server *sse.Server
+	store   db.Store
+	logger  *slog.Logger
+	server  *sse.Server
+	options Options
+
+	// topics orders the recording of the events of each list with their
+	// delivery, so that subscribers receive them in sequence order.
+	topics topicLocks
+
+	texts    texts
+	presence *presence.Tracker
+}
+
+// Options configure the service.
+type Options struct {
+	// Events configures the delivery of server sent events.
+	Events sse.Options
+
+	// SessionLifetime is how long a login lasts.
+	SessionLifetime time.Duration
+
+	// SecureCookies restricts session cookies to HTTPS.
+	SecureCookies bool
+
+	// TextCompaction is how often collaboratively edited texts are stored
+	// in their items.
+	TextCompaction time.Duration
+
+	// PresenceTTL is how long the presence of a client lasts unless it is
+	// refreshed.
+	PresenceTTL time.Duration
+
+	// AllowedOrigins are the origins of the web clients that may make
+	// requests with the credentials of their users.
+	AllowedOrigins []string
+
+	// MetricsToken is the bearer token required to read /metrics, which is
+	// not served if it is empty.
+	MetricsToken string
 }
 
-func New(ctx context.Context, logger *slog.Logger, store *db.DB) *api {
-	return &api{
-		store:  store,
-		logger: logger,
-		server: sse.New(ctx, logger),
+func New(ctx context.Context, logger *slog.Logger, store db.Store, opt Options) *api {
+	if opt.SessionLifetime <= 0 {
+		opt.SessionLifetime = 30 * 24 * time.Hour
+	}
+	if opt.TextCompaction <= 0 {
+		opt.TextCompaction = 10 * time.Second
+	}
+	if opt.PresenceTTL <= 0 {
+		opt.PresenceTTL = 30 * time.Second
+	}
+
+	a := &api{
+		store:   store,
+		logger:  logger,
+		server:  sse.New(ctx, logger, opt.Events),
+		options: opt,
+		topics:  topicLocks{locks: make(map[uuid.UUID]*topicLock)},
+		texts:   texts{docs: make(map[textKey]*textDoc)},
 	}
+	a.presence = presence.New(ctx, opt.PresenceTTL, a.leavePresence)
+	go a.compactTexts(ctx, opt.TextCompaction)
+	return a
 }
 
 func (a *api) logRequest(next http.Handler) http.Handler {
@@ -44,6 +110,11 @@ func (a *api) logRequest(next http.Handler) http.Handler {
 }
 
 func (a *api) Run() {
+	http.ListenAndServe(":2000", a.routes())
+}
+
+// routes returns the router serving the api.
+func (a *api) routes() http.Handler {
 	// Create a new Chi router
 	r := chi.NewRouter()
 	r.Use(a.logRequest)
@@ -51,293 +122,765 @@ func (a *api) Run() {
 	r.Use(middleware.RealIP)
 	r.Use(middleware.Recoverer)
 	r.Use(cors.Handler(cors.Options{
-		AllowedOrigins:   []string{"https://*", "http://*"},
-		AllowedMethods:   []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"},
+		AllowedOrigins:   a.options.AllowedOrigins,
+		AllowedMethods:   []string{"GET", "POST", "PUT", "PATCH", "DELETE", "OPTIONS"},
 		AllowedHeaders:   []string{"*"},
-		ExposedHeaders:   []string{"Link"},
-		AllowCredentials: false,
+		ExposedHeaders:   []string{"Link", "ETag", "X-Total-Count"},
+		AllowCredentials: true,
 		MaxAge:           300, // Maximum value not ignored by any of major browsers
 	}))
 
-	// Handle the HTTP route for SSE
-	r.Get("/events", a.handleEvents)
-
-	// Lists management
-	r.Post("/list", a.handleNewList)
-	r.Route("/list/{"+tokenList+"}", func(r chi.Router) {
-		r.Use(a.listContext)
-		r.Delete("/", a.handleDeleteList)
-		r.Put("/add", a.handleAddItem)
-		r.Route("/item/{"+tokenItem+"}", func(r chi.Router) {
-			r.Use(a.itemContext)
-			r.Put("/", a.handleUpdateItem)
-			r.Delete("/", a.handleDeleteItem)
+	if a.options.MetricsToken != "" {
+		r.Get("/metrics", a.handleMetrics)
+	}
+
+	// Accounts
+	r.Post("/register", a.handleRegister)
+	r.Post("/login", a.handleLogin)
+
+	r.Group(func(r chi.Router) {
+		r.Use(a.authenticate)
+		r.Post("/logout", a.handleLogout)
+		r.Get("/me", a.handleMe)
+
+		// Handle the HTTP routes for SSE, either for several lists given
+		// as list query parameters or for a single list
+		r.Get("/events", a.handleEvents)
+
+		// Apply changes queued by offline clients
+		r.Post("/sync", a.handleSync)
+
+		// Lists management
+		r.Get("/list", a.handleGetLists)
+		r.Post("/list", a.handleNewList)
+
+		// Full-text search across the lists of the user
+		r.Get("/search", a.handleSearch)
+
+		// Deleted lists and items, and restoring deleted lists, which
+		// listContext reports as missing
+		r.Get("/trash", a.handleGetTrash)
+		r.Post("/list/{"+tokenList+"}/restore", a.handleRestoreList)
+
+		r.Route("/list/{"+tokenList+"}", func(r chi.Router) {
+			r.Use(a.listContext)
+			r.Get("/", a.handleGetList)
+			r.Get("/items", a.handleGetItems)
+			r.Get("/events", a.handleListEvents)
+			r.Get("/history", a.handleGetHistory)
+			r.With(a.requireRole(db.RoleEditor), a.mutable).Post("/history/{"+tokenRevision+"}/undo", a.handleUndo)
+			r.With(a.requireRole(db.RoleOwner)).Post("/freeze", a.handleFreezeList)
+			r.With(a.requireRole(db.RoleOwner)).Post("/unfreeze", a.handleUnfreezeList)
+			r.With(a.requireRole(db.RoleOwner), a.mutable).Delete("/", a.handleDeleteList)
+			r.With(a.requireRole(db.RoleEditor), a.mutable).Put("/add", a.handleAddItem)
+			r.Route("/item/{"+tokenItem+"}", func(r chi.Router) {
+				r.Use(a.itemContext)
+				r.Get("/", a.handleGetItem)
+				r.Get("/text/{"+tokenField+"}", a.handleGetText)
+				r.Get("/history", a.handleGetItemHistory)
+				r.Group(func(r chi.Router) {
+					r.Use(a.requireRole(db.RoleEditor))
+					r.Use(a.mutable)
+					r.Put("/", a.handleUpdateItem)
+					r.Put("/add", a.handleAddChildItem)
+					r.Patch("/move", a.handleMoveItem)
+					r.Patch("/text/{"+tokenField+"}", a.handleUpdateText)
+					r.Delete("/", a.handleDeleteItem)
+					r.Post("/restore", a.handleRestoreItem)
+				})
+			})
+
+			// Presence
+			r.Get("/presence", a.handleGetPresence)
+			r.Post("/presence", a.handleSetPresence)
+			r.Delete("/presence", a.handleLeavePresence)
+
+			// Sharing
+			r.Route("/members", func(r chi.Router) {
+				r.Get("/", a.handleGetMembers)
+				r.With(a.requireRole(db.RoleAdmin)).Post("/", a.handleAddMember)
+				r.With(a.requireRole(db.RoleAdmin)).Put("/{"+tokenMember+"}", a.handleUpdateMember)
+				r.Delete("/{"+tokenMember+"}", a.handleRemoveMember)
+			})
 		})
 	})
-
-	http.ListenAndServe(":2000", r)
+	return r
 }
 
+// listContext adds the list, whether it is frozen and the role of the
+// authenticated user in it to the request. Lists that have not been shared
+// with the user are reported as missing, so that their existence is not
+// revealed.
 func (a *api) listContext(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		listID := chi.URLParam(r, tokenList)
-		ctx := context.WithValue(r.Context(), tokenList, listID)
+		id, err := uuid.FromString(chi.URLParam(r, tokenList))
+		if err != nil {
+			a.writeInvalidID(w, "list")
+			return
+		}
+
+		role, frozen, err := a.store.GetListAccess(r.Context(), id, principal(r.Context()).ID)
+		if err == nil && role == "" {
+			err = db.ErrNotFound
+		}
+		if err != nil {
+			a.writeStoreError(w, err, "list")
+			return
+		}
+
+		ctx := context.WithValue(r.Context(), tokenList, id)
+		ctx = context.WithValue(ctx, tokenRole, role)
+		ctx = context.WithValue(ctx, tokenFrozen, frozen)
 		next.ServeHTTP(w, r.WithContext(ctx))
 	})
 }
 
 func (a *api) itemContext(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		itemID := chi.URLParam(r, tokenItem)
-		ctx := context.WithValue(r.Context(), tokenItem, itemID)
+		id, err := uuid.FromString(chi.URLParam(r, tokenItem))
+		if err != nil {
+			a.writeInvalidID(w, "item")
+			return
+		}
+		ctx := context.WithValue(r.Context(), tokenItem, id)
 		next.ServeHTTP(w, r.WithContext(ctx))
 	})
 }
 
 func (a *api) handleEvents(w http.ResponseWriter, r *http.Request) {
+	var ids []uuid.UUID
+	for _, param := range r.URL.Query()["list"] {
+		for _, listID := range strings.Split(param, ",") {
+			id, err := uuid.FromString(listID)
+			if err != nil {
+				a.writeInvalidID(w, "list")
+				return
+			}
+			ids = append(ids, id)
+		}
+	}
+
+	if len(ids) == 0 {
+		a.writeError(w, http.StatusBadRequest, Error{
+			Code:    CodeBadRequest,
+			Message: "no lists to subscribe to",
+			Fields:  []FieldError{{Field: "list", Message: "is required"}},
+		})
+		return
+	}
+
+	for _, id := range ids {
+		role, _, err := a.store.GetListAccess(r.Context(), id, principal(r.Context()).ID)
+		if err == nil && role == "" {
+			err = db.ErrNotFound
+		}
+		if err != nil {
+			a.writeStoreError(w, err, "list")
+			return
+		}
+	}
+
+	a.streamEvents(w, r, ids)
+}
+
+func (a *api) handleListEvents(w http.ResponseWriter, r *http.Request) {
+	a.streamEvents(w, r, []uuid.UUID{pathID(r.Context(), tokenList)})
+}
+
+// streamEvents sends the current state of the lists to the client followed by
+// every change made to them, until the client goes away. A client that
+// reconnects with the ID of the last event it received is only sent the
+// events it missed, unless those are no longer in the event log. The items of
+// the initial state can be filtered, see parseItemFilter.
+func (a *api) streamEvents(w http.ResponseWriter, r *http.Request, ids []uuid.UUID) {
+	ctx := r.Context()
+
+	filter, fields := parseItemFilter(r)
+	if fields != nil {
+		a.writeError(w, http.StatusBadRequest, Error{Code: "invalid-filter", Message: "invalid item filter", Fields: fields})
+		return
+	}
+
+	lastEventID := r.Header.Get("Last-Event-ID")
+	if lastEventID == "" {
+		lastEventID = r.URL.Query().Get("lastEventId")
+	}
+
+	unlock := a.topics.lock(ids...)
+	locked := true
+	defer func() {
+		if locked {
+			unlock()
+		}
+	}()
+
+	var events []sse.Event
+	replay := false
+	if lastEventID != "" {
+		seq, err := strconv.ParseInt(lastEventID, 10, 64)
+		if err != nil {
+			a.writeError(w, http.StatusBadRequest, Error{
+				Code:    CodeBadRequest,
+				Message: "invalid last event id",
+				Fields:  []FieldError{{Field: "lastEventId", Message: "must be an event sequence number"}},
+			})
+			return
+		}
+
+		missed, err := a.store.EventsSince(ctx, seq, ids)
+		if err != nil && !errors.Is(err, db.ErrCompacted) {
+			a.writeInternal(w, "failed to get missed events", err)
+			return
+		}
+
+		if err == nil {
+			replay = true
+			for _, event := range missed {
+				events = append(events, sse.Event{
+					ID:   strconv.FormatInt(*event.Seq, 10),
+					Name: *event.Type,
+					Data: []byte(*event.Data),
+				})
+			}
+		}
+	}
+
+	if !replay {
+		// Events recorded while the snapshot is taken may be delivered
+		// twice, but never lost
+		seq, err := a.store.LatestEventSeq(ctx)
+		if err != nil {
+			a.writeInternal(w, "failed to get latest event", err)
+			return
+		}
+
+		for _, id := range ids {
+			todo, err := a.store.GetTodoList(ctx, id)
+			if err != nil {
+				a.writeStoreError(w, err, "list")
+				return
+			}
+
+			nlist := NewTodoList(todo)
+			nlist.Items = filter.apply(nlist.Items)
+			data, err := json.Marshal(ListEvent{
+				Type:     UpdateList,
+				TodoList: &nlist,
+			})
+			if err != nil {
+				a.writeInternal(w, "failed to marshal event", err)
+				return
+			}
+
+			events = append(events, sse.Event{
+				ID:   strconv.FormatInt(seq, 10),
+				Name: UpdateList,
+				Data: data,
+			})
+		}
+	}
+
 	w.Header().Set("Content-Type", "text/event-stream")
 	w.Header().Set("Cache-Control", "no-cache")
 	w.Header().Set("Connection", "keep-alive")
-	w.Header().Set("Access-Control-Allow-Origin", "*")
 
-	todos, err := a.store.GetTodoLists(r.Context())
+	topics := make([]string, len(ids))
+	for i, id := range ids {
+		topics[i] = listTopic(id)
+	}
+
+	session, err := a.server.NewSession(w, r, principal(ctx).ID.String(), topics...)
 	if err != nil {
-		a.logger.Error("failed to get todo lists", "error", err)
-		w.WriteHeader(http.StatusInternalServerError)
+		a.writeInternal(w, "failed to make SSE session", err)
 		return
 	}
 
-	var events []ListEvent
-	for _, todo := range todos {
-		nlist := NewTodoList(todo)
-		event := ListEvent{
-			Type:     UpdateList,
-			TodoList: &nlist,
+	// Send the missed events, or the existing todo lists, before any event
+	// published after subscribing
+	session.Preload(events...)
+
+	unlock()
+	locked = false
+
+	session.Wait()
+}
+
+func listTopic(id uuid.UUID) string {
+	return "list/" + id.String()
+}
+
+// pending is an event of a list that is recorded together with the change
+// it is about.
+type pending struct {
+	list  uuid.UUID
+	event event
+}
+
+// change calls fn to change the given lists and records the events it
+// returns in the event log in the same transaction, so that no change is
+// made without its events, then sends them to the subscribers of their
+// lists. The lists are locked meanwhile, so that the events of a list are
+// delivered in sequence order.
+func (a *api) change(ctx context.Context, lists []uuid.UUID, fn func(ctx context.Context) ([]pending, error)) error {
+	unlock := a.topics.lock(lists...)
+	defer unlock()
+
+	type recorded struct {
+		topic string
+		event sse.Event
+	}
+	var events []recorded
+	err := a.store.Atomically(ctx, func(ctx context.Context) error {
+		changes, err := fn(ctx)
+		if err != nil {
+			return err
+		}
+		events = events[:0]
+		for _, change := range changes {
+			data, err := json.Marshal(change.event)
+			if err != nil {
+				return err
+			}
+			seq, err := a.store.AppendEvent(ctx, db.Event{
+				List: &change.list,
+				Type: conv.Pointer(change.event.eventType()),
+				Data: conv.Pointer(string(data)),
+			})
+			if err != nil {
+				return err
+			}
+			events = append(events, recorded{listTopic(change.list), sse.Event{
+				ID:   strconv.FormatInt(seq, 10),
+				Name: change.event.eventType(),
+				Key:  change.event.coalesceKey(),
+				Data: data,
+			}})
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, recorded := range events {
+		a.server.Publish(recorded.topic, recorded.event)
+	}
+	return nil
+}
+
+// topicLocks are the locks of the lists whose events are being recorded or
+// whose subscribers are being sent their current state.
+type topicLocks struct {
+	sync.Mutex
+	locks map[uuid.UUID]*topicLock
+}
+
+type topicLock struct {
+	sync.Mutex
+	waiting int
+}
+
+// lock locks the given lists, in a fixed order so that callers locking
+// several lists do not deadlock, and returns the function unlocking them.
+func (t *topicLocks) lock(ids ...uuid.UUID) (unlock func()) {
+	ids = slices.Clone(ids)
+	slices.SortFunc(ids, func(a uuid.UUID, b uuid.UUID) int {
+		return bytes.Compare(a.Bytes(), b.Bytes())
+	})
+	ids = slices.Compact(ids)
+
+	locks := make([]*topicLock, len(ids))
+	t.Lock()
+	for i, id := range ids {
+		l, ok := t.locks[id]
+		if !ok {
+			l = &topicLock{}
+			t.locks[id] = l
+		}
+		l.waiting++
+		locks[i] = l
+	}
+	t.Unlock()
+
+	for _, l := range locks {
+		l.Lock()
+	}
+	return func() {
+		t.Lock()
+		defer t.Unlock()
+		for i, l := range locks {
+			l.Unlock()
+			l.waiting--
+			if l.waiting == 0 {
+				delete(t.locks, ids[i])
+			}
 		}
-		events = append(events, event)
 	}
+}
 
-	session, err := a.server.NewSession(w, r)
+// broadcast delivers an event to the subscribers of a list without recording
+// it, for events that reconnecting clients do not need.
+func (a *api) broadcast(list uuid.UUID, event event) {
+	data, err := json.Marshal(event)
 	if err != nil {
-		a.logger.Error("failed to make SSE session", "error", err)
-		w.WriteHeader(http.StatusInternalServerError)
+		a.logger.Error("unable to publish event", "error", err)
 		return
 	}
 
-	// Send all existing todo lists for a new client
-	for _, event := range events {
-		data, err := json.Marshal(event)
-		if err != nil {
-			a.logger.Error("failed to marshal event", "error", err)
-			w.WriteHeader(http.StatusInternalServerError)
-			return
-		}
+	a.server.Publish(listTopic(list), sse.Event{
+		Name: event.eventType(),
+		Key:  event.coalesceKey(),
+		Data: data,
+	})
+}
 
-		session.Send(data)
+// handleMetrics responds with the counters of the event delivery to callers
+// presenting the metrics token, which is not a session token.
+func (a *api) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	token, _ := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if subtle.ConstantTimeCompare([]byte(token), []byte(a.options.MetricsToken)) != 1 {
+		a.writeError(w, http.StatusUnauthorized, Error{Code: "unauthorized", Message: "metrics token required"})
+		return
 	}
 
-	session.Wait()
+	a.writeJSON(w, http.StatusOK, struct {
+		Events sse.Stats `json:"events"`
+	}{
+		Events: a.server.Stats(),
+	})
+}
+
+func (a *api) writeJSON(w http.ResponseWriter, status int, body any) {
+	data, err := json.Marshal(body)
+	if err != nil {
+		a.logger.Error("failed to marshal response", "error", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(data)
 }
 
 func (a *api) handleNewList(w http.ResponseWriter, r *http.Request) {
 	data, err := io.ReadAll(r.Body)
 	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
+		a.writeBadRequest(w, err)
 		return
 	}
 
 	var t TodoList
 	err = json.Unmarshal(data, &t)
 	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
+		a.writeBadRequest(w, err)
 		return
 	}
 
-	id, err := uuid.NewV4()
-	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
+	if t.Name == "" {
+		a.writeError(w, http.StatusUnprocessableEntity, Error{
+			Code:    "invalid-list",
+			Message: "the list needs a name",
+			Fields:  []FieldError{{Field: "name", Message: "is required"}},
+		})
 		return
 	}
-
-	t.ID = id
-	for i := range t.Items {
-		id, err = uuid.NewV4()
-		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			return
-		}
-		t.Items[i].ID = id
+	if !validPrices(t.Items) {
+		a.writeInvalidPrice(w)
+		return
+	}
+	fields := validateKinds(t.Items)
+	if fields != nil {
+		a.writeInvalid(w, fields)
+		return
 	}
 
-	if t.Name == "" {
-		w.WriteHeader(http.StatusBadRequest)
+	t.ID, err = uuid.NewV4()
+	if err != nil {
+		a.writeInternal(w, "failed to make list id", err)
 		return
 	}
-	if t.Owner == "" {
-		w.WriteHeader(http.StatusBadRequest)
+	err = assignItemIDs(t.Items, t.ID, nil)
+	if err != nil {
+		a.writeInternal(w, "failed to make item ids", err)
 		return
 	}
-
-	err = a.store.AddTodoList(r.Context(), t.Record())
+	// Lists are owned by whoever creates them
+	user := principal(r.Context())
+	record := t.Record()
+	record.OwnerID = &user.ID
+	for i := range record.Items {
+		completedBy(&record.Items[i], user.ID)
+	}
+	err = a.change(r.Context(), []uuid.UUID{t.ID}, func(ctx context.Context) ([]pending, error) {
+		err := a.store.AddTodoList(ctx, record)
+		if err != nil {
+			return nil, err
+		}
+		// Respond with the list so that the client learns its identity
+		// and can subscribe to it
+		stored, err := a.store.GetTodoList(ctx, t.ID)
+		if err != nil {
+			return nil, err
+		}
+		t = NewTodoList(stored)
+		return []pending{{t.ID, ListEvent{UpdateList, &t}}}, nil
+	})
 	if err != nil {
-		a.logger.Error("failed to add to store", "error", err)
-		w.WriteHeader(http.StatusBadRequest)
+		a.writeStoreError(w, err, "list")
 		return
 	}
 
-	event := ListEvent{UpdateList, &t}
-	data, err = json.Marshal(event)
-	if err == nil {
-		a.server.Broadcast(data)
-	} else {
-		a.logger.Error("unable to broadcast event", "error", err)
-	}
+	w.Header().Set("Location", "/list/"+t.ID.String())
+	w.Header().Set("ETag", etag(t.Version))
+	a.writeJSON(w, http.StatusCreated, t)
 }
 
 func (a *api) handleDeleteList(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
-	listID, ok := ctx.Value(tokenList).(string)
+	id := pathID(ctx, tokenList)
+
+	version, ok := a.ifMatch(r, id, nil)
 	if !ok {
-		w.WriteHeader(http.StatusBadRequest)
+		a.writePreconditionFailed(ctx, w, id, nil)
 		return
 	}
 
-	id, err := uuid.FromString(listID)
+	err := a.change(ctx, []uuid.UUID{id}, func(ctx context.Context) ([]pending, error) {
+		err := a.store.RemoveTodoList(ctx, id, version)
+		if err != nil {
+			return nil, err
+		}
+		return []pending{{id, ListEvent{RemoveList, &TodoList{ID: id}}}}, nil
+	})
+	if errors.Is(err, db.ErrVersionMismatch) {
+		a.writePreconditionFailed(ctx, w, id, nil)
+		return
+	}
 	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
+		a.writeStoreError(w, err, "list")
 		return
 	}
 
-	err = a.store.RemoveTodoList(ctx, id)
+	w.WriteHeader(http.StatusNoContent)
+	a.server.CloseTopic(listTopic(id))
+}
+
+func (a *api) handleFreezeList(w http.ResponseWriter, r *http.Request) {
+	a.setFrozen(w, r, true)
+}
+
+func (a *api) handleUnfreezeList(w http.ResponseWriter, r *http.Request) {
+	a.setFrozen(w, r, false)
+}
+
+func (a *api) setFrozen(w http.ResponseWriter, r *http.Request, frozen bool) {
+	ctx := r.Context()
+	id := pathID(ctx, tokenList)
+
+	list := &TodoList{ID: id, Frozen: frozen}
+	err := a.change(ctx, []uuid.UUID{id}, func(ctx context.Context) ([]pending, error) {
+		err := a.store.SetListFrozen(ctx, id, frozen)
+		if err != nil {
+			return nil, err
+		}
+		event := ListEvent{UnfreezeList, list}
+		if frozen {
+			event.Type = FreezeList
+		}
+		return []pending{{id, event}}, nil
+	})
 	if err != nil {
-		a.logger.Error("failed to remove from store", "error", err)
-		w.WriteHeader(http.StatusBadRequest)
+		a.writeStoreError(w, err, "list")
 		return
 	}
 
-	w.WriteHeader(http.StatusOK)
+	a.writeJSON(w, http.StatusOK, list)
+}
 
-	event := ListEvent{RemoveList, &TodoList{ID: id}}
-	data, err := json.Marshal(event)
-	if err == nil {
-		a.server.Broadcast(data)
-	} else {
-		a.logger.Error("unable to broadcast event", "error", err)
+// assignItemIDs gives new identities to items and, recursively, to their
+// children, since clients are not allowed to choose them.
+func assignItemIDs(items []TodoItem, list uuid.UUID, parent *uuid.UUID) error {
+	for i := range items {
+		id, err := uuid.NewV4()
+		if err != nil {
+			return err
+		}
+		items[i].ID = id
+		items[i].List = list
+		items[i].Parent = parent
+		err = assignItemIDs(items[i].Children, list, &items[i].ID)
+		if err != nil {
+			return err
+		}
 	}
+	return nil
 }
 
 func (a *api) handleAddItem(w http.ResponseWriter, r *http.Request) {
+	a.addItem(w, r, nil)
+}
+
+func (a *api) handleAddChildItem(w http.ResponseWriter, r *http.Request) {
+	parent := pathID(r.Context(), tokenItem)
+	a.addItem(w, r, &parent)
+}
+
+func (a *api) addItem(w http.ResponseWriter, r *http.Request, parent *uuid.UUID) {
 	ctx := r.Context()
-	listID, ok := ctx.Value(tokenList).(string)
-	if !ok {
-		w.WriteHeader(http.StatusBadRequest)
-		return
-	}
+	listID := pathID(ctx, tokenList)
 
-	id, err := uuid.NewV4()
+	// The body is optional and may hold the initial text, price and kind
+	data, err := io.ReadAll(r.Body)
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
+		a.writeBadRequest(w, err)
 		return
 	}
 
-	ulistID, err := uuid.FromString(listID)
+	var todo TodoItem
+	if len(bytes.TrimSpace(data)) > 0 {
+		err = json.Unmarshal(data, &todo)
+		if err != nil {
+			a.writeBadRequest(w, err)
+			return
+		}
+	}
+
+	todo.ID, err = uuid.NewV4()
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
+		a.writeInternal(w, "failed to make item id", err)
 		return
 	}
+	todo.List = listID
+	todo.Parent = parent
+	todo.Children = nil
+	if todo.Text == "" {
+		todo.Text = "My new item"
+	}
 
-	todo := TodoItem{
-		ID:     id,
-		List:   ulistID,
-		Text:   "My new item",
-		Marked: false,
+	if !validPrice(todo.Price) {
+		a.writeInvalidPrice(w)
+		return
 	}
-	err = a.store.AddTodoItem(ctx, ulistID, todo.Record())
-	if err != nil {
-		a.logger.Error("failed to add todo item", "error", err)
-		w.WriteHeader(http.StatusBadRequest)
+	fields := validateKind(&todo)
+	if fields != nil {
+		a.writeInvalid(w, fields)
 		return
 	}
 
-	event := ItemEvent{AddItem, &todo}
-	data, err := json.Marshal(event)
-	if err == nil {
-		a.server.Broadcast(data)
-	} else {
-		a.logger.Error("unable to broadcast event", "error", err)
+	record := todo.Record()
+	completedBy(&record, principal(ctx).ID)
+	err = a.change(ctx, []uuid.UUID{listID}, func(ctx context.Context) ([]pending, error) {
+		item, err := a.store.AddTodoItem(ctx, listID, record)
+		if err != nil {
+			return nil, err
+		}
+		todo = newTodoItem(listID, *item)
+		event := ItemEvent{Type: AddItem, TodoItem: conv.Pointer(todo)}
+		a.withTotals(ctx, &event)
+		return []pending{{listID, event}}, nil
+	})
+	if err != nil {
+		a.writeStoreError(w, err, "item")
+		return
 	}
+
+	w.Header().Set("Location", "/list/"+listID.String()+"/item/"+todo.ID.String())
+	w.Header().Set("ETag", etag(todo.Version))
+	a.writeJSON(w, http.StatusCreated, todo)
 }
 
 func (a *api) handleUpdateItem(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
+	listID := pathID(ctx, tokenList)
 
 	data, err := io.ReadAll(r.Body)
 	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
+		a.writeBadRequest(w, err)
 		return
 	}
 
 	var t TodoItem
 	err = json.Unmarshal(data, &t)
 	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
+		a.writeBadRequest(w, err)
 		return
 	}
 
-	err = a.store.UpdateTodoItem(ctx, t.Record())
-	if err != nil {
-		a.logger.Error("failed to update todo item", "error", err)
-		w.WriteHeader(http.StatusBadRequest)
+	if !validPrice(t.Price) {
+		a.writeInvalidPrice(w)
 		return
 	}
-
-	event := ItemEvent{UpdateItem, &t}
-	data, err = json.Marshal(event)
-	if err == nil {
-		a.server.Broadcast(data)
-	} else {
-		a.logger.Error("unable to broadcast event", "error", err)
+	fields := validateKind(&t)
+	if fields != nil {
+		a.writeInvalid(w, fields)
+		return
 	}
-}
 
-func (a *api) handleDeleteItem(w http.ResponseWriter, r *http.Request) {
-	ctx := r.Context()
-	listID, ok := ctx.Value(tokenList).(string)
+	t.ID = pathID(ctx, tokenItem)
+
+	version, ok := a.ifMatch(r, listID, &t.ID)
 	if !ok {
-		w.WriteHeader(http.StatusBadRequest)
+		a.writePreconditionFailed(ctx, w, listID, &t.ID)
 		return
 	}
 
-	itemID, ok := ctx.Value(tokenItem).(string)
-	if !ok {
-		w.WriteHeader(http.StatusBadRequest)
+	record := t.Record()
+	record.Version = version
+	completedBy(&record, principal(ctx).ID)
+	var updated TodoItem
+	err = a.change(ctx, []uuid.UUID{listID}, func(ctx context.Context) ([]pending, error) {
+		item, err := a.store.UpdateTodoItem(ctx, listID, record)
+		if err != nil {
+			return nil, err
+		}
+		updated = newTodoItem(listID, *item)
+		event := ItemEvent{Type: UpdateItem, TodoItem: conv.Pointer(updated)}
+		a.withTotals(ctx, &event)
+		return []pending{{listID, event}}, nil
+	})
+	if errors.Is(err, db.ErrVersionMismatch) {
+		a.writePreconditionFailed(ctx, w, listID, &t.ID)
 		return
 	}
-
-	ulistID, err := uuid.FromString(listID)
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
+		a.writeStoreError(w, err, "item")
 		return
 	}
 
-	uitemID, err := uuid.FromString(itemID)
-	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
+	a.syncTexts(updated)
+	w.Header().Set("ETag", etag(updated.Version))
+	a.writeJSON(w, http.StatusOK, updated)
+}
+
+func (a *api) handleDeleteItem(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	listID := pathID(ctx, tokenList)
+	itemID := pathID(ctx, tokenItem)
+
+	version, ok := a.ifMatch(r, listID, &itemID)
+	if !ok {
+		a.writePreconditionFailed(ctx, w, listID, &itemID)
 		return
 	}
 
-	err = a.store.DeleteTodoItem(ctx, uitemID)
+	err := a.change(ctx, []uuid.UUID{listID}, func(ctx context.Context) ([]pending, error) {
+		item, err := a.store.DeleteTodoItem(ctx, listID, itemID, version)
+		if err != nil {
+			return nil, err
+		}
+		event := ItemEvent{Type: RemoveItem, TodoItem: &TodoItem{ID: itemID, List: listID, Parent: item.Parent}}
+		a.withTotals(ctx, &event)
+		return []pending{{listID, event}}, nil
+	})
+	if errors.Is(err, db.ErrVersionMismatch) {
+		a.writePreconditionFailed(ctx, w, listID, &itemID)
+		return
+	}
 	if err != nil {
-		a.logger.Error("failed to delete todo item", "error", err)
-		w.WriteHeader(http.StatusBadRequest)
+		a.writeStoreError(w, err, "item")
 		return
 	}
 
-	event := ItemEvent{RemoveItem, &TodoItem{ID: uitemID, List: ulistID}}
-	data, err := json.Marshal(event)
-	if err == nil {
-		a.server.Broadcast(data)
-	} else {
-		a.logger.Error("unable to broadcast event", "error", err)
-	}
+	w.WriteHeader(http.StatusNoContent)
 }
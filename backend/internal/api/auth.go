@@ -0,0 +1,248 @@
+package api
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+	"todolist/internal/conv"
+	"todolist/internal/db"
+
+	"github.com/gofrs/uuid"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const sessionCookie = "todo_session"
+
+// User is an authenticated principal.
+type User struct {
+	ID   uuid.UUID `json:"id"`
+	Name string    `json:"name"`
+}
+
+type Credentials struct {
+	Name     string `json:"name"`
+	Password string `json:"password"`
+}
+
+// Login is the response to a successful login. The token is also set as a
+// cookie, and may otherwise be sent as a bearer token.
+type Login struct {
+	Token     string    `json:"token"`
+	ExpiresAt time.Time `json:"expires"`
+	User      User      `json:"user"`
+}
+
+// dummyHash is compared against when logging in as an unknown user, so that
+// the response time does not reveal which users exist.
+var dummyHash, _ = bcrypt.GenerateFromPassword([]byte("dummy password"), bcrypt.DefaultCost)
+
+func newUser(in *db.User) User {
+	return User{ID: *in.ID, Name: *in.Name}
+}
+
+func (c Credentials) validate() []FieldError {
+	var fields []FieldError
+	if strings.TrimSpace(c.Name) == "" || len(c.Name) > 64 {
+		fields = append(fields, FieldError{Field: "name", Message: "must be between 1 and 64 characters"})
+	}
+	// bcrypt only uses the first 72 bytes of a password
+	if len(c.Password) < 8 || len(c.Password) > 72 {
+		fields = append(fields, FieldError{Field: "password", Message: "must be between 8 and 72 bytes"})
+	}
+	return fields
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// principal returns the authenticated user of a request.
+func principal(ctx context.Context) User {
+	user, _ := ctx.Value(tokenUser).(User)
+	return user
+}
+
+// sessionToken returns the session token of a request, from either the
+// Authorization header or the session cookie.
+func sessionToken(r *http.Request) string {
+	header := r.Header.Get("Authorization")
+	if token, ok := strings.CutPrefix(header, "Bearer "); ok {
+		return token
+	}
+
+	cookie, err := r.Cookie(sessionCookie)
+	if err == nil {
+		return cookie.Value
+	}
+
+	return ""
+}
+
+func (a *api) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := sessionToken(r)
+		if token == "" {
+			a.writeError(w, http.StatusUnauthorized, Error{Code: "unauthorized", Message: "login required"})
+			return
+		}
+
+		user, err := a.store.GetSessionUser(r.Context(), hashToken(token))
+		if errors.Is(err, db.ErrNotFound) {
+			a.writeError(w, http.StatusUnauthorized, Error{Code: "unauthorized", Message: "session expired or invalid"})
+			return
+		}
+		if err != nil {
+			a.writeInternal(w, "failed to get session", err)
+			return
+		}
+
+		// Changes are recorded in the history as made by the user
+		ctx := context.WithValue(r.Context(), tokenUser, newUser(user))
+		ctx = db.WithAuthor(ctx, *user.ID)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+func readCredentials(r *http.Request) (Credentials, error) {
+	var c Credentials
+	data, err := io.ReadAll(r.Body)
+	if err != nil {
+		return c, err
+	}
+	err = json.Unmarshal(data, &c)
+	return c, err
+}
+
+func (a *api) handleRegister(w http.ResponseWriter, r *http.Request) {
+	c, err := readCredentials(r)
+	if err != nil {
+		a.writeBadRequest(w, err)
+		return
+	}
+
+	fields := c.validate()
+	if fields != nil {
+		a.writeError(w, http.StatusUnprocessableEntity, Error{Code: "invalid-credentials", Message: "invalid name or password", Fields: fields})
+		return
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(c.Password), bcrypt.DefaultCost)
+	if err != nil {
+		a.writeInternal(w, "failed to hash password", err)
+		return
+	}
+
+	id, err := uuid.NewV4()
+	if err != nil {
+		a.writeInternal(w, "failed to make user id", err)
+		return
+	}
+
+	user := db.User{
+		ID:           &id,
+		Name:         &c.Name,
+		PasswordHash: conv.Pointer(string(hash)),
+	}
+	// Registrations of the same name at the same time conflict, and are
+	// run again until one of them finds the name taken
+	err = a.store.Atomically(r.Context(), func(ctx context.Context) error {
+		return a.store.AddUser(ctx, user)
+	})
+	if errors.Is(err, db.ErrConflict) {
+		a.writeError(w, http.StatusConflict, Error{Code: "user-exists", Message: "the name is taken"})
+		return
+	}
+	if err != nil {
+		a.writeInternal(w, "failed to add user", err)
+		return
+	}
+
+	a.writeJSON(w, http.StatusCreated, newUser(&user))
+}
+
+func (a *api) handleLogin(w http.ResponseWriter, r *http.Request) {
+	c, err := readCredentials(r)
+	if err != nil {
+		a.writeBadRequest(w, err)
+		return
+	}
+
+	user, err := a.store.GetUserByName(r.Context(), c.Name)
+	if err != nil && !errors.Is(err, db.ErrNotFound) {
+		a.writeInternal(w, "failed to get user", err)
+		return
+	}
+
+	hash := dummyHash
+	if user != nil {
+		hash = []byte(*user.PasswordHash)
+	}
+	err = bcrypt.CompareHashAndPassword(hash, []byte(c.Password))
+	if user == nil || err != nil {
+		a.writeError(w, http.StatusUnauthorized, Error{Code: "unauthorized", Message: "wrong name or password"})
+		return
+	}
+
+	secret := make([]byte, 32)
+	_, err = rand.Read(secret)
+	if err != nil {
+		a.writeInternal(w, "failed to make session token", err)
+		return
+	}
+	token := base64.RawURLEncoding.EncodeToString(secret)
+	expires := time.Now().Add(a.options.SessionLifetime).UTC()
+
+	err = a.store.AddSession(r.Context(), db.Session{
+		TokenHash: conv.Pointer(hashToken(token)),
+		User:      user.ID,
+		ExpiresAt: &expires,
+	})
+	if err != nil {
+		a.writeInternal(w, "failed to add session", err)
+		return
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookie,
+		Value:    token,
+		Path:     "/",
+		Expires:  expires,
+		HttpOnly: true,
+		Secure:   a.options.SecureCookies,
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	a.writeJSON(w, http.StatusOK, Login{Token: token, ExpiresAt: expires, User: newUser(user)})
+}
+
+func (a *api) handleLogout(w http.ResponseWriter, r *http.Request) {
+	err := a.store.RemoveSession(r.Context(), hashToken(sessionToken(r)))
+	if err != nil {
+		a.writeInternal(w, "failed to remove session", err)
+		return
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookie,
+		Path:     "/",
+		MaxAge:   -1,
+		HttpOnly: true,
+		Secure:   a.options.SecureCookies,
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (a *api) handleMe(w http.ResponseWriter, r *http.Request) {
+	a.writeJSON(w, http.StatusOK, principal(r.Context()))
+}
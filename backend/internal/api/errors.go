@@ -0,0 +1,100 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"todolist/internal/db"
+
+	"github.com/gofrs/uuid"
+)
+
+// Error is the body of an unsuccessful response. Code is meant for programs
+// and Message for people.
+type Error struct {
+	Code    string       `json:"code"`
+	Message string       `json:"message"`
+	Fields  []FieldError `json:"fields,omitempty"`
+
+	// Current is the state of a resource that a conditional request did
+	// not match.
+	Current any `json:"current,omitempty"`
+}
+
+// FieldError describes what is wrong with a single field of a request.
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// Codes of errors that many handlers respond with.
+const (
+	CodeBadRequest = "bad-request"
+	CodeInvalidID  = "invalid-id"
+	CodeNotFound   = "not-found"
+	CodeConflict   = "conflict"
+	CodeInternal   = "internal"
+)
+
+func (a *api) writeError(w http.ResponseWriter, status int, body Error) {
+	a.writeJSON(w, status, body)
+}
+
+// writeBadRequest reports a request body that cannot be read or decoded.
+func (a *api) writeBadRequest(w http.ResponseWriter, err error) {
+	a.writeError(w, http.StatusBadRequest, Error{Code: CodeBadRequest, Message: "malformed request: " + err.Error()})
+}
+
+// writeInvalidID reports an ID in a path or query that is not a UUID.
+func (a *api) writeInvalidID(w http.ResponseWriter, field string) {
+	a.writeError(w, http.StatusBadRequest, Error{
+		Code:    CodeInvalidID,
+		Message: "invalid " + field + " id",
+		Fields:  []FieldError{{Field: field, Message: "must be a UUID"}},
+	})
+}
+
+// writeInternal logs a failure the client cannot do anything about, without
+// revealing it.
+func (a *api) writeInternal(w http.ResponseWriter, message string, err error) {
+	a.logger.Error(message, "error", err)
+	a.writeError(w, http.StatusInternalServerError, Error{Code: CodeInternal, Message: "internal server error"})
+}
+
+// writeStoreError maps the sentinel errors of the store to statuses. what
+// names the resource that was looked for.
+func (a *api) writeStoreError(w http.ResponseWriter, err error, what string) {
+	switch {
+	case errors.Is(err, db.ErrNotFound):
+		a.writeError(w, http.StatusNotFound, Error{Code: CodeNotFound, Message: "no such " + what})
+	case errors.Is(err, db.ErrConflict):
+		a.writeError(w, http.StatusConflict, Error{Code: CodeConflict, Message: "the " + what + " conflicts with an existing one"})
+	default:
+		a.writeInternal(w, "store failed", err)
+	}
+}
+
+// writeInvalid reports an item that does not satisfy the schema of its kind.
+func (a *api) writeInvalid(w http.ResponseWriter, fields []FieldError) {
+	a.writeError(w, http.StatusUnprocessableEntity, Error{
+		Code:    "invalid-item",
+		Message: "item does not match the schema of its kind",
+		Fields:  fields,
+	})
+}
+
+// writeInvalidPrice reports a price that is not in an ISO 4217 currency.
+func (a *api) writeInvalidPrice(w http.ResponseWriter) {
+	a.writeError(w, http.StatusUnprocessableEntity, Error{
+		Code:    "invalid-item",
+		Message: "invalid price",
+		Fields:  []FieldError{{Field: "price", Message: "must be in an ISO 4217 currency"}},
+	})
+}
+
+// pathID returns the list or item ID of a request, which listContext or
+// itemContext has validated.
+func pathID(ctx context.Context, token string) uuid.UUID {
+	id, _ := ctx.Value(token).(uuid.UUID)
+	return id
+}
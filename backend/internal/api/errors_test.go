@@ -0,0 +1,39 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"todolist/internal/db"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestWriteStoreError(t *testing.T) {
+	a := &api{logger: slog.New(slog.NewTextHandler(io.Discard, nil))}
+	tests := []struct {
+		err    error
+		status int
+		code   string
+	}{
+		{db.ErrNotFound, http.StatusNotFound, CodeNotFound},
+		{fmt.Errorf("parent item: %w", db.ErrNotFound), http.StatusNotFound, CodeNotFound},
+		{db.ErrConflict, http.StatusConflict, CodeConflict},
+		{errors.New("disk full"), http.StatusInternalServerError, CodeInternal},
+	}
+
+	for _, test := range tests {
+		w := httptest.NewRecorder()
+		a.writeStoreError(w, test.err, "item")
+		require.Equal(t, test.status, w.Code, test.err.Error())
+		var body Error
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &body))
+		require.Equal(t, test.code, body.Code)
+		require.NotContains(t, body.Message, "disk full")
+	}
+}
@@ -0,0 +1,127 @@
+package api
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestEventTopics(t *testing.T) {
+	s := newTestServer(t, "alice", "bob")
+	groceries := s.newList("alice", "Groceries")
+	chores := s.newList("alice", "Chores")
+	s.share("alice", groceries, "bob", "viewer")
+
+	// Subscribers are sent the lists they asked for, which they have to be
+	// able to read
+	both := s.subscribe("alice", "/events?list="+groceries.String()+","+chores.String())
+	var list ListEvent
+	both.nextNamed(UpdateList).decode(t, &list)
+	require.Equal(t, "Groceries", list.TodoList.Name)
+	both.nextNamed(UpdateList).decode(t, &list)
+	require.Equal(t, "Chores", list.TodoList.Name)
+	shared := s.subscribe("bob", "/events?list="+groceries.String())
+	shared.nextNamed(UpdateList).decode(t, &list)
+	require.Equal(t, "Groceries", list.TodoList.Name)
+	single := s.subscribe("bob", "/list/"+groceries.String()+"/events")
+	single.nextNamed(UpdateList)
+	require.Equal(t, http.StatusNotFound, s.do("bob", "GET", "/events?list="+groceries.String()+"&list="+chores.String(), nil).status)
+	require.Equal(t, http.StatusNotFound, s.do("bob", "GET", "/list/"+chores.String()+"/events", nil).status)
+	require.Equal(t, http.StatusBadRequest, s.do("bob", "GET", "/events", nil).status)
+	require.Equal(t, http.StatusBadRequest, s.do("bob", "GET", "/events?list=groceries", nil).status)
+
+	// Changes reach the subscribers of their list only
+	s.addItem("alice", chores, nil, "dishes")
+	var event ItemEvent
+	both.nextNamed(AddItem).decode(t, &event)
+	require.Equal(t, chores, event.TodoItem.List)
+	s.addItem("alice", groceries, nil, "milk")
+	both.nextNamed(AddItem).decode(t, &event)
+	require.Equal(t, groceries, event.TodoItem.List)
+	for _, events := range []*stream{shared, single} {
+		events.nextNamed(AddItem).decode(t, &event)
+		require.Equal(t, "milk", event.TodoItem.Text)
+		events.quiet()
+	}
+
+	// Members who leave stop receiving the events of the list
+	require.Equal(t, http.StatusNoContent, s.do("alice", "DELETE", "/list/"+groceries.String()+"/members/"+s.ids["bob"].String(), nil).status)
+	both.nextNamed(RemoveMember)
+	for _, events := range []*stream{shared, single} {
+		var member MemberEvent
+		events.nextNamed(RemoveMember).decode(t, &member)
+		require.Equal(t, s.ids["bob"], member.Member.User)
+	}
+	s.addItem("alice", groceries, nil, "eggs")
+	both.nextNamed(AddItem)
+	shared.quiet()
+	single.quiet()
+}
+
+func TestEventReplay(t *testing.T) {
+	s := newTestServer(t, "alice")
+	groceries := s.newList("alice", "Groceries")
+	chores := s.newList("alice", "Chores")
+	path := "/list/" + groceries.String() + "/events"
+	seq := func(event streamEvent) int64 {
+		t.Helper()
+		seq, err := strconv.ParseInt(event.id, 10, 64)
+		require.NoError(t, err)
+		return seq
+	}
+
+	// Events carry their sequence numbers, and snapshots the latest one
+	events := s.subscribe("alice", path)
+	snapshot := events.nextNamed(UpdateList)
+	require.NotEmpty(t, snapshot.id)
+	s.addItem("alice", groceries, nil, "milk")
+	milk := events.nextNamed(AddItem)
+	require.Greater(t, seq(milk), seq(snapshot))
+	events.close()
+
+	// Reconnecting clients are sent the events of their lists they missed,
+	// and then the new ones
+	s.addItem("alice", groceries, nil, "eggs")
+	s.addItem("alice", chores, nil, "dishes")
+	s.addItem("alice", groceries, nil, "bread")
+	for _, events := range []*stream{
+		s.subscribe("alice", path, "Last-Event-ID", milk.id),
+		s.subscribe("alice", path+"?lastEventId="+milk.id),
+	} {
+		var event ItemEvent
+		eggs := events.nextNamed(AddItem)
+		eggs.decode(t, &event)
+		require.Equal(t, "eggs", event.TodoItem.Text)
+		bread := events.nextNamed(AddItem)
+		bread.decode(t, &event)
+		require.Equal(t, "bread", event.TodoItem.Text)
+		require.Greater(t, seq(bread), seq(eggs))
+		events.quiet()
+	}
+	events = s.subscribe("alice", path, "Last-Event-ID", snapshot.id)
+	events.nextNamed(AddItem)
+	events.nextNamed(AddItem)
+	events.nextNamed(AddItem)
+	s.addItem("alice", groceries, nil, "butter")
+	var event ItemEvent
+	events.nextNamed(AddItem).decode(t, &event)
+	require.Equal(t, "butter", event.TodoItem.Text)
+	events.close()
+
+	// Once the events have been compacted, clients are sent the lists again
+	_, err := s.store.CompactEvents(context.Background(), time.Now().Add(time.Second))
+	require.NoError(t, err)
+	events = s.subscribe("alice", path, "Last-Event-ID", milk.id)
+	var list ListEvent
+	events.nextNamed(UpdateList).decode(t, &list)
+	require.Len(t, list.TodoList.Items, 4)
+	events.quiet()
+
+	var e Error
+	s.do("alice", "GET", path, nil, "Last-Event-ID", "milk").decode(t, http.StatusBadRequest, &e)
+	require.Equal(t, "lastEventId", e.Fields[0].Field)
+}
@@ -0,0 +1,102 @@
+package api
+
+import (
+	"net/http"
+	"strconv"
+	"testing"
+	"todolist/internal/crdt"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestFrozenList(t *testing.T) {
+	s := newTestServer(t, "alice", "dave", "erin")
+	list := s.newList("alice", "Groceries")
+	milk := s.addItem("alice", list, nil, "milk")
+	eggs := s.addItem("alice", list, nil, "eggs")
+	s.share("alice", list, "dave", "editor")
+	s.share("alice", list, "erin", "admin")
+	other := s.newList("dave", "Chores")
+	dishes := s.addItem("dave", other, nil, "dishes")
+	path := "/list/" + list.String()
+	milkPath := path + "/item/" + milk.ID.String()
+
+	var revisions []Revision
+	s.do("alice", "GET", path+"/history", nil).decode(t, http.StatusOK, &revisions)
+	undo := path + "/history/" + strconv.FormatInt(revisions[0].ID, 10) + "/undo"
+
+	// Only the owner freezes the list
+	require.Equal(t, http.StatusForbidden, s.do("erin", "POST", path+"/freeze", nil).status)
+	var frozen TodoList
+	s.do("alice", "POST", path+"/freeze", nil).decode(t, http.StatusOK, &frozen)
+	require.True(t, frozen.Frozen)
+	s.do("dave", "GET", path, nil).decode(t, http.StatusOK, &frozen)
+	require.True(t, frozen.Frozen)
+	require.Equal(t, http.StatusForbidden, s.do("erin", "POST", path+"/unfreeze", nil).status)
+
+	// Every change is refused to editors and admins, who still read the list
+	mutations := []struct {
+		method, path string
+		body         any
+	}{
+		{"PUT", path + "/add", map[string]any{"text": "bread"}},
+		{"PUT", milkPath, map[string]any{"text": "oat milk"}},
+		{"PUT", milkPath + "/add", map[string]any{"text": "oat"}},
+		{"PATCH", milkPath + "/move", Move{After: &eggs.ID}},
+		{"PATCH", milkPath + "/text/text", TextUpdate{}},
+		{"DELETE", milkPath, nil},
+		{"POST", milkPath + "/restore", nil},
+		{"POST", undo, nil},
+	}
+	for _, user := range []string{"dave", "erin"} {
+		for _, m := range mutations {
+			var e Error
+			s.do(user, m.method, m.path, m.body).decode(t, http.StatusLocked, &e)
+			require.Equal(t, "frozen", e.Code, m.method+" "+m.path)
+		}
+		require.Equal(t, http.StatusOK, s.do(user, "GET", milkPath, nil).status)
+		require.Equal(t, http.StatusOK, s.do(user, "GET", milkPath+"/text/text", nil).status)
+	}
+
+	// Items neither leave nor enter the list through other lists
+	var e Error
+	s.do("dave", "PATCH", "/list/"+other.String()+"/item/"+dishes.ID.String()+"/move", Move{List: &list}).decode(t, http.StatusLocked, &e)
+	require.Equal(t, "frozen", e.Code)
+	var result SyncResponse
+	s.do("dave", "POST", "/sync", SyncRequest{Operations: []Operation{
+		{ID: "1", Type: UpdateItem, List: list, Item: milk.ID, TodoItem: &TodoItem{Text: "oat milk"}},
+		{ID: "2", Type: MoveItem, List: other, Item: dishes.ID, Move: &Move{List: &list}},
+	}}).decode(t, http.StatusOK, &result)
+	for _, r := range result.Results {
+		require.Equal(t, StatusRejected, r.Status)
+		require.Equal(t, "frozen", r.Error.Code)
+	}
+
+	// The owner still changes everything
+	var item TodoItem
+	bread := s.addItem("alice", list, nil, "bread")
+	s.do("alice", "PUT", milkPath, map[string]any{"text": "oat milk"}).decode(t, http.StatusOK, &item)
+	require.Equal(t, "oat milk", item.Text)
+	s.addItem("alice", list, &milk.ID, "oat")
+	s.do("alice", "PATCH", milkPath+"/move", Move{After: &eggs.ID}).decode(t, http.StatusOK, &item)
+	var text TextState
+	s.do("alice", "GET", milkPath+"/text/text", nil).decode(t, http.StatusOK, &text)
+	update := TextUpdate{Epoch: text.Epoch, Update: crdt.Update{Inserts: []crdt.Insert{{ID: crdt.ID{Clock: text.Clock + 1, Site: "alice"}, Text: "fresh "}}}}
+	s.do("alice", "PATCH", milkPath+"/text/text", update).decode(t, http.StatusOK, &text)
+	require.Equal(t, "fresh oat milk", text.Text)
+	require.Equal(t, http.StatusNoContent, s.do("alice", "DELETE", path+"/item/"+bread.ID.String(), nil).status)
+	s.do("alice", "POST", path+"/item/"+bread.ID.String()+"/restore", nil).decode(t, http.StatusOK, &item)
+	require.Equal(t, http.StatusOK, s.do("alice", "POST", undo, nil).status)
+
+	// Unfreezing lets the others change the list again
+	var unfrozen TodoList
+	s.do("alice", "POST", path+"/unfreeze", nil).decode(t, http.StatusOK, &unfrozen)
+	require.False(t, unfrozen.Frozen)
+	s.addItem("dave", list, nil, "butter")
+	s.do("dave", "PATCH", "/list/"+other.String()+"/item/"+dishes.ID.String()+"/move", Move{List: &list}).decode(t, http.StatusOK, &item)
+	require.Equal(t, http.StatusNoContent, s.do("erin", "DELETE", milkPath, nil).status)
+
+	// Owners remove their lists even while frozen
+	require.Equal(t, http.StatusOK, s.do("alice", "POST", path+"/freeze", nil).status)
+	require.Equal(t, http.StatusNoContent, s.do("alice", "DELETE", path, nil).status)
+}
@@ -0,0 +1,242 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+	"todolist/internal/conv"
+	"todolist/internal/db"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/gofrs/uuid"
+)
+
+// Revision is a change to a list or, if Item is set, to one of its items.
+// Before and After are the list, without items, or the item, without
+// children, as it was before and after the change.
+type Revision struct {
+	ID        int64      `json:"id"`
+	List      uuid.UUID  `json:"list"`
+	FromList  *uuid.UUID `json:"fromlist,omitempty"`
+	Item      *uuid.UUID `json:"item,omitempty"`
+	Action    string     `json:"action"`
+	Author    string     `json:"author,omitempty"`
+	CreatedAt time.Time  `json:"createdat"`
+
+	// Undoes is the revision this one undid.
+	Undoes *int64 `json:"undoes,omitempty"`
+
+	Before any `json:"before,omitempty"`
+	After  any `json:"after,omitempty"`
+}
+
+func newRevision(in db.Revision) (out Revision, err error) {
+	out.ID = *in.ID
+	out.List = *in.List
+	out.FromList = in.FromList
+	out.Item = in.Item
+	out.Action = *in.Action
+	if in.Author != nil {
+		out.Author = *in.Author
+	}
+	out.CreatedAt = *in.CreatedAt
+	out.Undoes = in.Undoes
+	if in.Item == nil {
+		before, after, err := in.Lists()
+		if err != nil {
+			return out, err
+		}
+		if before != nil {
+			out.Before = NewTodoList(before)
+		}
+		if after != nil {
+			out.After = NewTodoList(after)
+		}
+		return out, nil
+	}
+	before, after, err := in.Items()
+	if err != nil {
+		return out, err
+	}
+	if before != nil {
+		// Before a move between lists the item was in the other list
+		list := out.List
+		if out.FromList != nil {
+			list = *out.FromList
+		}
+		out.Before = newTodoItem(list, *before)
+	}
+	if after != nil {
+		out.After = newTodoItem(out.List, *after)
+	}
+	return out, nil
+}
+
+// handleGetHistory responds with a page of the revisions of a list and its
+// items, most recent first.
+func (a *api) handleGetHistory(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	revisions, err := a.store.GetListHistory(ctx, pathID(ctx, tokenList))
+	if err != nil {
+		a.writeInternal(w, "failed to get history", err)
+		return
+	}
+	a.writeHistory(w, r, revisions)
+}
+
+// handleGetItemHistory responds with a page of the revisions of an item,
+// most recent first.
+func (a *api) handleGetItemHistory(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	revisions, err := a.store.GetItemHistory(ctx, pathID(ctx, tokenList), pathID(ctx, tokenItem))
+	if err != nil {
+		a.writeInternal(w, "failed to get history", err)
+		return
+	}
+	a.writeHistory(w, r, revisions)
+}
+
+func (a *api) writeHistory(w http.ResponseWriter, r *http.Request, revisions []db.Revision) {
+	q, ok := a.parseReadQuery(w, r)
+	if !ok {
+		return
+	}
+	start, end := q.page.window(len(revisions))
+	elements := make([]any, 0, end-start)
+	for _, rev := range revisions[start:end] {
+		revision, err := newRevision(rev)
+		if err != nil {
+			a.writeInternal(w, "failed to decode revision", err)
+			return
+		}
+		elements = append(elements, revision)
+	}
+	a.writeSelectedPage(w, r, q, len(revisions), elements)
+}
+
+// handleUndo reverts a revision of a list or of one of its items. Revisions
+// of the list itself can only be undone by its owner, and undoing a move
+// between lists requires the editor role in the other list as well.
+func (a *api) handleUndo(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	listID := pathID(ctx, tokenList)
+
+	id, err := strconv.ParseInt(chi.URLParam(r, tokenRevision), 10, 64)
+	if err != nil {
+		a.writeError(w, http.StatusBadRequest, Error{
+			Code:    CodeInvalidID,
+			Message: "invalid revision id",
+			Fields:  []FieldError{{Field: "revision", Message: "must be an integer"}},
+		})
+		return
+	}
+
+	rev, err := a.store.GetRevision(ctx, id)
+	if err == nil && *rev.List != listID && (rev.FromList == nil || *rev.FromList != listID) {
+		err = db.ErrNotFound
+	}
+	if err != nil {
+		a.writeStoreError(w, err, "revision")
+		return
+	}
+	if rev.Item == nil && !hasRole(listRole(ctx), db.RoleOwner) {
+		a.writeError(w, http.StatusForbidden, Error{Code: "forbidden", Message: "requires the " + db.RoleOwner + " role"})
+		return
+	}
+	lists := []uuid.UUID{listID}
+	if rev.FromList != nil {
+		other := *rev.FromList
+		if other == listID {
+			other = *rev.List
+		}
+		status, body := a.editDenied(ctx, other)
+		if status != 0 {
+			a.writeError(w, status, body)
+			return
+		}
+		lists = append(lists, other)
+	}
+
+	var undo *db.Revision
+	err = a.change(ctx, lists, func(ctx context.Context) ([]pending, error) {
+		var err error
+		undo, err = a.store.UndoRevision(ctx, id)
+		if err != nil {
+			return nil, err
+		}
+		return a.revisionEvents(ctx, *undo)
+	})
+	if errors.Is(err, db.ErrConflict) {
+		a.writeError(w, http.StatusConflict, Error{Code: CodeConflict, Message: "the revision has been undone already or can no longer be undone"})
+		return
+	}
+	if err != nil {
+		a.writeStoreError(w, err, "revision")
+		return
+	}
+
+	revision, err := newRevision(*undo)
+	if err != nil {
+		a.writeInternal(w, "failed to decode revision", err)
+		return
+	}
+	a.writeJSON(w, http.StatusOK, revision)
+
+	if undo.Item == nil && *undo.Action == db.RevisionRemoveList {
+		a.server.CloseTopic(listTopic(*undo.List))
+	}
+	if undo.Item != nil {
+		_, after, err := undo.Items()
+		if err == nil && after != nil {
+			a.syncTexts(newTodoItem(*undo.List, *after))
+		}
+	}
+}
+
+// revisionEvents returns the events of a change made by undoing a revision,
+// which are those of the same change made directly.
+func (a *api) revisionEvents(ctx context.Context, rev db.Revision) ([]pending, error) {
+	listID := *rev.List
+	if rev.Item == nil {
+		switch *rev.Action {
+		case db.RevisionRemoveList:
+			return []pending{{listID, ListEvent{RemoveList, &TodoList{ID: listID}}}}, nil
+		case db.RevisionFreezeList, db.RevisionUnfreezeList:
+			frozen := *rev.Action == db.RevisionFreezeList
+			event := ListEvent{UnfreezeList, &TodoList{ID: listID, Frozen: frozen}}
+			if frozen {
+				event.Type = FreezeList
+			}
+			return []pending{{listID, event}}, nil
+		}
+		return nil, nil
+	}
+
+	before, after, err := rev.Items()
+	if err != nil {
+		return nil, err
+	}
+	switch *rev.Action {
+	case db.RevisionUpdateItem, db.RevisionUpdateText:
+		event := ItemEvent{Type: UpdateItem, TodoItem: conv.Pointer(newTodoItem(listID, *after))}
+		a.withTotals(ctx, &event)
+		return []pending{{listID, event}}, nil
+	case db.RevisionRemoveItem:
+		event := ItemEvent{Type: RemoveItem, TodoItem: &TodoItem{ID: *before.ID, List: listID, Parent: before.Parent}}
+		a.withTotals(ctx, &event)
+		return []pending{{listID, event}}, nil
+	case db.RevisionRestoreItem:
+		event := ItemEvent{Type: RestoreItem, TodoItem: conv.Pointer(a.movedItem(ctx, listID, after))}
+		a.withTotals(ctx, &event)
+		return []pending{{listID, event}}, nil
+	case db.RevisionMoveItem:
+		from := listID
+		if rev.FromList != nil {
+			from = *rev.FromList
+		}
+		return a.moveEvents(ctx, from, before, a.movedItem(ctx, listID, after)), nil
+	}
+	return nil, nil
+}
@@ -0,0 +1,114 @@
+package api
+
+import (
+	"net/http"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestUndo(t *testing.T) {
+	s := newTestServer(t, "alice", "dave", "erin")
+	groceries := s.newList("alice", "Groceries")
+	milk := s.addItem("alice", groceries, nil, "milk")
+	s.share("alice", groceries, "dave", "editor")
+	s.share("alice", groceries, "erin", "admin")
+	chores := s.newList("dave", "Chores")
+	dishes := s.addItem("dave", chores, nil, "dishes")
+	path := "/list/" + groceries.String()
+
+	// Returns the most recent revision of a list with an action
+	latest := func(list string, action string) Revision {
+		t.Helper()
+		var revisions []Revision
+		s.do("alice", "GET", list+"/history", nil).decode(t, http.StatusOK, &revisions)
+		for _, rev := range revisions {
+			if rev.Action == action {
+				return rev
+			}
+		}
+		t.Fatalf("no %s revision", action)
+		return Revision{}
+	}
+	undo := func(user string, list string, rev Revision) response {
+		t.Helper()
+		return s.do(user, "POST", list+"/history/"+strconv.FormatInt(rev.ID, 10)+"/undo", nil)
+	}
+
+	groceryEvents := s.subscribe("alice", path+"/events")
+	groceryEvents.nextNamed(UpdateList)
+	choreEvents := s.subscribe("dave", "/list/"+chores.String()+"/events")
+	choreEvents.nextNamed(UpdateList)
+
+	// Changes of items are undone by editors, with the events of the same
+	// change made directly
+	require.Equal(t, http.StatusOK, s.do("dave", "PUT", path+"/item/"+milk.ID.String(), map[string]any{"text": "oat milk"}).status)
+	groceryEvents.nextNamed(UpdateItem)
+	var reverted Revision
+	undo("dave", path, latest(path, UpdateItem)).decode(t, http.StatusOK, &reverted)
+	require.Equal(t, UpdateItem, reverted.Action)
+	require.Equal(t, "dave", reverted.Author)
+	require.NotNil(t, reverted.Undoes)
+	var event ItemEvent
+	groceryEvents.nextNamed(UpdateItem).decode(t, &event)
+	require.Equal(t, "milk", event.TodoItem.Text)
+
+	// Revisions are undone once
+	var e Error
+	undo("alice", path, Revision{ID: *reverted.Undoes}).decode(t, http.StatusConflict, &e)
+	require.Equal(t, CodeConflict, e.Code)
+	groceryEvents.quiet()
+
+	// Revisions of the list itself are undone by the owner only
+	require.Equal(t, http.StatusOK, s.do("alice", "POST", path+"/freeze", nil).status)
+	groceryEvents.nextNamed(FreezeList)
+	require.Equal(t, http.StatusOK, s.do("alice", "POST", path+"/unfreeze", nil).status)
+	groceryEvents.nextNamed(UnfreezeList)
+	unfreeze := latest(path, "unfreeze-list")
+	for _, user := range []string{"dave", "erin"} {
+		undo(user, path, unfreeze).decode(t, http.StatusForbidden, &e)
+		require.Equal(t, "forbidden", e.Code)
+	}
+	require.Equal(t, http.StatusOK, undo("alice", path, unfreeze).status)
+	var list ListEvent
+	groceryEvents.nextNamed(FreezeList).decode(t, &list)
+	require.True(t, list.TodoList.Frozen)
+	require.Equal(t, http.StatusOK, s.do("alice", "POST", path+"/unfreeze", nil).status)
+	groceryEvents.nextNamed(UnfreezeList)
+
+	// Undoing a move between lists needs the editor role in both
+	require.Equal(t, http.StatusOK, s.do("dave", "PATCH", "/list/"+chores.String()+"/item/"+dishes.ID.String()+"/move", Move{List: &groceries}).status)
+	groceryEvents.nextNamed(MoveItem)
+	choreEvents.nextNamed(MoveItem)
+	move := latest(path, MoveItem)
+	require.Equal(t, chores, *move.FromList)
+	undo("alice", path, move).decode(t, http.StatusNotFound, &e)
+	s.share("dave", chores, "alice", "viewer")
+	undo("alice", path, move).decode(t, http.StatusForbidden, &e)
+	require.Equal(t, "forbidden", e.Code)
+	require.Equal(t, http.StatusOK, s.do("dave", "PUT", "/list/"+chores.String()+"/members/"+s.ids["alice"].String(), Member{Role: "editor"}).status)
+	choreEvents.nextNamed(UpdateMember)
+	choreEvents.nextNamed(UpdateMember)
+	undo("alice", path, move).decode(t, http.StatusOK, &reverted)
+	require.Equal(t, chores, reverted.List)
+	require.Equal(t, groceries, *reverted.FromList)
+	groceryEvents.nextNamed(MoveItem).decode(t, &event)
+	require.Equal(t, chores, event.TodoItem.List)
+	choreEvents.nextNamed(MoveItem).decode(t, &event)
+	require.Equal(t, dishes.ID, event.TodoItem.ID)
+	var item TodoItem
+	s.do("dave", "GET", "/list/"+chores.String()+"/item/"+dishes.ID.String(), nil).decode(t, http.StatusOK, &item)
+	require.Equal(t, "dishes", item.Text)
+
+	// Revisions are undone through the lists they belong to
+	undo("alice", "/list/"+chores.String(), latest(path, UpdateItem)).decode(t, http.StatusNotFound, &e)
+	require.Equal(t, http.StatusBadRequest, s.do("alice", "POST", path+"/history/latest/undo", nil).status)
+
+	// Removed lists are restored from the trash rather than by undoing
+	require.Equal(t, http.StatusNoContent, s.do("alice", "DELETE", path, nil).status)
+	groceryEvents.nextNamed(RemoveList)
+	require.Equal(t, http.StatusOK, s.do("alice", "POST", path+"/restore", nil).status)
+	undo("alice", path, latest(path, "remove-list")).decode(t, http.StatusConflict, &e)
+	require.Equal(t, CodeConflict, e.Code)
+}
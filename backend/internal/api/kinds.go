@@ -0,0 +1,166 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"sort"
+	"time"
+)
+
+const (
+	KindWorkTask = "work-task"
+	KindFood     = "food"
+)
+
+type attributeType int
+
+const (
+	attributeDate attributeType = iota
+	attributeGrams
+	attributeURL
+)
+
+type attribute struct {
+	Name     string
+	Type     attributeType
+	Required bool
+}
+
+// kindSchema lists the attributes an item of a kind may have.
+type kindSchema struct {
+	Attributes []attribute
+}
+
+// kinds is the registry of item kinds. Plain items have the empty kind and
+// no attributes.
+var kinds = map[string]kindSchema{
+	"": {},
+	KindWorkTask: {
+		Attributes: []attribute{
+			{Name: "deadline", Type: attributeDate, Required: true},
+		},
+	},
+	KindFood: {
+		Attributes: []attribute{
+			{Name: "carbohydrate", Type: attributeGrams, Required: true},
+			{Name: "fat", Type: attributeGrams, Required: true},
+			{Name: "protein", Type: attributeGrams, Required: true},
+			{Name: "picture", Type: attributeURL},
+		},
+	},
+}
+
+// validateKind checks the attributes of an item against the schema of its
+// kind and normalizes them. It returns nil if the item is valid.
+func validateKind(item *TodoItem) []FieldError {
+	schema, ok := kinds[item.Kind]
+	if !ok {
+		return []FieldError{{Field: "kind", Message: fmt.Sprintf("unknown kind %q", item.Kind)}}
+	}
+
+	values := make(map[string]any)
+	if len(item.Attributes) > 0 && !bytes.Equal(item.Attributes, []byte("null")) {
+		decoder := json.NewDecoder(bytes.NewReader(item.Attributes))
+		decoder.UseNumber()
+		err := decoder.Decode(&values)
+		if err != nil {
+			return []FieldError{{Field: "attributes", Message: "must be an object"}}
+		}
+	}
+
+	var fields []FieldError
+	known := make(map[string]bool, len(schema.Attributes))
+	for _, attr := range schema.Attributes {
+		known[attr.Name] = true
+		field := "attributes." + attr.Name
+
+		value, ok := values[attr.Name]
+		if !ok || value == nil {
+			delete(values, attr.Name)
+			if attr.Required {
+				fields = append(fields, FieldError{Field: field, Message: "is required"})
+			}
+			continue
+		}
+
+		err := attr.Type.check(value)
+		if err != nil {
+			fields = append(fields, FieldError{Field: field, Message: err.Error()})
+		}
+	}
+
+	var unknown []string
+	for name := range values {
+		if !known[name] {
+			unknown = append(unknown, name)
+		}
+	}
+	sort.Strings(unknown)
+	for _, name := range unknown {
+		fields = append(fields, FieldError{Field: "attributes." + name, Message: "is not an attribute of this kind"})
+	}
+
+	if len(fields) > 0 {
+		return fields
+	}
+
+	item.Attributes = nil
+	if len(values) > 0 {
+		data, err := json.Marshal(values)
+		if err != nil {
+			return []FieldError{{Field: "attributes", Message: err.Error()}}
+		}
+		item.Attributes = data
+	}
+
+	return nil
+}
+
+// validateKinds validates items and, recursively, their children.
+func validateKinds(items []TodoItem) []FieldError {
+	for i := range items {
+		fields := validateKind(&items[i])
+		if fields == nil {
+			fields = validateKinds(items[i].Children)
+		}
+		if fields != nil {
+			return fields
+		}
+	}
+	return nil
+}
+
+func (t attributeType) check(value any) error {
+	switch t {
+	case attributeDate:
+		s, ok := value.(string)
+		if !ok {
+			return fmt.Errorf("must be a date")
+		}
+		_, err := time.Parse(time.DateOnly, s)
+		if err != nil {
+			return fmt.Errorf("must be a date formatted as YYYY-MM-DD")
+		}
+	case attributeGrams:
+		n, ok := value.(json.Number)
+		if !ok {
+			return fmt.Errorf("must be a number")
+		}
+		f, err := n.Float64()
+		if err != nil || f < 0 || f > 100 {
+			return fmt.Errorf("must be between 0 and 100 g/100g")
+		}
+	case attributeURL:
+		s, ok := value.(string)
+		if !ok {
+			return fmt.Errorf("must be a URL")
+		}
+		u, err := url.Parse(s)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("must be an absolute http or https URL")
+		}
+	}
+	return nil
+}
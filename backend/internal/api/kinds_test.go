@@ -0,0 +1,47 @@
+package api
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestValidateKind(t *testing.T) {
+	tests := []struct {
+		kind       string
+		attributes string
+		fields     []string
+	}{
+		{"", "", nil},
+		{"", `{"deadline":"2024-05-01"}`, []string{"attributes.deadline"}},
+		{"chore", "", []string{"kind"}},
+		{KindWorkTask, `{"deadline":"2024-05-01"}`, nil},
+		{KindWorkTask, `{}`, []string{"attributes.deadline"}},
+		{KindWorkTask, `{"deadline":"tomorrow"}`, []string{"attributes.deadline"}},
+		{KindWorkTask, `[1,2]`, []string{"attributes"}},
+		{KindFood, `{"carbohydrate":17,"fat":0.1,"protein":2}`, nil},
+		{KindFood, `{"carbohydrate":17,"fat":0.1,"protein":2,"picture":"https://example.com/potato.png"}`, nil},
+		{KindFood, `{"carbohydrate":17,"fat":"lots","protein":200,"picture":"potato.png","color":"brown"}`,
+			[]string{"attributes.fat", "attributes.protein", "attributes.picture", "attributes.color"}},
+	}
+
+	for _, test := range tests {
+		item := TodoItem{Kind: test.kind, Attributes: json.RawMessage(test.attributes)}
+		var fields []string
+		for _, field := range validateKind(&item) {
+			fields = append(fields, field.Field)
+		}
+		require.Equal(t, test.fields, fields, "%s %s", test.kind, test.attributes)
+	}
+}
+
+func TestValidateKindNormalizes(t *testing.T) {
+	item := TodoItem{Kind: KindFood, Attributes: json.RawMessage(`{ "fat": 0.1, "protein": 2, "carbohydrate": 17, "picture": null }`)}
+	require.Nil(t, validateKind(&item))
+	require.JSONEq(t, `{"carbohydrate":17,"fat":0.1,"protein":2}`, string(item.Attributes))
+
+	item = TodoItem{Attributes: json.RawMessage(`null`)}
+	require.Nil(t, validateKind(&item))
+	require.Nil(t, item.Attributes)
+}
@@ -0,0 +1,36 @@
+package api
+
+import (
+	"bytes"
+	"regexp"
+
+	"github.com/microcosm-cc/bluemonday"
+	"github.com/yuin/goldmark"
+	"github.com/yuin/goldmark/extension"
+)
+
+// markdown renders CommonMark with task lists. Raw HTML in the source is
+// omitted by the renderer.
+var markdown = goldmark.New(goldmark.WithExtensions(extension.TaskList))
+
+// sanitizer is a second line of defence against markup a client could abuse,
+// allowing what markdown produces and the disabled checkboxes of task lists.
+var sanitizer = func() *bluemonday.Policy {
+	p := bluemonday.UGCPolicy()
+	p.AllowAttrs("type").Matching(regexp.MustCompile(`^checkbox$`)).OnElements("input")
+	p.AllowAttrs("checked", "disabled").OnElements("input")
+	return p
+}()
+
+// renderMarkdown returns the sanitized HTML of a markdown text.
+func renderMarkdown(source string) string {
+	if source == "" {
+		return ""
+	}
+	var buf bytes.Buffer
+	err := markdown.Convert([]byte(source), &buf)
+	if err != nil {
+		return ""
+	}
+	return sanitizer.Sanitize(buf.String())
+}
@@ -0,0 +1,25 @@
+package api
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRenderMarkdown(t *testing.T) {
+	tests := []struct {
+		source string
+		html   string
+	}{
+		{"", ""},
+		{"Buy **fresh** basil", "<p>Buy <strong>fresh</strong> basil</p>\n"},
+		{"- [x] Wash\n- [ ] Chop", "<ul>\n<li><input checked=\"\" disabled=\"\" type=\"checkbox\"> Wash</li>\n<li><input disabled=\"\" type=\"checkbox\"> Chop</li>\n</ul>\n"},
+		{"<script>alert(1)</script>", "\n"},
+		{"Hi <b onclick=\"alert(1)\">there</b>", "<p>Hi there</p>\n"},
+		{"[click](javascript:alert(1))", "<p>click</p>\n"},
+	}
+
+	for _, test := range tests {
+		require.Equal(t, test.html, renderMarkdown(test.source), test.source)
+	}
+}
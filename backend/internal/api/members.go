@@ -0,0 +1,269 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"todolist/internal/db"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/gofrs/uuid"
+)
+
+const tokenMember = "memberID"
+
+// Member is a user a list has been shared with.
+type Member struct {
+	User uuid.UUID `json:"user,omitempty"`
+	Name string    `json:"name,omitempty"`
+	Role string    `json:"role,omitempty"`
+}
+
+type MemberEvent struct {
+	Type   string    `json:"type,omitempty"`
+	List   uuid.UUID `json:"list,omitempty"`
+	Member *Member   `json:"member,omitempty"`
+}
+
+func (e MemberEvent) eventType() string {
+	return e.Type
+}
+
+func (e MemberEvent) coalesceKey() string {
+	if e.Type == UpdateMember && e.Member != nil {
+		return "member/" + e.List.String() + "/" + e.Member.User.String()
+	}
+	return ""
+}
+
+func newMember(in db.Member) Member {
+	return Member{User: *in.User, Name: *in.Name, Role: *in.Role}
+}
+
+// roles ranks the roles a user can have in a list.
+var roles = map[string]int{
+	db.RoleViewer: 1,
+	db.RoleEditor: 2,
+	db.RoleAdmin:  3,
+	db.RoleOwner:  4,
+}
+
+func hasRole(role string, required string) bool {
+	return roles[role] >= roles[required]
+}
+
+// listRole returns the role of the authenticated user in the request's list.
+func listRole(ctx context.Context) string {
+	role, _ := ctx.Value(tokenRole).(string)
+	return role
+}
+
+// requireRole refuses requests from users without at least the given role in
+// the list.
+func (a *api) requireRole(required string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !hasRole(listRole(r.Context()), required) {
+				a.writeError(w, http.StatusForbidden, Error{Code: "forbidden", Message: "requires the " + required + " role"})
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// editDenied returns the status and error to respond with if the
+// authenticated user may not change a list, or a zero status if they may.
+func (a *api) editDenied(ctx context.Context, listID uuid.UUID) (int, Error) {
+	role, frozen, err := a.store.GetListAccess(ctx, listID, principal(ctx).ID)
+	if errors.Is(err, db.ErrNotFound) || (err == nil && role == "") {
+		return http.StatusNotFound, Error{Code: CodeNotFound, Message: "no such list"}
+	}
+	if err != nil {
+		a.logger.Error("failed to get role", "error", err)
+		return http.StatusInternalServerError, Error{Code: CodeInternal, Message: "internal server error"}
+	}
+	if !hasRole(role, db.RoleEditor) {
+		return http.StatusForbidden, Error{Code: "forbidden", Message: "requires the " + db.RoleEditor + " role"}
+	}
+	if frozen && role != db.RoleOwner {
+		return http.StatusLocked, Error{Code: "frozen", Message: "the list is frozen"}
+	}
+	return 0, Error{}
+}
+
+// mutable refuses changes to frozen lists from anyone but the owner.
+func (a *api) mutable(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		frozen, _ := r.Context().Value(tokenFrozen).(bool)
+		if frozen && listRole(r.Context()) != db.RoleOwner {
+			a.writeError(w, http.StatusLocked, Error{Code: "frozen", Message: "the list is frozen"})
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// readMember reads the list and member of a request.
+func readMember(r *http.Request) (list uuid.UUID, member uuid.UUID, err error) {
+	list = pathID(r.Context(), tokenList)
+	member, err = uuid.FromString(chi.URLParam(r, tokenMember))
+	return
+}
+
+func (a *api) handleGetMembers(w http.ResponseWriter, r *http.Request) {
+	listID := pathID(r.Context(), tokenList)
+
+	members, err := a.store.GetListMembers(r.Context(), listID)
+	if err != nil {
+		a.writeInternal(w, "failed to get members", err)
+		return
+	}
+
+	out := make([]Member, len(members))
+	for i := range members {
+		out[i] = newMember(members[i])
+	}
+	a.writeJSON(w, http.StatusOK, out)
+}
+
+func (a *api) handleAddMember(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	listID := pathID(ctx, tokenList)
+
+	data, err := io.ReadAll(r.Body)
+	if err != nil {
+		a.writeBadRequest(w, err)
+		return
+	}
+
+	var m Member
+	err = json.Unmarshal(data, &m)
+	if err != nil {
+		a.writeBadRequest(w, err)
+		return
+	}
+
+	// Members are invited by name, which is what users know each other by
+	user, err := a.store.GetUserByName(ctx, m.Name)
+	if errors.Is(err, db.ErrNotFound) {
+		a.writeError(w, http.StatusUnprocessableEntity, Error{
+			Code:    "invalid-member",
+			Message: "no such user",
+			Fields:  []FieldError{{Field: "name", Message: "is not a user"}},
+		})
+		return
+	}
+	if err != nil {
+		a.writeInternal(w, "failed to get user", err)
+		return
+	}
+
+	m.User = *user.ID
+	a.setMember(w, r, listID, m, true)
+}
+
+func (a *api) handleUpdateMember(w http.ResponseWriter, r *http.Request) {
+	listID, memberID, err := readMember(r)
+	if err != nil {
+		a.writeInvalidID(w, "member")
+		return
+	}
+
+	data, err := io.ReadAll(r.Body)
+	if err != nil {
+		a.writeBadRequest(w, err)
+		return
+	}
+
+	var m Member
+	err = json.Unmarshal(data, &m)
+	if err != nil {
+		a.writeBadRequest(w, err)
+		return
+	}
+
+	m.User = memberID
+	a.setMember(w, r, listID, m, false)
+}
+
+// setMember adds a member to a list, or changes the role of an existing
+// member, which has to be one already.
+func (a *api) setMember(w http.ResponseWriter, r *http.Request, listID uuid.UUID, m Member, add bool) {
+	ctx := r.Context()
+	if m.Role == db.RoleOwner || roles[m.Role] == 0 {
+		a.writeError(w, http.StatusUnprocessableEntity, Error{
+			Code:    "invalid-member",
+			Message: "unknown role",
+			Fields:  []FieldError{{Field: "role", Message: "must be viewer, editor or admin"}},
+		})
+		return
+	}
+
+	set, status, missing := a.store.UpdateListMember, http.StatusOK, "not a member"
+	if add {
+		set, status, missing = a.store.SetListMember, http.StatusCreated, "no such user"
+	}
+	var out Member
+	err := a.change(ctx, []uuid.UUID{listID}, func(ctx context.Context) ([]pending, error) {
+		member, err := set(ctx, db.Member{List: &listID, User: &m.User, Role: &m.Role})
+		if err != nil {
+			return nil, err
+		}
+		out = newMember(*member)
+		return []pending{{listID, MemberEvent{Type: UpdateMember, List: listID, Member: &out}}}, nil
+	})
+	if errors.Is(err, db.ErrNotFound) {
+		a.writeError(w, http.StatusNotFound, Error{Code: CodeNotFound, Message: missing})
+		return
+	}
+	if errors.Is(err, db.ErrConflict) {
+		a.writeError(w, http.StatusConflict, Error{Code: "owner", Message: "the owner of a list cannot be a member"})
+		return
+	}
+	if err != nil {
+		a.writeInternal(w, "failed to set member", err)
+		return
+	}
+
+	a.writeJSON(w, status, out)
+}
+
+func (a *api) handleRemoveMember(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	listID, memberID, err := readMember(r)
+	if err != nil {
+		a.writeInvalidID(w, "member")
+		return
+	}
+
+	// Anyone may leave a list, but only admins may remove others
+	if memberID != principal(ctx).ID && !hasRole(listRole(ctx), db.RoleAdmin) {
+		a.writeError(w, http.StatusForbidden, Error{Code: "forbidden", Message: "requires the " + db.RoleAdmin + " role"})
+		return
+	}
+
+	err = a.change(ctx, []uuid.UUID{listID}, func(ctx context.Context) ([]pending, error) {
+		err := a.store.RemoveListMember(ctx, listID, memberID)
+		if err != nil {
+			return nil, err
+		}
+		return []pending{{listID, MemberEvent{Type: RemoveMember, List: listID, Member: &Member{User: memberID}}}}, nil
+	})
+	if errors.Is(err, db.ErrNotFound) {
+		a.writeError(w, http.StatusNotFound, Error{Code: CodeNotFound, Message: "not a member"})
+		return
+	}
+	if err != nil {
+		a.writeInternal(w, "failed to remove member", err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+
+	// The event reaches the removed member before its sessions stop
+	// receiving events of the list
+	a.server.UnsubscribePrincipal(memberID.String(), listTopic(listID))
+}
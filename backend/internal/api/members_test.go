@@ -0,0 +1,76 @@
+package api
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestAccess(t *testing.T) {
+	s := newTestServer(t, "alice", "bob", "carol", "dave", "erin")
+	list := s.newList("alice", "Groceries")
+	item := s.addItem("alice", list, nil, "milk")
+	s.share("alice", list, "bob", "viewer")
+	s.share("alice", list, "dave", "editor")
+	s.share("alice", list, "erin", "admin")
+	path := "/list/" + list.String()
+	itemPath := path + "/item/" + item.ID.String()
+
+	// Requires the status of a request and the code of its error
+	requireError := func(res response, status int, code string) {
+		t.Helper()
+		var e Error
+		res.decode(t, status, &e)
+		require.Equal(t, code, e.Code)
+	}
+
+	// Viewers read but may not change the list
+	require.Equal(t, http.StatusOK, s.do("bob", "GET", path, nil).status)
+	require.Equal(t, http.StatusOK, s.do("bob", "GET", itemPath, nil).status)
+	requireError(s.do("bob", "PUT", path+"/add", map[string]any{"text": "eggs"}), http.StatusForbidden, "forbidden")
+	requireError(s.do("bob", "PUT", itemPath, map[string]any{"text": "oat milk"}), http.StatusForbidden, "forbidden")
+	requireError(s.do("bob", "DELETE", itemPath, nil), http.StatusForbidden, "forbidden")
+	requireError(s.do("bob", "POST", path+"/members", Member{Name: "carol", Role: "viewer"}), http.StatusForbidden, "forbidden")
+
+	// Editors change items, but not the members or the list itself
+	require.Equal(t, http.StatusOK, s.do("dave", "PUT", itemPath, map[string]any{"text": "oat milk"}).status)
+	requireError(s.do("dave", "DELETE", path+"/members/"+s.ids["bob"].String(), nil), http.StatusForbidden, "forbidden")
+	requireError(s.do("dave", "DELETE", path, nil), http.StatusForbidden, "forbidden")
+
+	// Lists that were not shared are missing rather than forbidden, so
+	// that their existence is not revealed
+	for _, req := range []struct{ method, path string }{
+		{"GET", path},
+		{"GET", itemPath},
+		{"PUT", path + "/add"},
+		{"DELETE", itemPath},
+		{"DELETE", path},
+		{"GET", path + "/members"},
+	} {
+		requireError(s.do("carol", req.method, req.path, nil), http.StatusNotFound, CodeNotFound)
+	}
+	require.Equal(t, http.StatusUnauthorized, s.do("", "GET", path, nil).status)
+
+	// Admins share the list but cannot hand it over
+	requireError(s.do("erin", "POST", path+"/members", Member{Name: "carol", Role: "owner"}), http.StatusUnprocessableEntity, "invalid-member")
+	requireError(s.do("erin", "PUT", path+"/members/"+s.ids["bob"].String(), Member{Role: "owner"}), http.StatusUnprocessableEntity, "invalid-member")
+	requireError(s.do("erin", "PUT", path+"/members/"+s.ids["carol"].String(), Member{Role: "editor"}), http.StatusNotFound, CodeNotFound)
+	requireError(s.do("erin", "POST", path+"/members", Member{Name: "alice", Role: "admin"}), http.StatusConflict, "owner")
+	var member Member
+	s.do("erin", "PUT", path+"/members/"+s.ids["bob"].String(), Member{Role: "editor"}).decode(t, http.StatusOK, &member)
+	require.Equal(t, Member{User: s.ids["bob"], Name: "bob", Role: "editor"}, member)
+	require.Equal(t, http.StatusCreated, s.do("bob", "PUT", path+"/add", map[string]any{"text": "eggs"}).status)
+
+	// Members leave by themselves, after which the list is missing
+	require.Equal(t, http.StatusNoContent, s.do("bob", "DELETE", path+"/members/"+s.ids["bob"].String(), nil).status)
+	requireError(s.do("bob", "GET", path, nil), http.StatusNotFound, CodeNotFound)
+	requireError(s.do("erin", "DELETE", path+"/members/"+s.ids["bob"].String(), nil), http.StatusNotFound, CodeNotFound)
+
+	var members []Member
+	s.do("alice", "GET", path+"/members", nil).decode(t, http.StatusOK, &members)
+	require.ElementsMatch(t, []Member{
+		{User: s.ids["dave"], Name: "dave", Role: "editor"},
+		{User: s.ids["erin"], Name: "erin", Role: "admin"},
+	}, members)
+}
@@ -0,0 +1,140 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"todolist/internal/db"
+
+	"github.com/gofrs/uuid"
+)
+
+// Move is the destination of a moved item. List defaults to the item's list
+// and a missing Parent moves the item to the top level. Before or After name
+// a sibling to place the item next to; without either it is placed last.
+type Move struct {
+	List   *uuid.UUID `json:"list,omitempty"`
+	Parent *uuid.UUID `json:"parent,omitempty"`
+	Before *uuid.UUID `json:"before,omitempty"`
+	After  *uuid.UUID `json:"after,omitempty"`
+}
+
+func (m Move) Record() db.Move {
+	return db.Move{List: m.List, Parent: m.Parent, Before: m.Before, After: m.After}
+}
+
+// findItem returns the item with the given ID in a tree of items.
+func findItem(items []TodoItem, id uuid.UUID) *TodoItem {
+	for i := range items {
+		if items[i].ID == id {
+			return &items[i]
+		}
+		if item := findItem(items[i].Children, id); item != nil {
+			return item
+		}
+	}
+	return nil
+}
+
+// handleMoveItem reorders an item, reparents it or moves it to another list,
+// which requires the editor role in that list as well.
+func (a *api) handleMoveItem(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	listID := pathID(ctx, tokenList)
+	itemID := pathID(ctx, tokenItem)
+
+	data, err := io.ReadAll(r.Body)
+	if err != nil {
+		a.writeBadRequest(w, err)
+		return
+	}
+
+	var move Move
+	err = json.Unmarshal(data, &move)
+	if err != nil {
+		a.writeBadRequest(w, err)
+		return
+	}
+	if move.Before != nil && move.After != nil {
+		a.writeError(w, http.StatusUnprocessableEntity, Error{Code: "invalid-move", Message: "before and after cannot both be given"})
+		return
+	}
+
+	version, ok := a.ifMatch(r, listID, &itemID)
+	if !ok {
+		a.writePreconditionFailed(ctx, w, listID, &itemID)
+		return
+	}
+
+	target := listID
+	if move.List != nil && *move.List != listID {
+		target = *move.List
+		status, body := a.editDenied(ctx, target)
+		if status != 0 {
+			a.writeError(w, status, body)
+			return
+		}
+	}
+
+	record := move.Record()
+	record.Version = version
+	var item TodoItem
+	err = a.change(ctx, []uuid.UUID{listID, target}, func(ctx context.Context) ([]pending, error) {
+		old, moved, err := a.store.MoveTodoItem(ctx, listID, itemID, record)
+		if err != nil {
+			return nil, err
+		}
+		item = a.movedItem(ctx, target, moved)
+		return a.moveEvents(ctx, listID, old, item), nil
+	})
+	if errors.Is(err, db.ErrVersionMismatch) {
+		a.writePreconditionFailed(ctx, w, listID, &itemID)
+		return
+	}
+	if errors.Is(err, db.ErrNotFound) {
+		a.writeError(w, http.StatusNotFound, Error{Code: CodeNotFound, Message: "no such item"})
+		return
+	}
+	if errors.Is(err, db.ErrConflict) {
+		a.writeError(w, http.StatusConflict, Error{Code: CodeConflict, Message: "an item cannot be moved below itself"})
+		return
+	}
+	if err != nil {
+		a.writeInternal(w, "failed to move todo item", err)
+		return
+	}
+
+	a.syncTexts(item)
+	w.Header().Set("ETag", etag(item.Version))
+	a.writeJSON(w, http.StatusOK, item)
+}
+
+// movedItem returns a moved item with its subtree, which subscribers of the
+// list it was moved to may not have seen before.
+func (a *api) movedItem(ctx context.Context, listID uuid.UUID, moved *db.TodoItem) TodoItem {
+	item := newTodoItem(listID, *moved)
+	list, err := a.store.GetTodoList(ctx, listID)
+	if err != nil {
+		a.logger.Error("failed to get moved item", "error", err)
+	} else if found := findItem(NewTodoList(list).Items, item.ID); found != nil {
+		item = *found
+	}
+	return item
+}
+
+// moveEvents returns the events of a moved item for the list it was moved
+// from and, if it changed lists, for the list it was moved to.
+func (a *api) moveEvents(ctx context.Context, from uuid.UUID, old *db.TodoItem, item TodoItem) []pending {
+	event := ItemEvent{Type: MoveItem, TodoItem: &item}
+	if item.List == from {
+		a.withListTotals(ctx, &event, from, item.Parent, old.Parent)
+		return []pending{{from, event}}
+	}
+
+	a.withTotals(ctx, &event)
+	left := ItemEvent{Type: MoveItem, TodoItem: &item}
+	a.withListTotals(ctx, &left, from, old.Parent)
+	return []pending{{from, left}, {item.List, event}}
+}
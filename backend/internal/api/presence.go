@@ -0,0 +1,120 @@
+package api
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"time"
+	"todolist/internal/presence"
+
+	"github.com/gofrs/uuid"
+)
+
+// Presence event types.
+const (
+	UpdatePresence = "presence-update"
+	LeavePresence  = "presence-leave"
+)
+
+// Selection is a range of characters in a text field, End excluded.
+type Selection struct {
+	Start int `json:"start"`
+	End   int `json:"end"`
+}
+
+// Presence is where a client of a user is in a list, such as the text field
+// of an item it is editing with its caret and selection. Client tells the
+// tabs or devices of a user apart, and lets clients ignore their own
+// presence. Presences expire unless they are refreshed.
+type Presence struct {
+	List      uuid.UUID  `json:"list"`
+	User      User       `json:"user"`
+	Client    string     `json:"client"`
+	Item      *uuid.UUID `json:"item,omitempty"`
+	Field     string     `json:"field,omitempty"`
+	Caret     *int       `json:"caret,omitempty"`
+	Selection *Selection `json:"selection,omitempty"`
+	Expires   time.Time  `json:"expires"`
+}
+
+type PresenceEvent struct {
+	Type     string    `json:"type"`
+	Presence *Presence `json:"presence"`
+}
+
+func (e PresenceEvent) eventType() string {
+	return e.Type
+}
+
+func (e PresenceEvent) coalesceKey() string {
+	return "presence/" + e.Presence.List.String() + "/" + e.Presence.User.ID.String() + "/" + e.Presence.Client
+}
+
+func presenceKey(list uuid.UUID, user uuid.UUID, client string) presence.Key {
+	return presence.Key{Topic: listTopic(list), Client: user.String() + "/" + client}
+}
+
+// presenceOf returns the presence stored in entry.
+func presenceOf(entry presence.Entry) Presence {
+	p := entry.Data.(Presence)
+	p.Expires = entry.Expires
+	return p
+}
+
+// leavePresence tells the subscribers of a list that a presence has expired.
+func (a *api) leavePresence(entry presence.Entry) {
+	p := presenceOf(entry)
+	a.broadcast(p.List, PresenceEvent{Type: LeavePresence, Presence: &p})
+}
+
+func (a *api) handleGetPresence(w http.ResponseWriter, r *http.Request) {
+	listID := pathID(r.Context(), tokenList)
+
+	entries := a.presence.Topic(listTopic(listID))
+	presences := make([]Presence, len(entries))
+	for i, entry := range entries {
+		presences[i] = presenceOf(entry)
+	}
+	a.writeJSON(w, http.StatusOK, presences)
+}
+
+func (a *api) handleSetPresence(w http.ResponseWriter, r *http.Request) {
+	listID := pathID(r.Context(), tokenList)
+
+	data, err := io.ReadAll(r.Body)
+	if err != nil {
+		a.writeBadRequest(w, err)
+		return
+	}
+
+	var p Presence
+	err = json.Unmarshal(data, &p)
+	if err != nil {
+		a.writeBadRequest(w, err)
+		return
+	}
+	if p.Selection != nil && (p.Selection.Start < 0 || p.Selection.End < p.Selection.Start) {
+		a.writeError(w, http.StatusUnprocessableEntity, Error{Code: "invalid-presence", Message: "invalid selection"})
+		return
+	}
+
+	p.List = listID
+	p.User = principal(r.Context())
+	entry := a.presence.Set(presenceKey(listID, p.User.ID, p.Client), p)
+	p.Expires = entry.Expires
+
+	a.writeJSON(w, http.StatusOK, p)
+	a.broadcast(listID, PresenceEvent{Type: UpdatePresence, Presence: &p})
+}
+
+func (a *api) handleLeavePresence(w http.ResponseWriter, r *http.Request) {
+	listID := pathID(r.Context(), tokenList)
+
+	user := principal(r.Context())
+	entry, ok := a.presence.Remove(presenceKey(listID, user.ID, r.URL.Query().Get("client")))
+	w.WriteHeader(http.StatusNoContent)
+	if ok {
+		p := presenceOf(entry)
+		a.broadcast(listID, PresenceEvent{Type: LeavePresence, Presence: &p})
+	}
+}
@@ -0,0 +1,117 @@
+package api
+
+import (
+	"context"
+	"sort"
+
+	"github.com/gofrs/uuid"
+)
+
+// Price is an amount in minor units, e.g. cents, of an ISO 4217 currency.
+type Price struct {
+	Amount   int64  `json:"amount"`
+	Currency string `json:"currency"`
+}
+
+// ItemTotal is the total of an item and all of its descendants, and the
+// progress of its descendants.
+type ItemTotal struct {
+	ID       uuid.UUID `json:"id"`
+	Total    []Price   `json:"total"`
+	Progress *Progress `json:"progress,omitempty"`
+}
+
+func validPrice(p *Price) bool {
+	if p == nil {
+		return true
+	}
+	if len(p.Currency) != 3 {
+		return false
+	}
+	for _, c := range p.Currency {
+		if c < 'A' || c > 'Z' {
+			return false
+		}
+	}
+	return true
+}
+
+func validPrices(items []TodoItem) bool {
+	for _, item := range items {
+		if !validPrice(item.Price) || !validPrices(item.Children) {
+			return false
+		}
+	}
+	return true
+}
+
+// addPrices sums prices per currency. Amounts in different currencies are
+// never converted, so the result holds one price per currency, sorted by
+// currency.
+func addPrices(prices ...[]Price) []Price {
+	sums := make(map[string]int64)
+	for _, list := range prices {
+		for _, p := range list {
+			sums[p.Currency] += p.Amount
+		}
+	}
+
+	out := make([]Price, 0, len(sums))
+	for currency, amount := range sums {
+		out = append(out, Price{Amount: amount, Currency: currency})
+	}
+	sort.Slice(out, func(i, j int) bool {
+		return out[i].Currency < out[j].Currency
+	})
+	return out
+}
+
+// withTotals fills in the subtree total of the event's item, the totals of
+// its ancestors and the list total, all of which change with the item.
+func (a *api) withTotals(ctx context.Context, event *ItemEvent) {
+	a.withListTotals(ctx, event, event.TodoItem.List, event.TodoItem.Parent)
+}
+
+// withListTotals fills in the totals of a list and of the ancestors of each
+// of the given parents in it, and the subtree total of the event's item if
+// the item is in the list.
+func (a *api) withListTotals(ctx context.Context, event *ItemEvent, listID uuid.UUID, parents ...*uuid.UUID) {
+	list, err := a.store.GetTodoList(ctx, listID)
+	if err != nil {
+		a.logger.Error("failed to get totals", "error", err)
+		return
+	}
+
+	nlist := NewTodoList(list)
+	index := make(map[uuid.UUID]*TodoItem)
+	var walk func(items []TodoItem)
+	walk = func(items []TodoItem) {
+		for i := range items {
+			index[items[i].ID] = &items[i]
+			walk(items[i].Children)
+		}
+	}
+	walk(nlist.Items)
+
+	if item, ok := index[event.TodoItem.ID]; ok {
+		event.TodoItem.Total = item.Total
+		event.TodoItem.Progress = item.Progress
+	}
+
+	event.Totals = make([]ItemTotal, 0)
+	seen := make(map[uuid.UUID]bool)
+	for _, parent := range parents {
+		for parent != nil && !seen[*parent] {
+			item, ok := index[*parent]
+			if !ok {
+				break
+			}
+			seen[item.ID] = true
+			event.Totals = append(event.Totals, ItemTotal{ID: item.ID, Total: item.Total, Progress: item.Progress})
+			parent = item.Parent
+		}
+	}
+
+	event.ListTotal = nlist.Total
+	event.ListProgress = &nlist.Progress
+}
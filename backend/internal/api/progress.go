@@ -0,0 +1,127 @@
+package api
+
+import (
+	"net/http"
+	"time"
+	"todolist/internal/db"
+
+	"github.com/gofrs/uuid"
+)
+
+// Progress counts the marked items among a number of items.
+type Progress struct {
+	Done  int `json:"done"`
+	Total int `json:"total"`
+}
+
+// progressOf counts the given items and all of their descendants.
+func progressOf(items []TodoItem) (p Progress) {
+	for _, item := range items {
+		p.Total++
+		if item.Marked {
+			p.Done++
+		}
+		if item.Progress != nil {
+			p.Done += item.Progress.Done
+			p.Total += item.Progress.Total
+		}
+	}
+	return
+}
+
+// completedBy records a user as whoever marks the item or any of its
+// children.
+func completedBy(item *db.TodoItem, userID uuid.UUID) {
+	item.CompletedByID = &userID
+	for i := range item.Children {
+		completedBy(&item.Children[i], userID)
+	}
+}
+
+// Statuses items can be filtered by.
+const (
+	StatusOpen = "open"
+	StatusDone = "done"
+)
+
+// itemFilter selects items by status and by when they were completed. The
+// zero filter selects every item.
+type itemFilter struct {
+	status string
+	since  *time.Time
+	until  *time.Time
+}
+
+// parseItemFilter reads the status, completed-since and completed-until query
+// parameters. The times are in RFC 3339 format and select marked items
+// completed at or after since and before until.
+func parseItemFilter(r *http.Request) (f itemFilter, fields []FieldError) {
+	query := r.URL.Query()
+	f.status = query.Get("status")
+	switch f.status {
+	case "", StatusOpen, StatusDone:
+	default:
+		fields = append(fields, FieldError{Field: "status", Message: "must be open or done"})
+	}
+	for _, param := range []struct {
+		name string
+		dst  **time.Time
+	}{{"completed-since", &f.since}, {"completed-until", &f.until}} {
+		value := query.Get(param.name)
+		if value == "" {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			fields = append(fields, FieldError{Field: param.name, Message: "must be an RFC 3339 time"})
+			continue
+		}
+		*param.dst = &t
+	}
+	return
+}
+
+func (f itemFilter) empty() bool {
+	return f.status == "" && f.since == nil && f.until == nil
+}
+
+func (f itemFilter) match(item *TodoItem) bool {
+	switch {
+	case f.status == StatusOpen && item.Marked:
+		return false
+	case f.status == StatusDone && !item.Marked:
+		return false
+	}
+	if f.since != nil || f.until != nil {
+		if item.CompletedAt == nil {
+			return false
+		}
+		if f.since != nil && item.CompletedAt.Before(*f.since) {
+			return false
+		}
+		if f.until != nil && !item.CompletedAt.Before(*f.until) {
+			return false
+		}
+	}
+	return true
+}
+
+// apply returns the items that match the filter, keeping the ancestors of
+// matching items so that they stay in place. Totals and progress are left as
+// they are for the whole list.
+func (f itemFilter) apply(items []TodoItem) []TodoItem {
+	if f.empty() {
+		return items
+	}
+	out := make([]TodoItem, 0, len(items))
+	for _, item := range items {
+		item.Children = f.apply(item.Children)
+		if len(item.Children) > 0 || f.match(&item) {
+			if len(item.Children) == 0 {
+				item.Children = nil
+			}
+			out = append(out, item)
+		}
+	}
+	return out
+}
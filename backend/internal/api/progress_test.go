@@ -0,0 +1,66 @@
+package api
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+	"todolist/internal/conv"
+	"todolist/internal/db"
+
+	"github.com/gofrs/uuid"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProgress(t *testing.T) {
+	monday := time.Date(2024, 5, 6, 12, 0, 0, 0, time.UTC)
+	item := func(text string, completed *time.Time, children ...db.TodoItem) db.TodoItem {
+		return db.TodoItem{
+			ID:          conv.Pointer(uuid.Must(uuid.NewV4())),
+			Text:        conv.Pointer(text),
+			Marked:      conv.Pointer(completed != nil),
+			CompletedAt: completed,
+			Children:    children,
+		}
+	}
+
+	list := NewTodoList(&db.TodoList{
+		ID:    conv.Pointer(uuid.Must(uuid.NewV4())),
+		Owner: conv.Pointer("Jonas"),
+		Name:  conv.Pointer("Salad"),
+		Items: []db.TodoItem{
+			item("Salad", nil,
+				item("Lettuce", &monday),
+				item("Tomatoes", nil,
+					item("Basil", conv.Pointer(monday.AddDate(0, 0, 1))),
+				),
+			),
+			item("Napkins", conv.Pointer(monday.AddDate(0, 0, 2))),
+		},
+	})
+
+	require.Equal(t, Progress{Done: 3, Total: 5}, list.Progress)
+	require.Equal(t, &Progress{Done: 2, Total: 3}, list.Items[0].Progress)
+	require.Equal(t, &Progress{Done: 1, Total: 1}, list.Items[0].Children[1].Progress)
+	require.Nil(t, list.Items[1].Progress)
+
+	texts := func(query string) (out []string) {
+		filter, fields := parseItemFilter(httptest.NewRequest("GET", "/events?"+query, nil))
+		require.Empty(t, fields)
+		var walk func(items []TodoItem)
+		walk = func(items []TodoItem) {
+			for _, item := range items {
+				out = append(out, item.Text)
+				walk(item.Children)
+			}
+		}
+		walk(filter.apply(list.Items))
+		return
+	}
+	require.Equal(t, []string{"Salad", "Lettuce", "Tomatoes", "Basil", "Napkins"}, texts(""))
+	require.Equal(t, []string{"Salad", "Tomatoes"}, texts("status=open"))
+	require.Equal(t, []string{"Salad", "Lettuce", "Tomatoes", "Basil", "Napkins"}, texts("status=done"))
+	require.Equal(t, []string{"Salad", "Tomatoes", "Basil"}, texts("completed-since=2024-05-07T00:00:00Z&completed-until=2024-05-08T00:00:00Z"))
+
+	_, fields := parseItemFilter(httptest.NewRequest("GET", "/events?status=maybe&completed-since=monday", nil))
+	require.Len(t, fields, 2)
+}
@@ -0,0 +1,263 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"todolist/internal/db"
+)
+
+// Page sizes of list and item collections.
+const (
+	defaultPageSize = 50
+	maxPageSize     = 500
+)
+
+// page is a window of a collection selected by the offset and limit query
+// parameters.
+type page struct {
+	offset int
+	limit  int
+}
+
+func parsePage(r *http.Request) (p page, fields []FieldError) {
+	p.limit = defaultPageSize
+	query := r.URL.Query()
+	for _, param := range []struct {
+		name string
+		dst  *int
+		max  int
+	}{{"offset", &p.offset, -1}, {"limit", &p.limit, maxPageSize}} {
+		value := query.Get(param.name)
+		if value == "" {
+			continue
+		}
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 || (param.max >= 0 && (n < 1 || n > param.max)) {
+			message := "must be a non-negative integer"
+			if param.max >= 0 {
+				message = "must be between 1 and " + strconv.Itoa(param.max)
+			}
+			fields = append(fields, FieldError{Field: param.name, Message: message})
+			continue
+		}
+		*param.dst = n
+	}
+	return
+}
+
+// window returns the bounds of the page in a collection of n elements.
+func (p page) window(n int) (start, end int) {
+	start = min(p.offset, n)
+	end = min(start+p.limit, n)
+	return
+}
+
+// writePage responds with a page of a collection of n elements, linking to
+// the next page if there is one.
+func (a *api) writePage(w http.ResponseWriter, r *http.Request, p page, n int, elements []any) {
+	if p.offset+p.limit < n {
+		next := *r.URL
+		query := next.Query()
+		query.Set("offset", strconv.Itoa(p.offset+p.limit))
+		query.Set("limit", strconv.Itoa(p.limit))
+		next.RawQuery = query.Encode()
+		w.Header().Set("Link", "<"+next.RequestURI()+`>; rel="next"`)
+	}
+	w.Header().Set("X-Total-Count", strconv.Itoa(n))
+	a.writeJSON(w, http.StatusOK, elements)
+}
+
+// parseFields returns the fields selected by the fields query parameter, a
+// comma separated list of JSON field names, or nil to select all fields.
+func parseFields(r *http.Request) []string {
+	var fields []string
+	for _, param := range r.URL.Query()["fields"] {
+		for _, field := range strings.Split(param, ",") {
+			if field = strings.TrimSpace(field); field != "" {
+				fields = append(fields, field)
+			}
+		}
+	}
+	return fields
+}
+
+// selectFields returns the given fields of a JSON object, or the object
+// itself if no fields are given. Unknown fields are left out.
+func selectFields(v any, fields []string) (any, error) {
+	if fields == nil {
+		return v, nil
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	var object map[string]json.RawMessage
+	err = json.Unmarshal(data, &object)
+	if err != nil {
+		return nil, err
+	}
+	selected := make(map[string]json.RawMessage, len(fields))
+	for _, field := range fields {
+		if value, ok := object[field]; ok {
+			selected[field] = value
+		}
+	}
+	return selected, nil
+}
+
+// readQuery is what the read endpoints take from their query parameters.
+type readQuery struct {
+	filter itemFilter
+	page   page
+	fields []string
+}
+
+// parseReadQuery parses the item filter, page and fields of a request, or
+// responds with what is wrong with them.
+func (a *api) parseReadQuery(w http.ResponseWriter, r *http.Request) (q readQuery, ok bool) {
+	var fields, pageFields []FieldError
+	q.filter, fields = parseItemFilter(r)
+	q.page, pageFields = parsePage(r)
+	fields = append(fields, pageFields...)
+	if fields != nil {
+		a.writeError(w, http.StatusBadRequest, Error{Code: "invalid-query", Message: "invalid query parameters", Fields: fields})
+		return q, false
+	}
+	q.fields = parseFields(r)
+	return q, true
+}
+
+// writeSelected responds with the selected fields of a list or item of the
+// given version, or with 304 Not Modified if the client already has them.
+func (a *api) writeSelected(w http.ResponseWriter, r *http.Request, version int64, v any, fields []string) {
+	selected, err := selectFields(v, fields)
+	if err != nil {
+		a.writeInternal(w, "failed to select fields", err)
+		return
+	}
+	data, err := json.Marshal(selected)
+	if err != nil {
+		a.writeInternal(w, "failed to marshal response", err)
+		return
+	}
+	if notModified(w, r, readTag(version, data)) {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(data)
+}
+
+// writeSelectedPage responds with the selected fields of a page of elements.
+func (a *api) writeSelectedPage(w http.ResponseWriter, r *http.Request, q readQuery, n int, elements []any) {
+	for i := range elements {
+		selected, err := selectFields(elements[i], q.fields)
+		if err != nil {
+			a.writeInternal(w, "failed to select fields", err)
+			return
+		}
+		elements[i] = selected
+	}
+	a.writePage(w, r, q.page, n, elements)
+}
+
+// getList returns a list the way it is read, with its items filtered.
+func (a *api) getList(w http.ResponseWriter, r *http.Request, q readQuery) (*TodoList, bool) {
+	listID := pathID(r.Context(), tokenList)
+	list, err := a.store.GetTodoList(r.Context(), listID)
+	if err != nil {
+		a.writeStoreError(w, err, "list")
+		return nil, false
+	}
+	nlist := NewTodoList(list)
+	nlist.Items = q.filter.apply(nlist.Items)
+	return &nlist, true
+}
+
+// handleGetLists responds with a page of the lists the user owns or has been
+// shared with.
+func (a *api) handleGetLists(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	q, ok := a.parseReadQuery(w, r)
+	if !ok {
+		return
+	}
+
+	ids, err := a.store.GetMemberLists(ctx, principal(ctx).ID)
+	if err != nil {
+		a.writeInternal(w, "failed to get lists", err)
+		return
+	}
+
+	start, end := q.page.window(len(ids))
+	lists := make([]any, 0, end-start)
+	for _, id := range ids[start:end] {
+		list, err := a.store.GetTodoList(ctx, id)
+		if errors.Is(err, db.ErrNotFound) {
+			// Removed since the lists were enumerated
+			continue
+		}
+		if err != nil {
+			a.writeInternal(w, "failed to get todo list", err)
+			return
+		}
+		nlist := NewTodoList(list)
+		nlist.Items = q.filter.apply(nlist.Items)
+		lists = append(lists, nlist)
+	}
+	a.writeSelectedPage(w, r, q, len(ids), lists)
+}
+
+func (a *api) handleGetList(w http.ResponseWriter, r *http.Request) {
+	q, ok := a.parseReadQuery(w, r)
+	if !ok {
+		return
+	}
+	list, ok := a.getList(w, r, q)
+	if !ok {
+		return
+	}
+	a.writeSelected(w, r, list.Version, list, q.fields)
+}
+
+// handleGetItems responds with a page of the top level items of a list, each
+// with its subtree.
+func (a *api) handleGetItems(w http.ResponseWriter, r *http.Request) {
+	q, ok := a.parseReadQuery(w, r)
+	if !ok {
+		return
+	}
+	list, ok := a.getList(w, r, q)
+	if !ok {
+		return
+	}
+	start, end := q.page.window(len(list.Items))
+	items := make([]any, 0, end-start)
+	for _, item := range list.Items[start:end] {
+		items = append(items, item)
+	}
+	a.writeSelectedPage(w, r, q, len(list.Items), items)
+}
+
+func (a *api) handleGetItem(w http.ResponseWriter, r *http.Request) {
+	q, ok := a.parseReadQuery(w, r)
+	if !ok {
+		return
+	}
+	itemID := pathID(r.Context(), tokenItem)
+	// The item itself is found before filtering its subtree
+	list, ok := a.getList(w, r, readQuery{})
+	if !ok {
+		return
+	}
+	item := findItem(list.Items, itemID)
+	if item == nil {
+		a.writeError(w, http.StatusNotFound, Error{Code: CodeNotFound, Message: "no such item"})
+		return
+	}
+	item.Children = q.filter.apply(item.Children)
+	a.writeSelected(w, r, item.Version, item, q.fields)
+}
@@ -0,0 +1,162 @@
+package api
+
+import (
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPage(t *testing.T) {
+	p, fields := parsePage(httptest.NewRequest("GET", "/list?offset=4&limit=3", nil))
+	require.Empty(t, fields)
+	start, end := p.window(5)
+	require.Equal(t, []int{4, 5}, []int{start, end})
+	start, end = p.window(2)
+	require.Equal(t, []int{2, 2}, []int{start, end})
+
+	p, fields = parsePage(httptest.NewRequest("GET", "/list", nil))
+	require.Empty(t, fields)
+	require.Equal(t, page{offset: 0, limit: defaultPageSize}, p)
+
+	_, fields = parsePage(httptest.NewRequest("GET", "/list?offset=-1&limit=1000", nil))
+	require.Len(t, fields, 2)
+}
+
+func TestSelectFields(t *testing.T) {
+	item := TodoItem{Text: "Basil", Marked: true, Position: 1024}
+
+	selected, err := selectFields(item, nil)
+	require.NoError(t, err)
+	require.Equal(t, item, selected)
+
+	fields := parseFields(httptest.NewRequest("GET", "/list?fields=text,%20position&fields=color", nil))
+	require.Equal(t, []string{"text", "position", "color"}, fields)
+	selected, err = selectFields(item, fields)
+	require.NoError(t, err)
+	data, err := json.Marshal(selected)
+	require.NoError(t, err)
+	require.JSONEq(t, `{"text":"Basil","position":1024}`, string(data))
+}
+
+func TestWriteSelected(t *testing.T) {
+	a := &api{logger: slog.New(slog.NewTextHandler(io.Discard, nil))}
+	item := TodoItem{Text: "Basil", Version: 3, Children: []TodoItem{{Text: "Leaves"}}}
+	read := func(item TodoItem, fields []string, tag string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", "/list", nil)
+		r.Header.Set("If-None-Match", tag)
+		w := httptest.NewRecorder()
+		a.writeSelected(w, r, item.Version, item, fields)
+		return w
+	}
+
+	w := read(item, nil, "")
+	require.Equal(t, http.StatusOK, w.Code)
+	tag := w.Header().Get("ETag")
+	require.Equal(t, http.StatusNotModified, read(item, nil, tag).Code)
+
+	// Other fields and changed subtasks are read again, though the
+	// version is the same
+	require.Equal(t, http.StatusOK, read(item, []string{"text"}, tag).Code)
+	item.Children[0].Marked = true
+	require.Equal(t, http.StatusOK, read(item, nil, tag).Code)
+
+	// Changes only need to match the version
+	versions, ok := matchVersions(tag)
+	require.True(t, ok)
+	require.Equal(t, []int64{3}, versions)
+}
+
+func TestReadRoutes(t *testing.T) {
+	s := newTestServer(t, "alice", "bob")
+	groceries := s.newList("alice", "Groceries")
+	s.newList("alice", "Chores")
+	s.newList("alice", "Books")
+	s.newList("bob", "Secrets")
+	milk := s.addItem("alice", groceries, nil, "milk")
+	s.addItem("alice", groceries, &milk.ID, "oat")
+	s.addItem("alice", groceries, &milk.ID, "soy")
+	eggs := s.addItem("alice", groceries, nil, "eggs")
+	s.addItem("alice", groceries, nil, "bread")
+	require.Equal(t, http.StatusOK, s.do("alice", "PUT", "/list/"+groceries.String()+"/item/"+eggs.ID.String(), map[string]any{"text": "eggs", "marked": true}).status)
+
+	// Reads a page of objects with the selected fields
+	names := func(res response) []string {
+		t.Helper()
+		var page []map[string]any
+		res.decode(t, http.StatusOK, &page)
+		var names []string
+		for _, object := range page {
+			name, _ := object["name"].(string)
+			if name == "" {
+				name, _ = object["text"].(string)
+			}
+			names = append(names, name)
+		}
+		return names
+	}
+
+	// Lists are paged with their total and a link to the next page
+	res := s.do("alice", "GET", "/list?limit=2&fields=name", nil)
+	require.Equal(t, []string{"Groceries", "Chores"}, names(res))
+	require.Equal(t, "3", res.header.Get("X-Total-Count"))
+	require.Equal(t, `</list?fields=name&limit=2&offset=2>; rel="next"`, res.header.Get("Link"))
+	res = s.do("alice", "GET", "/list?fields=name&limit=2&offset=2", nil)
+	require.Equal(t, []string{"Books"}, names(res))
+	require.Equal(t, "3", res.header.Get("X-Total-Count"))
+	require.Empty(t, res.header.Get("Link"))
+	res = s.do("alice", "GET", "/list?offset=5", nil)
+	require.Empty(t, names(res))
+	require.Equal(t, "3", res.header.Get("X-Total-Count"))
+
+	// Only the selected fields are sent
+	var selected []map[string]any
+	s.do("alice", "GET", "/list?fields=name,progress&limit=1", nil).decode(t, http.StatusOK, &selected)
+	require.Equal(t, []map[string]any{{"name": "Groceries", "progress": map[string]any{"done": 1.0, "total": 5.0}}}, selected)
+	var list map[string]any
+	s.do("alice", "GET", "/list/"+groceries.String()+"?fields=name,unknown", nil).decode(t, http.StatusOK, &list)
+	require.Equal(t, map[string]any{"name": "Groceries"}, list)
+
+	// Items of a list are paged and filtered, with subtasks
+	path := "/list/" + groceries.String()
+	res = s.do("alice", "GET", path+"/items?limit=1&fields=text", nil)
+	require.Equal(t, []string{"milk"}, names(res))
+	require.Equal(t, "3", res.header.Get("X-Total-Count"))
+	require.Equal(t, "<"+path+`/items?fields=text&limit=1&offset=1>; rel="next"`, res.header.Get("Link"))
+	res = s.do("alice", "GET", path+"/items?status=open", nil)
+	require.Equal(t, []string{"milk", "bread"}, names(res))
+	require.Equal(t, "2", res.header.Get("X-Total-Count"))
+	res = s.do("alice", "GET", path+"/items?status=done&fields=text,marked", nil)
+	var done []map[string]any
+	res.decode(t, http.StatusOK, &done)
+	require.Equal(t, []map[string]any{{"text": "eggs", "marked": true}}, done)
+
+	var item TodoItem
+	s.do("alice", "GET", path+"/item/"+milk.ID.String(), nil).decode(t, http.StatusOK, &item)
+	require.Equal(t, "milk", item.Text)
+	require.Len(t, item.Children, 2)
+	var fields map[string]any
+	s.do("alice", "GET", path+"/item/"+milk.ID.String()+"?fields=text,version", nil).decode(t, http.StatusOK, &fields)
+	require.Equal(t, map[string]any{"text": "milk", "version": 1.0}, fields)
+
+	// Invalid queries are refused
+	for _, query := range []string{"limit=0", "limit=501", "offset=-1", "status=maybe", "completed-since=yesterday"} {
+		var e Error
+		s.do("alice", "GET", path+"/items?"+query, nil).decode(t, http.StatusBadRequest, &e)
+		require.Equal(t, "invalid-query", e.Code, query)
+	}
+
+	// Lists of others are missing, as are unknown items
+	res = s.do("bob", "GET", "/list", nil)
+	require.Equal(t, []string{"Secrets"}, names(res))
+	require.Equal(t, "1", res.header.Get("X-Total-Count"))
+	for _, path := range []string{path, path + "/items", path + "/item/" + milk.ID.String(), path + "/item/" + milk.ID.String() + "/text/text"} {
+		require.Equal(t, http.StatusNotFound, s.do("bob", "GET", path, nil).status, path)
+	}
+	require.Equal(t, http.StatusNotFound, s.do("alice", "GET", path+"/item/"+groceries.String(), nil).status)
+	require.Equal(t, http.StatusBadRequest, s.do("alice", "GET", "/list/groceries", nil).status)
+}
@@ -0,0 +1,112 @@
+package api
+
+import (
+	"errors"
+	"html"
+	"net/http"
+	"strings"
+	"todolist/internal/conv"
+	"todolist/internal/db"
+
+	"github.com/gofrs/uuid"
+)
+
+// SearchResult is a list or, if Item is set, an item of the list that
+// matches a search, without its children. Snippet is an HTML excerpt of the
+// matching text with the matches in mark elements, and a higher Score means
+// a better match.
+type SearchResult struct {
+	List     uuid.UUID `json:"list"`
+	ListName string    `json:"listname"`
+	Owner    string    `json:"owner"`
+	Item     *TodoItem `json:"item,omitempty"`
+	Snippet  string    `json:"snippet"`
+	Score    float64   `json:"score"`
+}
+
+// highlighter turns the markers of the store around matches into HTML.
+var highlighter = strings.NewReplacer(db.HighlightStart, "<mark>", db.HighlightEnd, "</mark>")
+
+func newSearchResult(in db.SearchResult) (out SearchResult) {
+	out.List = *in.List.ID
+	out.ListName = *in.List.Name
+	if in.List.Owner != nil {
+		out.Owner = *in.List.Owner
+	}
+	if in.Item != nil {
+		out.Item = conv.Pointer(newTodoItem(out.List, *in.Item))
+	}
+	out.Snippet = highlighter.Replace(html.EscapeString(*in.Snippet))
+	out.Score = *in.Score
+	return
+}
+
+// parseSearch reads the q, list and status query parameters and the
+// page of a search, or responds with what is wrong with them.
+func (a *api) parseSearch(w http.ResponseWriter, r *http.Request) (q db.SearchQuery, p page, ok bool) {
+	query := r.URL.Query()
+	p, fields := parsePage(r)
+	text := strings.TrimSpace(query.Get("q"))
+	if text == "" {
+		fields = append(fields, FieldError{Field: "q", Message: "must not be empty"})
+	}
+	q.Text = &text
+	if value := query.Get("list"); value != "" {
+		id, err := uuid.FromString(value)
+		if err != nil {
+			fields = append(fields, FieldError{Field: "list", Message: "must be a UUID"})
+		}
+		q.List = &id
+	}
+	switch query.Get("status") {
+	case "":
+	case StatusOpen:
+		q.Marked = conv.Pointer(false)
+	case StatusDone:
+		q.Marked = conv.Pointer(true)
+	default:
+		fields = append(fields, FieldError{Field: "status", Message: "must be open or done"})
+	}
+	if fields != nil {
+		a.writeError(w, http.StatusBadRequest, Error{Code: "invalid-query", Message: "invalid query parameters", Fields: fields})
+		return q, p, false
+	}
+	q.Offset, q.Limit = p.offset, p.limit
+	return q, p, true
+}
+
+// handleSearch responds with a page of the lists and items the user can read
+// that match a search, best matches first, narrowed down by the owner
+// parameter to the lists of the named user.
+func (a *api) handleSearch(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	q, p, ok := a.parseSearch(w, r)
+	if !ok {
+		return
+	}
+	q.User = conv.Pointer(principal(ctx).ID)
+	if owner := r.URL.Query().Get("owner"); owner != "" {
+		// Unknown users own no lists
+		user, err := a.store.GetUserByName(ctx, owner)
+		if errors.Is(err, db.ErrNotFound) {
+			a.writePage(w, r, p, 0, []any{})
+			return
+		}
+		if err != nil {
+			a.writeInternal(w, "failed to get user", err)
+			return
+		}
+		q.Owner = user.ID
+	}
+
+	results, total, err := a.store.Search(ctx, q)
+	if err != nil {
+		a.writeInternal(w, "failed to search", err)
+		return
+	}
+	elements := make([]any, len(results))
+	for i := range results {
+		elements[i] = newSearchResult(results[i])
+	}
+	a.writePage(w, r, p, total, elements)
+}
@@ -0,0 +1,72 @@
+package api
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSearch(t *testing.T) {
+	s := newTestServer(t, "alice", "bob")
+	groceries := s.newList("alice", "Groceries")
+	milk := s.addItem("alice", groceries, nil, "milk <b>&</b> honey")
+	s.addItem("alice", groceries, nil, "milkshake")
+	secrets := s.newList("bob", "Secret milk")
+	s.addItem("bob", secrets, nil, "milk for bob")
+	require.Equal(t, http.StatusOK, s.do("alice", "PUT", "/list/"+groceries.String()+"/item/"+milk.ID.String(), map[string]any{"text": milk.Text, "marked": true}).status)
+
+	search := func(user string, query string) (results []SearchResult, res response) {
+		t.Helper()
+		res = s.do(user, "GET", "/search?"+query, nil)
+		res.decode(t, http.StatusOK, &results)
+		return results, res
+	}
+
+	// Snippets are escaped before the matches are marked
+	results, res := search("alice", "q=MILK")
+	require.Equal(t, "2", res.header.Get("X-Total-Count"))
+	require.Len(t, results, 2)
+	require.Equal(t, milk.ID, results[0].Item.ID)
+	require.Equal(t, "<mark>milk</mark> &lt;b&gt;&amp;&lt;/b&gt; honey", results[0].Snippet)
+	require.Equal(t, "<mark>milkshake</mark>", results[1].Snippet)
+	require.Equal(t, "alice", results[0].Owner)
+	require.Equal(t, "Groceries", results[0].ListName)
+
+	// Searches are narrowed down and paged
+	results, _ = search("alice", "q=milk&status=open")
+	require.Len(t, results, 1)
+	require.Equal(t, "milkshake", results[0].Item.Text)
+	results, _ = search("alice", "q=milk+honey&list="+groceries.String())
+	require.Len(t, results, 1)
+	results, res = search("alice", "q=milk&limit=1")
+	require.Len(t, results, 1)
+	require.Equal(t, "2", res.header.Get("X-Total-Count"))
+	require.Equal(t, `</search?limit=1&offset=1&q=milk>; rel="next"`, res.header.Get("Link"))
+
+	// Only the lists of the user are searched, also when the owner is named
+	results, _ = search("bob", "q=milk")
+	require.Len(t, results, 2)
+	require.Equal(t, secrets, results[0].List)
+	results, _ = search("bob", "q=milk&owner=alice")
+	require.Empty(t, results)
+	results, _ = search("bob", "q=milk&list="+groceries.String())
+	require.Empty(t, results)
+	s.share("alice", groceries, "bob", "viewer")
+	results, _ = search("bob", "q=honey&owner=alice")
+	require.Len(t, results, 1)
+	results, res = search("bob", "q=milk&owner=nobody")
+	require.Empty(t, results)
+	require.Equal(t, "0", res.header.Get("X-Total-Count"))
+	results, _ = search("alice", "q=%21%3F")
+	require.Empty(t, results)
+
+	// Invalid queries are refused
+	for _, query := range []string{"", "q=", "q=+", "q=milk&list=groceries", "q=milk&status=maybe", "q=milk&limit=0"} {
+		var e Error
+		s.do("alice", "GET", "/search?"+query, nil).decode(t, http.StatusBadRequest, &e)
+		require.Equal(t, "invalid-query", e.Code, query)
+	}
+	require.Equal(t, http.StatusUnauthorized, s.do("", "GET", "/search?q="+url.QueryEscape("milk"), nil).status)
+}
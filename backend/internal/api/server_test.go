@@ -0,0 +1,233 @@
+package api
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+	"todolist/internal/db"
+
+	"github.com/gofrs/uuid"
+	"github.com/stretchr/testify/require"
+)
+
+// testServer serves the api over a memory store to users logged in by name.
+type testServer struct {
+	t      *testing.T
+	api    *api
+	store  db.Store
+	url    string
+	tokens map[string]string
+	ids    map[string]uuid.UUID
+}
+
+// newTestServer starts a server and registers and logs in the users.
+func newTestServer(t *testing.T, users ...string) *testServer {
+	ctx, cancel := context.WithCancel(context.Background())
+	store := db.NewMemory()
+	a := New(ctx, slog.New(slog.NewTextHandler(io.Discard, nil)), store, Options{TextCompaction: time.Hour})
+	server := httptest.NewServer(a.routes())
+	t.Cleanup(func() {
+		cancel()
+		server.CloseClientConnections()
+		server.Close()
+	})
+
+	s := &testServer{t: t, api: a, store: store, url: server.URL, tokens: make(map[string]string), ids: make(map[string]uuid.UUID)}
+	for _, name := range users {
+		credentials := Credentials{Name: name, Password: "password1"}
+		res := s.do("", "POST", "/register", credentials)
+		require.Equal(t, http.StatusCreated, res.status, string(res.body))
+		var login Login
+		s.do("", "POST", "/login", credentials).decode(t, http.StatusOK, &login)
+		s.tokens[name], s.ids[name] = login.Token, login.User.ID
+	}
+	return s
+}
+
+// response is a response with its body read.
+type response struct {
+	status int
+	header http.Header
+	body   []byte
+}
+
+// decode requires the response to have a status and decodes its body.
+func (r response) decode(t *testing.T, status int, v any) {
+	t.Helper()
+	require.Equal(t, status, r.status, string(r.body))
+	require.NoError(t, json.Unmarshal(r.body, v))
+}
+
+// do makes a request as a user, anonymously if user is empty. Bodies other
+// than strings are sent as JSON. header holds pairs of names and values.
+func (s *testServer) do(user string, method string, path string, body any, header ...string) response {
+	s.t.Helper()
+	r, err := http.NewRequest(method, s.url+path, s.body(body))
+	require.NoError(s.t, err)
+	if user != "" {
+		r.Header.Set("Authorization", "Bearer "+s.tokens[user])
+	}
+	for i := 0; i+1 < len(header); i += 2 {
+		r.Header.Set(header[i], header[i+1])
+	}
+	res, err := http.DefaultClient.Do(r)
+	require.NoError(s.t, err)
+	defer res.Body.Close()
+	data, err := io.ReadAll(res.Body)
+	require.NoError(s.t, err)
+	return response{status: res.StatusCode, header: res.Header, body: data}
+}
+
+func (s *testServer) body(body any) io.Reader {
+	switch body := body.(type) {
+	case nil:
+		return nil
+	case string:
+		return bytes.NewBufferString(body)
+	default:
+		data, err := json.Marshal(body)
+		require.NoError(s.t, err)
+		return bytes.NewBuffer(data)
+	}
+}
+
+// newList creates a list owned by a user.
+func (s *testServer) newList(user string, name string) uuid.UUID {
+	s.t.Helper()
+	var list TodoList
+	s.do(user, "POST", "/list", map[string]any{"name": name}).decode(s.t, http.StatusCreated, &list)
+	return list.ID
+}
+
+// addItem adds an item to a list, below a parent if it is not nil.
+func (s *testServer) addItem(user string, list uuid.UUID, parent *uuid.UUID, text string) TodoItem {
+	s.t.Helper()
+	path := "/list/" + list.String() + "/add"
+	if parent != nil {
+		path = "/list/" + list.String() + "/item/" + parent.String() + "/add"
+	}
+	var item TodoItem
+	s.do(user, "PUT", path, map[string]any{"text": text}).decode(s.t, http.StatusCreated, &item)
+	return item
+}
+
+// share makes a user a member of a list with a role.
+func (s *testServer) share(owner string, list uuid.UUID, member string, role string) {
+	s.t.Helper()
+	res := s.do(owner, "POST", "/list/"+list.String()+"/members", Member{Name: member, Role: role})
+	require.Equal(s.t, http.StatusCreated, res.status, string(res.body))
+}
+
+// stream is an event stream being read by a user.
+type stream struct {
+	t      *testing.T
+	cancel context.CancelFunc
+	events chan streamEvent
+}
+
+// streamEvent is an event as it was read from a stream.
+type streamEvent struct {
+	id   string
+	name string
+	data string
+}
+
+// decode decodes the data of the event.
+func (e streamEvent) decode(t *testing.T, v any) {
+	t.Helper()
+	require.NoError(t, json.Unmarshal([]byte(e.data), v))
+}
+
+// subscribe reads the events of a path as a user. header holds pairs of names
+// and values.
+func (s *testServer) subscribe(user string, path string, header ...string) *stream {
+	s.t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	r, err := http.NewRequestWithContext(ctx, "GET", s.url+path, nil)
+	require.NoError(s.t, err)
+	r.Header.Set("Authorization", "Bearer "+s.tokens[user])
+	for i := 0; i+1 < len(header); i += 2 {
+		r.Header.Set(header[i], header[i+1])
+	}
+	res, err := http.DefaultClient.Do(r)
+	require.NoError(s.t, err)
+	if res.StatusCode != http.StatusOK {
+		data, _ := io.ReadAll(res.Body)
+		res.Body.Close()
+		cancel()
+		s.t.Fatalf("subscribing to %s: %d %s", path, res.StatusCode, data)
+	}
+
+	st := &stream{t: s.t, cancel: cancel, events: make(chan streamEvent, 100)}
+	s.t.Cleanup(st.close)
+	go func() {
+		defer res.Body.Close()
+		defer close(st.events)
+		scanner := bufio.NewScanner(res.Body)
+		var event streamEvent
+		for scanner.Scan() {
+			field, value, _ := strings.Cut(scanner.Text(), ": ")
+			switch field {
+			case "id":
+				event.id = value
+			case "event":
+				event.name = value
+			case "data":
+				event.data = value
+			case "":
+				// Only events with data are dispatched
+				if event.data != "" {
+					st.events <- event
+				}
+				event = streamEvent{}
+			}
+		}
+	}()
+	return st
+}
+
+// next returns the next event of the stream.
+func (st *stream) next() streamEvent {
+	st.t.Helper()
+	select {
+	case event, ok := <-st.events:
+		require.True(st.t, ok, "the stream has ended")
+		return event
+	case <-time.After(5 * time.Second):
+		st.t.Fatal("no event within 5s")
+		return streamEvent{}
+	}
+}
+
+// nextNamed returns the next event of the stream, which has to have a name.
+func (st *stream) nextNamed(name string) streamEvent {
+	st.t.Helper()
+	event := st.next()
+	require.Equal(st.t, name, event.name, event.data)
+	return event
+}
+
+// quiet requires no event to arrive for a while.
+func (st *stream) quiet() {
+	st.t.Helper()
+	select {
+	case event, ok := <-st.events:
+		if ok {
+			st.t.Fatalf("unexpected %s event: %s", event.name, event.data)
+		}
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+// close stops reading the stream.
+func (st *stream) close() {
+	st.cancel()
+}
@@ -0,0 +1,332 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"todolist/internal/conv"
+	"todolist/internal/db"
+
+	"github.com/gofrs/uuid"
+)
+
+// Operation is a change queued by a client, for instance while it was
+// offline. ID is generated by the client and makes retrying a sync safe. Type
+// is one of AddItem, UpdateItem, RemoveItem and MoveItem. Added items keep the
+// Item ID chosen by the client, so that later operations can refer to them.
+// Base is the version of the item the change was based on; without it the
+// change is applied regardless.
+type Operation struct {
+	ID       string    `json:"id"`
+	Type     string    `json:"type"`
+	List     uuid.UUID `json:"list"`
+	Item     uuid.UUID `json:"item"`
+	Base     int64     `json:"base,omitempty"`
+	TodoItem *TodoItem `json:"todoitem,omitempty"`
+	Move     *Move     `json:"move,omitempty"`
+}
+
+// Statuses of synced operations.
+const (
+	// StatusApplied operations have been applied by this sync.
+	StatusApplied = "applied"
+	// StatusDuplicate operations had been applied by an earlier sync.
+	StatusDuplicate = "duplicate"
+	// StatusConflict operations were based on an outdated version, or would
+	// have made an item its own descendant. The error holds the current item.
+	StatusConflict = "conflict"
+	// StatusRejected operations are invalid or not allowed.
+	StatusRejected = "rejected"
+)
+
+type OperationResult struct {
+	ID       string    `json:"id"`
+	Status   string    `json:"status"`
+	TodoItem *TodoItem `json:"todoitem,omitempty"`
+	Error    *Error    `json:"error,omitempty"`
+}
+
+// SyncRequest holds the operations of a client in the order they were made.
+// Since is the sequence number of the last event the client has seen, and
+// Lists the lists it wants the changes of, by default every list it can see.
+type SyncRequest struct {
+	Since      *int64      `json:"since,omitempty"`
+	Lists      []uuid.UUID `json:"lists,omitempty"`
+	Operations []Operation `json:"operations"`
+}
+
+// SyncEvent is an event as it has been published to the subscribers of a list.
+type SyncEvent struct {
+	Seq  int64           `json:"seq"`
+	Type string          `json:"type"`
+	Data json.RawMessage `json:"data"`
+}
+
+// SyncResponse holds the result of every operation and the changes since the
+// request's Since, including those made by the operations. If Since was
+// missing or the events have been compacted, Lists holds a snapshot of the
+// lists instead. Seq is to be sent as Since by the next sync.
+type SyncResponse struct {
+	Results []OperationResult `json:"results"`
+	Seq     int64             `json:"seq"`
+	Events  []SyncEvent       `json:"events,omitempty"`
+	Lists   []TodoList        `json:"lists,omitempty"`
+}
+
+func (a *api) handleSync(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	user := principal(ctx)
+
+	data, err := io.ReadAll(r.Body)
+	if err != nil {
+		a.writeBadRequest(w, err)
+		return
+	}
+
+	var request SyncRequest
+	err = json.Unmarshal(data, &request)
+	if err != nil {
+		a.writeBadRequest(w, err)
+		return
+	}
+
+	lists := request.Lists
+	if len(lists) == 0 {
+		lists, err = a.store.GetMemberLists(ctx, user.ID)
+		if err != nil {
+			a.writeInternal(w, "failed to get lists", err)
+			return
+		}
+	}
+	for _, id := range lists {
+		role, _, err := a.store.GetListAccess(ctx, id, user.ID)
+		if errors.Is(err, db.ErrNotFound) || (err == nil && role == "") {
+			a.writeError(w, http.StatusNotFound, Error{Code: CodeNotFound, Message: "no such list"})
+			return
+		}
+		if err != nil {
+			a.writeInternal(w, "failed to get role", err)
+			return
+		}
+	}
+
+	// Operations that cannot be applied are rejected up front, and the rest
+	// are applied together
+	results := make([]OperationResult, len(request.Operations))
+	var ops []db.Operation
+	var applied []int
+	denied := make(map[uuid.UUID]*Error)
+	for i, op := range request.Operations {
+		results[i].ID = op.ID
+		record, problem := a.prepareOperation(ctx, op, denied)
+		if problem != nil {
+			results[i].Status = StatusRejected
+			results[i].Error = problem
+			continue
+		}
+		ops = append(ops, record)
+		applied = append(applied, i)
+	}
+
+	var changed []uuid.UUID
+	for _, op := range ops {
+		changed = append(changed, *op.List)
+		if op.Move != nil && op.Move.List != nil {
+			changed = append(changed, *op.Move.List)
+		}
+	}
+	var outcomes []db.OperationResult
+	var items []*TodoItem
+	err = a.change(ctx, changed, func(ctx context.Context) ([]pending, error) {
+		var err error
+		outcomes, err = a.store.Sync(ctx, user.ID, ops)
+		if err != nil {
+			return nil, err
+		}
+		items = make([]*TodoItem, len(outcomes))
+		var events []pending
+		for j, outcome := range outcomes {
+			if outcome.Duplicate || outcome.Err != nil {
+				continue
+			}
+			var changes []pending
+			items[j], changes = a.operationEvents(ctx, request.Operations[applied[j]], outcome)
+			events = append(events, changes...)
+		}
+		return events, nil
+	})
+	if err != nil {
+		a.writeInternal(w, "failed to sync", err)
+		return
+	}
+
+	for j, outcome := range outcomes {
+		op := request.Operations[applied[j]]
+		result := &results[applied[j]]
+		switch {
+		case outcome.Duplicate:
+			result.Status = StatusDuplicate
+		case errors.Is(outcome.Err, db.ErrVersionMismatch):
+			result.Status = StatusConflict
+			result.Error = &Error{Code: "version-mismatch", Message: "the item has been changed by someone else"}
+			if current := a.currentItem(ctx, op.List, op.Item); current != nil {
+				result.Error.Current = current
+			}
+		case errors.Is(outcome.Err, db.ErrConflict):
+			result.Status = StatusConflict
+			result.Error = &Error{Code: CodeConflict, Message: outcome.Err.Error()}
+		case errors.Is(outcome.Err, db.ErrNotFound):
+			result.Status = StatusRejected
+			result.Error = &Error{Code: CodeNotFound, Message: "no such list or item"}
+		default:
+			result.Status = StatusApplied
+			result.TodoItem = items[j]
+			if items[j] != nil {
+				a.syncTexts(*items[j])
+			}
+		}
+	}
+
+	response := SyncResponse{Results: results}
+
+	// Holding the locks of the lists keeps their events from being recorded
+	// between reading the changes and the sequence number
+	unlock := a.topics.lock(lists...)
+	defer unlock()
+
+	response.Seq, err = a.store.LatestEventSeq(ctx)
+	if err != nil {
+		a.writeInternal(w, "failed to get latest event", err)
+		return
+	}
+
+	if request.Since != nil {
+		events, err := a.store.EventsSince(ctx, *request.Since, lists)
+		if err != nil && !errors.Is(err, db.ErrCompacted) {
+			a.writeInternal(w, "failed to get events", err)
+			return
+		}
+		if err == nil {
+			response.Events = make([]SyncEvent, len(events))
+			for i, event := range events {
+				response.Events[i] = SyncEvent{Seq: *event.Seq, Type: *event.Type, Data: json.RawMessage(*event.Data)}
+			}
+			a.writeJSON(w, http.StatusOK, response)
+			return
+		}
+	}
+
+	response.Lists = make([]TodoList, 0, len(lists))
+	for _, id := range lists {
+		list, err := a.store.GetTodoList(ctx, id)
+		if errors.Is(err, db.ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			a.writeInternal(w, "failed to get todo list", err)
+			return
+		}
+		response.Lists = append(response.Lists, NewTodoList(list))
+	}
+	a.writeJSON(w, http.StatusOK, response)
+}
+
+// prepareOperation validates an operation and checks that the user may make
+// it. Lists the user may not change are remembered in denied.
+func (a *api) prepareOperation(ctx context.Context, op Operation, denied map[uuid.UUID]*Error) (db.Operation, *Error) {
+	if op.ID == "" {
+		return db.Operation{}, &Error{Code: "invalid-operation", Message: "operations need an id"}
+	}
+
+	record := db.Operation{
+		ID:   conv.Pointer(op.ID),
+		Type: conv.Pointer(op.Type),
+		List: conv.Pointer(op.List),
+		Item: &db.TodoItem{ID: conv.Pointer(op.Item)},
+	}
+
+	lists := []uuid.UUID{op.List}
+	switch op.Type {
+	case AddItem, UpdateItem:
+		if op.TodoItem == nil && op.Type == UpdateItem {
+			return db.Operation{}, &Error{Code: "invalid-operation", Message: op.Type + " needs a todoitem"}
+		}
+		var item TodoItem
+		if op.TodoItem != nil {
+			item = *op.TodoItem
+		}
+		item.ID = op.Item
+		item.List = op.List
+		item.Children = nil
+		if op.Type == AddItem && item.Text == "" {
+			item.Text = "My new item"
+		}
+		if !validPrice(item.Price) {
+			return db.Operation{}, &Error{Code: "invalid-item", Message: "invalid price", Fields: []FieldError{{Field: "price", Message: "must be in an ISO 4217 currency"}}}
+		}
+		fields := validateKind(&item)
+		if fields != nil {
+			return db.Operation{}, &Error{Code: "invalid-item", Message: "item does not match the schema of its kind", Fields: fields}
+		}
+		record.Item = conv.Pointer(item.Record())
+		completedBy(record.Item, principal(ctx).ID)
+	case RemoveItem:
+	case MoveItem:
+		if op.Move == nil {
+			return db.Operation{}, &Error{Code: "invalid-operation", Message: op.Type + " needs a move"}
+		}
+		if op.Move.Before != nil && op.Move.After != nil {
+			return db.Operation{}, &Error{Code: "invalid-move", Message: "before and after cannot both be given"}
+		}
+		if op.Move.List != nil {
+			lists = append(lists, *op.Move.List)
+		}
+		record.Move = conv.Pointer(op.Move.Record())
+	default:
+		return db.Operation{}, &Error{Code: "invalid-operation", Message: "unknown operation type " + op.Type}
+	}
+	if op.Type != AddItem && op.Base != 0 {
+		record.Item.Version = conv.Pointer(op.Base)
+	}
+
+	for _, id := range lists {
+		problem, ok := denied[id]
+		if !ok {
+			status, body := a.editDenied(ctx, id)
+			if status != 0 {
+				problem = &body
+			}
+			denied[id] = problem
+		}
+		if problem != nil {
+			return db.Operation{}, problem
+		}
+	}
+	return record, nil
+}
+
+// operationEvents returns the resulting item of an applied operation and the
+// events of the change it made.
+func (a *api) operationEvents(ctx context.Context, op Operation, outcome db.OperationResult) (*TodoItem, []pending) {
+	switch op.Type {
+	case AddItem, UpdateItem:
+		item := newTodoItem(op.List, *outcome.Item)
+		event := ItemEvent{Type: op.Type, TodoItem: conv.Pointer(item)}
+		a.withTotals(ctx, &event)
+		return &item, []pending{{op.List, event}}
+	case RemoveItem:
+		event := ItemEvent{Type: RemoveItem, TodoItem: &TodoItem{ID: op.Item, List: op.List, Parent: outcome.Old.Parent}}
+		a.withTotals(ctx, &event)
+		return nil, []pending{{op.List, event}}
+	case MoveItem:
+		target := op.List
+		if op.Move.List != nil {
+			target = *op.Move.List
+		}
+		item := a.movedItem(ctx, target, outcome.Item)
+		return &item, a.moveEvents(ctx, op.List, outcome.Old, item)
+	}
+	return nil, nil
+}
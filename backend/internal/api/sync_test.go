@@ -0,0 +1,134 @@
+package api
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/gofrs/uuid"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSync(t *testing.T) {
+	s := newTestServer(t, "alice", "bob", "dave")
+	groceries := s.newList("alice", "Groceries")
+	milk := s.addItem("alice", groceries, nil, "milk")
+	s.share("alice", groceries, "bob", "viewer")
+	s.share("alice", groceries, "dave", "editor")
+	chores := s.newList("alice", "Chores")
+	eggs := uuid.Must(uuid.NewV4())
+
+	sync := func(user string, request SyncRequest) SyncResponse {
+		t.Helper()
+		var response SyncResponse
+		s.do(user, "POST", "/sync", request).decode(t, http.StatusOK, &response)
+		require.Len(t, response.Results, len(request.Operations))
+		for i, result := range response.Results {
+			require.Equal(t, request.Operations[i].ID, result.ID)
+		}
+		return response
+	}
+	statuses := func(response SyncResponse) []string {
+		var statuses []string
+		for _, result := range response.Results {
+			statuses = append(statuses, result.Status)
+		}
+		return statuses
+	}
+
+	events := s.subscribe("alice", "/list/"+groceries.String()+"/events")
+	events.nextNamed(UpdateList)
+	start := sync("alice", SyncRequest{})
+	require.Len(t, start.Lists, 2)
+
+	// Operations are applied in order, later ones referring to items added
+	// by earlier ones, and published like the same changes made directly
+	offline := SyncRequest{Operations: []Operation{
+		{ID: "dave-1", Type: AddItem, List: groceries, Item: eggs, TodoItem: &TodoItem{Text: "eggs"}},
+		{ID: "dave-2", Type: UpdateItem, List: groceries, Item: milk.ID, Base: milk.Version, TodoItem: &TodoItem{Text: "oat milk"}},
+		{ID: "dave-3", Type: MoveItem, List: groceries, Item: eggs, Move: &Move{Before: &milk.ID}},
+		{ID: "dave-4", Type: UpdateItem, List: groceries, Item: eggs, TodoItem: &TodoItem{Text: "eggs", Marked: true}},
+	}}
+	response := sync("dave", offline)
+	require.Equal(t, []string{StatusApplied, StatusApplied, StatusApplied, StatusApplied}, statuses(response))
+	require.Equal(t, eggs, response.Results[0].TodoItem.ID)
+	require.Equal(t, "oat milk", response.Results[1].TodoItem.Text)
+	require.True(t, response.Results[3].TodoItem.Marked)
+	require.Equal(t, "dave", response.Results[3].TodoItem.CompletedBy)
+	require.NotEmpty(t, response.Lists)
+
+	var event ItemEvent
+	events.nextNamed(AddItem).decode(t, &event)
+	require.Equal(t, eggs, event.TodoItem.ID)
+	events.nextNamed(UpdateItem).decode(t, &event)
+	require.Equal(t, "oat milk", event.TodoItem.Text)
+	events.nextNamed(MoveItem)
+	events.nextNamed(UpdateItem).decode(t, &event)
+	require.Equal(t, 1, event.ListProgress.Done)
+
+	var list TodoList
+	s.do("alice", "GET", "/list/"+groceries.String(), nil).decode(t, http.StatusOK, &list)
+	require.Equal(t, []string{"eggs", "oat milk"}, []string{list.Items[0].Text, list.Items[1].Text})
+
+	// Replayed operations are not applied again
+	response = sync("dave", offline)
+	require.Equal(t, []string{StatusDuplicate, StatusDuplicate, StatusDuplicate, StatusDuplicate}, statuses(response))
+	events.quiet()
+
+	// Changes based on outdated versions conflict with the current item,
+	// and so do moves into the item's own subtree
+	oat := s.addItem("alice", groceries, &milk.ID, "oat")
+	events.nextNamed(AddItem)
+	response = sync("dave", SyncRequest{Operations: []Operation{
+		{ID: "dave-5", Type: UpdateItem, List: groceries, Item: milk.ID, Base: milk.Version, TodoItem: &TodoItem{Text: "soy milk"}},
+		{ID: "dave-6", Type: MoveItem, List: groceries, Item: milk.ID, Move: &Move{Parent: &oat.ID}},
+		{ID: "dave-7", Type: RemoveItem, List: groceries, Item: uuid.Must(uuid.NewV4())},
+	}})
+	require.Equal(t, []string{StatusConflict, StatusConflict, StatusRejected}, statuses(response))
+	require.Equal(t, "version-mismatch", response.Results[0].Error.Code)
+	current := response.Results[0].Error.Current.(map[string]any)
+	require.Equal(t, "oat milk", current["text"])
+	require.Equal(t, CodeConflict, response.Results[1].Error.Code)
+	require.Equal(t, CodeNotFound, response.Results[2].Error.Code)
+	events.quiet()
+
+	// Every operation needs the editor role in the lists it changes, and
+	// the others are applied regardless
+	s.share("alice", chores, "dave", "viewer")
+	response = sync("dave", SyncRequest{Operations: []Operation{
+		{ID: "dave-8", Type: AddItem, List: chores, Item: uuid.Must(uuid.NewV4())},
+		{ID: "dave-9", Type: MoveItem, List: groceries, Item: eggs, Move: &Move{List: &chores}},
+		{ID: "dave-10", Type: AddItem, List: uuid.Must(uuid.NewV4()), Item: uuid.Must(uuid.NewV4())},
+		{ID: "", Type: AddItem, List: groceries, Item: uuid.Must(uuid.NewV4())},
+		{ID: "dave-11", Type: "rename-item", List: groceries, Item: eggs},
+		{ID: "dave-12", Type: UpdateItem, List: groceries, Item: eggs},
+		{ID: "dave-13", Type: RemoveItem, List: groceries, Item: eggs},
+	}})
+	require.Equal(t, []string{StatusRejected, StatusRejected, StatusRejected, StatusRejected, StatusRejected, StatusRejected, StatusApplied}, statuses(response))
+	var codes []string
+	for _, result := range response.Results[:6] {
+		codes = append(codes, result.Error.Code)
+	}
+	require.Equal(t, []string{"forbidden", "forbidden", CodeNotFound, "invalid-operation", "invalid-operation", "invalid-operation"}, codes)
+	events.nextNamed(RemoveItem).decode(t, &event)
+	require.Equal(t, eggs, event.TodoItem.ID)
+	events.quiet()
+	response = sync("bob", SyncRequest{Operations: []Operation{
+		{ID: "bob-1", Type: UpdateItem, List: groceries, Item: milk.ID, TodoItem: &TodoItem{Text: "soy milk"}},
+	}})
+	require.Equal(t, "forbidden", response.Results[0].Error.Code)
+
+	// Clients catch up with the events since their last sync, of the lists
+	// they ask for, which they have to be able to read
+	since := start.Seq
+	response = sync("bob", SyncRequest{Since: &since, Lists: []uuid.UUID{groceries}})
+	require.Empty(t, response.Lists)
+	var types []string
+	for _, event := range response.Events {
+		types = append(types, event.Type)
+	}
+	require.Equal(t, []string{AddItem, UpdateItem, MoveItem, UpdateItem, AddItem, RemoveItem}, types)
+	require.Greater(t, response.Seq, since)
+	response = sync("bob", SyncRequest{Since: &response.Seq})
+	require.Empty(t, response.Events)
+	require.Equal(t, http.StatusNotFound, s.do("bob", "POST", "/sync", SyncRequest{Lists: []uuid.UUID{chores}}).status)
+}
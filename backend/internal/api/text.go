@@ -0,0 +1,329 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+	"todolist/internal/conv"
+	"todolist/internal/crdt"
+	"todolist/internal/db"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/gofrs/uuid"
+)
+
+const tokenField = "field"
+
+// UpdateText is the type of the events carrying changes to text fields.
+const UpdateText = "update-text"
+
+// textIdle is how long an unchanged text document is kept in memory after it
+// has been stored. Clients editing it afterwards have to fetch it again.
+const textIdle = 10 * time.Minute
+
+// textFields are the fields of items that can be edited collaboratively.
+var textFields = map[string]func(*TodoItem) string{
+	"text": func(item *TodoItem) string { return item.Text },
+	"description": func(item *TodoItem) string {
+		if item.Description == nil {
+			return ""
+		}
+		return *item.Description
+	},
+}
+
+// TextState is a text field being edited collaboratively. Epoch changes
+// whenever the document is recreated from the stored text, after which
+// updates based on an earlier epoch are refused and the state has to be
+// fetched again. New characters need a clock greater than Clock.
+type TextState struct {
+	Epoch string       `json:"epoch"`
+	Clock uint64       `json:"clock"`
+	Text  string       `json:"text"`
+	State *crdt.Update `json:"state,omitempty"`
+}
+
+// TextUpdate is an incremental change to a text field.
+type TextUpdate struct {
+	Epoch  string      `json:"epoch"`
+	Update crdt.Update `json:"update"`
+}
+
+// TextEvent fans out a change to a text field to the list's subscribers.
+type TextEvent struct {
+	Type   string      `json:"type"`
+	List   uuid.UUID   `json:"list"`
+	Item   uuid.UUID   `json:"item"`
+	Field  string      `json:"field"`
+	Epoch  string      `json:"epoch"`
+	Update crdt.Update `json:"update"`
+}
+
+func (e TextEvent) eventType() string {
+	return e.Type
+}
+
+func (e TextEvent) coalesceKey() string {
+	return ""
+}
+
+type textKey struct {
+	item  uuid.UUID
+	field string
+}
+
+// textDoc is a text field being edited. Dirty documents have changes that
+// have not been stored in the item yet. Version is the version of the item
+// the document was last read from or stored in, which the item must still
+// have when the document is stored. Editor is the user who last changed the
+// document, whom storing it is recorded as made by.
+type textDoc struct {
+	list    uuid.UUID
+	epoch   string
+	doc     *crdt.Doc
+	version int64
+	dirty   bool
+	edited  time.Time
+	editor  uuid.UUID
+}
+
+func (d *textDoc) state(full bool) TextState {
+	state := TextState{Epoch: d.epoch, Clock: d.doc.Clock(), Text: d.doc.Text()}
+	if full {
+		update := d.doc.State()
+		state.State = &update
+	}
+	return state
+}
+
+// texts holds the text fields being edited, which are merged in memory and
+// stored in their items by compactTexts.
+type texts struct {
+	sync.Mutex
+	docs map[textKey]*textDoc
+}
+
+// textDoc returns the document of a text field, creating it from the stored
+// item if it is not being edited. It must be called with the texts locked,
+// and unlocks them while reading the item.
+func (a *api) textDoc(ctx context.Context, listID uuid.UUID, key textKey) (*textDoc, error) {
+	doc, ok := a.texts.docs[key]
+	if ok {
+		return doc, nil
+	}
+
+	a.texts.Unlock()
+	item := a.currentItem(ctx, listID, key.item)
+	a.texts.Lock()
+
+	// Another request may have created the document in the meantime
+	doc, ok = a.texts.docs[key]
+	if ok {
+		return doc, nil
+	}
+	if item == nil {
+		return nil, db.ErrNotFound
+	}
+	epoch, err := uuid.NewV4()
+	if err != nil {
+		return nil, err
+	}
+	doc = &textDoc{
+		list:    listID,
+		epoch:   epoch.String(),
+		doc:     crdt.New(textFields[key.field](item), "server"),
+		version: item.Version,
+		edited:  time.Now(),
+	}
+	a.texts.docs[key] = doc
+	return doc, nil
+}
+
+// readText reads the list, item and field of a request.
+func readText(r *http.Request) (list uuid.UUID, key textKey, ok bool) {
+	ctx := r.Context()
+	list = pathID(ctx, tokenList)
+	key.item = pathID(ctx, tokenItem)
+	key.field = chi.URLParam(r, tokenField)
+	_, ok = textFields[key.field]
+	return
+}
+
+func (a *api) handleGetText(w http.ResponseWriter, r *http.Request) {
+	listID, key, ok := readText(r)
+	if !ok {
+		a.writeError(w, http.StatusNotFound, Error{Code: CodeNotFound, Message: "no such text field"})
+		return
+	}
+
+	a.texts.Lock()
+	defer a.texts.Unlock()
+
+	doc, err := a.textDoc(r.Context(), listID, key)
+	if err != nil {
+		a.writeStoreError(w, err, "item")
+		return
+	}
+	a.writeJSON(w, http.StatusOK, doc.state(true))
+}
+
+func (a *api) handleUpdateText(w http.ResponseWriter, r *http.Request) {
+	listID, key, ok := readText(r)
+	if !ok {
+		a.writeError(w, http.StatusNotFound, Error{Code: CodeNotFound, Message: "no such text field"})
+		return
+	}
+
+	data, err := io.ReadAll(r.Body)
+	if err != nil {
+		a.writeBadRequest(w, err)
+		return
+	}
+
+	var update TextUpdate
+	err = json.Unmarshal(data, &update)
+	if err != nil {
+		a.writeBadRequest(w, err)
+		return
+	}
+
+	a.texts.Lock()
+	defer a.texts.Unlock()
+
+	doc, err := a.textDoc(r.Context(), listID, key)
+	if err != nil {
+		a.writeStoreError(w, err, "item")
+		return
+	}
+
+	if update.Epoch == doc.epoch {
+		err = doc.doc.Apply(update.Update)
+	}
+	if update.Epoch != doc.epoch || errors.Is(err, crdt.ErrUnknownID) {
+		a.writeError(w, http.StatusConflict, Error{Code: "stale-text", Message: "the text has to be fetched again", Current: doc.state(true)})
+		return
+	}
+	if err != nil {
+		a.writeError(w, http.StatusUnprocessableEntity, Error{Code: "invalid-update", Message: err.Error()})
+		return
+	}
+	doc.dirty = true
+	doc.edited = time.Now()
+	doc.editor = principal(r.Context()).ID
+
+	a.writeJSON(w, http.StatusOK, doc.state(false))
+
+	// Updates are delivered in the order they were applied, but are not
+	// recorded; reconnecting clients fetch the text again
+	a.broadcast(listID, TextEvent{
+		Type:   UpdateText,
+		List:   listID,
+		Item:   key.item,
+		Field:  key.field,
+		Epoch:  doc.epoch,
+		Update: update.Update,
+	})
+}
+
+// syncTexts follows changes made to an item other than through its text
+// documents. Documents whose text was replaced are dropped, so that their
+// editors fetch them again, and the others take on the item's version.
+func (a *api) syncTexts(item TodoItem) {
+	a.texts.Lock()
+	defer a.texts.Unlock()
+
+	for field, value := range textFields {
+		key := textKey{item: item.ID, field: field}
+		doc, ok := a.texts.docs[key]
+		if !ok {
+			continue
+		}
+		doc.list = item.List
+		if value(&item) != doc.doc.Text() {
+			delete(a.texts.docs, key)
+			continue
+		}
+		doc.version = item.Version
+	}
+}
+
+// compactTexts periodically stores the merged text of the documents being
+// edited in their items, and forgets documents that are no longer edited.
+func (a *api) compactTexts(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+
+		var dirty []textKey
+		a.texts.Lock()
+		for key, doc := range a.texts.docs {
+			if doc.dirty {
+				dirty = append(dirty, key)
+			} else if time.Since(doc.edited) > textIdle {
+				delete(a.texts.docs, key)
+			}
+		}
+		a.texts.Unlock()
+
+		for _, key := range dirty {
+			a.storeText(ctx, key)
+		}
+	}
+}
+
+// storeText stores the text of a document in its item, unless the item has
+// changed since the document was read from it. The document is dropped in
+// that case, so that its editors fetch the stored text again. The texts are
+// not locked while the item is stored, and edits made meanwhile leave the
+// document dirty.
+func (a *api) storeText(ctx context.Context, key textKey) {
+	a.texts.Lock()
+	doc, ok := a.texts.docs[key]
+	if !ok {
+		a.texts.Unlock()
+		return
+	}
+	list, text, version := doc.list, doc.doc.Text(), doc.version
+	if doc.editor != uuid.Nil {
+		ctx = db.WithAuthor(ctx, doc.editor)
+	}
+	a.texts.Unlock()
+
+	var stored int64
+	err := a.change(ctx, []uuid.UUID{list}, func(ctx context.Context) ([]pending, error) {
+		item, err := a.store.UpdateItemText(ctx, list, key.item, key.field, text, &version)
+		if err != nil {
+			return nil, err
+		}
+		stored = *item.Version
+		event := ItemEvent{Type: UpdateItem, TodoItem: conv.Pointer(newTodoItem(list, *item))}
+		a.withTotals(ctx, &event)
+		return []pending{{list, event}}, nil
+	})
+
+	a.texts.Lock()
+	defer a.texts.Unlock()
+	if a.texts.docs[key] != doc {
+		// The document was dropped or replaced meanwhile
+		return
+	}
+	switch {
+	case errors.Is(err, db.ErrNotFound), errors.Is(err, db.ErrVersionMismatch):
+		delete(a.texts.docs, key)
+	case err != nil:
+		a.logger.Error("failed to store text", "error", err)
+	default:
+		doc.version = max(doc.version, stored)
+		doc.dirty = doc.doc.Text() != text
+	}
+}
@@ -0,0 +1,69 @@
+package api
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"testing"
+	"time"
+	"todolist/internal/conv"
+	"todolist/internal/crdt"
+	"todolist/internal/db"
+
+	"github.com/gofrs/uuid"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStoreText(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	store := db.NewMemory()
+	a := New(ctx, slog.New(slog.NewTextHandler(io.Discard, nil)), store, Options{TextCompaction: time.Hour})
+
+	listID, itemID := uuid.Must(uuid.NewV4()), uuid.Must(uuid.NewV4())
+	require.NoError(t, store.AddTodoList(ctx, db.TodoList{ID: &listID, Name: conv.Pointer("Texts"), Items: []db.TodoItem{
+		{ID: &itemID, Text: conv.Pointer("milk"), Marked: conv.Pointer(false)},
+	}}))
+	editor := db.User{ID: conv.Pointer(uuid.Must(uuid.NewV4())), Name: conv.Pointer("Jonas"), PasswordHash: conv.Pointer("hash")}
+	require.NoError(t, store.AddUser(ctx, editor))
+	key := textKey{item: itemID, field: "text"}
+
+	// Prepends text to the document, as an editor would
+	edit := func(text string) *textDoc {
+		a.texts.Lock()
+		defer a.texts.Unlock()
+		doc, err := a.textDoc(ctx, listID, key)
+		require.NoError(t, err)
+		require.NoError(t, doc.doc.Apply(crdt.Update{Inserts: []crdt.Insert{{ID: crdt.ID{Clock: doc.doc.Clock() + 1, Site: "test"}, Text: text}}}))
+		doc.dirty = true
+		doc.editor = *editor.ID
+		return doc
+	}
+	stored := func() *db.TodoItem {
+		list, err := store.GetTodoList(ctx, listID)
+		require.NoError(t, err)
+		return &list.Items[0]
+	}
+
+	doc := edit("oat ")
+	a.storeText(ctx, key)
+	require.Equal(t, "oat milk", *stored().Text)
+	require.False(t, doc.dirty)
+	require.Equal(t, *stored().Version, doc.version)
+	history, err := store.GetItemHistory(ctx, listID, itemID)
+	require.NoError(t, err)
+	require.Equal(t, db.RevisionUpdateText, *history[0].Action)
+	require.Equal(t, "Jonas", *history[0].Author)
+
+	// Texts changed through the item since are not overwritten, and the
+	// document is read again
+	edit("fresh ")
+	_, err = store.UpdateTodoItem(ctx, listID, db.TodoItem{ID: &itemID, Text: conv.Pointer("soy milk"), Marked: conv.Pointer(false)})
+	require.NoError(t, err)
+	a.storeText(ctx, key)
+	require.Equal(t, "soy milk", *stored().Text)
+	a.texts.Lock()
+	_, ok := a.texts.docs[key]
+	a.texts.Unlock()
+	require.False(t, ok)
+}
@@ -0,0 +1,142 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"slices"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/gofrs/uuid"
+
+	"todolist/internal/conv"
+	"todolist/internal/db"
+)
+
+// Trash holds what a user can restore: the deleted lists they own and the
+// deleted items of the lists they can edit, most recently deleted first.
+type Trash struct {
+	Lists []TodoList `json:"lists"`
+	Items []TodoItem `json:"items"`
+}
+
+func (a *api) handleGetTrash(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	user := principal(ctx).ID
+
+	lists, err := a.store.GetDeletedLists(ctx, user)
+	if err != nil {
+		a.writeInternal(w, "failed to get deleted lists", err)
+		return
+	}
+	trash := Trash{
+		Lists: make([]TodoList, 0, len(lists)),
+		Items: make([]TodoItem, 0),
+	}
+	for _, list := range lists {
+		trash.Lists = append(trash.Lists, NewTodoList(list))
+	}
+
+	ids, err := a.store.GetMemberLists(ctx, user)
+	if err != nil {
+		a.writeInternal(w, "failed to get lists", err)
+		return
+	}
+	for _, id := range ids {
+		// Lists may be removed after they were enumerated
+		role, _, err := a.store.GetListAccess(ctx, id, user)
+		if errors.Is(err, db.ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			a.writeInternal(w, "failed to get role", err)
+			return
+		}
+		if !hasRole(role, db.RoleEditor) {
+			continue
+		}
+		items, err := a.store.GetDeletedItems(ctx, id)
+		if errors.Is(err, db.ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			a.writeInternal(w, "failed to get deleted items", err)
+			return
+		}
+		for _, item := range items {
+			trash.Items = append(trash.Items, newTodoItem(id, item))
+		}
+	}
+	slices.SortStableFunc(trash.Items, func(a TodoItem, b TodoItem) int {
+		return b.DeletedAt.Compare(*a.DeletedAt)
+	})
+
+	a.writeJSON(w, http.StatusOK, trash)
+}
+
+// handleRestoreList takes a list out of the trash. It is not below
+// listContext, which treats deleted lists as missing, and only lets the owner
+// restore the list by looking for it in the owner's trash.
+func (a *api) handleRestoreList(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	id, err := uuid.FromString(chi.URLParam(r, tokenList))
+	if err != nil {
+		a.writeInvalidID(w, "list")
+		return
+	}
+
+	deleted, err := a.store.GetDeletedLists(ctx, principal(ctx).ID)
+	if err != nil {
+		a.writeInternal(w, "failed to get deleted lists", err)
+		return
+	}
+	owned := slices.ContainsFunc(deleted, func(list *db.TodoList) bool {
+		return *list.ID == id
+	})
+	if !owned {
+		a.writeStoreError(w, db.ErrNotFound, "list")
+		return
+	}
+
+	var t TodoList
+	err = a.change(ctx, []uuid.UUID{id}, func(ctx context.Context) ([]pending, error) {
+		list, err := a.store.RestoreTodoList(ctx, id)
+		if err != nil {
+			return nil, err
+		}
+		t = NewTodoList(list)
+		return []pending{{id, ListEvent{RestoreList, &t}}}, nil
+	})
+	if err != nil {
+		a.writeStoreError(w, err, "list")
+		return
+	}
+
+	w.Header().Set("ETag", etag(t.Version))
+	a.writeJSON(w, http.StatusOK, t)
+}
+
+func (a *api) handleRestoreItem(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	listID := pathID(ctx, tokenList)
+	itemID := pathID(ctx, tokenItem)
+
+	var restored TodoItem
+	err := a.change(ctx, []uuid.UUID{listID}, func(ctx context.Context) ([]pending, error) {
+		item, err := a.store.RestoreTodoItem(ctx, listID, itemID)
+		if err != nil {
+			return nil, err
+		}
+		restored = newTodoItem(listID, *item)
+		event := ItemEvent{Type: RestoreItem, TodoItem: conv.Pointer(restored)}
+		a.withTotals(ctx, &event)
+		return []pending{{listID, event}}, nil
+	})
+	if err != nil {
+		a.writeStoreError(w, err, "item")
+		return
+	}
+
+	w.Header().Set("ETag", etag(restored.Version))
+	a.writeJSON(w, http.StatusOK, restored)
+}
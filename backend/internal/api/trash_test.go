@@ -0,0 +1,110 @@
+package api
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/gofrs/uuid"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTrash(t *testing.T) {
+	s := newTestServer(t, "alice", "bob", "carol", "dave")
+	groceries := s.newList("alice", "Groceries")
+	milk := s.addItem("alice", groceries, nil, "milk")
+	oat := s.addItem("alice", groceries, &milk.ID, "oat")
+	eggs := s.addItem("alice", groceries, nil, "eggs")
+	s.share("alice", groceries, "bob", "viewer")
+	s.share("alice", groceries, "dave", "editor")
+	path := "/list/" + groceries.String()
+
+	trash := func(user string) (lists []uuid.UUID, items []uuid.UUID) {
+		t.Helper()
+		var trash Trash
+		s.do(user, "GET", "/trash", nil).decode(t, http.StatusOK, &trash)
+		for _, list := range trash.Lists {
+			lists = append(lists, list.ID)
+		}
+		for _, item := range trash.Items {
+			items = append(items, item.ID)
+		}
+		return
+	}
+
+	events := s.subscribe("dave", path+"/events")
+	events.nextNamed(UpdateList)
+
+	// Deleted items are in the trash of those who can restore them, most
+	// recently deleted first
+	require.Equal(t, http.StatusNoContent, s.do("dave", "DELETE", path+"/item/"+oat.ID.String(), nil).status)
+	events.nextNamed(RemoveItem)
+	require.Equal(t, http.StatusNoContent, s.do("alice", "DELETE", path+"/item/"+milk.ID.String(), nil).status)
+	events.nextNamed(RemoveItem)
+	for _, user := range []string{"alice", "dave"} {
+		lists, items := trash(user)
+		require.Empty(t, lists)
+		require.Equal(t, []uuid.UUID{milk.ID, oat.ID}, items, user)
+	}
+	for _, user := range []string{"bob", "carol"} {
+		lists, items := trash(user)
+		require.Empty(t, lists)
+		require.Empty(t, items, user)
+	}
+	require.Equal(t, http.StatusForbidden, s.do("bob", "POST", path+"/item/"+oat.ID.String()+"/restore", nil).status)
+	require.Equal(t, http.StatusNotFound, s.do("carol", "POST", path+"/item/"+oat.ID.String()+"/restore", nil).status)
+	require.Equal(t, http.StatusNotFound, s.do("dave", "POST", path+"/item/"+eggs.ID.String()+"/restore", nil).status)
+
+	// Items whose parent is still in the trash are restored to the top level
+	var item TodoItem
+	res := s.do("dave", "POST", path+"/item/"+oat.ID.String()+"/restore", nil)
+	res.decode(t, http.StatusOK, &item)
+	require.Nil(t, item.Parent)
+	require.Equal(t, etag(item.Version), res.header.Get("ETag"))
+	var event ItemEvent
+	events.nextNamed(RestoreItem).decode(t, &event)
+	require.Equal(t, oat.ID, event.TodoItem.ID)
+	require.Nil(t, event.TodoItem.Parent)
+	var list TodoList
+	s.do("bob", "GET", path, nil).decode(t, http.StatusOK, &list)
+	require.Equal(t, []string{"eggs", "oat"}, []string{list.Items[0].Text, list.Items[1].Text})
+
+	// Restored parents come back with their remaining children
+	s.do("alice", "POST", path+"/item/"+milk.ID.String()+"/restore", nil).decode(t, http.StatusOK, &item)
+	require.Nil(t, item.Parent)
+	events.nextNamed(RestoreItem)
+	_, items := trash("alice")
+	require.Empty(t, items)
+
+	// Deleted lists are in the trash of their owner only, who alone can
+	// restore them
+	var sync SyncResponse
+	s.do("alice", "POST", "/sync", SyncRequest{Lists: []uuid.UUID{groceries}}).decode(t, http.StatusOK, &sync)
+	require.Equal(t, http.StatusNoContent, s.do("alice", "DELETE", path, nil).status)
+	events.nextNamed(RemoveList)
+	lists, _ := trash("alice")
+	require.Equal(t, []uuid.UUID{groceries}, lists)
+	for _, user := range []string{"bob", "dave"} {
+		lists, items := trash(user)
+		require.Empty(t, lists)
+		require.Empty(t, items)
+		require.Equal(t, http.StatusNotFound, s.do(user, "GET", path, nil).status)
+		require.Equal(t, http.StatusNotFound, s.do(user, "POST", path+"/restore", nil).status)
+	}
+
+	res = s.do("alice", "POST", path+"/restore", nil)
+	res.decode(t, http.StatusOK, &list)
+	require.Equal(t, "Groceries", list.Name)
+	require.Len(t, list.Items, 3)
+	require.Equal(t, etag(list.Version), res.header.Get("ETag"))
+	require.Equal(t, http.StatusNotFound, s.do("alice", "POST", path+"/restore", nil).status)
+	require.Equal(t, http.StatusOK, s.do("dave", "GET", path, nil).status)
+
+	// Streams stop following removed lists, and members following the list
+	// by syncing learn of both changes
+	events.quiet()
+	since := sync.Seq
+	s.do("dave", "POST", "/sync", SyncRequest{Since: &since, Lists: []uuid.UUID{groceries}}).decode(t, http.StatusOK, &sync)
+	require.Len(t, sync.Events, 2)
+	require.Equal(t, RemoveList, sync.Events[0].Type)
+	require.Equal(t, RestoreList, sync.Events[1].Type)
+}
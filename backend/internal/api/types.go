@@ -1,17 +1,32 @@
 package api
 
 import (
+	"encoding/json"
+	"time"
+	"todolist/internal/conv"
 	"todolist/internal/db"
 
 	"github.com/gofrs/uuid"
 )
 
+// Event types. They are also the names of the server sent events, so that
+// clients can listen for each type separately.
 const (
 	UpdateList = "update-list"
 	RemoveList = "remove-list"
 	AddItem    = "add-item"
 	UpdateItem = "update-item"
 	RemoveItem = "remove-item"
+	MoveItem   = "move-item"
+
+	RestoreList = "restore-list"
+	RestoreItem = "restore-item"
+
+	UpdateMember = "update-member"
+	RemoveMember = "remove-member"
+
+	FreezeList   = "list-frozen"
+	UnfreezeList = "list-unfrozen"
 )
 
 type ListEvent struct {
@@ -22,6 +37,46 @@ type ListEvent struct {
 type ItemEvent struct {
 	Type     string    `json:"type,omitempty"`
 	TodoItem *TodoItem `json:"todoitem,omitempty"`
+
+	// Totals holds the updated totals of the item's ancestors, nearest
+	// first, and ListTotal and ListProgress those of the whole list. For
+	// moved items, the former ancestors follow the new ones. ListTotal is
+	// left out, like the total of a list, when the list has no prices,
+	// which events that carry ListProgress tell apart from missing totals.
+	Totals       []ItemTotal `json:"totals,omitempty"`
+	ListTotal    []Price     `json:"listtotal,omitempty"`
+	ListProgress *Progress   `json:"listprogress,omitempty"`
+}
+
+// event is implemented by the events published to list subscribers.
+type event interface {
+	eventType() string
+
+	// coalesceKey is shared by events that supersede each other, which may
+	// then be coalesced for slow clients.
+	coalesceKey() string
+}
+
+func (e ListEvent) eventType() string {
+	return e.Type
+}
+
+func (e ListEvent) coalesceKey() string {
+	if e.Type == UpdateList && e.TodoList != nil {
+		return "list/" + e.TodoList.ID.String()
+	}
+	return ""
+}
+
+func (e ItemEvent) eventType() string {
+	return e.Type
+}
+
+func (e ItemEvent) coalesceKey() string {
+	if e.Type == UpdateItem && e.TodoItem != nil {
+		return "item/" + e.TodoItem.ID.String()
+	}
+	return ""
 }
 
 type TodoList struct {
@@ -29,45 +84,156 @@ type TodoList struct {
 	Owner string     `json:"owner,omitempty"`
 	Name  string     `json:"name,omitempty"`
 	Items []TodoItem `json:"items"`
+	Total []Price    `json:"total,omitempty"`
+
+	// Progress counts the marked items of the whole list.
+	Progress Progress `json:"progress"`
+
+	// Frozen lists can only be changed by their owner.
+	Frozen bool `json:"frozen,omitempty"`
+
+	// Version changes whenever the list or one of its items changes. It is
+	// also sent as the ETag of the list.
+	Version int64 `json:"version,omitempty"`
+
+	// DeletedAt is when a list in the trash was deleted.
+	DeletedAt *time.Time `json:"deletedat,omitempty"`
 }
 
 type TodoItem struct {
-	ID     uuid.UUID `json:"id,omitempty"`
-	List   uuid.UUID `json:"list,omitempty"`
-	Text   string    `json:"text,omitempty"`
-	Marked bool      `json:"marked,omitempty"`
+	ID     uuid.UUID  `json:"id,omitempty"`
+	List   uuid.UUID  `json:"list,omitempty"`
+	Parent *uuid.UUID `json:"parent,omitempty"`
+	Text   string     `json:"text,omitempty"`
+	Marked bool       `json:"marked,omitempty"`
+	Price  *Price     `json:"price,omitempty"`
+
+	// Kind selects the schema that Attributes must satisfy.
+	Kind       string          `json:"kind,omitempty"`
+	Attributes json.RawMessage `json:"attributes,omitempty"`
+
+	// CompletedAt is when the item was marked and CompletedBy the name of
+	// who marked it. Both are recorded by the server.
+	CompletedAt *time.Time `json:"completedat,omitempty"`
+	CompletedBy string     `json:"completedby,omitempty"`
+
+	// Progress counts the marked descendants of items with children.
+	Progress *Progress `json:"progress,omitempty"`
+
+	// Description is markdown, which the server renders to sanitized HTML
+	// in DescriptionHTML. A nil Description leaves it unchanged when the
+	// item is updated.
+	Description     *string `json:"description,omitempty"`
+	DescriptionHTML string  `json:"descriptionhtml,omitempty"`
+
+	// Position orders the item among its siblings. It is assigned by the
+	// server and changed by moving the item.
+	Position int64 `json:"position"`
+
+	// Version changes whenever the item changes. It is also sent as the
+	// ETag of the item and expected in If-Match to make changes conditional.
+	Version int64 `json:"version,omitempty"`
+
+	// DeletedAt is when an item in the trash was deleted.
+	DeletedAt *time.Time `json:"deletedat,omitempty"`
+
+	Total    []Price    `json:"total,omitempty"`
+	Children []TodoItem `json:"children,omitempty"`
 }
 
 func newTodoItem(list uuid.UUID, in db.TodoItem) (out TodoItem) {
 	out.ID = *in.ID
 	out.List = list
+	out.Parent = in.Parent
 	out.Text = *in.Text
 	out.Marked = *in.Marked
+	if in.Position != nil {
+		out.Position = *in.Position
+	}
+	if in.Version != nil {
+		out.Version = *in.Version
+	}
+	if in.Kind != nil {
+		out.Kind = *in.Kind
+	}
+	if in.Attributes != nil {
+		out.Attributes = json.RawMessage(*in.Attributes)
+	}
+	out.CompletedAt = in.CompletedAt
+	out.DeletedAt = in.DeletedAt
+	if in.CompletedBy != nil {
+		out.CompletedBy = *in.CompletedBy
+	}
+	if in.Description != nil && *in.Description != "" {
+		out.Description = in.Description
+		out.DescriptionHTML = renderMarkdown(*in.Description)
+	}
+	if in.PriceAmount != nil && in.PriceCurrency != nil {
+		out.Price = &Price{Amount: *in.PriceAmount, Currency: *in.PriceCurrency}
+	}
+	totals := make([][]Price, 0, len(in.Children)+1)
+	if out.Price != nil {
+		totals = append(totals, []Price{*out.Price})
+	}
+	if len(in.Children) > 0 {
+		out.Children = make([]TodoItem, len(in.Children))
+		for i := range in.Children {
+			out.Children[i] = newTodoItem(list, in.Children[i])
+			totals = append(totals, out.Children[i].Total)
+		}
+		out.Progress = conv.Pointer(progressOf(out.Children))
+	}
+	out.Total = addPrices(totals...)
 	return
 }
 
 func NewTodoList(in *db.TodoList) (out TodoList) {
 	out.ID = *in.ID
-	out.Owner = *in.Owner
+	if in.Owner != nil {
+		out.Owner = *in.Owner
+	}
 	out.Name = *in.Name
+	out.Frozen = in.Frozen != nil && *in.Frozen
+	if in.Version != nil {
+		out.Version = *in.Version
+	}
+	out.DeletedAt = in.DeletedAt
 	out.Items = make([]TodoItem, len(in.Items))
+	totals := make([][]Price, len(in.Items))
 	for i := range in.Items {
 		out.Items[i] = newTodoItem(out.ID, in.Items[i])
+		totals[i] = out.Items[i].Total
 	}
+	out.Total = addPrices(totals...)
+	out.Progress = progressOf(out.Items)
 	return
 }
 
 func (in TodoItem) Record() (out db.TodoItem) {
 	out.ID = &in.ID
+	out.Parent = in.Parent
 	out.Text = &in.Text
 	out.Marked = &in.Marked
+	out.Kind = &in.Kind
+	out.Description = in.Description
+	if len(in.Attributes) > 0 {
+		out.Attributes = conv.Pointer(string(in.Attributes))
+	}
+	if in.Price != nil {
+		out.PriceAmount = &in.Price.Amount
+		out.PriceCurrency = &in.Price.Currency
+	}
+	out.Children = make([]db.TodoItem, len(in.Children))
+	for i := range in.Children {
+		out.Children[i] = in.Children[i].Record()
+	}
 	return
 }
 
 func (in TodoList) Record() (out db.TodoList) {
 	out.ID = &in.ID
-	out.Owner = &in.Owner
 	out.Name = &in.Name
+	out.Frozen = &in.Frozen
 	out.Items = make([]db.TodoItem, len(in.Items))
 	for i := range in.Items {
 		out.Items[i] = in.Items[i].Record()
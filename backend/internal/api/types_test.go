@@ -0,0 +1,76 @@
+package api
+
+import (
+	"net/http"
+	"testing"
+	"todolist/internal/conv"
+	"todolist/internal/db"
+
+	"github.com/gofrs/uuid"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTotals(t *testing.T) {
+	item := func(text string, amount int64, currency string, children ...db.TodoItem) db.TodoItem {
+		out := db.TodoItem{
+			ID:       conv.Pointer(uuid.Must(uuid.NewV4())),
+			Text:     conv.Pointer(text),
+			Marked:   conv.Pointer(false),
+			Children: children,
+		}
+		if currency != "" {
+			out.PriceAmount = conv.Pointer(amount)
+			out.PriceCurrency = conv.Pointer(currency)
+		}
+		return out
+	}
+
+	list := NewTodoList(&db.TodoList{
+		ID:    conv.Pointer(uuid.Must(uuid.NewV4())),
+		Owner: conv.Pointer("Jonas"),
+		Name:  conv.Pointer("Shopping list, Sunday"),
+		Items: []db.TodoItem{
+			item("Salad", 0, "",
+				item("Lettuce", 150, "EUR"),
+				item("Tomatoes", 325, "EUR",
+					item("Basil", 99, "EUR"),
+				),
+			),
+			item("Potatoes", 1200, "SEK"),
+			item("Napkins", 0, ""),
+		},
+	})
+
+	require.Equal(t, []Price{{Amount: 574, Currency: "EUR"}}, list.Items[0].Total)
+	require.Equal(t, []Price{{Amount: 424, Currency: "EUR"}}, list.Items[0].Children[1].Total)
+	require.Nil(t, list.Items[0].Price)
+	require.Empty(t, list.Items[2].Total)
+	require.Equal(t, []Price{{Amount: 574, Currency: "EUR"}, {Amount: 1200, Currency: "SEK"}}, list.Total)
+}
+
+func TestTotalEvents(t *testing.T) {
+	s := newTestServer(t, "alice")
+	list := s.newList("alice", "Shopping")
+	events := s.subscribe("alice", "/list/"+list.String()+"/events")
+	events.nextNamed(UpdateList)
+
+	var lettuce TodoItem
+	s.do("alice", "PUT", "/list/"+list.String()+"/add", map[string]any{"text": "Lettuce", "price": Price{Amount: 150, Currency: "EUR"}}).decode(t, http.StatusCreated, &lettuce)
+	var event map[string]any
+	events.nextNamed(AddItem).decode(t, &event)
+	require.Equal(t, []any{map[string]any{"amount": 150.0, "currency": "EUR"}}, event["listtotal"])
+
+	// Lists without prices have no total, which events leave out
+	require.Equal(t, http.StatusNoContent, s.do("alice", "DELETE", "/list/"+list.String()+"/item/"+lettuce.ID.String(), nil).status)
+	event = nil
+	events.nextNamed(RemoveItem).decode(t, &event)
+	require.NotContains(t, event, "listtotal")
+	require.Contains(t, event, "listprogress")
+}
+
+func TestValidPrice(t *testing.T) {
+	require.True(t, validPrice(nil))
+	require.True(t, validPrice(&Price{Amount: 100, Currency: "EUR"}))
+	require.False(t, validPrice(&Price{Amount: 100, Currency: "eur"}))
+	require.False(t, validPrice(&Price{Amount: 100}))
+}
@@ -0,0 +1,177 @@
+package api
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/gofrs/uuid"
+)
+
+// etag formats the version of a list or item as an entity tag.
+func etag(version int64) string {
+	return `"` + strconv.FormatInt(version, 10) + `"`
+}
+
+// readTag formats the entity tag of a list or item as read. It starts with
+// the version, like etag, and adds a hash of the response, which also differs
+// with the selected fields and items and with changes to subtasks, which do
+// not change the version of their parents.
+func readTag(version int64, body []byte) string {
+	sum := sha256.Sum256(body)
+	return `"` + strconv.FormatInt(version, 10) + "-" + hex.EncodeToString(sum[:8]) + `"`
+}
+
+// entityTag is an entity tag of an If-Match or If-None-Match header. Opaque
+// keeps its quotes, so that it can be compared with the tags set as ETag.
+type entityTag struct {
+	opaque string
+	weak   bool
+}
+
+// parseEntityTags parses the list of entity tags of an If-Match or
+// If-None-Match header as defined by RFC 9110. star is true if the header is
+// "*", and ok is false if it is malformed.
+func parseEntityTags(header string) (tags []entityTag, star bool, ok bool) {
+	header = strings.TrimSpace(header)
+	if header == "*" {
+		return nil, true, true
+	}
+	header = strings.TrimLeft(header, ", \t")
+	for header != "" {
+		var tag entityTag
+		if strings.HasPrefix(header, "W/") {
+			tag.weak = true
+			header = header[2:]
+		}
+		if !strings.HasPrefix(header, `"`) {
+			return nil, false, false
+		}
+		end := strings.IndexByte(header[1:], '"')
+		if end < 0 {
+			return nil, false, false
+		}
+		tag.opaque, header = header[:end+2], strings.TrimSpace(header[end+2:])
+		tags = append(tags, tag)
+
+		// Empty elements of the list are allowed and skipped
+		if header != "" && header[0] != ',' {
+			return nil, false, false
+		}
+		header = strings.TrimLeft(header, ", \t")
+	}
+	return tags, false, true
+}
+
+// matchVersions returns the versions of the strong entity tags of an If-Match
+// header, or nil if any version will do. ok is false if the header cannot
+// match any version, in which case the precondition has failed. Weak tags
+// never match, as If-Match compares tags strongly. Tags of reads only have to
+// match in their version.
+func matchVersions(header string) (versions []int64, ok bool) {
+	if strings.TrimSpace(header) == "" {
+		return nil, true
+	}
+	tags, star, ok := parseEntityTags(header)
+	if star || !ok {
+		return nil, ok
+	}
+	for _, tag := range tags {
+		if tag.weak {
+			continue
+		}
+		version, _, _ := strings.Cut(tag.opaque[1:len(tag.opaque)-1], "-")
+		v, err := strconv.ParseInt(version, 10, 64)
+		if err == nil && !slices.Contains(versions, v) {
+			versions = append(versions, v)
+		}
+	}
+	return versions, len(versions) > 0
+}
+
+// ifMatch returns the version of a list, or of an item of it if itemID is not
+// nil, required by the If-Match header of a request, or nil if any version
+// will do. ok is false if the precondition has failed. Of several versions,
+// the current one is required if it is among them, and the store checks that
+// it still is when making the change.
+func (a *api) ifMatch(r *http.Request, listID uuid.UUID, itemID *uuid.UUID) (version *int64, ok bool) {
+	versions, ok := matchVersions(r.Header.Get("If-Match"))
+	if !ok || versions == nil {
+		return nil, ok
+	}
+	if len(versions) == 1 {
+		return &versions[0], true
+	}
+
+	list, err := a.store.GetTodoList(r.Context(), listID)
+	if err != nil {
+		// The change fails the same way when the store looks for the list
+		return &versions[0], true
+	}
+	current := NewTodoList(list).Version
+	if itemID != nil {
+		item := findItem(NewTodoList(list).Items, *itemID)
+		if item == nil {
+			return &versions[0], true
+		}
+		current = item.Version
+	}
+	if !slices.Contains(versions, current) {
+		return nil, false
+	}
+	return &current, true
+}
+
+// notModified sets the ETag of a resource being read and responds with 304
+// Not Modified if the client already has it. If-None-Match compares tags
+// weakly, so weak tags match their strong counterparts.
+func notModified(w http.ResponseWriter, r *http.Request, tag string) bool {
+	w.Header().Set("ETag", tag)
+	tags, matched, _ := parseEntityTags(r.Header.Get("If-None-Match"))
+	for _, match := range tags {
+		if match.opaque == tag {
+			matched = true
+		}
+	}
+	if matched {
+		w.WriteHeader(http.StatusNotModified)
+	}
+	return matched
+}
+
+// writePreconditionFailed responds with the current state of a list, or of an
+// item of it if itemID is not nil, when a change was based on another version.
+func (a *api) writePreconditionFailed(ctx context.Context, w http.ResponseWriter, listID uuid.UUID, itemID *uuid.UUID) {
+	body := Error{Code: "version-mismatch", Message: "the resource has been changed by someone else"}
+
+	list, err := a.store.GetTodoList(ctx, listID)
+	if err != nil {
+		a.logger.Error("failed to get current state", "error", err)
+		a.writeError(w, http.StatusPreconditionFailed, body)
+		return
+	}
+	current := NewTodoList(list)
+	if itemID == nil {
+		body.Current = current
+		w.Header().Set("ETag", etag(current.Version))
+	} else if item := findItem(current.Items, *itemID); item != nil {
+		body.Current = item
+		w.Header().Set("ETag", etag(item.Version))
+	}
+	a.writeError(w, http.StatusPreconditionFailed, body)
+}
+
+// currentItem returns the current state of an item with its subtree, or nil
+// if it cannot be found.
+func (a *api) currentItem(ctx context.Context, listID uuid.UUID, itemID uuid.UUID) *TodoItem {
+	list, err := a.store.GetTodoList(ctx, listID)
+	if err != nil {
+		a.logger.Error("failed to get current state", "error", err)
+		return nil
+	}
+	return findItem(NewTodoList(list).Items, itemID)
+}
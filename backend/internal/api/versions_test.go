@@ -0,0 +1,92 @@
+package api
+
+import (
+	"net/http"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMatchVersions(t *testing.T) {
+	for _, test := range []struct {
+		header   string
+		versions []int64
+		ok       bool
+	}{
+		{"", nil, true},
+		{"*", nil, true},
+		{`"3"`, []int64{3}, true},
+		{`"3-0123abcd"`, []int64{3}, true},
+		{` "3", "4-0123abcd" ,, "3"`, []int64{3, 4}, true},
+		{`, "3"`, []int64{3}, true},
+		{`W/"3"`, nil, false},
+		{`W/"3", "4"`, []int64{4}, true},
+		{`"milk"`, nil, false},
+		{`"3`, nil, false},
+		{`3`, nil, false},
+		{`"3" "4"`, nil, false},
+	} {
+		versions, ok := matchVersions(test.header)
+		require.Equal(t, test.ok, ok, test.header)
+		require.Equal(t, test.versions, versions, test.header)
+	}
+}
+
+func TestVersions(t *testing.T) {
+	s := newTestServer(t, "alice")
+	list := s.newList("alice", "Groceries")
+	milk := s.addItem("alice", list, nil, "milk")
+	path := "/list/" + list.String() + "/item/" + milk.ID.String()
+
+	// Reads are tagged with their version and a hash of the response
+	res := s.do("alice", "GET", path, nil)
+	require.Equal(t, http.StatusOK, res.status)
+	tag := res.header.Get("ETag")
+	require.Regexp(t, `^"1-[0-9a-f]{16}"$`, tag)
+	fields := s.do("alice", "GET", path+"?fields=text", nil)
+	require.Equal(t, http.StatusOK, fields.status)
+	require.NotEqual(t, tag, fields.header.Get("ETag"))
+	require.Equal(t, tag[:3], fields.header.Get("ETag")[:3])
+
+	// Clients that already have the response are told so, also when they
+	// tag it weakly or among others
+	for _, match := range []string{tag, "W/" + tag, `"0", ` + tag, "*"} {
+		res := s.do("alice", "GET", path, nil, "If-None-Match", match)
+		require.Equal(t, http.StatusNotModified, res.status, match)
+		require.Empty(t, res.body)
+		require.Equal(t, tag, res.header.Get("ETag"))
+	}
+	require.Equal(t, http.StatusOK, s.do("alice", "GET", path, nil, "If-None-Match", `"0"`).status)
+
+	// Changes based on the read succeed once
+	var item TodoItem
+	s.do("alice", "PUT", path, map[string]any{"text": "oat milk"}, "If-Match", tag).decode(t, http.StatusOK, &item)
+	require.Equal(t, int64(2), item.Version)
+	require.Equal(t, http.StatusOK, s.do("alice", "GET", path, nil, "If-None-Match", tag).status)
+
+	// Changes based on another version fail with the current item
+	for _, match := range []string{tag, `"1"`, `W/"2"`, `"0", "1"`, `"milk"`} {
+		var e Error
+		res := s.do("alice", "PUT", path, map[string]any{"text": "soy milk"}, "If-Match", match)
+		res.decode(t, http.StatusPreconditionFailed, &e)
+		require.Equal(t, "version-mismatch", e.Code, match)
+		require.Equal(t, `"2"`, res.header.Get("ETag"))
+		current := e.Current.(map[string]any)
+		require.Equal(t, "oat milk", current["text"])
+	}
+
+	// The current version may be one of several
+	s.do("alice", "PUT", path, map[string]any{"text": "soy milk"}, "If-Match", `"1", W/"3", "2"`).decode(t, http.StatusOK, &item)
+	require.Equal(t, int64(3), item.Version)
+	s.do("alice", "PATCH", path+"/move", Move{}, "If-Match", `"3-0123abcd", "4"`).decode(t, http.StatusOK, &item)
+	require.Equal(t, http.StatusPreconditionFailed, s.do("alice", "DELETE", path, nil, "If-Match", `"1", "2"`).status)
+	require.Equal(t, http.StatusNoContent, s.do("alice", "DELETE", path, nil, "If-Match", `"0", "`+strconv.FormatInt(item.Version, 10)+`"`).status)
+
+	// Lists are versioned the same way
+	res = s.do("alice", "GET", "/list/"+list.String(), nil)
+	require.Equal(t, http.StatusOK, res.status)
+	require.Equal(t, http.StatusNotModified, s.do("alice", "GET", "/list/"+list.String(), nil, "If-None-Match", res.header.Get("ETag")).status)
+	require.Equal(t, http.StatusPreconditionFailed, s.do("alice", "DELETE", "/list/"+list.String(), nil, "If-Match", `"0"`).status)
+	require.Equal(t, http.StatusNoContent, s.do("alice", "DELETE", "/list/"+list.String(), nil, "If-Match", res.header.Get("ETag")).status)
+}
@@ -0,0 +1,203 @@
+// Package crdt implements a replicated growable array (RGA), a sequence CRDT
+// for collaborative text editing. Every character has a unique ID made of a
+// Lamport clock and the site that inserted it. Characters are inserted after
+// another one and never removed, only marked as deleted, so that concurrent
+// updates can be applied in any order and still converge.
+package crdt
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+var (
+	// ErrUnknownID is returned for updates referring to characters the
+	// document does not have, typically because it was reset.
+	ErrUnknownID = errors.New("unknown character")
+
+	// ErrInvalid is returned for malformed updates.
+	ErrInvalid = errors.New("invalid update")
+)
+
+// ID identifies a character. The zero ID stands for the start of the text.
+type ID struct {
+	Clock uint64 `json:"clock"`
+	Site  string `json:"site"`
+}
+
+// Less orders IDs by clock and then by site. Of two characters inserted at
+// the same place, the greater ID comes first.
+func (id ID) Less(other ID) bool {
+	if id.Clock != other.Clock {
+		return id.Clock < other.Clock
+	}
+	return id.Site < other.Site
+}
+
+// Insert inserts a run of characters after another one. The characters get
+// consecutive clocks starting at the clock of ID.
+type Insert struct {
+	ID    ID     `json:"id"`
+	After ID     `json:"after"`
+	Text  string `json:"text"`
+}
+
+// Update is a set of changes to a document. Inserts may refer to characters
+// inserted by earlier inserts of the same update.
+type Update struct {
+	Inserts []Insert `json:"inserts,omitempty"`
+	Deletes []ID     `json:"deletes,omitempty"`
+}
+
+type element struct {
+	id      ID
+	char    rune
+	deleted bool
+}
+
+// Doc is a text document. It is not safe for concurrent use.
+type Doc struct {
+	elements []element
+	known    map[ID]bool
+	clock    uint64
+}
+
+// New returns a document holding text, inserted by the given site.
+func New(text string, site string) *Doc {
+	d := &Doc{known: make(map[ID]bool)}
+	if text != "" {
+		// A fresh document cannot refer to unknown characters
+		_ = d.Apply(Update{Inserts: []Insert{{ID: ID{Clock: 1, Site: site}, Text: text}}})
+	}
+	return d
+}
+
+// Text returns the current text.
+func (d *Doc) Text() string {
+	var text strings.Builder
+	for _, e := range d.elements {
+		if !e.deleted {
+			text.WriteRune(e.char)
+		}
+	}
+	return text.String()
+}
+
+// Clock returns the highest clock seen. New characters must have a higher
+// clock.
+func (d *Doc) Clock() uint64 {
+	return d.clock
+}
+
+// Apply applies an update. Characters that are already known are skipped, so
+// applying an update twice has no further effect. Either the whole update is
+// applied or, if it is invalid, none of it.
+func (d *Doc) Apply(u Update) error {
+	// Validate against a copy so that a failed update leaves no trace
+	next := d.clone()
+	for _, insert := range u.Inserts {
+		err := next.insert(insert)
+		if err != nil {
+			return err
+		}
+	}
+	for _, id := range u.Deletes {
+		i := next.index(id)
+		if i < 0 {
+			return fmt.Errorf("%w: %v", ErrUnknownID, id)
+		}
+		next.elements[i].deleted = true
+	}
+	*d = *next
+	return nil
+}
+
+func (d *Doc) insert(insert Insert) error {
+	if insert.ID.Clock == 0 || insert.Text == "" || !utf8.ValidString(insert.Text) {
+		return fmt.Errorf("%w: insert %v", ErrInvalid, insert.ID)
+	}
+
+	after := insert.After
+	id := insert.ID
+	for _, char := range insert.Text {
+		if !d.known[id] {
+			position := 0
+			if after != (ID{}) {
+				position = d.index(after)
+				if position < 0 {
+					return fmt.Errorf("%w: %v", ErrUnknownID, after)
+				}
+				position++
+			}
+
+			// Concurrent inserts at the same place are ordered by
+			// descending ID. Characters inserted after those have
+			// greater IDs still and are skipped along with them.
+			for position < len(d.elements) && id.Less(d.elements[position].id) {
+				position++
+			}
+
+			d.elements = append(d.elements, element{})
+			copy(d.elements[position+1:], d.elements[position:])
+			d.elements[position] = element{id: id, char: char}
+			d.known[id] = true
+			d.clock = max(d.clock, id.Clock)
+		}
+		after = id
+		id.Clock++
+	}
+	return nil
+}
+
+func (d *Doc) index(id ID) int {
+	if !d.known[id] {
+		return -1
+	}
+	for i := range d.elements {
+		if d.elements[i].id == id {
+			return i
+		}
+	}
+	return -1
+}
+
+func (d *Doc) clone() *Doc {
+	c := &Doc{
+		elements: make([]element, len(d.elements)),
+		known:    make(map[ID]bool, len(d.known)),
+		clock:    d.clock,
+	}
+	copy(c.elements, d.elements)
+	for id := range d.known {
+		c.known[id] = true
+	}
+	return c
+}
+
+// State returns an update that recreates the document, including its
+// deleted characters, when applied to an empty one.
+func (d *Doc) State() Update {
+	var u Update
+	var after ID
+	for _, e := range d.elements {
+		last := len(u.Inserts) - 1
+		if last >= 0 && after == e.id.previous() && u.Inserts[last].ID.Site == e.id.Site {
+			u.Inserts[last].Text += string(e.char)
+		} else {
+			u.Inserts = append(u.Inserts, Insert{ID: e.id, After: after, Text: string(e.char)})
+		}
+		if e.deleted {
+			u.Deletes = append(u.Deletes, e.id)
+		}
+		after = e.id
+	}
+	return u
+}
+
+// previous returns the ID of the character inserted just before by the same
+// site, which a run continues from.
+func (id ID) previous() ID {
+	return ID{Clock: id.Clock - 1, Site: id.Site}
+}
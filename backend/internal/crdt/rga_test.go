@@ -0,0 +1,60 @@
+package crdt_test
+
+import (
+	"testing"
+	"todolist/internal/crdt"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestConcurrentInserts(t *testing.T) {
+	base := crdt.New("ac", "server")
+	b := crdt.ID{Clock: 1, Site: "server"}
+
+	// Two sites insert at the same place without seeing each other
+	alice := crdt.Update{Inserts: []crdt.Insert{{ID: crdt.ID{Clock: 3, Site: "alice"}, After: b, Text: "bb"}}}
+	bob := crdt.Update{
+		Inserts: []crdt.Insert{{ID: crdt.ID{Clock: 3, Site: "bob"}, After: b, Text: "x"}},
+		Deletes: []crdt.ID{{Clock: 2, Site: "server"}},
+	}
+
+	first := crdt.New("", "")
+	require.NoError(t, first.Apply(base.State()))
+	require.NoError(t, first.Apply(alice))
+	require.NoError(t, first.Apply(bob))
+
+	second := crdt.New("", "")
+	require.NoError(t, second.Apply(base.State()))
+	require.NoError(t, second.Apply(bob))
+	require.NoError(t, second.Apply(alice))
+	require.NoError(t, second.Apply(alice))
+
+	require.Equal(t, "axbb", first.Text())
+	require.Equal(t, first.Text(), second.Text())
+	require.Equal(t, uint64(4), first.Clock())
+
+	// The state recreates the document, deleted characters included
+	copied := crdt.New("", "")
+	require.NoError(t, copied.Apply(first.State()))
+	require.Equal(t, first.Text(), copied.Text())
+	require.Equal(t, first.State(), copied.State())
+}
+
+func TestInvalidUpdates(t *testing.T) {
+	doc := crdt.New("abc", "server")
+
+	err := doc.Apply(crdt.Update{Inserts: []crdt.Insert{
+		{ID: crdt.ID{Clock: 4, Site: "alice"}, Text: "x"},
+		{ID: crdt.ID{Clock: 5, Site: "alice"}, After: crdt.ID{Clock: 9, Site: "bob"}, Text: "y"},
+	}})
+	require.ErrorIs(t, err, crdt.ErrUnknownID)
+
+	err = doc.Apply(crdt.Update{Deletes: []crdt.ID{{Clock: 1, Site: "bob"}}})
+	require.ErrorIs(t, err, crdt.ErrUnknownID)
+
+	err = doc.Apply(crdt.Update{Inserts: []crdt.Insert{{ID: crdt.ID{Site: "alice"}, Text: "x"}}})
+	require.ErrorIs(t, err, crdt.ErrInvalid)
+
+	// Failed updates are not applied in part
+	require.Equal(t, "abc", doc.Text())
+}
@@ -4,68 +4,119 @@ import (
 	"context"
 	"database/sql"
 	"errors"
-	"os"
+	"fmt"
+	"math/rand/v2"
+	"slices"
+	"time"
+	"todolist/internal/conv"
 
 	"github.com/gofrs/uuid"
-	_ "modernc.org/sqlite"
 )
 
-type DB struct {
-	db *sql.DB
-}
+var (
+	// ErrNotFound is returned when a list, item or user does not exist.
+	ErrNotFound = errors.New("not found")
+
+	// ErrConflict is returned when a record conflicts with an existing one.
+	ErrConflict = errors.New("conflict")
 
-type Options struct {
-	DSN string
+	// ErrVersionMismatch is returned when a list or item no longer has the
+	// version a change was based on.
+	ErrVersionMismatch = errors.New("version mismatch")
+)
+
+// DB is the Store kept in an SQL database, which is either SQLite or
+// PostgreSQL.
+type DB struct {
+	db *sqlDB
 }
 
+// NewDB opens the SQLite or PostgreSQL database of opt.
 func NewDB(ctx context.Context, opt Options) (*DB, error) {
-	var create bool
-	_, err := os.Stat(opt.DSN)
-	if err != nil && errors.Is(err, os.ErrNotExist) {
-		create = true
+	var dialect *dialect
+	switch kind := storeOf(opt); kind {
+	case StoreSQLite:
+		dialect = sqlite
+	case StorePostgres:
+		dialect = postgres
+	default:
+		return nil, fmt.Errorf("store %q is not an SQL database", kind)
 	}
+	conn, err := sql.Open(dialect.driver, dialect.dsn(opt.DSN))
+	if err != nil {
+		return nil, err
+	}
+	db := &sqlDB{DB: conn, dialect: dialect}
 
-	db, err := sql.Open("sqlite", opt.DSN)
+	err = createVersionTable(ctx, db)
 	if err != nil {
+		db.Close()
 		return nil, err
 	}
 
-	if create {
-		err := createTables(ctx, db)
+	d := &DB{
+		db: db,
+	}
+
+	if !opt.SkipMigrations {
+		_, err = d.Migrate(ctx)
 		if err != nil {
+			db.Close()
 			return nil, err
 		}
 	}
 
-	return &DB{
-		db: db,
-	}, nil
+	return d, nil
 }
 
-func createTables(ctx context.Context, db *sql.DB) error {
-	_, err := db.ExecContext(ctx, `CREATE TABLE list (
-   id UUID PRIMARY KEY NOT NULL,
-   owner TEXT NOT NULL,
-   name TEXT NOT NULL
-);`)
-	if err != nil {
-		return err
+// Atomically calls fn in a single transaction, which the methods of the store
+// called with the context fn is given take part in. Nothing fn changes is
+// kept if it returns an error. Transactions that conflict with concurrent
+// ones are run again, calling fn again, unless they are part of another.
+func (d *DB) Atomically(ctx context.Context, fn func(ctx context.Context) error) error {
+	if _, nested := ctx.Value(txKey{d.db}).(*sqlTx); nested {
+		return fn(ctx)
 	}
+	return d.retry(ctx, func() error {
+		tx, err := d.db.BeginTx(ctx, &sql.TxOptions{
+			Isolation: sql.LevelSerializable,
+			ReadOnly:  false,
+		})
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+		err = fn(withTx(ctx, d.db, tx))
+		if err != nil {
+			return err
+		}
+		return tx.Commit()
+	})
+}
 
-	_, err = db.ExecContext(ctx, `CREATE TABLE list_item (
-   id UUID PRIMARY KEY NOT NULL,
-   list_id UUID NOT NULL,
-   text TEXT NOT NULL,
-   marked BOOLEAN NOT NULL,
-   FOREIGN KEY (list_id) REFERENCES lists(id)
-);`)
-	if err != nil {
-		return err
-	}
+// maxAttempts is how often retry runs a transaction that keeps conflicting
+// with concurrent ones.
+const maxAttempts = 5
 
-	return nil
+// retry runs a transaction until it succeeds, fails for another reason than
+// conflicting with concurrent transactions, or has been tried maxAttempts
+// times. Attempts are spread out by a random delay growing with every one.
+func (d *DB) retry(ctx context.Context, tx func() error) error {
+	for attempt := 1; ; attempt++ {
+		err := tx()
+		if err == nil || d.db.dialect.retryable == nil || !d.db.dialect.retryable(err) || attempt == maxAttempts {
+			return err
+		}
+		select {
+		case <-time.After(rand.N(time.Duration(attempt) * 10 * time.Millisecond)):
+		case <-ctx.Done():
+			return err
+		}
+	}
 }
 
+// AddTodoList adds a list with its items. It returns ErrConflict if a list
+// with the same ID exists.
 func (d *DB) AddTodoList(ctx context.Context, todo TodoList) error {
 	tx, err := d.db.BeginTx(ctx, &sql.TxOptions{
 		Isolation: sql.LevelSerializable,
@@ -75,15 +126,35 @@ func (d *DB) AddTodoList(ctx context.Context, todo TodoList) error {
 		return err
 	}
 	defer tx.Rollback()
-	_, err = tx.ExecContext(ctx, "INSERT INTO list VALUES (?, ?, ?)", todo.ID, todo.Owner, todo.Name)
+	var exists bool
+	err = tx.QueryRowContext(ctx, "SELECT EXISTS (SELECT 1 FROM list WHERE id = ?)", *todo.ID).Scan(&exists)
 	if err != nil {
 		return err
 	}
-	for _, item := range todo.Items {
-		_, err = tx.ExecContext(ctx, "INSERT INTO list_item VALUES (?, ?, ?, ?)", item.ID, todo.ID, item.Text, item.Marked)
-		if err != nil {
-			return err
-		}
+	if exists {
+		return fmt.Errorf("%w: list %s already exists", ErrConflict, *todo.ID)
+	}
+	frozen := todo.Frozen != nil && *todo.Frozen
+	_, err = tx.ExecContext(ctx, "INSERT INTO list (id, owner_id, name, frozen, position) VALUES (?, ?, ?, ?, (SELECT COALESCE(MAX(position), 0) + ? FROM list))",
+		todo.ID, todo.OwnerID, todo.Name, frozen, positionGap)
+	if err != nil {
+		return err
+	}
+	err = insertTodoItems(ctx, tx, *todo.ID, nil, todo.Items)
+	if err != nil {
+		return err
+	}
+	err = indexList(ctx, tx, *todo.ID)
+	if err != nil {
+		return err
+	}
+	list, err := getList(ctx, tx, *todo.ID)
+	if err != nil {
+		return err
+	}
+	err = recordList(ctx, tx, RevisionAddList, *todo.ID, nil, list)
+	if err != nil {
+		return err
 	}
 	err = tx.Commit()
 	if err != nil {
@@ -92,6 +163,71 @@ func (d *DB) AddTodoList(ctx context.Context, todo TodoList) error {
 	return nil
 }
 
+// listColumns are the list columns, aliased as l, that scanList reads, along
+// with the name of the owner.
+const listColumns = "l.id, l.owner_id, (SELECT o.name FROM users AS o WHERE o.id = l.owner_id), l.name, l.frozen, l.position, l.version, l.deleted_at"
+
+// scanList returns the scan destinations matching listColumns.
+func scanList(list *TodoList) []any {
+	return []any{&list.ID, &list.OwnerID, &list.Owner, &list.Name, &list.Frozen, &list.Position, &list.Version, &list.DeletedAt}
+}
+
+// itemColumns are the list_item columns, aliased as i, that scanItem reads.
+const itemColumns = "i.id, i.parent_id, i.text, i.marked, i.price_amount, i.price_currency, i.kind, i.attributes, i.description, i.completed_at, i.completed_by_id, (SELECT c.name FROM users AS c WHERE c.id = i.completed_by_id), i.position, i.version, i.deleted_at, i.deleted_with"
+
+// scanItem returns the scan destinations matching itemColumns.
+func scanItem(item *TodoItem) []any {
+	return []any{&item.ID, &item.Parent, &item.Text, &item.Marked, &item.PriceAmount, &item.PriceCurrency, &item.Kind, &item.Attributes, &item.Description, &item.CompletedAt, &item.CompletedByID, &item.CompletedBy, &item.Position, &item.Version, &item.DeletedAt, &item.DeletedWith}
+}
+
+// insertTodoItem inserts an item after its last sibling.
+func insertTodoItem(ctx context.Context, tx *sqlTx, listId uuid.UUID, item TodoItem) error {
+	kind := ""
+	if item.Kind != nil {
+		kind = *item.Kind
+	}
+	siblings, err := getSiblings(ctx, tx, listId, item.Parent)
+	if err != nil {
+		return err
+	}
+	position := int64(positionGap)
+	if len(siblings) > 0 {
+		position = siblings[len(siblings)-1].position + positionGap
+	}
+	description := ""
+	if item.Description != nil {
+		description = *item.Description
+	}
+	var completedAt *time.Time
+	var completedBy *uuid.UUID
+	if item.Marked != nil && *item.Marked {
+		completedAt = conv.Pointer(time.Now().UTC())
+		completedBy = item.CompletedByID
+	}
+	_, err = tx.ExecContext(ctx, "INSERT INTO list_item (id, list_id, parent_id, text, marked, price_amount, price_currency, kind, attributes, description, completed_at, completed_by_id, position) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
+		item.ID, listId, item.Parent, item.Text, item.Marked, item.PriceAmount, item.PriceCurrency, kind, item.Attributes, description, completedAt, completedBy, position)
+	if err != nil {
+		return err
+	}
+	return indexItem(ctx, tx, *item.ID)
+}
+
+// insertTodoItems inserts items and, recursively, their children.
+func insertTodoItems(ctx context.Context, tx *sqlTx, listId uuid.UUID, parent *uuid.UUID, items []TodoItem) error {
+	for _, item := range items {
+		item.Parent = parent
+		err := insertTodoItem(ctx, tx, listId, item)
+		if err != nil {
+			return err
+		}
+		err = insertTodoItems(ctx, tx, listId, item.ID, item.Children)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func (d *DB) GetTodoLists(ctx context.Context) ([]*TodoList, error) {
 	tx, err := d.db.BeginTx(ctx, &sql.TxOptions{
 		Isolation: sql.LevelSerializable,
@@ -101,15 +237,44 @@ func (d *DB) GetTodoLists(ctx context.Context) ([]*TodoList, error) {
 		return nil, err
 	}
 	defer tx.Rollback()
-	rows, err := tx.QueryContext(ctx, "SELECT l.id, l.owner, l.name, i.id, i.text, i.marked FROM list AS l LEFT JOIN list_item AS i ON l.id = i.list_id")
+	return getTodoLists(ctx, tx, "WHERE l.deleted_at IS NULL")
+}
+
+// GetTodoList returns a single list with its items.
+func (d *DB) GetTodoList(ctx context.Context, id uuid.UUID) (*TodoList, error) {
+	tx, err := d.db.BeginTx(ctx, &sql.TxOptions{
+		Isolation: sql.LevelSerializable,
+		ReadOnly:  true,
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	lists, err := getTodoLists(ctx, tx, "WHERE l.id = ? AND l.deleted_at IS NULL", id)
+	if err != nil {
+		return nil, err
+	}
+	if len(lists) == 0 {
+		return nil, ErrNotFound
+	}
+	return lists[0], nil
+}
+
+// getTodoLists returns the lists matching the where clause, which may refer
+// to the list as l and to its items as i, with the items not in the trash.
+func getTodoLists(ctx context.Context, tx *sqlTx, where string, args ...any) ([]*TodoList, error) {
+	rows, err := tx.QueryContext(ctx, "SELECT "+listColumns+", "+itemColumns+" FROM list AS l LEFT JOIN list_item AS i ON l.id = i.list_id AND i.deleted_at IS NULL "+where+
+		" ORDER BY l.position, l.id, i.position, i.id", args...)
 	if err != nil {
 		return nil, err
 	}
+	defer rows.Close()
 	m := make(map[uuid.UUID]*TodoList)
+	var lists []*TodoList
 	for rows.Next() {
 		var list TodoList
 		var item TodoItem
-		err = rows.Scan(&list.ID, &list.Owner, &list.Name, &item.ID, &item.Text, &item.Marked)
+		err = rows.Scan(append(scanList(&list), scanItem(&item)...)...)
 		if err != nil {
 			return nil, err
 		}
@@ -117,19 +282,70 @@ func (d *DB) GetTodoLists(ctx context.Context) ([]*TodoList, error) {
 		if !ok {
 			list.Items = make([]TodoItem, 0)
 			m[*list.ID] = &list
+			lists = append(lists, &list)
 		}
 		if item.ID != nil {
 			m[*list.ID].Items = append(m[*list.ID].Items, item)
 		}
 	}
-	var lists []*TodoList
-	for _, list := range m {
-		lists = append(lists, list)
+	err = rows.Err()
+	if err != nil {
+		return nil, err
+	}
+	for _, list := range lists {
+		list.Items = buildTree(list.Items)
 	}
 	return lists, nil
 }
 
-func (d *DB) RemoveTodoList(ctx context.Context, id uuid.UUID) error {
+// buildTree arranges a flat slice of items into trees by their parent
+// reference and returns the roots, keeping the order of the slice among
+// siblings. Items whose parent is missing are treated as roots so that they
+// are never hidden.
+func buildTree(items []TodoItem) []TodoItem {
+	return buildTreeFunc(items, func(item TodoItem, parent TodoItem) bool {
+		return true
+	})
+}
+
+// buildTreeFunc is buildTree for items that are only placed below their
+// parent if below says so, and are roots otherwise.
+func buildTreeFunc(items []TodoItem, below func(item TodoItem, parent TodoItem) bool) []TodoItem {
+	known := make(map[uuid.UUID]TodoItem, len(items))
+	for _, item := range items {
+		known[*item.ID] = item
+	}
+
+	children := make(map[uuid.UUID][]TodoItem)
+	roots := make([]TodoItem, 0)
+	for _, item := range items {
+		parent, ok := TodoItem{}, false
+		if item.Parent != nil {
+			parent, ok = known[*item.Parent]
+		}
+		if ok && below(item, parent) {
+			children[*item.Parent] = append(children[*item.Parent], item)
+		} else {
+			roots = append(roots, item)
+		}
+	}
+
+	var attach func(items []TodoItem)
+	attach = func(items []TodoItem) {
+		for i := range items {
+			items[i].Children = children[*items[i].ID]
+			attach(items[i].Children)
+		}
+	}
+	attach(roots)
+
+	return roots
+}
+
+// RemoveTodoList moves a list with its items and members to the trash, from
+// which RestoreTodoList brings it back until PurgeDeleted removes it. If
+// version is not nil, the list must still have that version.
+func (d *DB) RemoveTodoList(ctx context.Context, id uuid.UUID, version *int64) error {
 	tx, err := d.db.BeginTx(ctx, &sql.TxOptions{
 		Isolation: sql.LevelSerializable,
 		ReadOnly:  false,
@@ -138,22 +354,37 @@ func (d *DB) RemoveTodoList(ctx context.Context, id uuid.UUID) error {
 		return err
 	}
 	defer tx.Rollback()
-	_, err = tx.ExecContext(ctx, "DELETE FROM list WHERE id = ?", id)
+	err = removeTodoList(ctx, tx, id, version)
 	if err != nil {
 		return err
 	}
-	_, err = tx.ExecContext(ctx, "DELETE FROM list_item WHERE list_id = ?", id)
+	err = tx.Commit()
 	if err != nil {
 		return err
 	}
-	err = tx.Commit()
+	return nil
+}
+
+func removeTodoList(ctx context.Context, tx *sqlTx, id uuid.UUID, version *int64) error {
+	list, err := getList(ctx, tx, id)
 	if err != nil {
 		return err
 	}
-	return nil
+	if list.DeletedAt != nil {
+		return ErrNotFound
+	}
+	if version != nil && *version != *list.Version {
+		return ErrVersionMismatch
+	}
+	_, err = tx.ExecContext(ctx, "UPDATE list SET deleted_at = ?, version = version + 1 WHERE id = ?", time.Now().UTC(), id)
+	if err != nil {
+		return err
+	}
+	return recordList(ctx, tx, RevisionRemoveList, id, list, nil)
 }
 
-func (d *DB) AddTodoItem(ctx context.Context, listId uuid.UUID, todo TodoItem) error {
+// SetListFrozen freezes or unfreezes a list.
+func (d *DB) SetListFrozen(ctx context.Context, id uuid.UUID, frozen bool) error {
 	tx, err := d.db.BeginTx(ctx, &sql.TxOptions{
 		Isolation: sql.LevelSerializable,
 		ReadOnly:  false,
@@ -162,7 +393,7 @@ func (d *DB) AddTodoItem(ctx context.Context, listId uuid.UUID, todo TodoItem) e
 		return err
 	}
 	defer tx.Rollback()
-	_, err = tx.ExecContext(ctx, "INSERT INTO list_item (id, list_id, text, marked) VALUES (?, ?, ?, ?)", *todo.ID, listId, *todo.Text, *todo.Marked)
+	err = setListFrozen(ctx, tx, id, frozen)
 	if err != nil {
 		return err
 	}
@@ -173,44 +404,485 @@ func (d *DB) AddTodoItem(ctx context.Context, listId uuid.UUID, todo TodoItem) e
 	return nil
 }
 
-func (d *DB) UpdateTodoItem(ctx context.Context, todo TodoItem) error {
+func setListFrozen(ctx context.Context, tx *sqlTx, id uuid.UUID, frozen bool) error {
+	before, err := getList(ctx, tx, id)
+	if err != nil {
+		return err
+	}
+	if before.DeletedAt != nil {
+		return ErrNotFound
+	}
+	_, err = tx.ExecContext(ctx, "UPDATE list SET frozen = ?, version = version + 1 WHERE id = ?", frozen, id)
+	if err != nil {
+		return err
+	}
+	after, err := getList(ctx, tx, id)
+	if err != nil {
+		return err
+	}
+	action := RevisionUnfreezeList
+	if frozen {
+		action = RevisionFreezeList
+	}
+	return recordList(ctx, tx, action, id, before, after)
+}
+
+// AddTodoItem adds an item to a list and returns the item as stored, without
+// its children. If the item has a parent, the parent must be an item of the
+// same list.
+func (d *DB) AddTodoItem(ctx context.Context, listId uuid.UUID, todo TodoItem) (*TodoItem, error) {
 	tx, err := d.db.BeginTx(ctx, &sql.TxOptions{
 		Isolation: sql.LevelSerializable,
 		ReadOnly:  false,
 	})
 	if err != nil {
-		return err
+		return nil, err
 	}
 	defer tx.Rollback()
-	_, err = tx.ExecContext(ctx, "UPDATE list_item SET text=?, marked=? WHERE id=?", *todo.Text, *todo.Marked, *todo.ID)
+	item, err := addTodoItem(ctx, tx, listId, todo)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	err = tx.Commit()
 	if err != nil {
-		return err
+		return nil, err
 	}
-	return nil
+	return item, nil
+}
+
+func addTodoItem(ctx context.Context, tx *sqlTx, listId uuid.UUID, todo TodoItem) (*TodoItem, error) {
+	var exists bool
+	err := tx.QueryRowContext(ctx, "SELECT EXISTS (SELECT 1 FROM list_item WHERE id = ?)", *todo.ID).Scan(&exists)
+	if err != nil {
+		return nil, err
+	}
+	if exists {
+		return nil, fmt.Errorf("%w: item %s already exists", ErrConflict, *todo.ID)
+	}
+	err = tx.QueryRowContext(ctx, "SELECT EXISTS (SELECT 1 FROM list WHERE id = ? AND deleted_at IS NULL)", listId).Scan(&exists)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, fmt.Errorf("list %s: %w", listId, ErrNotFound)
+	}
+	if todo.Parent != nil {
+		_, err = getTodoItem(ctx, tx, listId, *todo.Parent)
+		if err != nil {
+			return nil, fmt.Errorf("parent item %s: %w", *todo.Parent, err)
+		}
+	}
+	err = insertTodoItem(ctx, tx, listId, todo)
+	if err != nil {
+		return nil, err
+	}
+	err = touchList(ctx, tx, listId)
+	if err != nil {
+		return nil, err
+	}
+	item, err := getTodoItem(ctx, tx, listId, *todo.ID)
+	if err != nil {
+		return nil, err
+	}
+	err = recordItem(ctx, tx, RevisionAddItem, listId, nil, nil, item)
+	if err != nil {
+		return nil, err
+	}
+	return item, nil
 }
 
-func (d *DB) DeleteTodoItem(ctx context.Context, itemId uuid.UUID) error {
+// UpdateTodoItem updates the text, mark, price and kind of an item of a list
+// and returns the item as stored, without its children. If the version of
+// todo is set, the item must still have that version.
+func (d *DB) UpdateTodoItem(ctx context.Context, listId uuid.UUID, todo TodoItem) (*TodoItem, error) {
 	tx, err := d.db.BeginTx(ctx, &sql.TxOptions{
 		Isolation: sql.LevelSerializable,
 		ReadOnly:  false,
 	})
 	if err != nil {
-		return err
+		return nil, err
 	}
 	defer tx.Rollback()
-	_, err = tx.ExecContext(ctx, "DELETE FROM list_item WHERE id = ?", itemId)
+	item, err := updateTodoItem(ctx, tx, listId, todo)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	err = tx.Commit()
 	if err != nil {
+		return nil, err
+	}
+	return item, nil
+}
+
+func updateTodoItem(ctx context.Context, tx *sqlTx, listId uuid.UUID, todo TodoItem) (*TodoItem, error) {
+	current, err := getTodoItem(ctx, tx, listId, *todo.ID)
+	if err != nil {
+		return nil, err
+	}
+	if todo.Version != nil && *todo.Version != *current.Version {
+		return nil, ErrVersionMismatch
+	}
+	kind := ""
+	if todo.Kind != nil {
+		kind = *todo.Kind
+	}
+	// Completion is recorded when the item is marked and forgotten when it
+	// is unmarked
+	completedAt, completedBy := current.CompletedAt, current.CompletedByID
+	if *todo.Marked != *current.Marked {
+		completedAt, completedBy = nil, nil
+		if *todo.Marked {
+			completedAt = conv.Pointer(time.Now().UTC())
+			completedBy = todo.CompletedByID
+		}
+	}
+	_, err = tx.ExecContext(ctx, "UPDATE list_item SET text=?, marked=?, price_amount=?, price_currency=?, kind=?, attributes=?, description=COALESCE(?, description), completed_at=?, completed_by_id=?, version=version+1 WHERE id=?",
+		*todo.Text, *todo.Marked, todo.PriceAmount, todo.PriceCurrency, kind, todo.Attributes, todo.Description, completedAt, completedBy, *todo.ID)
+	if err != nil {
+		return nil, err
+	}
+	err = touchList(ctx, tx, listId)
+	if err != nil {
+		return nil, err
+	}
+	err = indexItem(ctx, tx, *todo.ID)
+	if err != nil {
+		return nil, err
+	}
+	item, err := getTodoItem(ctx, tx, listId, *todo.ID)
+	if err != nil {
+		return nil, err
+	}
+	err = recordItem(ctx, tx, RevisionUpdateItem, listId, nil, current, item)
+	if err != nil {
+		return nil, err
+	}
+	return item, nil
+}
+
+// textColumns maps the text fields of items that can be edited on their own
+// to their columns.
+var textColumns = map[string]string{
+	"text":        "text",
+	"description": "description",
+}
+
+// UpdateItemText sets a text field of an item, such as "text", and returns
+// the item as stored, without its children. If version is not nil, the item
+// must still have that version.
+func (d *DB) UpdateItemText(ctx context.Context, listId uuid.UUID, itemId uuid.UUID, field string, text string, version *int64) (*TodoItem, error) {
+	column, ok := textColumns[field]
+	if !ok {
+		return nil, fmt.Errorf("unknown text field %q", field)
+	}
+	tx, err := d.db.BeginTx(ctx, &sql.TxOptions{
+		Isolation: sql.LevelSerializable,
+		ReadOnly:  false,
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	current, err := getTodoItem(ctx, tx, listId, itemId)
+	if err != nil {
+		return nil, err
+	}
+	if version != nil && *version != *current.Version {
+		return nil, ErrVersionMismatch
+	}
+	_, err = tx.ExecContext(ctx, "UPDATE list_item SET "+column+" = ?, version = version + 1 WHERE id = ?", text, itemId)
+	if err != nil {
+		return nil, err
+	}
+	err = touchList(ctx, tx, listId)
+	if err != nil {
+		return nil, err
+	}
+	err = indexItem(ctx, tx, itemId)
+	if err != nil {
+		return nil, err
+	}
+	item, err := getTodoItem(ctx, tx, listId, itemId)
+	if err != nil {
+		return nil, err
+	}
+	err = recordItem(ctx, tx, RevisionUpdateText, listId, nil, current, item)
+	if err != nil {
+		return nil, err
+	}
+	err = tx.Commit()
+	if err != nil {
+		return nil, err
+	}
+	return item, nil
+}
+
+// DeleteTodoItem moves an item of a list together with all of its
+// descendants to the trash and returns the deleted item, without its
+// children. If version is not nil, the item must still have that version.
+func (d *DB) DeleteTodoItem(ctx context.Context, listId uuid.UUID, itemId uuid.UUID, version *int64) (*TodoItem, error) {
+	tx, err := d.db.BeginTx(ctx, &sql.TxOptions{
+		Isolation: sql.LevelSerializable,
+		ReadOnly:  false,
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	item, err := deleteTodoItem(ctx, tx, listId, itemId, version)
+	if err != nil {
+		return nil, err
+	}
+	err = tx.Commit()
+	if err != nil {
+		return nil, err
+	}
+	return item, nil
+}
+
+func deleteTodoItem(ctx context.Context, tx *sqlTx, listId uuid.UUID, itemId uuid.UUID, version *int64) (*TodoItem, error) {
+	item, err := getTodoItem(ctx, tx, listId, itemId)
+	if err != nil {
+		return nil, err
+	}
+	if version != nil && *version != *item.Version {
+		return nil, ErrVersionMismatch
+	}
+	_, err = tx.ExecContext(ctx, `WITH RECURSIVE subtree(id) AS (
+   SELECT id FROM list_item WHERE id = ?
+   UNION ALL
+   SELECT i.id FROM list_item AS i JOIN subtree AS s ON i.parent_id = s.id
+)
+UPDATE list_item SET deleted_at = ?, deleted_with = ? WHERE id IN (SELECT id FROM subtree) AND deleted_at IS NULL`, itemId, time.Now().UTC(), itemId)
+	if err != nil {
+		return nil, err
+	}
+	err = touchList(ctx, tx, listId)
+	if err != nil {
+		return nil, err
+	}
+	err = recordItem(ctx, tx, RevisionRemoveItem, listId, nil, item, nil)
+	if err != nil {
+		return nil, err
+	}
+	return item, nil
+}
+
+// MoveTodoItem moves an item, together with its descendants, within its list
+// or to another list, and returns the item as it was before and after the
+// move, without its children. ErrConflict is returned when the item would
+// become its own descendant.
+func (d *DB) MoveTodoItem(ctx context.Context, listId uuid.UUID, itemId uuid.UUID, to Move) (old *TodoItem, moved *TodoItem, err error) {
+	tx, err := d.db.BeginTx(ctx, &sql.TxOptions{
+		Isolation: sql.LevelSerializable,
+		ReadOnly:  false,
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	defer tx.Rollback()
+	old, moved, err = moveTodoItem(ctx, tx, listId, itemId, to)
+	if err != nil {
+		return nil, nil, err
+	}
+	err = tx.Commit()
+	if err != nil {
+		return nil, nil, err
+	}
+	return old, moved, nil
+}
+
+func moveTodoItem(ctx context.Context, tx *sqlTx, listId uuid.UUID, itemId uuid.UUID, to Move) (old *TodoItem, moved *TodoItem, err error) {
+	old, err = getTodoItem(ctx, tx, listId, itemId)
+	if err != nil {
+		return nil, nil, err
+	}
+	if to.Version != nil && *to.Version != *old.Version {
+		return nil, nil, ErrVersionMismatch
+	}
+	target := listId
+	if to.List != nil {
+		target = *to.List
+		var exists bool
+		err = tx.QueryRowContext(ctx, "SELECT EXISTS (SELECT 1 FROM list WHERE id = ? AND deleted_at IS NULL)", target).Scan(&exists)
+		if err != nil {
+			return nil, nil, err
+		}
+		if !exists {
+			return nil, nil, ErrNotFound
+		}
+	}
+	if to.Parent != nil {
+		_, err = getTodoItem(ctx, tx, target, *to.Parent)
+		if err != nil {
+			return nil, nil, err
+		}
+		var cycle bool
+		err = tx.QueryRowContext(ctx, `WITH RECURSIVE ancestors(id, parent_id) AS (
+   SELECT id, parent_id FROM list_item WHERE id = ?
+   UNION ALL
+   SELECT i.id, i.parent_id FROM list_item AS i JOIN ancestors AS a ON i.id = a.parent_id
+)
+SELECT EXISTS (SELECT 1 FROM ancestors WHERE id = ?)`, *to.Parent, itemId).Scan(&cycle)
+		if err != nil {
+			return nil, nil, err
+		}
+		if cycle {
+			return nil, nil, fmt.Errorf("%w: item %s cannot be moved below itself", ErrConflict, itemId)
+		}
+	}
+
+	siblings, err := getSiblings(ctx, tx, target, to.Parent)
+	if err != nil {
+		return nil, nil, err
+	}
+	siblings = slices.DeleteFunc(siblings, func(s sibling) bool {
+		return s.id == itemId
+	})
+	index := len(siblings)
+	if to.Before != nil || to.After != nil {
+		anchor := to.Before
+		if anchor == nil {
+			anchor = to.After
+		}
+		index = slices.IndexFunc(siblings, func(s sibling) bool {
+			return s.id == *anchor
+		})
+		if index < 0 {
+			return nil, nil, ErrNotFound
+		}
+		if to.Before == nil {
+			index++
+		}
+	}
+	position, err := placeBetween(siblings, index, func(id uuid.UUID, position int64) error {
+		_, err := tx.ExecContext(ctx, "UPDATE list_item SET position = ? WHERE id = ?", position, id)
 		return err
+	})
+	if err != nil {
+		return nil, nil, err
 	}
-	return nil
+
+	_, err = tx.ExecContext(ctx, "UPDATE list_item SET parent_id = ?, position = ?, version = version + 1 WHERE id = ?", to.Parent, position, itemId)
+	if err != nil {
+		return nil, nil, err
+	}
+	err = touchList(ctx, tx, listId)
+	if err != nil {
+		return nil, nil, err
+	}
+	if target != listId {
+		_, err = tx.ExecContext(ctx, `WITH RECURSIVE subtree(id) AS (
+   SELECT id FROM list_item WHERE id = ?
+   UNION ALL
+   SELECT i.id FROM list_item AS i JOIN subtree AS s ON i.parent_id = s.id
+)
+UPDATE list_item SET list_id = ? WHERE id IN (SELECT id FROM subtree)`, itemId, target)
+		if err != nil {
+			return nil, nil, err
+		}
+		err = touchList(ctx, tx, target)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	moved, err = getTodoItem(ctx, tx, target, itemId)
+	if err != nil {
+		return nil, nil, err
+	}
+	var from *uuid.UUID
+	if target != listId {
+		from = &listId
+	}
+	err = recordItem(ctx, tx, RevisionMoveItem, target, from, old, moved)
+	if err != nil {
+		return nil, nil, err
+	}
+	return old, moved, nil
+}
+
+// touchList increments the version of a list after one of its items changed.
+func touchList(ctx context.Context, tx *sqlTx, listId uuid.UUID) error {
+	_, err := tx.ExecContext(ctx, "UPDATE list SET version = version + 1 WHERE id = ?", listId)
+	return err
+}
+
+// positionGap is the distance between the positions of consecutive items, so
+// that items can usually be placed between others without renumbering.
+const positionGap = 1024
+
+type sibling struct {
+	id       uuid.UUID
+	position int64
+}
+
+// getSiblings returns the items below a parent, or the top level items of a
+// list if parent is nil, in order.
+func getSiblings(ctx context.Context, tx *sqlTx, listId uuid.UUID, parent *uuid.UUID) ([]sibling, error) {
+	query := "SELECT id, position FROM list_item WHERE list_id = ? AND parent_id IS NULL AND deleted_at IS NULL ORDER BY position, id"
+	args := []any{listId}
+	if parent != nil {
+		query = "SELECT id, position FROM list_item WHERE list_id = ? AND parent_id = ? AND deleted_at IS NULL ORDER BY position, id"
+		args = append(args, *parent)
+	}
+	rows, err := tx.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var siblings []sibling
+	for rows.Next() {
+		var s sibling
+		err = rows.Scan(&s.id, &s.position)
+		if err != nil {
+			return nil, err
+		}
+		siblings = append(siblings, s)
+	}
+	return siblings, rows.Err()
+}
+
+// placeBetween returns a free position before siblings[index], or after the
+// last sibling if index is past the end. Siblings are renumbered with
+// renumber when there is no gap left between them.
+func placeBetween(siblings []sibling, index int, renumber func(id uuid.UUID, position int64) error) (int64, error) {
+	switch {
+	case len(siblings) == 0:
+		return positionGap, nil
+	case index == len(siblings):
+		return siblings[index-1].position + positionGap, nil
+	case index == 0:
+		return siblings[0].position - positionGap, nil
+	}
+	low, high := siblings[index-1].position, siblings[index].position
+	if high-low >= 2 {
+		return low + (high-low)/2, nil
+	}
+	for i, s := range siblings {
+		position := int64(i+1) * positionGap
+		if i >= index {
+			position += positionGap
+		}
+		err := renumber(s.id, position)
+		if err != nil {
+			return 0, err
+		}
+	}
+	return int64(index+1) * positionGap, nil
+}
+
+// getTodoItem returns an item of a list that is not in the trash, without its
+// children.
+func getTodoItem(ctx context.Context, tx *sqlTx, listId uuid.UUID, itemId uuid.UUID) (*TodoItem, error) {
+	var item TodoItem
+	err := tx.QueryRowContext(ctx, "SELECT "+itemColumns+" FROM list_item AS i WHERE i.id = ? AND i.list_id = ? AND i.deleted_at IS NULL", itemId, listId).Scan(scanItem(&item)...)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &item, nil
 }
 
 func (d *DB) Close(ctx context.Context) error {
@@ -2,8 +2,11 @@ package db_test
 
 import (
 	"context"
+	"database/sql"
+	"errors"
 	"os"
 	"testing"
+	"time"
 	"todolist/internal/conv"
 	"todolist/internal/db"
 
@@ -12,7 +15,175 @@ import (
 )
 
 func TestDB(t *testing.T) {
-	const path = "/tmp/test.db"
+	forEachStore(t, "/tmp/test.db", func(t *testing.T, d db.Store) {
+		ctx := context.Background()
+		var err error
+
+		ids := make([]*uuid.UUID, 5)
+		for i := 0; i < 5; i++ {
+			id := uuid.Must(uuid.NewV4())
+			ids[i] = &id
+		}
+
+		a := db.TodoList{
+			ID:   ids[0],
+			Name: conv.Pointer("Shopping list, Sunday"),
+			Items: []db.TodoItem{
+				{
+					ID:     ids[1],
+					Text:   conv.Pointer("Salad"),
+					Marked: conv.Pointer(false),
+				},
+				{
+					ID:     ids[2],
+					Text:   conv.Pointer("Potatoes"),
+					Marked: conv.Pointer(true),
+				},
+			},
+		}
+
+		b := db.TodoList{
+			ID:    ids[3],
+			Name:  conv.Pointer("X"),
+			Items: []db.TodoItem{},
+		}
+
+		c := db.TodoList{
+			ID:    ids[4],
+			Name:  conv.Pointer("Y"),
+			Items: []db.TodoItem{},
+		}
+
+		err = d.AddTodoList(ctx, a)
+		require.NoError(t, err)
+
+		err = d.AddTodoList(ctx, b)
+		require.NoError(t, err)
+
+		err = d.AddTodoList(ctx, c)
+		require.NoError(t, err)
+
+		err = d.AddTodoList(ctx, c)
+		require.ErrorIs(t, err, db.ErrConflict)
+
+		lists, err := d.GetTodoLists(ctx)
+		require.NoError(t, err)
+		require.Equal(t, 3, len(lists))
+
+		err = d.RemoveTodoList(ctx, *b.ID, nil)
+		lists, err = d.GetTodoLists(ctx)
+		require.NoError(t, err)
+		require.Equal(t, 2, len(lists))
+
+		ie := a.Items[0]
+		ie.Text = conv.Pointer("testie")
+		_, err = d.UpdateTodoItem(ctx, *a.ID, ie)
+		require.NoError(t, err)
+		lists, err = d.GetTodoLists(ctx)
+		require.NoError(t, err)
+		require.Equal(t, 2, len(lists))
+		var found bool
+		for _, list := range lists {
+			for _, item := range list.Items {
+				if *item.Text == "testie" {
+					found = true
+				}
+			}
+		}
+		require.True(t, found)
+
+		missing := uuid.Must(uuid.NewV4())
+		_, err = d.UpdateTodoItem(ctx, *a.ID, db.TodoItem{ID: &missing, Text: conv.Pointer("?"), Marked: conv.Pointer(false)})
+		require.ErrorIs(t, err, db.ErrNotFound)
+		_, err = d.DeleteTodoItem(ctx, *a.ID, missing, nil)
+		require.ErrorIs(t, err, db.ErrNotFound)
+		require.ErrorIs(t, d.RemoveTodoList(ctx, missing, nil), db.ErrNotFound)
+	})
+}
+
+func TestMigrate(t *testing.T) {
+	const path = "/tmp/test-migrate.db"
+	os.Remove(path)
+	t.Cleanup(func() {
+		os.Remove(path)
+	})
+	ctx := context.Background()
+
+	// A database created before schema versioning existed
+	legacy, err := sql.Open("sqlite", path)
+	require.NoError(t, err)
+	_, err = legacy.ExecContext(ctx, `CREATE TABLE list (id UUID PRIMARY KEY NOT NULL, owner TEXT NOT NULL, name TEXT NOT NULL)`)
+	require.NoError(t, err)
+	_, err = legacy.ExecContext(ctx, `CREATE TABLE list_item (id UUID PRIMARY KEY NOT NULL, list_id UUID NOT NULL, text TEXT NOT NULL, marked BOOLEAN NOT NULL)`)
+	require.NoError(t, err)
+	listID := uuid.Must(uuid.NewV4())
+	_, err = legacy.ExecContext(ctx, `INSERT INTO list VALUES (?, 'Jonas', 'Old list')`, listID)
+	require.NoError(t, err)
+	_, err = legacy.ExecContext(ctx, `INSERT INTO list_item VALUES (?, ?, 'Kept', FALSE)`, uuid.Must(uuid.NewV4()), listID)
+	require.NoError(t, err)
+	_, err = legacy.ExecContext(ctx, `INSERT INTO list_item VALUES (?, ?, 'Done', TRUE)`, uuid.Must(uuid.NewV4()), listID)
+	require.NoError(t, err)
+	orphan := uuid.Must(uuid.NewV4())
+	_, err = legacy.ExecContext(ctx, `INSERT INTO list_item VALUES (?, ?, 'Orphan', FALSE)`, orphan, uuid.Must(uuid.NewV4()))
+	require.NoError(t, err)
+	require.NoError(t, legacy.Close())
+
+	d, err := db.NewDB(ctx, db.Options{DSN: path, SkipMigrations: true})
+	require.NoError(t, err)
+	version, err := d.SchemaVersion(ctx)
+	require.NoError(t, err)
+	require.Equal(t, 0, version)
+
+	applied, err := d.Migrate(ctx)
+	require.NoError(t, err)
+	require.Equal(t, db.LatestVersion(), len(applied))
+	require.Len(t, applied[13].Notes, 1)
+	require.Contains(t, applied[13].Notes[0], orphan.String())
+	require.Equal(t, []string{"list " + listID.String() + " is owned by \"Jonas\", who has no account: fsck -repair hands it over once they register"}, applied[5].Notes)
+
+	applied, err = d.Migrate(ctx)
+	require.NoError(t, err)
+	require.Empty(t, applied)
+
+	lists, err := d.GetTodoLists(ctx)
+	require.NoError(t, err)
+	require.Equal(t, 1, len(lists))
+	require.Equal(t, 2, len(lists[0].Items))
+	require.Nil(t, lists[0].OwnerID)
+	require.Nil(t, lists[0].Items[0].CompletedAt)
+	require.NotNil(t, lists[0].Items[1].CompletedAt)
+	problems, err := d.Check(ctx)
+	require.NoError(t, err)
+	require.Equal(t, []string{"list " + listID.String() + " has no owner until \"Jonas\" registers"}, problems)
+
+	// Once the owner has registered, repairing hands the list over
+	jonas := db.User{ID: conv.Pointer(uuid.Must(uuid.NewV4())), Name: conv.Pointer("Jonas"), PasswordHash: conv.Pointer("hash")}
+	require.NoError(t, d.AddUser(ctx, jonas))
+	repaired, err := d.Repair(ctx)
+	require.NoError(t, err)
+	require.Equal(t, []string{"list " + listID.String() + " handed over to user \"Jonas\""}, repaired)
+	lists, err = d.GetTodoLists(ctx)
+	require.NoError(t, err)
+	require.Equal(t, *jonas.ID, *lists[0].OwnerID)
+	problems, err = d.Check(ctx)
+	require.NoError(t, err)
+	require.Empty(t, problems)
+	require.NoError(t, d.Close(ctx))
+
+	// Pretend a newer build has migrated the database
+	newer, err := sql.Open("sqlite", path)
+	require.NoError(t, err)
+	_, err = newer.ExecContext(ctx, "INSERT INTO schema_migration VALUES (?, 'from the future', ?)", db.LatestVersion()+1, time.Now())
+	require.NoError(t, err)
+	require.NoError(t, newer.Close())
+
+	_, err = db.NewDB(ctx, db.Options{DSN: path})
+	require.ErrorIs(t, err, db.ErrSchemaTooNew)
+}
+
+func TestCheck(t *testing.T) {
+	const path = "/tmp/test-check.db"
+	os.Remove(path)
 	t.Cleanup(func() {
 		os.Remove(path)
 	})
@@ -21,76 +192,1010 @@ func TestDB(t *testing.T) {
 	require.NoError(t, err)
 	defer d.Close(ctx)
 
-	ids := make([]*uuid.UUID, 5)
-	for i := 0; i < 5; i++ {
-		id := uuid.Must(uuid.NewV4())
-		ids[i] = &id
-	}
-
-	a := db.TodoList{
-		ID:    ids[0],
-		Owner: conv.Pointer("Jonas"),
-		Name:  conv.Pointer("Shopping list, Sunday"),
-		Items: []db.TodoItem{
+	listID := uuid.Must(uuid.NewV4())
+	parent := uuid.Must(uuid.NewV4())
+	child := uuid.Must(uuid.NewV4())
+	require.NoError(t, d.AddTodoList(ctx, db.TodoList{
+		ID:   &listID,
+		Name: conv.Pointer("Checked"),
+		Items: []db.TodoItem{{
+			ID:       &parent,
+			Text:     conv.Pointer("Parent"),
+			Marked:   conv.Pointer(false),
+			Children: []db.TodoItem{{ID: &child, Text: conv.Pointer("Child"), Marked: conv.Pointer(false)}},
+		}},
+	}))
+	_, err = d.AddTodoItem(ctx, uuid.Must(uuid.NewV4()), db.TodoItem{ID: conv.Pointer(uuid.Must(uuid.NewV4())), Text: conv.Pointer("?"), Marked: conv.Pointer(false)})
+	require.ErrorIs(t, err, db.ErrNotFound)
+
+	// Connections that do not enforce foreign keys can still orphan items
+	unchecked, err := sql.Open("sqlite", path)
+	require.NoError(t, err)
+	defer unchecked.Close()
+	_, err = unchecked.ExecContext(ctx, "DELETE FROM list_item WHERE id = ?", parent)
+	require.NoError(t, err)
+
+	problems, err := d.Check(ctx)
+	require.NoError(t, err)
+	require.Len(t, problems, 2)
+	require.Contains(t, problems[1], child.String())
+
+	repaired, err := d.Repair(ctx)
+	require.NoError(t, err)
+	require.Equal(t, []string{"item " + child.String() + " is below missing item " + parent.String() + ": moved to the top level"}, repaired)
+	problems, err = d.Check(ctx)
+	require.NoError(t, err)
+	require.Empty(t, problems)
+
+	// Purging a removed list removes its items
+	require.NoError(t, d.RemoveTodoList(ctx, listID, nil))
+	purged, err := d.PurgeDeleted(ctx, time.Now().Add(time.Minute))
+	require.NoError(t, err)
+	require.Equal(t, int64(1), purged)
+	var items int
+	require.NoError(t, unchecked.QueryRowContext(ctx, "SELECT COUNT(*) FROM list_item").Scan(&items))
+	require.Zero(t, items)
+}
+
+func TestSubtasks(t *testing.T) {
+	forEachStore(t, "/tmp/test-subtasks.db", func(t *testing.T, d db.Store) {
+		ctx := context.Background()
+		var err error
+
+		ids := make([]*uuid.UUID, 6)
+		for i := range ids {
+			id := uuid.Must(uuid.NewV4())
+			ids[i] = &id
+		}
+
+		a := db.TodoList{
+			ID:   ids[0],
+			Name: conv.Pointer("Shopping list, Sunday"),
+			Items: []db.TodoItem{
+				{
+					ID:     ids[1],
+					Text:   conv.Pointer("Salad"),
+					Marked: conv.Pointer(false),
+					Children: []db.TodoItem{
+						{
+							ID:     ids[2],
+							Text:   conv.Pointer("Lettuce"),
+							Marked: conv.Pointer(false),
+						},
+					},
+				},
+			},
+		}
+		b := db.TodoList{
+			ID:   ids[4],
+			Name: conv.Pointer("X"),
+		}
+		require.NoError(t, d.AddTodoList(ctx, a))
+		require.NoError(t, d.AddTodoList(ctx, b))
+
+		_, err = d.AddTodoItem(ctx, *ids[0], db.TodoItem{
+			ID:     ids[3],
+			Parent: ids[2],
+			Text:   conv.Pointer("Seeds"),
+			Marked: conv.Pointer(false),
+		})
+		require.NoError(t, err)
+
+		// Parents have to be in the same list
+		_, err = d.AddTodoItem(ctx, *ids[4], db.TodoItem{
+			ID:     ids[5],
+			Parent: ids[1],
+			Text:   conv.Pointer("Wrong list"),
+			Marked: conv.Pointer(false),
+		})
+		require.Error(t, err)
+
+		find := func() *db.TodoList {
+			lists, err := d.GetTodoLists(ctx)
+			require.NoError(t, err)
+			for _, list := range lists {
+				if *list.ID == *ids[0] {
+					return list
+				}
+			}
+			return nil
+		}
+
+		list := find()
+		require.Len(t, list.Items, 1)
+		require.Len(t, list.Items[0].Children, 1)
+		require.Equal(t, *ids[2], *list.Items[0].Children[0].ID)
+		require.Len(t, list.Items[0].Children[0].Children, 1)
+		require.Equal(t, *ids[3], *list.Items[0].Children[0].Children[0].ID)
+		require.Equal(t, *ids[2], *list.Items[0].Children[0].Children[0].Parent)
+
+		removed, err := d.DeleteTodoItem(ctx, *ids[0], *ids[2], nil)
+		require.NoError(t, err)
+		require.Equal(t, *ids[1], *removed.Parent)
+
+		list = find()
+		require.Len(t, list.Items, 1)
+		require.Empty(t, list.Items[0].Children)
+
+		// The grandchild went with its parent
+		_, err = d.DeleteTodoItem(ctx, *ids[0], *ids[3], nil)
+		require.ErrorIs(t, err, db.ErrNotFound)
+
+		// Items can only be reached through their own list
+		_, err = d.DeleteTodoItem(ctx, *ids[4], *ids[1], nil)
+		require.ErrorIs(t, err, db.ErrNotFound)
+	})
+}
+
+func TestMove(t *testing.T) {
+	forEachStore(t, "/tmp/test-move.db", func(t *testing.T, d db.Store) {
+		ctx := context.Background()
+
+		ids := make([]*uuid.UUID, 6)
+		for i := range ids {
+			id := uuid.Must(uuid.NewV4())
+			ids[i] = &id
+		}
+
+		item := func(id *uuid.UUID, text string) db.TodoItem {
+			return db.TodoItem{ID: id, Text: conv.Pointer(text), Marked: conv.Pointer(false)}
+		}
+		a := db.TodoList{
+			ID:    ids[0],
+			Name:  conv.Pointer("A"),
+			Items: []db.TodoItem{item(ids[1], "1"), item(ids[2], "2"), item(ids[3], "3")},
+		}
+		b := db.TodoList{
+			ID:    ids[4],
+			Name:  conv.Pointer("B"),
+			Items: []db.TodoItem{item(ids[5], "5")},
+		}
+		require.NoError(t, d.AddTodoList(ctx, a))
+		require.NoError(t, d.AddTodoList(ctx, b))
+
+		order := func(items []db.TodoItem) []uuid.UUID {
+			var order []uuid.UUID
+			for _, item := range items {
+				order = append(order, *item.ID)
+			}
+			return order
+		}
+
+		// Lists and items keep the order they were added in
+		lists, err := d.GetTodoLists(ctx)
+		require.NoError(t, err)
+		require.Len(t, lists, 2)
+		require.Equal(t, *ids[0], *lists[0].ID)
+		require.Equal(t, []uuid.UUID{*ids[1], *ids[2], *ids[3]}, order(lists[0].Items))
+
+		_, _, err = d.MoveTodoItem(ctx, *ids[0], *ids[3], db.Move{Before: ids[1]})
+		require.NoError(t, err)
+		_, _, err = d.MoveTodoItem(ctx, *ids[0], *ids[1], db.Move{After: ids[3]})
+		require.NoError(t, err)
+		list, err := d.GetTodoList(ctx, *ids[0])
+		require.NoError(t, err)
+		require.Equal(t, []uuid.UUID{*ids[3], *ids[1], *ids[2]}, order(list.Items))
+
+		// Repeated moves into the same gap renumber the siblings
+		for i := 0; i < 12; i++ {
+			_, _, err = d.MoveTodoItem(ctx, *ids[0], *ids[2], db.Move{After: ids[3]})
+			require.NoError(t, err)
+			_, _, err = d.MoveTodoItem(ctx, *ids[0], *ids[1], db.Move{After: ids[3]})
+			require.NoError(t, err)
+		}
+		list, err = d.GetTodoList(ctx, *ids[0])
+		require.NoError(t, err)
+		require.Equal(t, []uuid.UUID{*ids[3], *ids[1], *ids[2]}, order(list.Items))
+
+		old, moved, err := d.MoveTodoItem(ctx, *ids[0], *ids[2], db.Move{Parent: ids[1]})
+		require.NoError(t, err)
+		require.Nil(t, old.Parent)
+		require.Equal(t, *ids[1], *moved.Parent)
+
+		// Items cannot be moved below themselves
+		_, _, err = d.MoveTodoItem(ctx, *ids[0], *ids[1], db.Move{Parent: ids[2]})
+		require.ErrorIs(t, err, db.ErrConflict)
+
+		// The subtree moves to the other list
+		_, _, err = d.MoveTodoItem(ctx, *ids[0], *ids[1], db.Move{List: ids[4], Before: ids[5]})
+		require.NoError(t, err)
+		list, err = d.GetTodoList(ctx, *ids[4])
+		require.NoError(t, err)
+		require.Equal(t, []uuid.UUID{*ids[1], *ids[5]}, order(list.Items))
+		require.Equal(t, []uuid.UUID{*ids[2]}, order(list.Items[0].Children))
+		list, err = d.GetTodoList(ctx, *ids[0])
+		require.NoError(t, err)
+		require.Equal(t, []uuid.UUID{*ids[3]}, order(list.Items))
+
+		_, _, err = d.MoveTodoItem(ctx, *ids[0], *ids[1], db.Move{})
+		require.ErrorIs(t, err, db.ErrNotFound)
+		_, _, err = d.MoveTodoItem(ctx, *ids[4], *ids[1], db.Move{Before: ids[3]})
+		require.ErrorIs(t, err, db.ErrNotFound)
+	})
+}
+
+func TestDescriptions(t *testing.T) {
+	forEachStore(t, "/tmp/test-descriptions.db", func(t *testing.T, d db.Store) {
+		ctx := context.Background()
+		var err error
+
+		listID := uuid.Must(uuid.NewV4())
+		itemID := uuid.Must(uuid.NewV4())
+		err = d.AddTodoList(ctx, db.TodoList{
+			ID:    &listID,
+			Name:  conv.Pointer("Descriptions"),
+			Items: []db.TodoItem{{ID: &itemID, Text: conv.Pointer("Salad"), Marked: conv.Pointer(false)}},
+		})
+		require.NoError(t, err)
+
+		item, err := d.UpdateTodoItem(ctx, listID, db.TodoItem{ID: &itemID, Text: conv.Pointer("Salad"), Marked: conv.Pointer(false), Description: conv.Pointer("- [ ] Wash")})
+		require.NoError(t, err)
+		require.Equal(t, "- [ ] Wash", *item.Description)
+
+		// Updates without a description keep it
+		item, err = d.UpdateTodoItem(ctx, listID, db.TodoItem{ID: &itemID, Text: conv.Pointer("Green salad"), Marked: conv.Pointer(false)})
+		require.NoError(t, err)
+		require.Equal(t, "- [ ] Wash", *item.Description)
+
+		item, err = d.UpdateItemText(ctx, listID, itemID, "description", "- [x] Wash", nil)
+		require.NoError(t, err)
+		require.Equal(t, "- [x] Wash", *item.Description)
+		require.Equal(t, "Green salad", *item.Text)
+	})
+}
+
+func TestCompletion(t *testing.T) {
+	forEachStore(t, "/tmp/test-completion.db", func(t *testing.T, d db.Store) {
+		ctx := context.Background()
+		var err error
+
+		var users [2]db.User
+		for i, name := range []string{"Jonas", "Anna"} {
+			users[i] = db.User{ID: conv.Pointer(uuid.Must(uuid.NewV4())), Name: conv.Pointer(name), PasswordHash: conv.Pointer("hash")}
+			require.NoError(t, d.AddUser(ctx, users[i]))
+		}
+		jonas, anna := users[0].ID, users[1].ID
+
+		listID := uuid.Must(uuid.NewV4())
+		itemID := uuid.Must(uuid.NewV4())
+		err = d.AddTodoList(ctx, db.TodoList{
+			ID:    &listID,
+			Name:  conv.Pointer("Completion"),
+			Items: []db.TodoItem{{ID: &itemID, Text: conv.Pointer("A"), Marked: conv.Pointer(false), CompletedByID: jonas}},
+		})
+		require.NoError(t, err)
+
+		list, err := d.GetTodoList(ctx, listID)
+		require.NoError(t, err)
+		require.Nil(t, list.Items[0].CompletedAt)
+		require.Nil(t, list.Items[0].CompletedByID)
+
+		before := time.Now().UTC()
+		item, err := d.UpdateTodoItem(ctx, listID, db.TodoItem{ID: &itemID, Text: conv.Pointer("A"), Marked: conv.Pointer(true), CompletedByID: anna})
+		require.NoError(t, err)
+		require.NotNil(t, item.CompletedAt)
+		require.False(t, item.CompletedAt.Before(before.Truncate(time.Second)))
+		require.Equal(t, *anna, *item.CompletedByID)
+		require.Equal(t, "Anna", *item.CompletedBy)
+		completedAt := *item.CompletedAt
+
+		// Editing a marked item keeps who completed it and when
+		item, err = d.UpdateTodoItem(ctx, listID, db.TodoItem{ID: &itemID, Text: conv.Pointer("B"), Marked: conv.Pointer(true), CompletedByID: jonas})
+		require.NoError(t, err)
+		require.Equal(t, completedAt, *item.CompletedAt)
+		require.Equal(t, "Anna", *item.CompletedBy)
+
+		item, err = d.UpdateTodoItem(ctx, listID, db.TodoItem{ID: &itemID, Text: conv.Pointer("B"), Marked: conv.Pointer(false), CompletedByID: jonas})
+		require.NoError(t, err)
+		require.Nil(t, item.CompletedAt)
+		require.Nil(t, item.CompletedByID)
+		require.Nil(t, item.CompletedBy)
+	})
+}
+
+func TestVersions(t *testing.T) {
+	forEachStore(t, "/tmp/test-versions.db", func(t *testing.T, d db.Store) {
+		ctx := context.Background()
+		var err error
+
+		listID := uuid.Must(uuid.NewV4())
+		itemID := uuid.Must(uuid.NewV4())
+		err = d.AddTodoList(ctx, db.TodoList{
+			ID:    &listID,
+			Name:  conv.Pointer("Versions"),
+			Items: []db.TodoItem{{ID: &itemID, Text: conv.Pointer("A"), Marked: conv.Pointer(false)}},
+		})
+		require.NoError(t, err)
+
+		list, err := d.GetTodoList(ctx, listID)
+		require.NoError(t, err)
+		require.Equal(t, int64(1), *list.Version)
+		require.Equal(t, int64(1), *list.Items[0].Version)
+
+		update := db.TodoItem{ID: &itemID, Text: conv.Pointer("B"), Marked: conv.Pointer(false), Version: conv.Pointer(int64(1))}
+		item, err := d.UpdateTodoItem(ctx, listID, update)
+		require.NoError(t, err)
+		require.Equal(t, int64(2), *item.Version)
+
+		// The second update was based on the first version
+		_, err = d.UpdateTodoItem(ctx, listID, update)
+		require.ErrorIs(t, err, db.ErrVersionMismatch)
+		_, err = d.DeleteTodoItem(ctx, listID, itemID, conv.Pointer(int64(1)))
+		require.ErrorIs(t, err, db.ErrVersionMismatch)
+
+		// Changes to items change the version of the list as well
+		list, err = d.GetTodoList(ctx, listID)
+		require.NoError(t, err)
+		require.Equal(t, int64(2), *list.Version)
+		require.ErrorIs(t, d.RemoveTodoList(ctx, listID, conv.Pointer(int64(1))), db.ErrVersionMismatch)
+		require.NoError(t, d.RemoveTodoList(ctx, listID, conv.Pointer(int64(2))))
+	})
+}
+
+func TestSync(t *testing.T) {
+	forEachStore(t, "/tmp/test-sync.db", func(t *testing.T, d db.Store) {
+		ctx := context.Background()
+
+		userID := uuid.Must(uuid.NewV4())
+		listID := uuid.Must(uuid.NewV4())
+		a := uuid.Must(uuid.NewV4())
+		b := uuid.Must(uuid.NewV4())
+		require.NoError(t, d.AddUser(ctx, db.User{ID: &userID, Name: conv.Pointer("Jonas"), PasswordHash: conv.Pointer("hash")}))
+		require.NoError(t, d.AddTodoList(ctx, db.TodoList{ID: &listID, Name: conv.Pointer("Sync")}))
+
+		ops := []db.Operation{
+			{
+				ID:   conv.Pointer("1"),
+				Type: conv.Pointer(db.OpAddItem),
+				List: &listID,
+				Item: &db.TodoItem{ID: &a, Text: conv.Pointer("A"), Marked: conv.Pointer(false)},
+			},
+			{
+				ID:   conv.Pointer("2"),
+				Type: conv.Pointer(db.OpAddItem),
+				List: &listID,
+				Item: &db.TodoItem{ID: &b, Parent: &a, Text: conv.Pointer("B"), Marked: conv.Pointer(false)},
+			},
+			{
+				ID:   conv.Pointer("3"),
+				Type: conv.Pointer(db.OpUpdateItem),
+				List: &listID,
+				Item: &db.TodoItem{ID: &a, Text: conv.Pointer("A2"), Marked: conv.Pointer(true), Version: conv.Pointer(int64(1))},
+			},
 			{
-				ID:     ids[1],
-				Text:   conv.Pointer("Salad"),
-				Marked: conv.Pointer(false),
+				ID:   conv.Pointer("4"),
+				Type: conv.Pointer(db.OpUpdateItem),
+				List: &listID,
+				Item: &db.TodoItem{ID: &a, Text: conv.Pointer("A3"), Marked: conv.Pointer(false), Version: conv.Pointer(int64(1))},
 			},
 			{
-				ID:     ids[2],
-				Text:   conv.Pointer("Potatoes"),
-				Marked: conv.Pointer(true),
+				ID:   conv.Pointer("5"),
+				Type: conv.Pointer(db.OpMoveItem),
+				List: &listID,
+				Item: &db.TodoItem{ID: &b},
+				Move: &db.Move{},
 			},
-		},
-	}
+		}
+		results, err := d.Sync(ctx, userID, ops)
+		require.NoError(t, err)
+		require.Len(t, results, 5)
+		require.NoError(t, results[0].Err)
+		require.NoError(t, results[1].Err)
+		require.NoError(t, results[2].Err)
+		require.Equal(t, int64(2), *results[2].Item.Version)
+		require.ErrorIs(t, results[3].Err, db.ErrVersionMismatch)
+		require.NoError(t, results[4].Err)
+		require.Equal(t, a, *results[4].Old.Parent)
 
-	b := db.TodoList{
-		ID:    ids[3],
-		Owner: conv.Pointer("Jonas"),
-		Name:  conv.Pointer("X"),
-		Items: []db.TodoItem{},
-	}
+		// Applied operations are not applied again, failed ones are retried
+		results, err = d.Sync(ctx, userID, ops)
+		require.NoError(t, err)
+		require.True(t, results[0].Duplicate)
+		require.True(t, results[2].Duplicate)
+		require.False(t, results[3].Duplicate)
+		require.ErrorIs(t, results[3].Err, db.ErrVersionMismatch)
 
-	c := db.TodoList{
-		ID:    ids[4],
-		Owner: conv.Pointer("Jonas"),
-		Name:  conv.Pointer("Y"),
-		Items: []db.TodoItem{},
-	}
+		list, err := d.GetTodoList(ctx, listID)
+		require.NoError(t, err)
+		require.Len(t, list.Items, 2)
+		require.Equal(t, "A2", *list.Items[0].Text)
 
-	err = d.AddTodoList(ctx, a)
-	require.NoError(t, err)
+		removed, err := d.RemoveOperations(ctx, time.Now().Add(time.Minute))
+		require.NoError(t, err)
+		require.Equal(t, int64(4), removed)
+	})
+}
 
-	err = d.AddTodoList(ctx, b)
-	require.NoError(t, err)
+func TestEvents(t *testing.T) {
+	forEachStore(t, "/tmp/test-events.db", func(t *testing.T, d db.Store) {
+		ctx := context.Background()
+
+		a := uuid.Must(uuid.NewV4())
+		b := uuid.Must(uuid.NewV4())
+		old := time.Now().Add(-time.Hour)
+
+		var seqs []int64
+		for i, list := range []uuid.UUID{a, b, a, a} {
+			event := db.Event{
+				List: &list,
+				Type: conv.Pointer("update-list"),
+				Data: conv.Pointer("{}"),
+			}
+			if i < 2 {
+				event.CreatedAt = &old
+			}
+			seq, err := d.AppendEvent(ctx, event)
+			require.NoError(t, err)
+			seqs = append(seqs, seq)
+		}
+		require.IsIncreasing(t, seqs)
+
+		latest, err := d.LatestEventSeq(ctx)
+		require.NoError(t, err)
+		require.Equal(t, seqs[3], latest)
+
+		events, err := d.EventsSince(ctx, 0, []uuid.UUID{a})
+		require.NoError(t, err)
+		require.Len(t, events, 3)
+		require.Equal(t, seqs[2], *events[1].Seq)
+
+		events, err = d.EventsSince(ctx, seqs[2], []uuid.UUID{a, b})
+		require.NoError(t, err)
+		require.Len(t, events, 1)
+
+		_, err = d.EventsSince(ctx, seqs[3]+1, []uuid.UUID{a})
+		require.ErrorIs(t, err, db.ErrCompacted)
+
+		removed, err := d.CompactEvents(ctx, time.Now().Add(-time.Minute))
+		require.NoError(t, err)
+		require.Equal(t, int64(2), removed)
+
+		_, err = d.EventsSince(ctx, seqs[0], []uuid.UUID{a})
+		require.ErrorIs(t, err, db.ErrCompacted)
+
+		events, err = d.EventsSince(ctx, seqs[1], []uuid.UUID{a})
+		require.NoError(t, err)
+		require.Len(t, events, 2)
+	})
+}
+
+func TestAtomically(t *testing.T) {
+	forEachStore(t, "/tmp/test-atomically.db", func(t *testing.T, d db.Store) {
+		ctx := context.Background()
+
+		id := uuid.Must(uuid.NewV4())
+		change := func(ctx context.Context) error {
+			err := d.AddTodoList(ctx, db.TodoList{ID: &id, Name: conv.Pointer("Atomic")})
+			if err != nil {
+				return err
+			}
+			_, err = d.AppendEvent(ctx, db.Event{List: &id, Type: conv.Pointer("update-list"), Data: conv.Pointer("{}")})
+			return err
+		}
+
+		// Nothing is kept of a failed change, not even its events
+		failed := errors.New("failed")
+		err := d.Atomically(ctx, func(ctx context.Context) error {
+			err := change(ctx)
+			require.NoError(t, err)
+			return failed
+		})
+		require.ErrorIs(t, err, failed)
+		_, err = d.GetTodoList(ctx, id)
+		require.ErrorIs(t, err, db.ErrNotFound)
+		latest, err := d.LatestEventSeq(ctx)
+		require.NoError(t, err)
+		require.Zero(t, latest)
+
+		err = d.Atomically(ctx, change)
+		require.NoError(t, err)
+		_, err = d.GetTodoList(ctx, id)
+		require.NoError(t, err)
+		events, err := d.EventsSince(ctx, 0, []uuid.UUID{id})
+		require.NoError(t, err)
+		require.Len(t, events, 1)
+	})
+}
+
+func TestUsers(t *testing.T) {
+	forEachStore(t, "/tmp/test-users.db", func(t *testing.T, d db.Store) {
+		ctx := context.Background()
+
+		user := db.User{
+			ID:           conv.Pointer(uuid.Must(uuid.NewV4())),
+			Name:         conv.Pointer("Jonas"),
+			PasswordHash: conv.Pointer("hash"),
+		}
+		require.NoError(t, d.AddUser(ctx, user))
+
+		taken := user
+		taken.ID = conv.Pointer(uuid.Must(uuid.NewV4()))
+		require.ErrorIs(t, d.AddUser(ctx, taken), db.ErrConflict)
+
+		found, err := d.GetUserByName(ctx, "Jonas")
+		require.NoError(t, err)
+		require.Equal(t, *user.ID, *found.ID)
+
+		_, err = d.GetUserByName(ctx, "Nobody")
+		require.ErrorIs(t, err, db.ErrNotFound)
+
+		expires := time.Now().Add(time.Hour)
+		expired := time.Now().Add(-time.Hour)
+		require.NoError(t, d.AddSession(ctx, db.Session{TokenHash: conv.Pointer("a"), User: user.ID, ExpiresAt: &expires}))
+		require.NoError(t, d.AddSession(ctx, db.Session{TokenHash: conv.Pointer("b"), User: user.ID, ExpiresAt: &expired}))
+
+		found, err = d.GetSessionUser(ctx, "a")
+		require.NoError(t, err)
+		require.Equal(t, "Jonas", *found.Name)
+
+		_, err = d.GetSessionUser(ctx, "b")
+		require.ErrorIs(t, err, db.ErrNotFound)
+
+		removed, err := d.RemoveExpiredSessions(ctx, time.Now())
+		require.NoError(t, err)
+		require.Equal(t, int64(1), removed)
+
+		require.NoError(t, d.RemoveSession(ctx, "a"))
+		_, err = d.GetSessionUser(ctx, "a")
+		require.ErrorIs(t, err, db.ErrNotFound)
+	})
+}
+
+func TestMembers(t *testing.T) {
+	forEachStore(t, "/tmp/test-members.db", func(t *testing.T, d db.Store) {
+		ctx := context.Background()
+
+		users := make([]db.User, 3)
+		for i, name := range []string{"Jonas", "Alice", "Bob"} {
+			users[i] = db.User{
+				ID:           conv.Pointer(uuid.Must(uuid.NewV4())),
+				Name:         conv.Pointer(name),
+				PasswordHash: conv.Pointer("hash"),
+			}
+			require.NoError(t, d.AddUser(ctx, users[i]))
+		}
+
+		list := db.TodoList{
+			ID:      conv.Pointer(uuid.Must(uuid.NewV4())),
+			OwnerID: users[0].ID,
+			Name:    conv.Pointer("Shared"),
+		}
+		require.NoError(t, d.AddTodoList(ctx, list))
+		stored, err := d.GetTodoList(ctx, *list.ID)
+		require.NoError(t, err)
+		require.Equal(t, "Jonas", *stored.Owner)
+
+		role, frozen, err := d.GetListAccess(ctx, *list.ID, *users[0].ID)
+		require.NoError(t, err)
+		require.Equal(t, db.RoleOwner, role)
+		require.False(t, frozen)
+
+		role, _, err = d.GetListAccess(ctx, *list.ID, *users[1].ID)
+		require.NoError(t, err)
+		require.Equal(t, "", role)
+
+		_, _, err = d.GetListAccess(ctx, uuid.Must(uuid.NewV4()), *users[1].ID)
+		require.ErrorIs(t, err, db.ErrNotFound)
+
+		member, err := d.SetListMember(ctx, db.Member{List: list.ID, User: users[1].ID, Role: conv.Pointer(db.RoleViewer)})
+		require.NoError(t, err)
+		require.Equal(t, "Alice", *member.Name)
+
+		member, err = d.UpdateListMember(ctx, db.Member{List: list.ID, User: users[1].ID, Role: conv.Pointer(db.RoleEditor)})
+		require.NoError(t, err)
+		require.Equal(t, "Alice", *member.Name)
+		_, err = d.UpdateListMember(ctx, db.Member{List: list.ID, User: users[2].ID, Role: conv.Pointer(db.RoleEditor)})
+		require.ErrorIs(t, err, db.ErrNotFound)
+
+		_, err = d.SetListMember(ctx, db.Member{List: list.ID, User: users[0].ID, Role: conv.Pointer(db.RoleViewer)})
+		require.ErrorIs(t, err, db.ErrConflict)
+
+		role, _, err = d.GetListAccess(ctx, *list.ID, *users[1].ID)
+		require.NoError(t, err)
+		require.Equal(t, db.RoleEditor, role)
+
+		members, err := d.GetListMembers(ctx, *list.ID)
+		require.NoError(t, err)
+		require.Len(t, members, 1)
+
+		require.NoError(t, d.RemoveListMember(ctx, *list.ID, *users[1].ID))
+		require.ErrorIs(t, d.RemoveListMember(ctx, *list.ID, *users[2].ID), db.ErrNotFound)
+
+		role, _, err = d.GetListAccess(ctx, *list.ID, *users[1].ID)
+		require.NoError(t, err)
+		require.Equal(t, "", role)
 
-	err = d.AddTodoList(ctx, c)
+		require.NoError(t, d.SetListFrozen(ctx, *list.ID, true))
+		_, frozen, err = d.GetListAccess(ctx, *list.ID, *users[1].ID)
+		require.NoError(t, err)
+		require.True(t, frozen)
+		require.ErrorIs(t, d.SetListFrozen(ctx, uuid.Must(uuid.NewV4()), true), db.ErrNotFound)
+	})
+}
+
+func TestTrash(t *testing.T) {
+	forEachStore(t, "/tmp/test-trash.db", func(t *testing.T, d db.Store) {
+		ctx := context.Background()
+
+		user := db.User{
+			ID:           conv.Pointer(uuid.Must(uuid.NewV4())),
+			Name:         conv.Pointer("Jonas"),
+			PasswordHash: conv.Pointer("hash"),
+		}
+		require.NoError(t, d.AddUser(ctx, user))
+
+		ids := make([]uuid.UUID, 5)
+		for i := range ids {
+			ids[i] = uuid.Must(uuid.NewV4())
+		}
+		list, parent, child, grandchild, other := ids[0], ids[1], ids[2], ids[3], ids[4]
+		require.NoError(t, d.AddTodoList(ctx, db.TodoList{
+			ID:      &list,
+			OwnerID: user.ID,
+			Name:    conv.Pointer("Trash"),
+			Items: []db.TodoItem{
+				{ID: &parent, Text: conv.Pointer("Parent"), Marked: conv.Pointer(false), Children: []db.TodoItem{
+					{ID: &child, Text: conv.Pointer("Child"), Marked: conv.Pointer(false), Children: []db.TodoItem{
+						{ID: &grandchild, Text: conv.Pointer("Grandchild"), Marked: conv.Pointer(false)},
+					}},
+				}},
+				{ID: &other, Text: conv.Pointer("Other"), Marked: conv.Pointer(false)},
+			},
+		}))
+
+		// The child is deleted before its parent, and is a trash tree of its own
+		_, err := d.DeleteTodoItem(ctx, list, child, nil)
+		require.NoError(t, err)
+		_, err = d.DeleteTodoItem(ctx, list, parent, nil)
+		require.NoError(t, err)
+
+		stored, err := d.GetTodoList(ctx, list)
+		require.NoError(t, err)
+		require.Len(t, stored.Items, 1)
+		require.Equal(t, other, *stored.Items[0].ID)
+		_, err = d.UpdateTodoItem(ctx, list, db.TodoItem{ID: &parent, Text: conv.Pointer("?"), Marked: conv.Pointer(false)})
+		require.ErrorIs(t, err, db.ErrNotFound)
+
+		deleted, err := d.GetDeletedItems(ctx, list)
+		require.NoError(t, err)
+		require.Len(t, deleted, 2)
+		require.Equal(t, parent, *deleted[0].ID)
+		require.Empty(t, deleted[0].Children)
+		require.Equal(t, child, *deleted[1].ID)
+		require.Len(t, deleted[1].Children, 1)
+		require.NotNil(t, deleted[1].DeletedAt)
+
+		// Without its parent, the child is restored at the top level
+		restored, err := d.RestoreTodoItem(ctx, list, child)
+		require.NoError(t, err)
+		require.Nil(t, restored.Parent)
+		require.Nil(t, restored.DeletedAt)
+		require.Len(t, restored.Children, 1)
+		require.Equal(t, grandchild, *restored.Children[0].ID)
+		_, err = d.RestoreTodoItem(ctx, list, child)
+		require.ErrorIs(t, err, db.ErrNotFound)
+
+		_, err = d.RestoreTodoItem(ctx, list, parent)
+		require.NoError(t, err)
+		stored, err = d.GetTodoList(ctx, list)
+		require.NoError(t, err)
+		require.Len(t, stored.Items, 3)
+		require.Equal(t, []uuid.UUID{parent, other, child}, []uuid.UUID{*stored.Items[0].ID, *stored.Items[1].ID, *stored.Items[2].ID})
+		deleted, err = d.GetDeletedItems(ctx, list)
+		require.NoError(t, err)
+		require.Empty(t, deleted)
+
+		// Deleted lists are hidden until they are restored
+		require.NoError(t, d.RemoveTodoList(ctx, list, nil))
+		_, err = d.GetTodoList(ctx, list)
+		require.ErrorIs(t, err, db.ErrNotFound)
+		_, _, err = d.GetListAccess(ctx, list, *user.ID)
+		require.ErrorIs(t, err, db.ErrNotFound)
+		lists, err := d.GetMemberLists(ctx, *user.ID)
+		require.NoError(t, err)
+		require.Empty(t, lists)
+		require.ErrorIs(t, d.RemoveTodoList(ctx, list, nil), db.ErrNotFound)
+
+		trash, err := d.GetDeletedLists(ctx, *user.ID)
+		require.NoError(t, err)
+		require.Len(t, trash, 1)
+		require.NotNil(t, trash[0].DeletedAt)
+		require.Len(t, trash[0].Items, 3)
+
+		restoredList, err := d.RestoreTodoList(ctx, list)
+		require.NoError(t, err)
+		require.Nil(t, restoredList.DeletedAt)
+		require.Len(t, restoredList.Items, 3)
+		_, err = d.RestoreTodoList(ctx, list)
+		require.ErrorIs(t, err, db.ErrNotFound)
+
+		// Only what was deleted before the point in time is purged
+		_, err = d.DeleteTodoItem(ctx, list, other, nil)
+		require.NoError(t, err)
+		purged, err := d.PurgeDeleted(ctx, time.Now().Add(-time.Hour))
+		require.NoError(t, err)
+		require.Zero(t, purged)
+		purged, err = d.PurgeDeleted(ctx, time.Now().Add(time.Minute))
+		require.NoError(t, err)
+		require.Equal(t, int64(1), purged)
+		_, err = d.RestoreTodoItem(ctx, list, other)
+		require.ErrorIs(t, err, db.ErrNotFound)
+
+		require.NoError(t, d.RemoveTodoList(ctx, list, nil))
+		purged, err = d.PurgeDeleted(ctx, time.Now().Add(time.Minute))
+		require.NoError(t, err)
+		require.Equal(t, int64(1), purged)
+		trash, err = d.GetDeletedLists(ctx, *user.ID)
+		require.NoError(t, err)
+		require.Empty(t, trash)
+		_, err = d.RestoreTodoList(ctx, list)
+		require.ErrorIs(t, err, db.ErrNotFound)
+	})
+}
+
+func TestDeletionBatches(t *testing.T) {
+	const path = "/tmp/test-batches.db"
+	os.Remove(path)
+	t.Cleanup(func() {
+		os.Remove(path)
+	})
+	ctx := context.Background()
+	d, err := db.NewDB(ctx, db.Options{DSN: path})
 	require.NoError(t, err)
+	defer d.Close(ctx)
 
-	lists, err := d.GetTodoLists(ctx)
+	list, parent, child := uuid.Must(uuid.NewV4()), uuid.Must(uuid.NewV4()), uuid.Must(uuid.NewV4())
+	require.NoError(t, d.AddTodoList(ctx, db.TodoList{ID: &list, Name: conv.Pointer("Batches"), Items: []db.TodoItem{
+		{ID: &parent, Text: conv.Pointer("Parent"), Marked: conv.Pointer(false), Children: []db.TodoItem{
+			{ID: &child, Text: conv.Pointer("Child"), Marked: conv.Pointer(false)},
+		}},
+	}}))
+	_, err = d.DeleteTodoItem(ctx, list, child, nil)
+	require.NoError(t, err)
+	_, err = d.DeleteTodoItem(ctx, list, parent, nil)
 	require.NoError(t, err)
-	require.Equal(t, 3, len(lists))
 
-	err = d.RemoveTodoList(ctx, *b.ID)
-	lists, err = d.GetTodoLists(ctx)
+	// Deletions within the same instant are still told apart
+	raw, err := sql.Open("sqlite", path)
+	require.NoError(t, err)
+	defer raw.Close()
+	_, err = raw.ExecContext(ctx, "UPDATE list_item SET deleted_at = (SELECT deleted_at FROM list_item WHERE id = ?)", parent)
 	require.NoError(t, err)
-	require.Equal(t, 2, len(lists))
+	deleted, err := d.GetDeletedItems(ctx, list)
+	require.NoError(t, err)
+	require.Len(t, deleted, 2)
 
-	ie := a.Items[0]
-	ie.Text = conv.Pointer("testie")
-	err = d.UpdateTodoItem(ctx, ie)
+	restored, err := d.RestoreTodoItem(ctx, list, parent)
 	require.NoError(t, err)
-	lists, err = d.GetTodoLists(ctx)
+	require.Empty(t, restored.Children)
+	deleted, err = d.GetDeletedItems(ctx, list)
 	require.NoError(t, err)
-	require.Equal(t, 2, len(lists))
-	var found bool
-	for _, list := range lists {
-		for _, item := range list.Items {
-			if *item.Text == "testie" {
-				found = true
+	require.Len(t, deleted, 1)
+	require.Equal(t, child, *deleted[0].ID)
+}
+
+func TestHistory(t *testing.T) {
+	forEachStore(t, "/tmp/test-history.db", func(t *testing.T, d db.Store) {
+		user := db.User{
+			ID:           conv.Pointer(uuid.Must(uuid.NewV4())),
+			Name:         conv.Pointer("Jonas"),
+			PasswordHash: conv.Pointer("hash"),
+		}
+		require.NoError(t, d.AddUser(context.Background(), user))
+		ctx := db.WithAuthor(context.Background(), *user.ID)
+
+		ids := make([]uuid.UUID, 5)
+		for i := range ids {
+			ids[i] = uuid.Must(uuid.NewV4())
+		}
+		list, other, a, b, c := ids[0], ids[1], ids[2], ids[3], ids[4]
+		for _, id := range []uuid.UUID{list, other} {
+			require.NoError(t, d.AddTodoList(ctx, db.TodoList{ID: &id, Name: conv.Pointer("History")}))
+		}
+		for _, id := range []uuid.UUID{a, b, c} {
+			_, err := d.AddTodoItem(ctx, list, db.TodoItem{ID: &id, Text: conv.Pointer("Item"), Marked: conv.Pointer(false)})
+			require.NoError(t, err)
+		}
+
+		_, err := d.UpdateTodoItem(ctx, list, db.TodoItem{ID: &a, Text: conv.Pointer("Changed"), Marked: conv.Pointer(true)})
+		require.NoError(t, err)
+		history, err := d.GetItemHistory(ctx, list, a)
+		require.NoError(t, err)
+		require.Len(t, history, 2)
+		update := history[0]
+		require.Equal(t, db.RevisionUpdateItem, *update.Action)
+		require.Equal(t, *user.ID, *update.AuthorID)
+		require.Equal(t, "Jonas", *update.Author)
+		before, after, err := update.Items()
+		require.NoError(t, err)
+		require.Equal(t, "Item", *before.Text)
+		require.Equal(t, "Changed", *after.Text)
+		require.Equal(t, db.RevisionAddItem, *history[1].Action)
+		require.Nil(t, history[1].Before)
+
+		// Changes made since are kept, and undone revisions cannot be undone again
+		_, err = d.UpdateItemText(ctx, list, a, "description", "More", nil)
+		require.NoError(t, err)
+		undo, err := d.UndoRevision(ctx, *update.ID)
+		require.NoError(t, err)
+		require.Equal(t, *update.ID, *undo.Undoes)
+		stored, err := d.GetTodoList(ctx, list)
+		require.NoError(t, err)
+		require.Equal(t, "Item", *stored.Items[0].Text)
+		require.False(t, *stored.Items[0].Marked)
+		require.Equal(t, "More", *stored.Items[0].Description)
+		_, err = d.UndoRevision(ctx, *update.ID)
+		require.ErrorIs(t, err, db.ErrConflict)
+
+		// A field changed again since cannot be reverted
+		_, err = d.UpdateItemText(ctx, list, a, "text", "Again", nil)
+		require.NoError(t, err)
+		_, err = d.UndoRevision(ctx, *undo.ID)
+		require.ErrorIs(t, err, db.ErrConflict)
+
+		// Items moved to another list go back next to their former siblings
+		_, _, err = d.MoveTodoItem(ctx, list, b, db.Move{List: &other})
+		require.NoError(t, err)
+		history, err = d.GetItemHistory(ctx, list, b)
+		require.NoError(t, err)
+		require.Equal(t, db.RevisionMoveItem, *history[0].Action)
+		require.Equal(t, other, *history[0].List)
+		require.Equal(t, list, *history[0].FromList)
+		_, err = d.UndoRevision(ctx, *history[0].ID)
+		require.NoError(t, err)
+		stored, err = d.GetTodoList(ctx, list)
+		require.NoError(t, err)
+		require.Equal(t, []uuid.UUID{a, b, c}, []uuid.UUID{*stored.Items[0].ID, *stored.Items[1].ID, *stored.Items[2].ID})
+
+		// Removals are undone by restoring and the other way around
+		_, err = d.DeleteTodoItem(ctx, list, c, nil)
+		require.NoError(t, err)
+		history, err = d.GetItemHistory(ctx, list, c)
+		require.NoError(t, err)
+		require.Equal(t, db.RevisionRemoveItem, *history[0].Action)
+		undo, err = d.UndoRevision(ctx, *history[0].ID)
+		require.NoError(t, err)
+		require.Equal(t, db.RevisionRestoreItem, *undo.Action)
+		_, err = d.UndoRevision(ctx, *undo.ID)
+		require.NoError(t, err)
+		stored, err = d.GetTodoList(ctx, list)
+		require.NoError(t, err)
+		require.Len(t, stored.Items, 2)
+
+		require.NoError(t, d.SetListFrozen(ctx, list, true))
+		history, err = d.GetListHistory(ctx, list)
+		require.NoError(t, err)
+		require.Equal(t, db.RevisionFreezeList, *history[0].Action)
+		require.Nil(t, history[0].Item)
+		_, err = d.UndoRevision(ctx, *history[0].ID)
+		require.NoError(t, err)
+		stored, err = d.GetTodoList(ctx, list)
+		require.NoError(t, err)
+		require.False(t, *stored.Frozen)
+
+		// Removed lists are restored from the trash rather than undone
+		require.NoError(t, d.RemoveTodoList(ctx, list, nil))
+		_, err = d.RestoreTodoList(ctx, list)
+		require.NoError(t, err)
+		history, err = d.GetListHistory(ctx, list)
+		require.NoError(t, err)
+		require.Equal(t, db.RevisionRemoveList, *history[1].Action)
+		_, err = d.UndoRevision(ctx, *history[1].ID)
+		require.ErrorIs(t, err, db.ErrConflict)
+
+		history, err = d.GetListHistory(ctx, other)
+		require.NoError(t, err)
+		require.Len(t, history, 3)
+		require.Equal(t, db.RevisionAddList, *history[2].Action)
+
+		_, err = d.UndoRevision(ctx, 1000)
+		require.ErrorIs(t, err, db.ErrNotFound)
+
+		// Purging forgets revisions made before a point in time
+		purged, err := d.PurgeHistory(ctx, time.Now().Add(-time.Hour))
+		require.NoError(t, err)
+		require.Zero(t, purged)
+		purged, err = d.PurgeHistory(ctx, time.Now().Add(time.Minute))
+		require.NoError(t, err)
+		require.Positive(t, purged)
+		history, err = d.GetListHistory(ctx, list)
+		require.NoError(t, err)
+		require.Empty(t, history)
+	})
+}
+
+func TestSearch(t *testing.T) {
+	forEachStore(t, "/tmp/test-search.db", func(t *testing.T, d db.Store) {
+		ctx := context.Background()
+
+		var users [2]db.User
+		for i, name := range []string{"Jonas", "Anna"} {
+			users[i] = db.User{ID: conv.Pointer(uuid.Must(uuid.NewV4())), Name: conv.Pointer(name), PasswordHash: conv.Pointer("hash")}
+			require.NoError(t, d.AddUser(ctx, users[i]))
+		}
+		ids := make([]uuid.UUID, 5)
+		for i := range ids {
+			ids[i] = uuid.Must(uuid.NewV4())
+		}
+		home, room, call, milk, old := ids[0], ids[1], ids[2], ids[3], ids[4]
+		require.NoError(t, d.AddTodoList(ctx, db.TodoList{ID: &home, OwnerID: users[0].ID, Name: conv.Pointer("Home"), Items: []db.TodoItem{
+			{ID: &call, Text: conv.Pointer("Call the plumber"), Marked: conv.Pointer(false), Description: conv.Pointer("About the noisy boiler")},
+			{ID: &milk, Text: conv.Pointer("Buy milk"), Marked: conv.Pointer(true)},
+			{ID: &old, Text: conv.Pointer("Old boiler manual"), Marked: conv.Pointer(false)},
+		}}))
+		require.NoError(t, d.AddTodoList(ctx, db.TodoList{ID: &room, OwnerID: users[1].ID, Name: conv.Pointer("Boiler room")}))
+		_, err := d.DeleteTodoItem(ctx, home, old, nil)
+		require.NoError(t, err)
+
+		search := func(text string, filter db.SearchQuery) ([]db.SearchResult, int) {
+			filter.User, filter.Text = users[0].ID, &text
+			if filter.Limit == 0 {
+				filter.Limit = 10
 			}
+			results, total, err := d.Search(ctx, filter)
+			require.NoError(t, err)
+			return results, total
 		}
-	}
-	require.True(t, found)
+
+		// Lists that have not been shared and deleted items are not found
+		results, total := search("BOIL", db.SearchQuery{})
+		require.Equal(t, 1, total)
+		require.Equal(t, call, *results[0].Item.ID)
+		require.Equal(t, home, *results[0].List.ID)
+		require.Contains(t, *results[0].Snippet, db.HighlightStart+"boiler"+db.HighlightEnd)
+
+		// Names weigh more than descriptions
+		_, err = d.SetListMember(ctx, db.Member{List: &room, User: users[0].ID, Role: conv.Pointer(db.RoleViewer)})
+		require.NoError(t, err)
+		results, total = search("boiler", db.SearchQuery{})
+		require.Equal(t, 2, total)
+		require.Equal(t, room, *results[0].List.ID)
+		require.Nil(t, results[0].Item)
+		require.Greater(t, *results[0].Score, *results[1].Score)
+		results, total = search("boiler", db.SearchQuery{Offset: 1, Limit: 1})
+		require.Equal(t, 2, total)
+		require.Len(t, results, 1)
+		require.Equal(t, call, *results[0].Item.ID)
+
+		results, _ = search("boiler", db.SearchQuery{Owner: users[0].ID})
+		require.Len(t, results, 1)
+		results, _ = search("boiler", db.SearchQuery{List: &room})
+		require.Len(t, results, 1)
+		results, _ = search("call noisy", db.SearchQuery{})
+		require.Len(t, results, 1)
+		results, _ = search("call milk", db.SearchQuery{})
+		require.Empty(t, results)
+
+		// Punctuation separates words as it does in the searched texts
+		results, _ = search("boiler-room", db.SearchQuery{})
+		require.Len(t, results, 1)
+		require.Equal(t, room, *results[0].List.ID)
+		results, _ = search("c++", db.SearchQuery{})
+		require.Len(t, results, 1)
+		require.Equal(t, call, *results[0].Item.ID)
+		results, _ = search("--", db.SearchQuery{})
+		require.Empty(t, results)
+
+		// Done state only selects items
+		results, _ = search("milk", db.SearchQuery{Marked: conv.Pointer(true)})
+		require.Len(t, results, 1)
+		results, _ = search("milk", db.SearchQuery{Marked: conv.Pointer(false)})
+		require.Empty(t, results)
+
+		// Changed texts are searched as they are now
+		_, err = d.UpdateTodoItem(ctx, home, db.TodoItem{ID: &call, Text: conv.Pointer("Call the electrician"), Marked: conv.Pointer(false)})
+		require.NoError(t, err)
+		results, _ = search("plumber", db.SearchQuery{})
+		require.Empty(t, results)
+		_, err = d.UpdateItemText(ctx, home, call, "description", "Lights flicker", nil)
+		require.NoError(t, err)
+		results, _ = search("electric flick", db.SearchQuery{})
+		require.Len(t, results, 1)
+
+		removed, err := d.PurgeDeleted(ctx, time.Now().Add(time.Minute))
+		require.NoError(t, err)
+		require.Equal(t, int64(1), removed)
+		results, _ = search("manual", db.SearchQuery{})
+		require.Empty(t, results)
+	})
 }
@@ -0,0 +1,185 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"strconv"
+	"strings"
+
+	"github.com/jackc/pgx/v5/pgconn"
+	_ "github.com/jackc/pgx/v5/stdlib"
+	_ "modernc.org/sqlite"
+)
+
+// dialect describes the differences between the SQL databases DB can use.
+// Queries are written with ? placeholders, which are rewritten for databases
+// using numbered ones.
+type dialect struct {
+	name     string
+	driver   string
+	numbered bool
+
+	// params are added to the query of every DSN.
+	params string
+
+	// bigint is the type of 64 bit integer columns and serial the type of
+	// an auto-incrementing 64 bit primary key.
+	bigint string
+	serial string
+
+	// retryable reports whether a transaction failed only because it
+	// conflicted with concurrent ones, and may succeed if run again. It is
+	// nil for databases that serialize transactions by locking.
+	retryable func(err error) bool
+}
+
+var (
+	sqlite = &dialect{
+		name:   "sqlite",
+		driver: "sqlite",
+		// Foreign keys are only enforced on connections enabling them
+		params: "_pragma=foreign_keys(1)",
+		bigint: "INTEGER",
+		serial: "INTEGER PRIMARY KEY AUTOINCREMENT",
+	}
+	postgres = &dialect{
+		name:     "postgres",
+		driver:   "pgx",
+		numbered: true,
+		bigint:   "BIGINT",
+		serial:   "BIGSERIAL PRIMARY KEY",
+		retryable: func(err error) bool {
+			// serialization_failure and deadlock_detected
+			var pgErr *pgconn.PgError
+			return errors.As(err, &pgErr) && (pgErr.Code == "40001" || pgErr.Code == "40P01")
+		},
+	}
+)
+
+// dsn returns a DSN with the parameters of the dialect.
+func (d *dialect) dsn(dsn string) string {
+	switch {
+	case d.params == "":
+		return dsn
+	case strings.Contains(dsn, "?"):
+		return dsn + "&" + d.params
+	default:
+		return dsn + "?" + d.params
+	}
+}
+
+// rebind rewrites the ? placeholders of a query for the dialect. Question
+// marks in quoted strings and identifiers are left alone.
+func (d *dialect) rebind(query string) string {
+	if !d.numbered || !strings.Contains(query, "?") {
+		return query
+	}
+	var b strings.Builder
+	n := 0
+	var quote rune
+	for _, r := range query {
+		switch {
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			}
+		case r == '\'' || r == '"':
+			quote = r
+		case r == '?':
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// sqlDB is a database connection pool that rewrites queries for its dialect.
+type sqlDB struct {
+	*sql.DB
+	dialect *dialect
+}
+
+// txKey is the context key of the transaction of a database that the
+// queries made with the context take part in.
+type txKey struct {
+	db *sqlDB
+}
+
+// withTx returns a context in which the queries of the database of tx take
+// part in tx.
+func withTx(ctx context.Context, d *sqlDB, tx *sqlTx) context.Context {
+	return context.WithValue(ctx, txKey{d}, tx)
+}
+
+// BeginTx starts a transaction, unless the context already has one, in which
+// case the returned transaction is part of it and its Commit and Rollback do
+// nothing.
+func (d *sqlDB) BeginTx(ctx context.Context, opts *sql.TxOptions) (*sqlTx, error) {
+	if outer, ok := ctx.Value(txKey{d}).(*sqlTx); ok {
+		return &sqlTx{Tx: outer.Tx, dialect: d.dialect, nested: true}, nil
+	}
+	tx, err := d.DB.BeginTx(ctx, opts)
+	if err != nil {
+		return nil, err
+	}
+	return &sqlTx{Tx: tx, dialect: d.dialect}, nil
+}
+
+func (d *sqlDB) ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error) {
+	if tx, ok := ctx.Value(txKey{d}).(*sqlTx); ok {
+		return tx.ExecContext(ctx, query, args...)
+	}
+	return d.DB.ExecContext(ctx, d.dialect.rebind(query), args...)
+}
+
+func (d *sqlDB) QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error) {
+	if tx, ok := ctx.Value(txKey{d}).(*sqlTx); ok {
+		return tx.QueryContext(ctx, query, args...)
+	}
+	return d.DB.QueryContext(ctx, d.dialect.rebind(query), args...)
+}
+
+func (d *sqlDB) QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row {
+	if tx, ok := ctx.Value(txKey{d}).(*sqlTx); ok {
+		return tx.QueryRowContext(ctx, query, args...)
+	}
+	return d.DB.QueryRowContext(ctx, d.dialect.rebind(query), args...)
+}
+
+// sqlTx is a transaction that rewrites queries for its dialect.
+type sqlTx struct {
+	*sql.Tx
+	dialect *dialect
+
+	// nested is set on the transactions that are part of another one.
+	nested bool
+}
+
+func (t *sqlTx) Commit() error {
+	if t.nested {
+		return nil
+	}
+	return t.Tx.Commit()
+}
+
+func (t *sqlTx) Rollback() error {
+	if t.nested {
+		return nil
+	}
+	return t.Tx.Rollback()
+}
+
+func (t *sqlTx) ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error) {
+	return t.Tx.ExecContext(ctx, t.dialect.rebind(query), args...)
+}
+
+func (t *sqlTx) QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error) {
+	return t.Tx.QueryContext(ctx, t.dialect.rebind(query), args...)
+}
+
+func (t *sqlTx) QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row {
+	return t.Tx.QueryRowContext(ctx, t.dialect.rebind(query), args...)
+}
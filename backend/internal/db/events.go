@@ -0,0 +1,174 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/gofrs/uuid"
+)
+
+// ErrCompacted is returned when the events following a sequence number are no
+// longer, or were never, in the event log.
+var ErrCompacted = errors.New("events have been compacted")
+
+// eventLock is the PostgreSQL advisory lock taken by the transactions
+// recording events.
+const eventLock = 7_461_233
+
+// AppendEvent records an event in the event log and returns its sequence
+// number. Called within Atomically, the event is only recorded if the rest of
+// the transaction is.
+func (d *DB) AppendEvent(ctx context.Context, event Event) (int64, error) {
+	tx, err := d.db.BeginTx(ctx, &sql.TxOptions{
+		Isolation: sql.LevelSerializable,
+		ReadOnly:  false,
+	})
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	if tx.dialect == postgres {
+		// Sequence numbers are taken in the order the transactions commit,
+		// as they are in SQLite, so that a reader that has seen an event
+		// has seen those before it too
+		_, err = tx.ExecContext(ctx, "SELECT pg_advisory_xact_lock(?)", eventLock)
+		if err != nil {
+			return 0, err
+		}
+	}
+	createdAt := time.Now().UTC()
+	if event.CreatedAt != nil {
+		createdAt = *event.CreatedAt
+	}
+	var seq int64
+	err = tx.QueryRowContext(ctx, "INSERT INTO event (list_id, type, data, created_at) VALUES (?, ?, ?, ?) RETURNING seq", *event.List, *event.Type, *event.Data, createdAt).Scan(&seq)
+	if err != nil {
+		return 0, err
+	}
+	err = tx.Commit()
+	if err != nil {
+		return 0, err
+	}
+	return seq, nil
+}
+
+// LatestEventSeq returns the sequence number of the most recent event.
+func (d *DB) LatestEventSeq(ctx context.Context) (int64, error) {
+	tx, err := d.db.BeginTx(ctx, &sql.TxOptions{
+		Isolation: sql.LevelSerializable,
+		ReadOnly:  true,
+	})
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	_, latest, err := eventBounds(ctx, tx)
+	return latest, err
+}
+
+// EventsSince returns the events of the lists that were recorded after seq,
+// in order. It returns ErrCompacted if any of them may have been removed.
+func (d *DB) EventsSince(ctx context.Context, seq int64, lists []uuid.UUID) ([]Event, error) {
+	tx, err := d.db.BeginTx(ctx, &sql.TxOptions{
+		Isolation: sql.LevelSerializable,
+		ReadOnly:  true,
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	horizon, latest, err := eventBounds(ctx, tx)
+	if err != nil {
+		return nil, err
+	}
+	if seq < horizon || seq > latest {
+		return nil, ErrCompacted
+	}
+
+	events := make([]Event, 0)
+	if len(lists) == 0 {
+		return events, nil
+	}
+
+	args := []any{seq}
+	for _, list := range lists {
+		args = append(args, list)
+	}
+	rows, err := tx.QueryContext(ctx, "SELECT seq, list_id, type, data, created_at FROM event WHERE seq > ? AND list_id IN (?"+strings.Repeat(", ?", len(lists)-1)+") ORDER BY seq", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var event Event
+		err = rows.Scan(&event.Seq, &event.List, &event.Type, &event.Data, &event.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, event)
+	}
+	err = rows.Err()
+	if err != nil {
+		return nil, err
+	}
+	return events, nil
+}
+
+// CompactEvents removes the events recorded before a point in time and
+// returns how many were removed.
+func (d *DB) CompactEvents(ctx context.Context, before time.Time) (int64, error) {
+	tx, err := d.db.BeginTx(ctx, &sql.TxOptions{
+		Isolation: sql.LevelSerializable,
+		ReadOnly:  false,
+	})
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	var last sql.NullInt64
+	err = tx.QueryRowContext(ctx, "SELECT MAX(seq) FROM event WHERE created_at < ?", before.UTC()).Scan(&last)
+	if err != nil {
+		return 0, err
+	}
+	if !last.Valid {
+		return 0, nil
+	}
+	result, err := tx.ExecContext(ctx, "DELETE FROM event WHERE seq <= ?", last.Int64)
+	if err != nil {
+		return 0, err
+	}
+	removed, err := result.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	_, err = tx.ExecContext(ctx, "UPDATE event_horizon SET seq = CASE WHEN seq < ? THEN ? ELSE seq END", last.Int64, last.Int64)
+	if err != nil {
+		return 0, err
+	}
+	err = tx.Commit()
+	if err != nil {
+		return 0, err
+	}
+	return removed, nil
+}
+
+// eventBounds returns the compaction horizon and the latest sequence number.
+func eventBounds(ctx context.Context, tx *sqlTx) (horizon int64, latest int64, err error) {
+	err = tx.QueryRowContext(ctx, "SELECT seq FROM event_horizon").Scan(&horizon)
+	if err != nil {
+		return 0, 0, err
+	}
+	var max sql.NullInt64
+	err = tx.QueryRowContext(ctx, "SELECT MAX(seq) FROM event").Scan(&max)
+	if err != nil {
+		return 0, 0, err
+	}
+	latest = horizon
+	if max.Valid && max.Int64 > latest {
+		latest = max.Int64
+	}
+	return horizon, latest, nil
+}
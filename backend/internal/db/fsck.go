@@ -0,0 +1,321 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+
+	"github.com/gofrs/uuid"
+)
+
+// orphanCheck finds records referring to records that do not exist, which
+// databases created before foreign keys were enforced may contain.
+type orphanCheck struct {
+	// problem describes an orphan given its two columns.
+	problem string
+	table   string
+	columns string
+	where   string
+
+	// repair is the statement, followed by where, that repairs the
+	// orphans, and fix describes what it does.
+	repair string
+	fix    string
+}
+
+// orphanChecks are the checks of fsck, run in order, as repairing an orphan
+// may orphan others.
+var orphanChecks = []orphanCheck{
+	{
+		problem: "item %s belongs to missing list %s",
+		table:   "list_item",
+		columns: "id, list_id",
+		where:   "list_id NOT IN (SELECT id FROM list)",
+		repair:  "DELETE FROM list_item WHERE ",
+		fix:     "removed",
+	},
+	{
+		problem: "item %s is below missing item %s",
+		table:   "list_item",
+		columns: "id, parent_id",
+		where:   "parent_id IS NOT NULL AND parent_id NOT IN (SELECT id FROM list_item)",
+		repair:  "UPDATE list_item SET parent_id = NULL WHERE ",
+		fix:     "moved to the top level",
+	},
+	{
+		problem: "item %s is below item %s of another list",
+		table:   "list_item",
+		columns: "id, parent_id",
+		where:   "parent_id IN (SELECT p.id FROM list_item AS p WHERE p.list_id <> list_item.list_id)",
+		repair:  "UPDATE list_item SET parent_id = NULL WHERE ",
+		fix:     "moved to the top level",
+	},
+	{
+		problem: "member %[2]s belongs to missing list %[1]s",
+		table:   "list_member",
+		columns: "list_id, user_id",
+		where:   "list_id NOT IN (SELECT id FROM list)",
+		repair:  "DELETE FROM list_member WHERE ",
+		fix:     "removed",
+	},
+	{
+		problem: "member of list %s is missing user %s",
+		table:   "list_member",
+		columns: "list_id, user_id",
+		where:   "user_id NOT IN (SELECT id FROM users)",
+		repair:  "DELETE FROM list_member WHERE ",
+		fix:     "removed",
+	},
+	{
+		problem: "a session belongs to missing user %[2]s",
+		table:   "session",
+		columns: "token_hash, user_id",
+		where:   "user_id NOT IN (SELECT id FROM users)",
+		repair:  "DELETE FROM session WHERE ",
+		fix:     "removed",
+	},
+	{
+		problem: "synced operation %[2]s belongs to missing user %[1]s",
+		table:   "sync_operation",
+		columns: "user_id, id",
+		where:   "user_id NOT IN (SELECT id FROM users)",
+		repair:  "DELETE FROM sync_operation WHERE ",
+		fix:     "removed",
+	},
+}
+
+// find returns a description of every orphan.
+func (c orphanCheck) find(ctx context.Context, tx *sqlTx) ([]string, error) {
+	rows, err := tx.QueryContext(ctx, "SELECT "+c.columns+" FROM "+c.table+" WHERE "+c.where)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var problems []string
+	for rows.Next() {
+		var a, b string
+		err = rows.Scan(&a, &b)
+		if err != nil {
+			return nil, err
+		}
+		problems = append(problems, fmt.Sprintf(c.problem, a, b))
+	}
+	return problems, rows.Err()
+}
+
+// findOrphans returns a description of every orphan.
+func findOrphans(ctx context.Context, tx *sqlTx) ([]string, error) {
+	var problems []string
+	for _, c := range orphanChecks {
+		found, err := c.find(ctx, tx)
+		if err != nil {
+			return nil, err
+		}
+		problems = append(problems, found...)
+	}
+	return problems, nil
+}
+
+// repairOrphans removes the orphans found by checks, or moves orphaned items to
+// the top level of their list, and returns what it repaired.
+func repairOrphans(ctx context.Context, tx *sqlTx, checks []orphanCheck) ([]string, error) {
+	var repaired []string
+	for _, c := range checks {
+		found, err := c.find(ctx, tx)
+		if err != nil {
+			return nil, err
+		}
+		if len(found) == 0 {
+			continue
+		}
+		_, err = tx.ExecContext(ctx, c.repair+c.where)
+		if err != nil {
+			return nil, err
+		}
+		for _, problem := range found {
+			repaired = append(repaired, problem+": "+c.fix)
+		}
+	}
+	return repaired, nil
+}
+
+// requireLatest refuses databases that have not been migrated to the latest
+// version, which Check and Repair need.
+func (d *DB) requireLatest(ctx context.Context) error {
+	version, err := d.SchemaVersion(ctx)
+	if err != nil {
+		return err
+	}
+	if version != LatestVersion() {
+		return fmt.Errorf("database is at version %d, migrate it to version %d first", version, LatestVersion())
+	}
+	return nil
+}
+
+// Check verifies the integrity of the database and returns a description of
+// every problem found, which is empty if there are none.
+func (d *DB) Check(ctx context.Context) ([]string, error) {
+	err := d.requireLatest(ctx)
+	if err != nil {
+		return nil, err
+	}
+	tx, err := d.db.BeginTx(ctx, &sql.TxOptions{
+		Isolation: sql.LevelSerializable,
+		ReadOnly:  true,
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	var problems []string
+	if tx.dialect == sqlite {
+		problems, err = checkSQLite(ctx, tx)
+		if err != nil {
+			return nil, err
+		}
+	}
+	orphans, err := findOrphans(ctx, tx)
+	if err != nil {
+		return nil, err
+	}
+	unclaimed, err := findUnclaimedLists(ctx, tx)
+	if err != nil {
+		return nil, err
+	}
+	return append(append(problems, orphans...), unclaimed...), nil
+}
+
+// findUnclaimedLists describes the lists still owned by the name of someone
+// who had no account when owners became users.
+func findUnclaimedLists(ctx context.Context, tx *sqlTx) ([]string, error) {
+	rows, err := tx.QueryContext(ctx, "SELECT id, unclaimed_owner FROM list WHERE unclaimed_owner IS NOT NULL ORDER BY id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var problems []string
+	for rows.Next() {
+		var id, owner string
+		err = rows.Scan(&id, &owner)
+		if err != nil {
+			return nil, err
+		}
+		problems = append(problems, fmt.Sprintf("list %s has no owner until %q registers", id, owner))
+	}
+	return problems, rows.Err()
+}
+
+// claimLists hands the unclaimed lists over to the users registered under the
+// names that owned them, and returns which it handed over.
+func claimLists(ctx context.Context, tx *sqlTx) ([]string, error) {
+	rows, err := tx.QueryContext(ctx, "SELECT l.id, u.id, u.name FROM list AS l JOIN users AS u ON u.name = l.unclaimed_owner ORDER BY l.id")
+	if err != nil {
+		return nil, err
+	}
+	type claim struct {
+		list, user uuid.UUID
+		name       string
+	}
+	var claims []claim
+	for rows.Next() {
+		var c claim
+		err = rows.Scan(&c.list, &c.user, &c.name)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		claims = append(claims, c)
+	}
+	rows.Close()
+	err = rows.Err()
+	if err != nil {
+		return nil, err
+	}
+	var claimed []string
+	for _, c := range claims {
+		_, err = tx.ExecContext(ctx, "UPDATE list SET owner_id = ?, unclaimed_owner = NULL WHERE id = ?", c.user, c.list)
+		if err != nil {
+			return nil, err
+		}
+		claimed = append(claimed, fmt.Sprintf("list %s handed over to user %q", c.list, c.name))
+	}
+	return claimed, nil
+}
+
+// checkSQLite runs the integrity and foreign key checks of SQLite.
+func checkSQLite(ctx context.Context, tx *sqlTx) ([]string, error) {
+	rows, err := tx.QueryContext(ctx, "PRAGMA integrity_check")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var problems []string
+	for rows.Next() {
+		var problem string
+		err = rows.Scan(&problem)
+		if err != nil {
+			return nil, err
+		}
+		if problem != "ok" {
+			problems = append(problems, problem)
+		}
+	}
+	err = rows.Err()
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err = tx.QueryContext(ctx, "PRAGMA foreign_key_check")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var table, parent string
+		var rowid sql.NullInt64
+		var key int
+		err = rows.Scan(&table, &rowid, &parent, &key)
+		if err != nil {
+			return nil, err
+		}
+		problems = append(problems, fmt.Sprintf("row %d of %s refers to a missing row of %s", rowid.Int64, table, parent))
+	}
+	return problems, rows.Err()
+}
+
+// Repair removes orphaned records, or moves orphaned items to the top level
+// of their list, hands unclaimed lists over to the users who registered under
+// the names that owned them, and returns what it repaired.
+func (d *DB) Repair(ctx context.Context) ([]string, error) {
+	err := d.requireLatest(ctx)
+	if err != nil {
+		return nil, err
+	}
+	tx, err := d.db.BeginTx(ctx, &sql.TxOptions{
+		Isolation: sql.LevelSerializable,
+		ReadOnly:  false,
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	repaired, err := repairOrphans(ctx, tx, orphanChecks)
+	if err != nil {
+		return nil, err
+	}
+	claimed, err := claimLists(ctx, tx)
+	if err != nil {
+		return nil, err
+	}
+	repaired = append(repaired, claimed...)
+	// Removed items are no longer searched
+	err = removeOrphanDocuments(ctx, tx)
+	if err != nil {
+		return nil, err
+	}
+	err = tx.Commit()
+	if err != nil {
+		return nil, err
+	}
+	return repaired, nil
+}
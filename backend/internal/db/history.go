@@ -0,0 +1,430 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+	"todolist/internal/conv"
+
+	"github.com/gofrs/uuid"
+)
+
+type authorKey struct{}
+
+type undoKey struct{}
+
+// WithAuthor returns a context in which changes are recorded as made by a
+// user. Changes made in other contexts are recorded without an author.
+func WithAuthor(ctx context.Context, userId uuid.UUID) context.Context {
+	return context.WithValue(ctx, authorKey{}, userId)
+}
+
+func authorOf(ctx context.Context) *uuid.UUID {
+	id, ok := ctx.Value(authorKey{}).(uuid.UUID)
+	if !ok {
+		return nil
+	}
+	return &id
+}
+
+// undoing returns a context in which changes are recorded as undoing a
+// revision.
+func undoing(ctx context.Context, id int64) context.Context {
+	return context.WithValue(ctx, undoKey{}, id)
+}
+
+func undoneBy(ctx context.Context) *int64 {
+	id, ok := ctx.Value(undoKey{}).(int64)
+	if !ok {
+		return nil
+	}
+	return &id
+}
+
+// itemRevision returns the revision of a change to an item of a list, which
+// the item was moved to from another list if from is not nil.
+func itemRevision(ctx context.Context, action string, listId uuid.UUID, from *uuid.UUID, before *TodoItem, after *TodoItem) (Revision, error) {
+	rev := newRevision(ctx, action, listId)
+	rev.FromList = from
+	var err error
+	if before != nil {
+		rev.Item = clone(before.ID)
+		rev.Before, err = encodeState(cloneItem(*before))
+		if err != nil {
+			return Revision{}, err
+		}
+	}
+	if after != nil {
+		rev.Item = clone(after.ID)
+		rev.After, err = encodeState(cloneItem(*after))
+		if err != nil {
+			return Revision{}, err
+		}
+	}
+	return rev, nil
+}
+
+// listRevision returns the revision of a change to a list.
+func listRevision(ctx context.Context, action string, listId uuid.UUID, before *TodoList, after *TodoList) (Revision, error) {
+	rev := newRevision(ctx, action, listId)
+	var err error
+	if before != nil {
+		rev.Before, err = encodeState(cloneList(*before))
+		if err != nil {
+			return Revision{}, err
+		}
+	}
+	if after != nil {
+		rev.After, err = encodeState(cloneList(*after))
+		if err != nil {
+			return Revision{}, err
+		}
+	}
+	return rev, nil
+}
+
+func newRevision(ctx context.Context, action string, listId uuid.UUID) Revision {
+	return Revision{
+		List:      &listId,
+		Action:    &action,
+		AuthorID:  authorOf(ctx),
+		CreatedAt: conv.Pointer(time.Now().UTC()),
+		Undoes:    undoneBy(ctx),
+	}
+}
+
+func encodeState(v any) (*string, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	return conv.Pointer(string(data)), nil
+}
+
+func decodeState[T any](data *string) (*T, error) {
+	if data == nil {
+		return nil, nil
+	}
+	var v T
+	err := json.Unmarshal([]byte(*data), &v)
+	if err != nil {
+		return nil, err
+	}
+	return &v, nil
+}
+
+// Items returns the item of a revision as it was before and after the
+// change, without its children.
+func (r Revision) Items() (before *TodoItem, after *TodoItem, err error) {
+	before, err = decodeState[TodoItem](r.Before)
+	if err != nil {
+		return nil, nil, err
+	}
+	after, err = decodeState[TodoItem](r.After)
+	if err != nil {
+		return nil, nil, err
+	}
+	return before, after, nil
+}
+
+// Lists returns the list of a revision as it was before and after the
+// change, without its items.
+func (r Revision) Lists() (before *TodoList, after *TodoList, err error) {
+	before, err = decodeState[TodoList](r.Before)
+	if err != nil {
+		return nil, nil, err
+	}
+	after, err = decodeState[TodoList](r.After)
+	if err != nil {
+		return nil, nil, err
+	}
+	return before, after, nil
+}
+
+// revert returns the value a field is reverted to by undoing a change from
+// before to after. A field the change did not touch keeps its current value,
+// and conflict is set if the field has been changed again since.
+func revert[T comparable](before *T, after *T, current *T, conflict *bool) *T {
+	if equal(before, after) {
+		return current
+	}
+	if !equal(current, after) {
+		*conflict = true
+	}
+	return before
+}
+
+func equal[T comparable](a *T, b *T) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return *a == *b
+}
+
+// revertItem returns the update that undoes a change of an item from before
+// to after. It returns ErrConflict if a changed field no longer has the value
+// the change gave it.
+func revertItem(before TodoItem, after TodoItem, current TodoItem) (TodoItem, error) {
+	var conflict bool
+	todo := TodoItem{
+		ID:            current.ID,
+		Text:          revert(before.Text, after.Text, current.Text, &conflict),
+		Marked:        revert(before.Marked, after.Marked, current.Marked, &conflict),
+		Kind:          revert(before.Kind, after.Kind, current.Kind, &conflict),
+		Attributes:    revert(before.Attributes, after.Attributes, current.Attributes, &conflict),
+		Description:   revert(before.Description, after.Description, current.Description, &conflict),
+		PriceAmount:   revert(before.PriceAmount, after.PriceAmount, current.PriceAmount, &conflict),
+		PriceCurrency: revert(before.PriceCurrency, after.PriceCurrency, current.PriceCurrency, &conflict),
+		CompletedByID: before.CompletedByID,
+	}
+	if conflict {
+		return TodoItem{}, fmt.Errorf("%w: item %s has been changed since", ErrConflict, *current.ID)
+	}
+	if todo.Description == nil {
+		todo.Description = conv.Pointer("")
+	}
+	return todo, nil
+}
+
+// revertMove returns the move that takes an item from the list it is in back
+// to where it was before a move, ahead of the first sibling that followed it
+// there. from is the list the item was moved from.
+func revertMove(listId uuid.UUID, from uuid.UUID, before TodoItem, after TodoItem, current TodoItem, siblings []sibling) (Move, error) {
+	if !equal(current.Parent, after.Parent) {
+		return Move{}, fmt.Errorf("%w: item %s has been moved since", ErrConflict, *current.ID)
+	}
+	move := Move{Parent: before.Parent}
+	if from != listId {
+		move.List = &from
+	}
+	for _, s := range siblings {
+		if s.id != *current.ID && s.position > *before.Position {
+			move.Before = &s.id
+			break
+		}
+	}
+	return move, nil
+}
+
+// revisionColumns are the revision columns, aliased as r, that scanRevision
+// reads.
+const revisionColumns = "r.id, r.list_id, r.from_list_id, r.item_id, r.action, r.author_id, (SELECT a.name FROM users AS a WHERE a.id = r.author_id), r.created_at, r.undoes, r.before_data, r.after_data"
+
+// scanRevision returns the scan destinations matching revisionColumns.
+func scanRevision(rev *Revision) []any {
+	return []any{&rev.ID, &rev.List, &rev.FromList, &rev.Item, &rev.Action, &rev.AuthorID, &rev.Author, &rev.CreatedAt, &rev.Undoes, &rev.Before, &rev.After}
+}
+
+func insertRevision(ctx context.Context, tx *sqlTx, rev Revision) error {
+	_, err := tx.ExecContext(ctx, "INSERT INTO revision (list_id, from_list_id, item_id, action, author_id, created_at, undoes, before_data, after_data) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)",
+		rev.List, rev.FromList, rev.Item, rev.Action, rev.AuthorID, rev.CreatedAt, rev.Undoes, rev.Before, rev.After)
+	return err
+}
+
+// recordItem records a change to an item of a list, given as the item before
+// and after it, without children.
+func recordItem(ctx context.Context, tx *sqlTx, action string, listId uuid.UUID, from *uuid.UUID, before *TodoItem, after *TodoItem) error {
+	rev, err := itemRevision(ctx, action, listId, from, before, after)
+	if err != nil {
+		return err
+	}
+	return insertRevision(ctx, tx, rev)
+}
+
+// recordList records a change to a list, given as the list before and after
+// it, without items.
+func recordList(ctx context.Context, tx *sqlTx, action string, listId uuid.UUID, before *TodoList, after *TodoList) error {
+	rev, err := listRevision(ctx, action, listId, before, after)
+	if err != nil {
+		return err
+	}
+	return insertRevision(ctx, tx, rev)
+}
+
+// getList returns a list, even if it is in the trash, without its items.
+func getList(ctx context.Context, tx *sqlTx, id uuid.UUID) (*TodoList, error) {
+	var list TodoList
+	err := tx.QueryRowContext(ctx, "SELECT "+listColumns+" FROM list AS l WHERE l.id = ?", id).Scan(scanList(&list)...)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &list, nil
+}
+
+// GetListHistory returns the revisions of a list and of the items in it,
+// including the moves of items away from it, most recent first.
+func (d *DB) GetListHistory(ctx context.Context, listId uuid.UUID) ([]Revision, error) {
+	return d.getRevisions(ctx, "WHERE r.list_id = ? OR r.from_list_id = ?", listId, listId)
+}
+
+// GetItemHistory returns the revisions of an item made in a list, or when it
+// was moved to or from the list, most recent first.
+func (d *DB) GetItemHistory(ctx context.Context, listId uuid.UUID, itemId uuid.UUID) ([]Revision, error) {
+	return d.getRevisions(ctx, "WHERE r.item_id = ? AND (r.list_id = ? OR r.from_list_id = ?)", itemId, listId, listId)
+}
+
+func (d *DB) getRevisions(ctx context.Context, where string, args ...any) ([]Revision, error) {
+	tx, err := d.db.BeginTx(ctx, &sql.TxOptions{
+		Isolation: sql.LevelSerializable,
+		ReadOnly:  true,
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	rows, err := tx.QueryContext(ctx, "SELECT "+revisionColumns+" FROM revision AS r "+where+" ORDER BY r.id DESC", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	revisions := make([]Revision, 0)
+	for rows.Next() {
+		var rev Revision
+		err = rows.Scan(scanRevision(&rev)...)
+		if err != nil {
+			return nil, err
+		}
+		revisions = append(revisions, rev)
+	}
+	return revisions, rows.Err()
+}
+
+// PurgeHistory removes the revisions made before a point in time and returns
+// how many were removed. They can no longer be undone.
+func (d *DB) PurgeHistory(ctx context.Context, before time.Time) (int64, error) {
+	result, err := d.db.ExecContext(ctx, "DELETE FROM revision WHERE created_at < ?", before.UTC())
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// GetRevision returns a single revision.
+func (d *DB) GetRevision(ctx context.Context, id int64) (*Revision, error) {
+	tx, err := d.db.BeginTx(ctx, &sql.TxOptions{
+		Isolation: sql.LevelSerializable,
+		ReadOnly:  true,
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	return getRevision(ctx, tx, "WHERE r.id = ?", id)
+}
+
+func getRevision(ctx context.Context, tx *sqlTx, where string, args ...any) (*Revision, error) {
+	var rev Revision
+	err := tx.QueryRowContext(ctx, "SELECT "+revisionColumns+" FROM revision AS r "+where+" ORDER BY r.id DESC LIMIT 1", args...).Scan(scanRevision(&rev)...)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &rev, nil
+}
+
+// UndoRevision reverts the change of a revision and returns the revision of
+// the change that reverted it. It returns ErrConflict if the revision has
+// been undone already or the list or item has since changed in a way that
+// prevents reverting it, and for removals of lists, which are restored from
+// the trash instead.
+func (d *DB) UndoRevision(ctx context.Context, id int64) (*Revision, error) {
+	tx, err := d.db.BeginTx(ctx, &sql.TxOptions{
+		Isolation: sql.LevelSerializable,
+		ReadOnly:  false,
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	rev, err := getRevision(ctx, tx, "WHERE r.id = ?", id)
+	if err != nil {
+		return nil, err
+	}
+	var undone bool
+	err = tx.QueryRowContext(ctx, "SELECT EXISTS (SELECT 1 FROM revision WHERE undoes = ?)", id).Scan(&undone)
+	if err != nil {
+		return nil, err
+	}
+	if undone {
+		return nil, fmt.Errorf("%w: revision %d has been undone already", ErrConflict, id)
+	}
+	err = undoRevision(undoing(ctx, id), tx, *rev)
+	if errors.Is(err, ErrNotFound) || errors.Is(err, ErrVersionMismatch) {
+		return nil, fmt.Errorf("%w: revision %d can no longer be undone", ErrConflict, id)
+	}
+	if err != nil {
+		return nil, err
+	}
+	undo, err := getRevision(ctx, tx, "WHERE r.undoes = ?", id)
+	if err != nil {
+		return nil, err
+	}
+	err = tx.Commit()
+	if err != nil {
+		return nil, err
+	}
+	return undo, nil
+}
+
+// errListRemoval is returned for undoing the removal of a list. Its history
+// is only reachable while the list is not in the trash.
+var errListRemoval = fmt.Errorf("%w: removed lists are restored from the trash", ErrConflict)
+
+func undoRevision(ctx context.Context, tx *sqlTx, rev Revision) error {
+	switch *rev.Action {
+	case RevisionAddList, RevisionRestoreList:
+		return removeTodoList(ctx, tx, *rev.List, nil)
+	case RevisionRemoveList:
+		return errListRemoval
+	case RevisionFreezeList, RevisionUnfreezeList:
+		return setListFrozen(ctx, tx, *rev.List, *rev.Action == RevisionUnfreezeList)
+	case RevisionAddItem, RevisionRestoreItem:
+		_, err := deleteTodoItem(ctx, tx, *rev.List, *rev.Item, nil)
+		return err
+	case RevisionRemoveItem:
+		_, err := restoreTodoItem(ctx, tx, *rev.List, *rev.Item)
+		return err
+	}
+
+	before, after, err := rev.Items()
+	if err != nil {
+		return err
+	}
+	current, err := getTodoItem(ctx, tx, *rev.List, *rev.Item)
+	if err != nil {
+		return err
+	}
+	switch *rev.Action {
+	case RevisionUpdateItem, RevisionUpdateText:
+		todo, err := revertItem(*before, *after, *current)
+		if err != nil {
+			return err
+		}
+		_, err = updateTodoItem(ctx, tx, *rev.List, todo)
+		return err
+	case RevisionMoveItem:
+		from := *rev.List
+		if rev.FromList != nil {
+			from = *rev.FromList
+		}
+		siblings, err := getSiblings(ctx, tx, from, before.Parent)
+		if err != nil {
+			return err
+		}
+		move, err := revertMove(*rev.List, from, *before, *after, *current, siblings)
+		if err != nil {
+			return err
+		}
+		_, _, err = moveTodoItem(ctx, tx, *rev.List, *rev.Item, move)
+		return err
+	}
+	return fmt.Errorf("unknown revision action %q", *rev.Action)
+}
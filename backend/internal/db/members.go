@@ -0,0 +1,173 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+
+	"github.com/gofrs/uuid"
+)
+
+// GetListAccess returns the role of a user in a list, or an empty role if the
+// list has not been shared with the user, and whether the list is frozen.
+func (d *DB) GetListAccess(ctx context.Context, listId uuid.UUID, userId uuid.UUID) (role string, frozen bool, err error) {
+	var r sql.NullString
+	err = d.db.QueryRowContext(ctx, `SELECT CASE WHEN l.owner_id = ? THEN ? ELSE m.role END, l.frozen FROM list AS l
+   LEFT JOIN list_member AS m ON m.list_id = l.id AND m.user_id = ?
+   WHERE l.id = ? AND l.deleted_at IS NULL`, userId, RoleOwner, userId, listId).Scan(&r, &frozen)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", false, ErrNotFound
+	}
+	if err != nil {
+		return "", false, err
+	}
+	return r.String, frozen, nil
+}
+
+// GetListMembers returns the users a list has been shared with.
+func (d *DB) GetListMembers(ctx context.Context, listId uuid.UUID) ([]Member, error) {
+	rows, err := d.db.QueryContext(ctx, `SELECT m.list_id, m.user_id, u.name, m.role FROM list_member AS m
+   JOIN users AS u ON u.id = m.user_id
+   WHERE m.list_id = ? ORDER BY u.name`, listId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	members := make([]Member, 0)
+	for rows.Next() {
+		var member Member
+		err = rows.Scan(&member.List, &member.User, &member.Name, &member.Role)
+		if err != nil {
+			return nil, err
+		}
+		members = append(members, member)
+	}
+	err = rows.Err()
+	if err != nil {
+		return nil, err
+	}
+	return members, nil
+}
+
+// GetMemberLists returns the lists a user owns or has been shared with.
+func (d *DB) GetMemberLists(ctx context.Context, userId uuid.UUID) ([]uuid.UUID, error) {
+	rows, err := d.db.QueryContext(ctx, `SELECT l.id FROM list AS l
+   LEFT JOIN list_member AS m ON m.list_id = l.id AND m.user_id = ?
+   WHERE (l.owner_id = ? OR m.user_id IS NOT NULL) AND l.deleted_at IS NULL
+   ORDER BY l.position, l.id`, userId, userId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	lists := make([]uuid.UUID, 0)
+	for rows.Next() {
+		var id uuid.UUID
+		err = rows.Scan(&id)
+		if err != nil {
+			return nil, err
+		}
+		lists = append(lists, id)
+	}
+	err = rows.Err()
+	if err != nil {
+		return nil, err
+	}
+	return lists, nil
+}
+
+// SetListMember shares a list with a user, or changes the role of a user the
+// list is already shared with. It returns the member as stored.
+func (d *DB) SetListMember(ctx context.Context, member Member) (*Member, error) {
+	tx, err := d.db.BeginTx(ctx, &sql.TxOptions{
+		Isolation: sql.LevelSerializable,
+		ReadOnly:  false,
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	var owner *uuid.UUID
+	err = tx.QueryRowContext(ctx, "SELECT owner_id FROM list WHERE id = ? AND deleted_at IS NULL", *member.List).Scan(&owner)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	var name string
+	err = tx.QueryRowContext(ctx, "SELECT name FROM users WHERE id = ?", *member.User).Scan(&name)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	if owner != nil && *owner == *member.User {
+		// The owner always has every permission
+		return nil, ErrConflict
+	}
+	_, err = tx.ExecContext(ctx, `INSERT INTO list_member (list_id, user_id, role) VALUES (?, ?, ?)
+   ON CONFLICT (list_id, user_id) DO UPDATE SET role = excluded.role`, *member.List, *member.User, *member.Role)
+	if err != nil {
+		return nil, err
+	}
+	err = tx.Commit()
+	if err != nil {
+		return nil, err
+	}
+	member.Name = &name
+	return &member, nil
+}
+
+// UpdateListMember changes the role of a user a list is shared with. It
+// returns ErrNotFound if the list has not been shared with the user, and the
+// member as stored otherwise.
+func (d *DB) UpdateListMember(ctx context.Context, member Member) (*Member, error) {
+	tx, err := d.db.BeginTx(ctx, &sql.TxOptions{
+		Isolation: sql.LevelSerializable,
+		ReadOnly:  false,
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	result, err := tx.ExecContext(ctx, `UPDATE list_member SET role = ?
+   WHERE list_id = ? AND user_id = ? AND list_id IN (SELECT id FROM list WHERE deleted_at IS NULL)`, *member.Role, *member.List, *member.User)
+	if err != nil {
+		return nil, err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return nil, err
+	}
+	if n == 0 {
+		return nil, ErrNotFound
+	}
+	var name string
+	err = tx.QueryRowContext(ctx, "SELECT name FROM users WHERE id = ?", *member.User).Scan(&name)
+	if err != nil {
+		return nil, err
+	}
+	err = tx.Commit()
+	if err != nil {
+		return nil, err
+	}
+	member.Name = &name
+	return &member, nil
+}
+
+// RemoveListMember stops sharing a list with a user.
+func (d *DB) RemoveListMember(ctx context.Context, listId uuid.UUID, userId uuid.UUID) error {
+	result, err := d.db.ExecContext(ctx, "DELETE FROM list_member WHERE list_id = ? AND user_id = ?", listId, userId)
+	if err != nil {
+		return err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
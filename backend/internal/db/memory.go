@@ -0,0 +1,1402 @@
+package db
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"sync"
+	"time"
+	"todolist/internal/conv"
+
+	"github.com/gofrs/uuid"
+)
+
+// Memory is the Store kept in memory, which is lost when the process exits.
+// It is meant for tests and for trying out todoserv.
+type Memory struct {
+	mu sync.Mutex
+
+	// Lists and items are only changed by replacing them, so that copies of
+	// the maps are snapshots that Sync can restore.
+	lists      map[uuid.UUID]TodoList
+	items      map[uuid.UUID]memoryItem
+	members    map[memberKey]string
+	users      map[uuid.UUID]User
+	sessions   map[string]Session
+	operations map[operationKey]time.Time
+
+	events  []Event
+	seq     int64
+	horizon int64
+
+	revisions   []Revision
+	revisionSeq int64
+}
+
+// memoryItem is an item of a list, without its children.
+type memoryItem struct {
+	TodoItem
+	list uuid.UUID
+}
+
+type memberKey struct {
+	list uuid.UUID
+	user uuid.UUID
+}
+
+type operationKey struct {
+	user uuid.UUID
+	id   string
+}
+
+func NewMemory() *Memory {
+	return &Memory{
+		lists:      make(map[uuid.UUID]TodoList),
+		items:      make(map[uuid.UUID]memoryItem),
+		members:    make(map[memberKey]string),
+		users:      make(map[uuid.UUID]User),
+		sessions:   make(map[string]Session),
+		operations: make(map[operationKey]time.Time),
+	}
+}
+
+// memoryTxKey is the context key marking the calls made by the function
+// given to Atomically, which already hold the lock of the store.
+type memoryTxKey struct {
+	m *Memory
+}
+
+// lock locks the store, unless the context is that of a call to Atomically,
+// and returns the function that unlocks it.
+func (m *Memory) lock(ctx context.Context) func() {
+	if ctx.Value(memoryTxKey{m}) != nil {
+		return func() {}
+	}
+	m.mu.Lock()
+	return m.mu.Unlock
+}
+
+// Atomically calls fn while holding the lock of the store, which the methods
+// of the store called with the context fn is given do not wait for. Nothing
+// fn changes is kept if it returns an error.
+func (m *Memory) Atomically(ctx context.Context, fn func(ctx context.Context) error) error {
+	defer m.lock(ctx)()
+	lists, items, members := maps.Clone(m.lists), maps.Clone(m.items), maps.Clone(m.members)
+	users, sessions, operations := maps.Clone(m.users), maps.Clone(m.sessions), maps.Clone(m.operations)
+	events, seq, horizon := slices.Clone(m.events), m.seq, m.horizon
+	revisions, revisionSeq := slices.Clone(m.revisions), m.revisionSeq
+	err := fn(context.WithValue(ctx, memoryTxKey{m}, true))
+	if err != nil {
+		m.lists, m.items, m.members = lists, items, members
+		m.users, m.sessions, m.operations = users, sessions, operations
+		m.events, m.seq, m.horizon = events, seq, horizon
+		m.revisions, m.revisionSeq = revisions, revisionSeq
+		return err
+	}
+	return nil
+}
+
+// clone returns a pointer to a copy of the value p points to, or nil.
+func clone[T any](p *T) *T {
+	if p == nil {
+		return nil
+	}
+	v := *p
+	return &v
+}
+
+// cloneList copies a list, without its items.
+func cloneList(list TodoList) TodoList {
+	return TodoList{
+		ID:        clone(list.ID),
+		OwnerID:   clone(list.OwnerID),
+		Owner:     clone(list.Owner),
+		Name:      clone(list.Name),
+		Frozen:    clone(list.Frozen),
+		Position:  clone(list.Position),
+		Version:   clone(list.Version),
+		DeletedAt: clone(list.DeletedAt),
+	}
+}
+
+// cloneItem copies an item, without its children.
+func cloneItem(item TodoItem) TodoItem {
+	return TodoItem{
+		ID:            clone(item.ID),
+		Parent:        clone(item.Parent),
+		Text:          clone(item.Text),
+		Marked:        clone(item.Marked),
+		Kind:          clone(item.Kind),
+		Attributes:    clone(item.Attributes),
+		Description:   clone(item.Description),
+		CompletedAt:   clone(item.CompletedAt),
+		CompletedByID: clone(item.CompletedByID),
+		CompletedBy:   clone(item.CompletedBy),
+		PriceAmount:   clone(item.PriceAmount),
+		PriceCurrency: clone(item.PriceCurrency),
+		Position:      clone(item.Position),
+		Version:       clone(item.Version),
+		DeletedAt:     clone(item.DeletedAt),
+		DeletedWith:   clone(item.DeletedWith),
+	}
+}
+
+func cloneEvent(event Event) Event {
+	return Event{
+		Seq:       clone(event.Seq),
+		List:      clone(event.List),
+		Type:      clone(event.Type),
+		Data:      clone(event.Data),
+		CreatedAt: clone(event.CreatedAt),
+	}
+}
+
+func cloneUser(user User) *User {
+	return &User{
+		ID:           clone(user.ID),
+		Name:         clone(user.Name),
+		PasswordHash: clone(user.PasswordHash),
+		CreatedAt:    clone(user.CreatedAt),
+	}
+}
+
+// compareIDs orders IDs the way the SQL databases do.
+func compareIDs(a uuid.UUID, b uuid.UUID) int {
+	return bytes.Compare(a[:], b[:])
+}
+
+func compareLists(a TodoList, b TodoList) int {
+	if *a.Position != *b.Position {
+		return cmp.Compare(*a.Position, *b.Position)
+	}
+	return compareIDs(*a.ID, *b.ID)
+}
+
+// compareItems orders siblings by their position.
+func compareItems(a TodoItem, b TodoItem) int {
+	if *a.Position != *b.Position {
+		return cmp.Compare(*a.Position, *b.Position)
+	}
+	return compareIDs(*a.ID, *b.ID)
+}
+
+// AddTodoList adds a list with its items. It returns ErrConflict if a list
+// with the same ID exists.
+func (m *Memory) AddTodoList(ctx context.Context, todo TodoList) error {
+	defer m.lock(ctx)()
+	_, exists := m.lists[*todo.ID]
+	if exists {
+		return fmt.Errorf("%w: list %s already exists", ErrConflict, *todo.ID)
+	}
+	var owner *string
+	if todo.OwnerID != nil {
+		user, ok := m.users[*todo.OwnerID]
+		if !ok {
+			return fmt.Errorf("%w: user %s", ErrNotFound, *todo.OwnerID)
+		}
+		owner = clone(user.Name)
+	}
+	var position int64
+	for _, list := range m.lists {
+		position = max(position, *list.Position)
+	}
+	items := maps.Clone(m.items)
+	err := m.insertTodoItems(*todo.ID, nil, todo.Items)
+	if err != nil {
+		m.items = items
+		return err
+	}
+	list := cloneList(todo)
+	list.Owner = owner
+	list.Frozen = conv.Pointer(todo.Frozen != nil && *todo.Frozen)
+	list.Position = conv.Pointer(position + positionGap)
+	list.Version = conv.Pointer(int64(1))
+	m.lists[*todo.ID] = list
+	return m.recordList(ctx, RevisionAddList, *todo.ID, nil, &list)
+}
+
+// insertTodoItem inserts an item after its last sibling.
+func (m *Memory) insertTodoItem(listId uuid.UUID, item TodoItem) error {
+	_, exists := m.items[*item.ID]
+	if exists {
+		return fmt.Errorf("%w: item %s already exists", ErrConflict, *item.ID)
+	}
+	stored := cloneItem(item)
+	if stored.Kind == nil {
+		stored.Kind = conv.Pointer("")
+	}
+	if stored.Description == nil {
+		stored.Description = conv.Pointer("")
+	}
+	stored.CompletedAt, stored.CompletedByID, stored.CompletedBy = nil, nil, nil
+	if item.Marked != nil && *item.Marked {
+		stored.CompletedAt = conv.Pointer(time.Now().UTC())
+		stored.CompletedByID, stored.CompletedBy = clone(item.CompletedByID), m.userName(item.CompletedByID)
+	}
+	siblings := m.siblings(listId, item.Parent)
+	position := int64(positionGap)
+	if len(siblings) > 0 {
+		position = siblings[len(siblings)-1].position + positionGap
+	}
+	stored.Position = &position
+	stored.Version = conv.Pointer(int64(1))
+	m.items[*item.ID] = memoryItem{TodoItem: stored, list: listId}
+	return nil
+}
+
+// insertTodoItems inserts items and, recursively, their children.
+func (m *Memory) insertTodoItems(listId uuid.UUID, parent *uuid.UUID, items []TodoItem) error {
+	for _, item := range items {
+		item.Parent = parent
+		err := m.insertTodoItem(listId, item)
+		if err != nil {
+			return err
+		}
+		err = m.insertTodoItems(listId, item.ID, item.Children)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *Memory) GetTodoLists(ctx context.Context) ([]*TodoList, error) {
+	defer m.lock(ctx)()
+	stored := make([]TodoList, 0, len(m.lists))
+	for _, list := range m.lists {
+		if list.DeletedAt == nil {
+			stored = append(stored, list)
+		}
+	}
+	slices.SortFunc(stored, compareLists)
+	var lists []*TodoList
+	for _, list := range stored {
+		lists = append(lists, m.todoList(list))
+	}
+	return lists, nil
+}
+
+// GetTodoList returns a single list with its items.
+func (m *Memory) GetTodoList(ctx context.Context, id uuid.UUID) (*TodoList, error) {
+	defer m.lock(ctx)()
+	list, ok := m.list(id)
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return m.todoList(list), nil
+}
+
+// list returns a list that is not in the trash.
+func (m *Memory) list(id uuid.UUID) (TodoList, bool) {
+	list, ok := m.lists[id]
+	if !ok || list.DeletedAt != nil {
+		return TodoList{}, false
+	}
+	return list, true
+}
+
+// userName returns the name of a user, or nil if there is no such user.
+func (m *Memory) userName(id *uuid.UUID) *string {
+	if id == nil {
+		return nil
+	}
+	return clone(m.users[*id].Name)
+}
+
+// ownedBy reports whether a list is owned by a user.
+func ownedBy(list TodoList, userId uuid.UUID) bool {
+	return list.OwnerID != nil && *list.OwnerID == userId
+}
+
+// todoList returns a copy of a list with its items that are not in the trash.
+func (m *Memory) todoList(list TodoList) *TodoList {
+	var stored []memoryItem
+	for _, item := range m.items {
+		if item.list == *list.ID && item.DeletedAt == nil {
+			stored = append(stored, item)
+		}
+	}
+	slices.SortFunc(stored, func(a memoryItem, b memoryItem) int {
+		return compareItems(a.TodoItem, b.TodoItem)
+	})
+	items := make([]TodoItem, len(stored))
+	for i := range stored {
+		items[i] = cloneItem(stored[i].TodoItem)
+	}
+	out := cloneList(list)
+	out.Items = buildTree(items)
+	return &out
+}
+
+// RemoveTodoList moves a list with its items and members to the trash, from
+// which RestoreTodoList brings it back until PurgeDeleted removes it. If
+// version is not nil, the list must still have that version.
+func (m *Memory) RemoveTodoList(ctx context.Context, id uuid.UUID, version *int64) error {
+	defer m.lock(ctx)()
+	return m.removeTodoList(ctx, id, version)
+}
+
+func (m *Memory) removeTodoList(ctx context.Context, id uuid.UUID, version *int64) error {
+	list, ok := m.list(id)
+	if !ok {
+		return ErrNotFound
+	}
+	if version != nil && *version != *list.Version {
+		return ErrVersionMismatch
+	}
+	before := list
+	list.DeletedAt = conv.Pointer(time.Now().UTC())
+	list.Version = conv.Pointer(*list.Version + 1)
+	m.lists[id] = list
+	return m.recordList(ctx, RevisionRemoveList, id, &before, nil)
+}
+
+// SetListFrozen freezes or unfreezes a list.
+func (m *Memory) SetListFrozen(ctx context.Context, id uuid.UUID, frozen bool) error {
+	defer m.lock(ctx)()
+	return m.setListFrozen(ctx, id, frozen)
+}
+
+func (m *Memory) setListFrozen(ctx context.Context, id uuid.UUID, frozen bool) error {
+	list, ok := m.list(id)
+	if !ok {
+		return ErrNotFound
+	}
+	before := list
+	list.Frozen = &frozen
+	list.Version = conv.Pointer(*list.Version + 1)
+	m.lists[id] = list
+	action := RevisionUnfreezeList
+	if frozen {
+		action = RevisionFreezeList
+	}
+	return m.recordList(ctx, action, id, &before, &list)
+}
+
+// AddTodoItem adds an item to a list and returns the item as stored, without
+// its children. If the item has a parent, the parent must be an item of the
+// same list.
+func (m *Memory) AddTodoItem(ctx context.Context, listId uuid.UUID, todo TodoItem) (*TodoItem, error) {
+	defer m.lock(ctx)()
+	return m.addTodoItem(ctx, listId, todo)
+}
+
+func (m *Memory) addTodoItem(ctx context.Context, listId uuid.UUID, todo TodoItem) (*TodoItem, error) {
+	_, exists := m.items[*todo.ID]
+	if exists {
+		return nil, fmt.Errorf("%w: item %s already exists", ErrConflict, *todo.ID)
+	}
+	_, exists = m.list(listId)
+	if !exists {
+		return nil, fmt.Errorf("list %s: %w", listId, ErrNotFound)
+	}
+	if todo.Parent != nil {
+		_, err := m.getTodoItem(listId, *todo.Parent)
+		if err != nil {
+			return nil, fmt.Errorf("parent item %s: %w", *todo.Parent, err)
+		}
+	}
+	err := m.insertTodoItem(listId, todo)
+	if err != nil {
+		return nil, err
+	}
+	m.touchList(listId)
+	item, err := m.getTodoItem(listId, *todo.ID)
+	if err != nil {
+		return nil, err
+	}
+	return item, m.recordItem(ctx, RevisionAddItem, listId, nil, nil, item)
+}
+
+// UpdateTodoItem updates the text, mark, price and kind of an item of a list
+// and returns the item as stored, without its children. If the version of
+// todo is set, the item must still have that version.
+func (m *Memory) UpdateTodoItem(ctx context.Context, listId uuid.UUID, todo TodoItem) (*TodoItem, error) {
+	defer m.lock(ctx)()
+	return m.updateTodoItem(ctx, listId, todo)
+}
+
+func (m *Memory) updateTodoItem(ctx context.Context, listId uuid.UUID, todo TodoItem) (*TodoItem, error) {
+	item, err := m.item(listId, *todo.ID)
+	if err != nil {
+		return nil, err
+	}
+	before := cloneItem(item.TodoItem)
+	if todo.Version != nil && *todo.Version != *item.Version {
+		return nil, ErrVersionMismatch
+	}
+	// Completion is recorded when the item is marked and forgotten when it
+	// is unmarked
+	if *todo.Marked != *item.Marked {
+		item.CompletedAt, item.CompletedByID, item.CompletedBy = nil, nil, nil
+		if *todo.Marked {
+			item.CompletedAt = conv.Pointer(time.Now().UTC())
+			item.CompletedByID, item.CompletedBy = clone(todo.CompletedByID), m.userName(todo.CompletedByID)
+		}
+	}
+	item.Text = clone(todo.Text)
+	item.Marked = clone(todo.Marked)
+	item.PriceAmount = clone(todo.PriceAmount)
+	item.PriceCurrency = clone(todo.PriceCurrency)
+	item.Kind = conv.Pointer("")
+	if todo.Kind != nil {
+		item.Kind = clone(todo.Kind)
+	}
+	item.Attributes = clone(todo.Attributes)
+	if todo.Description != nil {
+		item.Description = clone(todo.Description)
+	}
+	item.Version = conv.Pointer(*item.Version + 1)
+	m.items[*todo.ID] = item
+	m.touchList(listId)
+	after, err := m.getTodoItem(listId, *todo.ID)
+	if err != nil {
+		return nil, err
+	}
+	return after, m.recordItem(ctx, RevisionUpdateItem, listId, nil, &before, after)
+}
+
+// UpdateItemText sets a text field of an item, such as "text", and returns
+// the item as stored, without its children. If version is not nil, the item
+// must still have that version.
+func (m *Memory) UpdateItemText(ctx context.Context, listId uuid.UUID, itemId uuid.UUID, field string, text string, version *int64) (*TodoItem, error) {
+	_, ok := textColumns[field]
+	if !ok {
+		return nil, fmt.Errorf("unknown text field %q", field)
+	}
+	defer m.lock(ctx)()
+	item, err := m.item(listId, itemId)
+	if err != nil {
+		return nil, err
+	}
+	if version != nil && *version != *item.Version {
+		return nil, ErrVersionMismatch
+	}
+	before := cloneItem(item.TodoItem)
+	switch field {
+	case "text":
+		item.Text = &text
+	case "description":
+		item.Description = &text
+	}
+	item.Version = conv.Pointer(*item.Version + 1)
+	m.items[itemId] = item
+	m.touchList(listId)
+	after, err := m.getTodoItem(listId, itemId)
+	if err != nil {
+		return nil, err
+	}
+	return after, m.recordItem(ctx, RevisionUpdateText, listId, nil, &before, after)
+}
+
+// DeleteTodoItem moves an item of a list together with all of its
+// descendants to the trash and returns the deleted item, without its
+// children. If version is not nil, the item must still have that version.
+func (m *Memory) DeleteTodoItem(ctx context.Context, listId uuid.UUID, itemId uuid.UUID, version *int64) (*TodoItem, error) {
+	defer m.lock(ctx)()
+	return m.deleteTodoItem(ctx, listId, itemId, version)
+}
+
+func (m *Memory) deleteTodoItem(ctx context.Context, listId uuid.UUID, itemId uuid.UUID, version *int64) (*TodoItem, error) {
+	item, err := m.getTodoItem(listId, itemId)
+	if err != nil {
+		return nil, err
+	}
+	if version != nil && *version != *item.Version {
+		return nil, ErrVersionMismatch
+	}
+	now := time.Now().UTC()
+	for _, id := range m.subtree(itemId) {
+		item := m.items[id]
+		if item.DeletedAt == nil {
+			item.DeletedAt, item.DeletedWith = &now, &itemId
+			m.items[id] = item
+		}
+	}
+	m.touchList(listId)
+	return item, m.recordItem(ctx, RevisionRemoveItem, listId, nil, item, nil)
+}
+
+// MoveTodoItem moves an item, together with its descendants, within its list
+// or to another list, and returns the item as it was before and after the
+// move, without its children. ErrConflict is returned when the item would
+// become its own descendant.
+func (m *Memory) MoveTodoItem(ctx context.Context, listId uuid.UUID, itemId uuid.UUID, to Move) (old *TodoItem, moved *TodoItem, err error) {
+	defer m.lock(ctx)()
+	return m.moveTodoItem(ctx, listId, itemId, to)
+}
+
+func (m *Memory) moveTodoItem(ctx context.Context, listId uuid.UUID, itemId uuid.UUID, to Move) (old *TodoItem, moved *TodoItem, err error) {
+	old, err = m.getTodoItem(listId, itemId)
+	if err != nil {
+		return nil, nil, err
+	}
+	if to.Version != nil && *to.Version != *old.Version {
+		return nil, nil, ErrVersionMismatch
+	}
+	target := listId
+	if to.List != nil {
+		target = *to.List
+		_, exists := m.list(target)
+		if !exists {
+			return nil, nil, ErrNotFound
+		}
+	}
+	if to.Parent != nil {
+		_, err = m.getTodoItem(target, *to.Parent)
+		if err != nil {
+			return nil, nil, err
+		}
+		for id := to.Parent; id != nil; {
+			if *id == itemId {
+				return nil, nil, fmt.Errorf("%w: item %s cannot be moved below itself", ErrConflict, itemId)
+			}
+			ancestor, ok := m.items[*id]
+			if !ok {
+				break
+			}
+			id = ancestor.Parent
+		}
+	}
+
+	siblings := slices.DeleteFunc(m.siblings(target, to.Parent), func(s sibling) bool {
+		return s.id == itemId
+	})
+	index := len(siblings)
+	if to.Before != nil || to.After != nil {
+		anchor := to.Before
+		if anchor == nil {
+			anchor = to.After
+		}
+		index = slices.IndexFunc(siblings, func(s sibling) bool {
+			return s.id == *anchor
+		})
+		if index < 0 {
+			return nil, nil, ErrNotFound
+		}
+		if to.Before == nil {
+			index++
+		}
+	}
+	position, err := placeBetween(siblings, index, func(id uuid.UUID, position int64) error {
+		item := m.items[id]
+		item.Position = &position
+		m.items[id] = item
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	item := m.items[itemId]
+	item.Parent = clone(to.Parent)
+	item.Position = &position
+	item.Version = conv.Pointer(*item.Version + 1)
+	m.items[itemId] = item
+	m.touchList(listId)
+	if target != listId {
+		for _, id := range m.subtree(itemId) {
+			item := m.items[id]
+			item.list = target
+			m.items[id] = item
+		}
+		m.touchList(target)
+	}
+	moved, err = m.getTodoItem(target, itemId)
+	if err != nil {
+		return nil, nil, err
+	}
+	var from *uuid.UUID
+	if target != listId {
+		from = &listId
+	}
+	return old, moved, m.recordItem(ctx, RevisionMoveItem, target, from, old, moved)
+}
+
+// touchList increments the version of a list after one of its items changed.
+func (m *Memory) touchList(listId uuid.UUID) {
+	list, ok := m.lists[listId]
+	if !ok {
+		return
+	}
+	list.Version = conv.Pointer(*list.Version + 1)
+	m.lists[listId] = list
+}
+
+// siblings returns the items below a parent, or the top level items of a
+// list if parent is nil, in order.
+func (m *Memory) siblings(listId uuid.UUID, parent *uuid.UUID) []sibling {
+	var siblings []sibling
+	for id, item := range m.items {
+		if item.list != listId || item.DeletedAt != nil || (item.Parent == nil) != (parent == nil) {
+			continue
+		}
+		if parent != nil && *item.Parent != *parent {
+			continue
+		}
+		siblings = append(siblings, sibling{id: id, position: *item.Position})
+	}
+	slices.SortFunc(siblings, func(a sibling, b sibling) int {
+		if a.position != b.position {
+			return cmp.Compare(a.position, b.position)
+		}
+		return compareIDs(a.id, b.id)
+	})
+	return siblings
+}
+
+// subtree returns the ID of an item and of all of its descendants.
+func (m *Memory) subtree(itemId uuid.UUID) []uuid.UUID {
+	ids := []uuid.UUID{itemId}
+	for i := 0; i < len(ids); i++ {
+		for id, item := range m.items {
+			if item.Parent != nil && *item.Parent == ids[i] {
+				ids = append(ids, id)
+			}
+		}
+	}
+	return ids
+}
+
+// item returns the stored item of a list that is not in the trash.
+func (m *Memory) item(listId uuid.UUID, itemId uuid.UUID) (memoryItem, error) {
+	item, ok := m.items[itemId]
+	if !ok || item.list != listId || item.DeletedAt != nil {
+		return memoryItem{}, ErrNotFound
+	}
+	return item, nil
+}
+
+// getTodoItem returns a copy of an item of a list, without its children.
+func (m *Memory) getTodoItem(listId uuid.UUID, itemId uuid.UUID) (*TodoItem, error) {
+	item, err := m.item(listId, itemId)
+	if err != nil {
+		return nil, err
+	}
+	out := cloneItem(item.TodoItem)
+	return &out, nil
+}
+
+// GetDeletedLists returns the lists in the trash that a user owns, most
+// recently deleted first, with the items they had when they were deleted.
+func (m *Memory) GetDeletedLists(ctx context.Context, userId uuid.UUID) ([]*TodoList, error) {
+	defer m.lock(ctx)()
+	var lists []*TodoList
+	var stored []TodoList
+	for _, list := range m.lists {
+		if list.DeletedAt != nil && ownedBy(list, userId) {
+			stored = append(stored, list)
+		}
+	}
+	slices.SortFunc(stored, compareLists)
+	for _, list := range stored {
+		lists = append(lists, m.todoList(list))
+	}
+	slices.SortStableFunc(lists, compareDeletedLists)
+	return lists, nil
+}
+
+// GetDeletedItems returns the items of a list that are in the trash, most
+// recently deleted first. Items are returned with the descendants that were
+// deleted together with them.
+func (m *Memory) GetDeletedItems(ctx context.Context, listId uuid.UUID) ([]TodoItem, error) {
+	defer m.lock(ctx)()
+	_, ok := m.list(listId)
+	if !ok {
+		return nil, ErrNotFound
+	}
+	var stored []memoryItem
+	for _, item := range m.items {
+		if item.list == listId && item.DeletedAt != nil {
+			stored = append(stored, item)
+		}
+	}
+	slices.SortFunc(stored, func(a memoryItem, b memoryItem) int {
+		if !a.DeletedAt.Equal(*b.DeletedAt) {
+			return b.DeletedAt.Compare(*a.DeletedAt)
+		}
+		return compareItems(a.TodoItem, b.TodoItem)
+	})
+	items := make([]TodoItem, len(stored))
+	for i := range stored {
+		items[i] = cloneItem(stored[i].TodoItem)
+	}
+	return buildTrash(items), nil
+}
+
+// RestoreTodoList takes a list out of the trash and returns it with its
+// items.
+func (m *Memory) RestoreTodoList(ctx context.Context, id uuid.UUID) (*TodoList, error) {
+	defer m.lock(ctx)()
+	return m.restoreTodoList(ctx, id)
+}
+
+func (m *Memory) restoreTodoList(ctx context.Context, id uuid.UUID) (*TodoList, error) {
+	list, ok := m.lists[id]
+	if !ok || list.DeletedAt == nil {
+		return nil, ErrNotFound
+	}
+	list.DeletedAt = nil
+	list.Version = conv.Pointer(*list.Version + 1)
+	m.lists[id] = list
+	return m.todoList(list), m.recordList(ctx, RevisionRestoreList, id, nil, &list)
+}
+
+// RestoreTodoItem takes an item of a list out of the trash, together with
+// the descendants that were deleted with it, and returns it as stored, with
+// its children. An item whose parent is still in the trash is restored at
+// the top level of the list.
+func (m *Memory) RestoreTodoItem(ctx context.Context, listId uuid.UUID, itemId uuid.UUID) (*TodoItem, error) {
+	defer m.lock(ctx)()
+	return m.restoreTodoItem(ctx, listId, itemId)
+}
+
+func (m *Memory) restoreTodoItem(ctx context.Context, listId uuid.UUID, itemId uuid.UUID) (*TodoItem, error) {
+	item, ok := m.items[itemId]
+	if !ok || item.list != listId || item.DeletedAt == nil {
+		return nil, ErrNotFound
+	}
+	_, ok = m.list(listId)
+	if !ok {
+		return nil, ErrNotFound
+	}
+	if item.Parent != nil {
+		_, err := m.item(listId, *item.Parent)
+		if err != nil {
+			siblings := m.siblings(listId, nil)
+			position := int64(positionGap)
+			if len(siblings) > 0 {
+				position = siblings[len(siblings)-1].position + positionGap
+			}
+			item.Parent = nil
+			item.Position = &position
+		}
+	}
+	// Descendants deleted before the item stay in the trash
+	for _, id := range m.subtree(itemId)[1:] {
+		descendant := m.items[id]
+		if descendant.DeletedWith != nil && *descendant.DeletedWith == *item.DeletedWith {
+			descendant.DeletedAt, descendant.DeletedWith = nil, nil
+			m.items[id] = descendant
+		}
+	}
+	item.DeletedAt, item.DeletedWith = nil, nil
+	item.Version = conv.Pointer(*item.Version + 1)
+	m.items[itemId] = item
+	m.touchList(listId)
+	restored := cloneItem(item.TodoItem)
+	err := m.recordItem(ctx, RevisionRestoreItem, listId, nil, nil, &restored)
+	if err != nil {
+		return nil, err
+	}
+	list, _ := m.list(listId)
+	return findTodoItem(m.todoList(list).Items, itemId), nil
+}
+
+// PurgeDeleted removes the lists and items that were moved to the trash
+// before a point in time and returns how many were removed. Items removed
+// with their list or parent are only counted if they were in the trash
+// themselves.
+func (m *Memory) PurgeDeleted(ctx context.Context, before time.Time) (int64, error) {
+	defer m.lock(ctx)()
+	var removed int64
+	var purged []uuid.UUID
+	for id, item := range m.items {
+		if item.DeletedAt != nil && item.DeletedAt.Before(before) {
+			removed++
+			purged = append(purged, id)
+		}
+	}
+	for _, id := range purged {
+		for _, id := range m.subtree(id) {
+			delete(m.items, id)
+		}
+	}
+	for id, list := range m.lists {
+		if list.DeletedAt == nil || !list.DeletedAt.Before(before) {
+			continue
+		}
+		removed++
+		delete(m.lists, id)
+		maps.DeleteFunc(m.items, func(_ uuid.UUID, item memoryItem) bool {
+			return item.list == id
+		})
+		maps.DeleteFunc(m.members, func(key memberKey, _ string) bool {
+			return key.list == id
+		})
+		m.revisions = slices.DeleteFunc(m.revisions, func(rev Revision) bool {
+			return *rev.List == id
+		})
+	}
+	return removed, nil
+}
+
+// recordItem records a change to an item of a list, given as the item before
+// and after it, without children.
+func (m *Memory) recordItem(ctx context.Context, action string, listId uuid.UUID, from *uuid.UUID, before *TodoItem, after *TodoItem) error {
+	rev, err := itemRevision(ctx, action, listId, from, before, after)
+	if err != nil {
+		return err
+	}
+	m.addRevision(rev)
+	return nil
+}
+
+// recordList records a change to a list, given as the list before and after
+// it, without items.
+func (m *Memory) recordList(ctx context.Context, action string, listId uuid.UUID, before *TodoList, after *TodoList) error {
+	rev, err := listRevision(ctx, action, listId, before, after)
+	if err != nil {
+		return err
+	}
+	m.addRevision(rev)
+	return nil
+}
+
+func (m *Memory) addRevision(rev Revision) {
+	m.revisionSeq++
+	rev.ID = conv.Pointer(m.revisionSeq)
+	m.revisions = append(m.revisions, rev)
+}
+
+func cloneRevision(rev Revision) Revision {
+	return Revision{
+		ID:        clone(rev.ID),
+		List:      clone(rev.List),
+		FromList:  clone(rev.FromList),
+		Item:      clone(rev.Item),
+		Action:    clone(rev.Action),
+		AuthorID:  clone(rev.AuthorID),
+		CreatedAt: clone(rev.CreatedAt),
+		Undoes:    clone(rev.Undoes),
+		Before:    clone(rev.Before),
+		After:     clone(rev.After),
+	}
+}
+
+// GetListHistory returns the revisions of a list and of the items in it,
+// including the moves of items away from it, most recent first.
+func (m *Memory) GetListHistory(ctx context.Context, listId uuid.UUID) ([]Revision, error) {
+	defer m.lock(ctx)()
+	return m.history(func(rev Revision) bool {
+		return *rev.List == listId || (rev.FromList != nil && *rev.FromList == listId)
+	}), nil
+}
+
+// GetItemHistory returns the revisions of an item made in a list, or when it
+// was moved to or from the list, most recent first.
+func (m *Memory) GetItemHistory(ctx context.Context, listId uuid.UUID, itemId uuid.UUID) ([]Revision, error) {
+	defer m.lock(ctx)()
+	return m.history(func(rev Revision) bool {
+		if rev.Item == nil || *rev.Item != itemId {
+			return false
+		}
+		return *rev.List == listId || (rev.FromList != nil && *rev.FromList == listId)
+	}), nil
+}
+
+// history returns copies of the matching revisions, most recent first.
+func (m *Memory) history(match func(rev Revision) bool) []Revision {
+	revisions := make([]Revision, 0)
+	for i := len(m.revisions) - 1; i >= 0; i-- {
+		if match(m.revisions[i]) {
+			rev := cloneRevision(m.revisions[i])
+			rev.Author = m.userName(rev.AuthorID)
+			revisions = append(revisions, rev)
+		}
+	}
+	return revisions
+}
+
+// PurgeHistory removes the revisions made before a point in time and returns
+// how many were removed.
+func (m *Memory) PurgeHistory(ctx context.Context, before time.Time) (int64, error) {
+	defer m.lock(ctx)()
+	n := len(m.revisions)
+	m.revisions = slices.DeleteFunc(m.revisions, func(rev Revision) bool {
+		return rev.CreatedAt.Before(before)
+	})
+	return int64(n - len(m.revisions)), nil
+}
+
+// GetRevision returns a single revision.
+func (m *Memory) GetRevision(ctx context.Context, id int64) (*Revision, error) {
+	defer m.lock(ctx)()
+	return m.revision(func(rev Revision) bool {
+		return *rev.ID == id
+	})
+}
+
+// revision returns a copy of the most recent matching revision.
+func (m *Memory) revision(match func(rev Revision) bool) (*Revision, error) {
+	for i := len(m.revisions) - 1; i >= 0; i-- {
+		if match(m.revisions[i]) {
+			rev := cloneRevision(m.revisions[i])
+			rev.Author = m.userName(rev.AuthorID)
+			return &rev, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+// UndoRevision reverts the change of a revision and returns the revision of
+// the change that reverted it. It returns ErrConflict if the revision has
+// been undone already or the list or item has since changed in a way that
+// prevents reverting it.
+func (m *Memory) UndoRevision(ctx context.Context, id int64) (*Revision, error) {
+	defer m.lock(ctx)()
+	rev, err := m.revision(func(rev Revision) bool {
+		return *rev.ID == id
+	})
+	if err != nil {
+		return nil, err
+	}
+	undone := slices.ContainsFunc(m.revisions, func(rev Revision) bool {
+		return rev.Undoes != nil && *rev.Undoes == id
+	})
+	if undone {
+		return nil, fmt.Errorf("%w: revision %d has been undone already", ErrConflict, id)
+	}
+	lists, items, revisions := maps.Clone(m.lists), maps.Clone(m.items), len(m.revisions)
+	err = m.undoRevision(undoing(ctx, id), *rev)
+	if err != nil {
+		m.lists, m.items, m.revisions = lists, items, m.revisions[:revisions]
+	}
+	if errors.Is(err, ErrNotFound) || errors.Is(err, ErrVersionMismatch) {
+		return nil, fmt.Errorf("%w: revision %d can no longer be undone", ErrConflict, id)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return m.revision(func(rev Revision) bool {
+		return rev.Undoes != nil && *rev.Undoes == id
+	})
+}
+
+func (m *Memory) undoRevision(ctx context.Context, rev Revision) error {
+	switch *rev.Action {
+	case RevisionAddList, RevisionRestoreList:
+		return m.removeTodoList(ctx, *rev.List, nil)
+	case RevisionRemoveList:
+		return errListRemoval
+	case RevisionFreezeList, RevisionUnfreezeList:
+		return m.setListFrozen(ctx, *rev.List, *rev.Action == RevisionUnfreezeList)
+	case RevisionAddItem, RevisionRestoreItem:
+		_, err := m.deleteTodoItem(ctx, *rev.List, *rev.Item, nil)
+		return err
+	case RevisionRemoveItem:
+		_, err := m.restoreTodoItem(ctx, *rev.List, *rev.Item)
+		return err
+	}
+
+	before, after, err := rev.Items()
+	if err != nil {
+		return err
+	}
+	current, err := m.getTodoItem(*rev.List, *rev.Item)
+	if err != nil {
+		return err
+	}
+	switch *rev.Action {
+	case RevisionUpdateItem, RevisionUpdateText:
+		todo, err := revertItem(*before, *after, *current)
+		if err != nil {
+			return err
+		}
+		_, err = m.updateTodoItem(ctx, *rev.List, todo)
+		return err
+	case RevisionMoveItem:
+		from := *rev.List
+		if rev.FromList != nil {
+			from = *rev.FromList
+		}
+		move, err := revertMove(*rev.List, from, *before, *after, *current, m.siblings(from, before.Parent))
+		if err != nil {
+			return err
+		}
+		_, _, err = m.moveTodoItem(ctx, *rev.List, *rev.Item, move)
+		return err
+	}
+	return fmt.Errorf("unknown revision action %q", *rev.Action)
+}
+
+// Search returns a page of the lists and items matching a query, best
+// matches first, and how many match in all.
+func (m *Memory) Search(ctx context.Context, query SearchQuery) ([]SearchResult, int, error) {
+	defer m.lock(ctx)()
+	results := make([]SearchResult, 0)
+	terms := searchTerms(*query.Text)
+	_, ok := m.users[*query.User]
+	if len(terms) == 0 || !ok {
+		return results, 0, nil
+	}
+	var lists []TodoList
+	for id, list := range m.lists {
+		_, member := m.members[memberKey{list: id, user: *query.User}]
+		switch {
+		case list.DeletedAt != nil, !ownedBy(list, *query.User) && !member:
+		case query.List != nil && id != *query.List:
+		case query.Owner != nil && !ownedBy(list, *query.Owner):
+		default:
+			lists = append(lists, list)
+		}
+	}
+	slices.SortFunc(lists, compareLists)
+	var matches []SearchResult
+	add := func(list TodoList, item *TodoItem, fields [3]string) {
+		score, snippet, ok := matchDocument(fields, terms)
+		if ok {
+			matches = append(matches, SearchResult{List: &list, Item: item, Snippet: &snippet, Score: &score})
+		}
+	}
+	for _, list := range lists {
+		list := cloneList(list)
+		if query.Marked == nil {
+			add(list, nil, [3]string{*list.Name, "", ""})
+		}
+		var items []TodoItem
+		for _, item := range m.items {
+			if item.list == *list.ID && item.DeletedAt == nil && (query.Marked == nil || *item.Marked == *query.Marked) {
+				items = append(items, cloneItem(item.TodoItem))
+			}
+		}
+		slices.SortFunc(items, compareItems)
+		for i := range items {
+			description := ""
+			if items[i].Description != nil {
+				description = *items[i].Description
+			}
+			add(list, &items[i], [3]string{"", *items[i].Text, description})
+		}
+	}
+	slices.SortStableFunc(matches, func(a SearchResult, b SearchResult) int {
+		return cmp.Compare(*b.Score, *a.Score)
+	})
+	start := min(query.Offset, len(matches))
+	end := min(start+query.Limit, len(matches))
+	return append(results, matches[start:end]...), len(matches), nil
+}
+
+// Sync applies the operations of a user in order and all at once. Operations
+// that fail with ErrNotFound, ErrConflict or ErrVersionMismatch are reported
+// in their result and do not prevent the others from being applied, while
+// any other error aborts the sync. Operations that have been applied before
+// are not applied again.
+func (m *Memory) Sync(ctx context.Context, userId uuid.UUID, ops []Operation) ([]OperationResult, error) {
+	defer m.lock(ctx)()
+	lists, items, operations := maps.Clone(m.lists), maps.Clone(m.items), maps.Clone(m.operations)
+	revisions := len(m.revisions)
+	results := make([]OperationResult, len(ops))
+	for i, op := range ops {
+		key := operationKey{user: userId, id: *op.ID}
+		_, applied := m.operations[key]
+		if applied {
+			results[i].Duplicate = true
+			continue
+		}
+
+		// Failed operations are rolled back on their own
+		opLists, opItems, opRevisions := maps.Clone(m.lists), maps.Clone(m.items), len(m.revisions)
+		var err error
+		results[i], err = m.applyOperation(ctx, op)
+		if errors.Is(err, ErrNotFound) || errors.Is(err, ErrConflict) || errors.Is(err, ErrVersionMismatch) {
+			results[i].Err = err
+			m.lists, m.items, m.revisions = opLists, opItems, m.revisions[:opRevisions]
+			continue
+		}
+		if err != nil {
+			m.lists, m.items, m.operations, m.revisions = lists, items, operations, m.revisions[:revisions]
+			return nil, err
+		}
+		m.operations[key] = time.Now().UTC()
+	}
+	return results, nil
+}
+
+func (m *Memory) applyOperation(ctx context.Context, op Operation) (result OperationResult, err error) {
+	switch *op.Type {
+	case OpAddItem:
+		result.Item, err = m.addTodoItem(ctx, *op.List, *op.Item)
+	case OpUpdateItem:
+		result.Old, err = m.getTodoItem(*op.List, *op.Item.ID)
+		if err != nil {
+			return
+		}
+		result.Item, err = m.updateTodoItem(ctx, *op.List, *op.Item)
+	case OpRemoveItem:
+		result.Old, err = m.deleteTodoItem(ctx, *op.List, *op.Item.ID, op.Item.Version)
+	case OpMoveItem:
+		to := *op.Move
+		to.Version = op.Item.Version
+		result.Old, result.Item, err = m.moveTodoItem(ctx, *op.List, *op.Item.ID, to)
+	default:
+		err = fmt.Errorf("unknown operation %q", *op.Type)
+	}
+	return
+}
+
+// RemoveOperations forgets the operations synced before the given time and
+// returns how many were removed.
+func (m *Memory) RemoveOperations(ctx context.Context, before time.Time) (int64, error) {
+	defer m.lock(ctx)()
+	var removed int64
+	maps.DeleteFunc(m.operations, func(_ operationKey, at time.Time) bool {
+		if at.Before(before) {
+			removed++
+			return true
+		}
+		return false
+	})
+	return removed, nil
+}
+
+// GetListAccess returns the role of a user in a list, or an empty role if the
+// list has not been shared with the user, and whether the list is frozen.
+func (m *Memory) GetListAccess(ctx context.Context, listId uuid.UUID, userId uuid.UUID) (role string, frozen bool, err error) {
+	defer m.lock(ctx)()
+	list, ok := m.list(listId)
+	if !ok {
+		return "", false, ErrNotFound
+	}
+	if ownedBy(list, userId) {
+		return RoleOwner, *list.Frozen, nil
+	}
+	return m.members[memberKey{list: listId, user: userId}], *list.Frozen, nil
+}
+
+// GetListMembers returns the users a list has been shared with.
+func (m *Memory) GetListMembers(ctx context.Context, listId uuid.UUID) ([]Member, error) {
+	defer m.lock(ctx)()
+	members := make([]Member, 0)
+	for key, role := range m.members {
+		user, ok := m.users[key.user]
+		if key.list != listId || !ok {
+			continue
+		}
+		members = append(members, Member{List: conv.Pointer(key.list), User: conv.Pointer(key.user), Name: clone(user.Name), Role: conv.Pointer(role)})
+	}
+	slices.SortFunc(members, func(a Member, b Member) int {
+		return cmp.Compare(*a.Name, *b.Name)
+	})
+	return members, nil
+}
+
+// GetMemberLists returns the lists a user owns or has been shared with.
+func (m *Memory) GetMemberLists(ctx context.Context, userId uuid.UUID) ([]uuid.UUID, error) {
+	defer m.lock(ctx)()
+	ids := make([]uuid.UUID, 0)
+	var lists []TodoList
+	for id, list := range m.lists {
+		_, member := m.members[memberKey{list: id, user: userId}]
+		if (ownedBy(list, userId) || member) && list.DeletedAt == nil {
+			lists = append(lists, list)
+		}
+	}
+	slices.SortFunc(lists, compareLists)
+	for _, list := range lists {
+		ids = append(ids, *list.ID)
+	}
+	return ids, nil
+}
+
+// SetListMember shares a list with a user, or changes the role of a user the
+// list is already shared with. It returns the member as stored.
+func (m *Memory) SetListMember(ctx context.Context, member Member) (*Member, error) {
+	defer m.lock(ctx)()
+	list, ok := m.list(*member.List)
+	if !ok {
+		return nil, ErrNotFound
+	}
+	user, ok := m.users[*member.User]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	if ownedBy(list, *member.User) {
+		// The owner always has every permission
+		return nil, ErrConflict
+	}
+	m.members[memberKey{list: *member.List, user: *member.User}] = *member.Role
+	return &Member{List: clone(member.List), User: clone(member.User), Name: clone(user.Name), Role: clone(member.Role)}, nil
+}
+
+// UpdateListMember changes the role of a user a list is shared with.
+func (m *Memory) UpdateListMember(ctx context.Context, member Member) (*Member, error) {
+	defer m.lock(ctx)()
+	key := memberKey{list: *member.List, user: *member.User}
+	_, shared := m.members[key]
+	_, ok := m.list(*member.List)
+	if !ok || !shared {
+		return nil, ErrNotFound
+	}
+	m.members[key] = *member.Role
+	user := m.users[*member.User]
+	return &Member{List: clone(member.List), User: clone(member.User), Name: clone(user.Name), Role: clone(member.Role)}, nil
+}
+
+// RemoveListMember stops sharing a list with a user.
+func (m *Memory) RemoveListMember(ctx context.Context, listId uuid.UUID, userId uuid.UUID) error {
+	defer m.lock(ctx)()
+	key := memberKey{list: listId, user: userId}
+	_, ok := m.members[key]
+	if !ok {
+		return ErrNotFound
+	}
+	delete(m.members, key)
+	return nil
+}
+
+// AppendEvent records an event in the event log and returns its sequence
+// number.
+func (m *Memory) AppendEvent(ctx context.Context, event Event) (int64, error) {
+	defer m.lock(ctx)()
+	m.seq++
+	stored := cloneEvent(event)
+	stored.Seq = conv.Pointer(m.seq)
+	if stored.CreatedAt == nil {
+		stored.CreatedAt = conv.Pointer(time.Now().UTC())
+	}
+	m.events = append(m.events, stored)
+	return m.seq, nil
+}
+
+// LatestEventSeq returns the sequence number of the most recent event.
+func (m *Memory) LatestEventSeq(ctx context.Context) (int64, error) {
+	defer m.lock(ctx)()
+	_, latest := m.eventBounds()
+	return latest, nil
+}
+
+// EventsSince returns the events of the lists that were recorded after seq,
+// in order. It returns ErrCompacted if any of them may have been removed.
+func (m *Memory) EventsSince(ctx context.Context, seq int64, lists []uuid.UUID) ([]Event, error) {
+	defer m.lock(ctx)()
+	horizon, latest := m.eventBounds()
+	if seq < horizon || seq > latest {
+		return nil, ErrCompacted
+	}
+	events := make([]Event, 0)
+	for _, event := range m.events {
+		if *event.Seq > seq && slices.Contains(lists, *event.List) {
+			events = append(events, cloneEvent(event))
+		}
+	}
+	return events, nil
+}
+
+// CompactEvents removes the events recorded before a point in time and
+// returns how many were removed.
+func (m *Memory) CompactEvents(ctx context.Context, before time.Time) (int64, error) {
+	defer m.lock(ctx)()
+	last := int64(-1)
+	for _, event := range m.events {
+		if event.CreatedAt.Before(before) {
+			last = max(last, *event.Seq)
+		}
+	}
+	if last < 0 {
+		return 0, nil
+	}
+	n := len(m.events)
+	m.events = slices.DeleteFunc(m.events, func(event Event) bool {
+		return *event.Seq <= last
+	})
+	m.horizon = max(m.horizon, last)
+	return int64(n - len(m.events)), nil
+}
+
+// eventBounds returns the compaction horizon and the latest sequence number.
+func (m *Memory) eventBounds() (horizon int64, latest int64) {
+	latest = m.horizon
+	if len(m.events) > 0 {
+		latest = max(latest, *m.events[len(m.events)-1].Seq)
+	}
+	return m.horizon, latest
+}
+
+// AddUser adds a user. It returns ErrConflict if the name is taken.
+func (m *Memory) AddUser(ctx context.Context, user User) error {
+	defer m.lock(ctx)()
+	for id, other := range m.users {
+		if id == *user.ID || *other.Name == *user.Name {
+			return ErrConflict
+		}
+	}
+	stored := *cloneUser(user)
+	stored.CreatedAt = conv.Pointer(time.Now().UTC())
+	if user.CreatedAt != nil {
+		stored.CreatedAt = conv.Pointer(user.CreatedAt.UTC())
+	}
+	m.users[*user.ID] = stored
+	return nil
+}
+
+// GetUserByName returns the user with the given name.
+func (m *Memory) GetUserByName(ctx context.Context, name string) (*User, error) {
+	defer m.lock(ctx)()
+	for _, user := range m.users {
+		if *user.Name == name {
+			return cloneUser(user), nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+// AddSession records a login.
+func (m *Memory) AddSession(ctx context.Context, session Session) error {
+	defer m.lock(ctx)()
+	_, exists := m.sessions[*session.TokenHash]
+	if exists {
+		return ErrConflict
+	}
+	m.sessions[*session.TokenHash] = Session{
+		TokenHash: clone(session.TokenHash),
+		User:      clone(session.User),
+		ExpiresAt: conv.Pointer(session.ExpiresAt.UTC()),
+	}
+	return nil
+}
+
+// GetSessionUser returns the user logged in with the session, unless the
+// session has expired.
+func (m *Memory) GetSessionUser(ctx context.Context, tokenHash string) (*User, error) {
+	defer m.lock(ctx)()
+	session, ok := m.sessions[tokenHash]
+	if !ok || !session.ExpiresAt.After(time.Now()) {
+		return nil, ErrNotFound
+	}
+	user, ok := m.users[*session.User]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return cloneUser(user), nil
+}
+
+// RemoveSession ends a login.
+func (m *Memory) RemoveSession(ctx context.Context, tokenHash string) error {
+	defer m.lock(ctx)()
+	delete(m.sessions, tokenHash)
+	return nil
+}
+
+// RemoveExpiredSessions removes the sessions that expired before a point in
+// time and returns how many were removed.
+func (m *Memory) RemoveExpiredSessions(ctx context.Context, before time.Time) (int64, error) {
+	defer m.lock(ctx)()
+	var removed int64
+	maps.DeleteFunc(m.sessions, func(_ string, session Session) bool {
+		if !session.ExpiresAt.After(before) {
+			removed++
+			return true
+		}
+		return false
+	})
+	return removed, nil
+}
+
+func (m *Memory) Close(ctx context.Context) error {
+	return nil
+}
@@ -0,0 +1,676 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ErrSchemaTooNew is returned when the database has been migrated by a newer
+// version of todoserv than the one currently running.
+var ErrSchemaTooNew = errors.New("database schema is newer than supported")
+
+// migration is a single, ordered step of the schema. Migrations are applied in
+// order of Version and must never be changed once released; add a new one
+// instead. The SQL they produce for SQLite has to stay the same when they
+// are adapted to other dialects.
+type migration struct {
+	Version int
+	Name    string
+	Up      func(ctx context.Context, tx *sqlTx) error
+
+	// Repair, if set, runs before Up to fix data that Up would refuse, and
+	// returns a description of every change it made.
+	Repair func(ctx context.Context, tx *sqlTx) ([]string, error)
+}
+
+// MigrationState describes a known migration and whether it has been applied.
+// Notes describe the data that was repaired when it was applied, and are
+// only known to the Migrate call that applied it.
+type MigrationState struct {
+	Version   int
+	Name      string
+	AppliedAt *time.Time
+	Notes     []string
+}
+
+var migrations = []migration{
+	{
+		Version: 1,
+		Name:    "initial schema",
+		Up: func(ctx context.Context, tx *sqlTx) error {
+			// Databases created before versioning already have these
+			// tables, which is why they are created conditionally.
+			_, err := tx.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS list (
+   id UUID PRIMARY KEY NOT NULL,
+   owner TEXT NOT NULL,
+   name TEXT NOT NULL
+);`)
+			if err != nil {
+				return err
+			}
+
+			// SQLite does not enforce the foreign key, which refers to a
+			// table that does not exist, and other databases refuse it.
+			foreignKey := ""
+			if tx.dialect == sqlite {
+				foreignKey = ",\n   FOREIGN KEY (list_id) REFERENCES lists(id)"
+			}
+			_, err = tx.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS list_item (
+   id UUID PRIMARY KEY NOT NULL,
+   list_id UUID NOT NULL,
+   text TEXT NOT NULL,
+   marked BOOLEAN NOT NULL`+foreignKey+`
+);`)
+			return err
+		},
+	},
+	{
+		Version: 2,
+		Name:    "item parents",
+		Up: func(ctx context.Context, tx *sqlTx) error {
+			_, err := tx.ExecContext(ctx, "ALTER TABLE list_item ADD COLUMN parent_id UUID NULL")
+			if err != nil {
+				return err
+			}
+			_, err = tx.ExecContext(ctx, "CREATE INDEX list_item_parent ON list_item (parent_id)")
+			return err
+		},
+	},
+	{
+		Version: 3,
+		Name:    "item prices",
+		Up: func(ctx context.Context, tx *sqlTx) error {
+			_, err := tx.ExecContext(ctx, "ALTER TABLE list_item ADD COLUMN price_amount "+tx.dialect.bigint+" NULL")
+			if err != nil {
+				return err
+			}
+			_, err = tx.ExecContext(ctx, "ALTER TABLE list_item ADD COLUMN price_currency TEXT NULL")
+			return err
+		},
+	},
+	{
+		Version: 4,
+		Name:    "item kinds",
+		Up: func(ctx context.Context, tx *sqlTx) error {
+			_, err := tx.ExecContext(ctx, "ALTER TABLE list_item ADD COLUMN kind TEXT NOT NULL DEFAULT ''")
+			if err != nil {
+				return err
+			}
+			_, err = tx.ExecContext(ctx, "ALTER TABLE list_item ADD COLUMN attributes TEXT NULL")
+			return err
+		},
+	},
+	{
+		Version: 5,
+		Name:    "event log",
+		Up: func(ctx context.Context, tx *sqlTx) error {
+			_, err := tx.ExecContext(ctx, `CREATE TABLE event (
+   seq `+tx.dialect.serial+`,
+   list_id UUID NOT NULL,
+   type TEXT NOT NULL,
+   data TEXT NOT NULL,
+   created_at TIMESTAMP NOT NULL
+);`)
+			if err != nil {
+				return err
+			}
+			_, err = tx.ExecContext(ctx, "CREATE INDEX event_list ON event (list_id, seq)")
+			if err != nil {
+				return err
+			}
+			// The horizon is the highest sequence number removed by
+			// compaction, so that replays from before it can be refused.
+			_, err = tx.ExecContext(ctx, "CREATE TABLE event_horizon (seq "+tx.dialect.bigint+" NOT NULL)")
+			if err != nil {
+				return err
+			}
+			_, err = tx.ExecContext(ctx, "INSERT INTO event_horizon (seq) VALUES (0)")
+			return err
+		},
+	},
+	{
+		Version: 6,
+		Name:    "users",
+		Repair:  findUnclaimedOwners,
+		Up: func(ctx context.Context, tx *sqlTx) error {
+			_, err := tx.ExecContext(ctx, `CREATE TABLE users (
+   id UUID PRIMARY KEY NOT NULL,
+   name TEXT NOT NULL UNIQUE,
+   password_hash TEXT NOT NULL,
+   created_at TIMESTAMP NOT NULL
+);`)
+			if err != nil {
+				return err
+			}
+			_, err = tx.ExecContext(ctx, `CREATE TABLE session (
+   token_hash TEXT PRIMARY KEY NOT NULL,
+   user_id UUID NOT NULL,
+   expires_at TIMESTAMP NOT NULL
+);`)
+			if err != nil {
+				return err
+			}
+			_, err = tx.ExecContext(ctx, "CREATE INDEX session_user ON session (user_id)")
+			if err != nil {
+				return err
+			}
+			// Lists are owned by users. The names that owned them so
+			// far belong to nobody yet, and are kept until the operator
+			// hands the lists over with fsck -repair.
+			for _, query := range []string{
+				"ALTER TABLE list ADD COLUMN owner_id UUID NULL REFERENCES users (id)",
+				"ALTER TABLE list ADD COLUMN unclaimed_owner TEXT NULL",
+				"UPDATE list SET unclaimed_owner = owner",
+				"ALTER TABLE list DROP COLUMN owner",
+				"CREATE INDEX list_owner ON list (owner_id)",
+			} {
+				_, err := tx.ExecContext(ctx, query)
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+	},
+	{
+		Version: 7,
+		Name:    "list members",
+		Up: func(ctx context.Context, tx *sqlTx) error {
+			_, err := tx.ExecContext(ctx, `CREATE TABLE list_member (
+   list_id UUID NOT NULL,
+   user_id UUID NOT NULL,
+   role TEXT NOT NULL,
+   PRIMARY KEY (list_id, user_id)
+);`)
+			if err != nil {
+				return err
+			}
+			_, err = tx.ExecContext(ctx, "CREATE INDEX list_member_user ON list_member (user_id)")
+			return err
+		},
+	},
+	{
+		Version: 8,
+		Name:    "frozen lists",
+		Up: func(ctx context.Context, tx *sqlTx) error {
+			_, err := tx.ExecContext(ctx, "ALTER TABLE list ADD COLUMN frozen BOOLEAN NOT NULL DEFAULT FALSE")
+			return err
+		},
+	},
+	{
+		Version: 9,
+		Name:    "positions",
+		Up: func(ctx context.Context, tx *sqlTx) error {
+			// Existing rows keep the order they were inserted in.
+			for _, table := range []string{"list", "list_item"} {
+				_, err := tx.ExecContext(ctx, "ALTER TABLE "+table+" ADD COLUMN position "+tx.dialect.bigint+" NOT NULL DEFAULT 0")
+				if err != nil {
+					return err
+				}
+				query := "UPDATE " + table + " SET position = rowid * ?"
+				if tx.dialect != sqlite {
+					query = "UPDATE " + table + " AS t SET position = r.n * ? FROM (SELECT id, row_number() OVER () AS n FROM " + table + ") AS r WHERE t.id = r.id"
+				}
+				_, err = tx.ExecContext(ctx, query, positionGap)
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+	},
+	{
+		Version: 10,
+		Name:    "row versions",
+		Up: func(ctx context.Context, tx *sqlTx) error {
+			for _, table := range []string{"list", "list_item"} {
+				_, err := tx.ExecContext(ctx, "ALTER TABLE "+table+" ADD COLUMN version "+tx.dialect.bigint+" NOT NULL DEFAULT 1")
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+	},
+	{
+		Version: 11,
+		Name:    "sync operations",
+		Up: func(ctx context.Context, tx *sqlTx) error {
+			_, err := tx.ExecContext(ctx, `CREATE TABLE sync_operation (
+   user_id UUID NOT NULL,
+   id TEXT NOT NULL,
+   created_at TIMESTAMP NOT NULL,
+   PRIMARY KEY (user_id, id)
+);`)
+			return err
+		},
+	},
+	{
+		Version: 12,
+		Name:    "item descriptions",
+		Up: func(ctx context.Context, tx *sqlTx) error {
+			_, err := tx.ExecContext(ctx, "ALTER TABLE list_item ADD COLUMN description TEXT NOT NULL DEFAULT ''")
+			return err
+		},
+	},
+	{
+		Version: 13,
+		Name:    "completion",
+		Up: func(ctx context.Context, tx *sqlTx) error {
+			for _, query := range []string{
+				"ALTER TABLE list_item ADD COLUMN completed_at TIMESTAMP",
+				"ALTER TABLE list_item ADD COLUMN completed_by_id UUID NULL REFERENCES users (id)",
+			} {
+				_, err := tx.ExecContext(ctx, query)
+				if err != nil {
+					return err
+				}
+			}
+			// Items marked before completion was recorded are taken to
+			// have been completed when the database is migrated, which
+			// is the latest they can have been, by nobody
+			_, err := tx.ExecContext(ctx, "UPDATE list_item SET completed_at = ? WHERE marked", time.Now().UTC())
+			return err
+		},
+	},
+	{
+		Version: 14,
+		Name:    "foreign keys",
+		Repair: func(ctx context.Context, tx *sqlTx) ([]string, error) {
+			return repairOrphans(ctx, tx, foreignKeyOrphans)
+		},
+		Up: func(ctx context.Context, tx *sqlTx) error {
+			if tx.dialect != sqlite {
+				for _, query := range []string{
+					"ALTER TABLE list_item ADD FOREIGN KEY (list_id) REFERENCES list (id) ON DELETE CASCADE",
+					"ALTER TABLE list_item ADD FOREIGN KEY (parent_id) REFERENCES list_item (id) ON DELETE CASCADE",
+					"ALTER TABLE list_member ADD FOREIGN KEY (list_id) REFERENCES list (id) ON DELETE CASCADE",
+					"ALTER TABLE list_member ADD FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE",
+					"ALTER TABLE session ADD FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE",
+					"ALTER TABLE sync_operation ADD FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE",
+					"CREATE INDEX list_item_list ON list_item (list_id)",
+				} {
+					_, err := tx.ExecContext(ctx, query)
+					if err != nil {
+						return err
+					}
+				}
+				return nil
+			}
+
+			// SQLite cannot add constraints to a table, so the tables are
+			// rebuilt, which also drops the foreign key of list_item that
+			// referred to a table that never existed.
+			err := rebuildTable(ctx, tx, "list_item",
+				"id, list_id, parent_id, text, marked, price_amount, price_currency, kind, attributes, description, completed_at, completed_by_id, position, version", `
+   id UUID PRIMARY KEY NOT NULL,
+   list_id UUID NOT NULL REFERENCES list (id) ON DELETE CASCADE,
+   parent_id UUID NULL REFERENCES list_item_new (id) ON DELETE CASCADE,
+   text TEXT NOT NULL,
+   marked BOOLEAN NOT NULL,
+   price_amount INTEGER NULL,
+   price_currency TEXT NULL,
+   kind TEXT NOT NULL DEFAULT '',
+   attributes TEXT NULL,
+   description TEXT NOT NULL DEFAULT '',
+   completed_at TIMESTAMP,
+   completed_by_id UUID NULL REFERENCES users (id),
+   position INTEGER NOT NULL DEFAULT 0,
+   version INTEGER NOT NULL DEFAULT 1
+`, "CREATE INDEX list_item_parent ON list_item (parent_id)", "CREATE INDEX list_item_list ON list_item (list_id)")
+			if err != nil {
+				return err
+			}
+			err = rebuildTable(ctx, tx, "list_member", "list_id, user_id, role", `
+   list_id UUID NOT NULL REFERENCES list (id) ON DELETE CASCADE,
+   user_id UUID NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+   role TEXT NOT NULL,
+   PRIMARY KEY (list_id, user_id)
+`, "CREATE INDEX list_member_user ON list_member (user_id)")
+			if err != nil {
+				return err
+			}
+			err = rebuildTable(ctx, tx, "session", "token_hash, user_id, expires_at", `
+   token_hash TEXT PRIMARY KEY NOT NULL,
+   user_id UUID NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+   expires_at TIMESTAMP NOT NULL
+`, "CREATE INDEX session_user ON session (user_id)")
+			if err != nil {
+				return err
+			}
+			return rebuildTable(ctx, tx, "sync_operation", "user_id, id, created_at", `
+   user_id UUID NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+   id TEXT NOT NULL,
+   created_at TIMESTAMP NOT NULL,
+   PRIMARY KEY (user_id, id)
+`)
+		},
+	},
+	{
+		Version: 15,
+		Name:    "trash",
+		Up: func(ctx context.Context, tx *sqlTx) error {
+			for _, query := range []string{
+				"ALTER TABLE list ADD COLUMN deleted_at TIMESTAMP",
+				"ALTER TABLE list_item ADD COLUMN deleted_at TIMESTAMP",
+				"ALTER TABLE list_item ADD COLUMN deleted_with UUID NULL",
+				"CREATE INDEX list_deleted ON list (deleted_at)",
+				"CREATE INDEX list_item_deleted ON list_item (deleted_at)",
+			} {
+				_, err := tx.ExecContext(ctx, query)
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+	},
+	{
+		Version: 16,
+		Name:    "revisions",
+		Up: func(ctx context.Context, tx *sqlTx) error {
+			// Lists moved from are not referenced, so that the history
+			// of an item outlives the list it was moved from
+			_, err := tx.ExecContext(ctx, `CREATE TABLE revision (
+   id `+tx.dialect.serial+`,
+   list_id UUID NOT NULL REFERENCES list (id) ON DELETE CASCADE,
+   from_list_id UUID NULL,
+   item_id UUID NULL,
+   action TEXT NOT NULL,
+   author_id UUID NULL REFERENCES users (id),
+   created_at TIMESTAMP NOT NULL,
+   undoes `+tx.dialect.bigint+` NULL,
+   before_data TEXT NULL,
+   after_data TEXT NULL
+);`)
+			if err != nil {
+				return err
+			}
+			for _, query := range []string{
+				"CREATE INDEX revision_list ON revision (list_id, id)",
+				"CREATE INDEX revision_from_list ON revision (from_list_id)",
+				"CREATE INDEX revision_item ON revision (item_id)",
+				"CREATE INDEX revision_undoes ON revision (undoes)",
+				"CREATE INDEX revision_created_at ON revision (created_at)",
+			} {
+				_, err := tx.ExecContext(ctx, query)
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+	},
+	{
+		Version: 17,
+		Name:    "search",
+		Up: func(ctx context.Context, tx *sqlTx) error {
+			// Documents are removed by PurgeDeleted rather than by foreign
+			// keys, so that they can be removed from the full-text index
+			_, err := tx.ExecContext(ctx, `CREATE TABLE search_document (
+   id `+tx.dialect.serial+`,
+   list_id UUID NULL UNIQUE,
+   item_id UUID NULL UNIQUE,
+   name TEXT NOT NULL,
+   text TEXT NOT NULL,
+   description TEXT NOT NULL
+);`)
+			if err != nil {
+				return err
+			}
+			queries := []string{
+				"INSERT INTO search_document (list_id, name, text, description) SELECT id, name, '', '' FROM list",
+				"INSERT INTO search_document (item_id, name, text, description) SELECT id, '', text, COALESCE(description, '') FROM list_item",
+			}
+			if tx.dialect == sqlite {
+				queries = append(queries,
+					"CREATE VIRTUAL TABLE search USING fts5(name, text, description, content = 'search_document', content_rowid = 'id', tokenize = 'unicode61 remove_diacritics 2')",
+					"INSERT INTO search (search) VALUES ('rebuild')",
+				)
+			} else {
+				queries = append(queries, "CREATE INDEX search_document_text ON search_document USING GIN (to_tsvector('simple', name || ' ' || text || ' ' || description))")
+			}
+			for _, query := range queries {
+				_, err := tx.ExecContext(ctx, query)
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+	},
+}
+
+// foreignKeyOrphans are the orphans the foreign keys migration repairs. They
+// are a copy of the checks of fsck as they were when the migration was
+// written, so that changing those does not change how it upgrades databases.
+var foreignKeyOrphans = []orphanCheck{
+	{
+		problem: "item %s belongs to missing list %s",
+		table:   "list_item",
+		columns: "id, list_id",
+		where:   "list_id NOT IN (SELECT id FROM list)",
+		repair:  "DELETE FROM list_item WHERE ",
+		fix:     "removed",
+	},
+	{
+		problem: "item %s is below missing item %s",
+		table:   "list_item",
+		columns: "id, parent_id",
+		where:   "parent_id IS NOT NULL AND parent_id NOT IN (SELECT id FROM list_item)",
+		repair:  "UPDATE list_item SET parent_id = NULL WHERE ",
+		fix:     "moved to the top level",
+	},
+	{
+		problem: "item %s is below item %s of another list",
+		table:   "list_item",
+		columns: "id, parent_id",
+		where:   "parent_id IN (SELECT p.id FROM list_item AS p WHERE p.list_id <> list_item.list_id)",
+		repair:  "UPDATE list_item SET parent_id = NULL WHERE ",
+		fix:     "moved to the top level",
+	},
+	{
+		problem: "member %[2]s belongs to missing list %[1]s",
+		table:   "list_member",
+		columns: "list_id, user_id",
+		where:   "list_id NOT IN (SELECT id FROM list)",
+		repair:  "DELETE FROM list_member WHERE ",
+		fix:     "removed",
+	},
+	{
+		problem: "member of list %s is missing user %s",
+		table:   "list_member",
+		columns: "list_id, user_id",
+		where:   "user_id NOT IN (SELECT id FROM users)",
+		repair:  "DELETE FROM list_member WHERE ",
+		fix:     "removed",
+	},
+	{
+		problem: "a session belongs to missing user %[2]s",
+		table:   "session",
+		columns: "token_hash, user_id",
+		where:   "user_id NOT IN (SELECT id FROM users)",
+		repair:  "DELETE FROM session WHERE ",
+		fix:     "removed",
+	},
+	{
+		problem: "synced operation %[2]s belongs to missing user %[1]s",
+		table:   "sync_operation",
+		columns: "user_id, id",
+		where:   "user_id NOT IN (SELECT id FROM users)",
+		repair:  "DELETE FROM sync_operation WHERE ",
+		fix:     "removed",
+	},
+}
+
+// findUnclaimedOwners describes the lists the users migration leaves without
+// an owner, which are all of them, as no user exists before it.
+func findUnclaimedOwners(ctx context.Context, tx *sqlTx) ([]string, error) {
+	rows, err := tx.QueryContext(ctx, "SELECT id, owner FROM list ORDER BY id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var found []string
+	for rows.Next() {
+		var id, owner string
+		err = rows.Scan(&id, &owner)
+		if err != nil {
+			return nil, err
+		}
+		found = append(found, fmt.Sprintf("list %s is owned by %q, who has no account: fsck -repair hands it over once they register", id, owner))
+	}
+	return found, rows.Err()
+}
+
+// rebuildTable replaces an SQLite table by one with a new definition, copying
+// the columns of its rows. The definition refers to the table as table_new,
+// which is renamed once the old table has been dropped. Indexes are dropped
+// with the old table and have to be created again.
+func rebuildTable(ctx context.Context, tx *sqlTx, table string, columns string, definition string, indexes ...string) error {
+	queries := []string{
+		"CREATE TABLE " + table + "_new (" + definition + ")",
+		"INSERT INTO " + table + "_new (" + columns + ") SELECT " + columns + " FROM " + table,
+		"DROP TABLE " + table,
+		"ALTER TABLE " + table + "_new RENAME TO " + table,
+	}
+	for _, query := range append(queries, indexes...) {
+		_, err := tx.ExecContext(ctx, query)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// LatestVersion returns the schema version this build of todoserv expects.
+func LatestVersion() int {
+	return migrations[len(migrations)-1].Version
+}
+
+func createVersionTable(ctx context.Context, db *sqlDB) error {
+	_, err := db.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS schema_migration (
+   version INTEGER PRIMARY KEY NOT NULL,
+   name TEXT NOT NULL,
+   applied_at TIMESTAMP NOT NULL
+);`)
+	return err
+}
+
+// SchemaVersion returns the highest migration version applied to the database.
+func (d *DB) SchemaVersion(ctx context.Context) (int, error) {
+	var version sql.NullInt64
+	err := d.db.QueryRowContext(ctx, "SELECT MAX(version) FROM schema_migration").Scan(&version)
+	if err != nil {
+		return 0, err
+	}
+	return int(version.Int64), nil
+}
+
+// Migrations returns every migration known to this build together with the
+// time it was applied, if it has been.
+func (d *DB) Migrations(ctx context.Context) ([]MigrationState, error) {
+	rows, err := d.db.QueryContext(ctx, "SELECT version, name, applied_at FROM schema_migration ORDER BY version")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	applied := make(map[int]MigrationState)
+	for rows.Next() {
+		var state MigrationState
+		var at time.Time
+		err = rows.Scan(&state.Version, &state.Name, &at)
+		if err != nil {
+			return nil, err
+		}
+		state.AppliedAt = &at
+		applied[state.Version] = state
+	}
+	err = rows.Err()
+	if err != nil {
+		return nil, err
+	}
+
+	states := make([]MigrationState, 0, len(migrations))
+	for _, m := range migrations {
+		state, ok := applied[m.Version]
+		if !ok {
+			state = MigrationState{Version: m.Version, Name: m.Name}
+		}
+		delete(applied, m.Version)
+		states = append(states, state)
+	}
+
+	// Versions recorded by a newer build are reported as well, so that the
+	// caller can tell why the database is refused.
+	for _, state := range applied {
+		states = append(states, state)
+	}
+
+	return states, nil
+}
+
+// Migrate applies every pending migration, each in its own transaction, and
+// returns the migrations that were applied.
+func (d *DB) Migrate(ctx context.Context) ([]MigrationState, error) {
+	current, err := d.SchemaVersion(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if current > LatestVersion() {
+		return nil, fmt.Errorf("%w: database is at version %d, latest known is %d", ErrSchemaTooNew, current, LatestVersion())
+	}
+
+	var applied []MigrationState
+	for _, m := range migrations {
+		if m.Version <= current {
+			continue
+		}
+
+		at, notes, err := d.applyMigration(ctx, m)
+		if err != nil {
+			return applied, fmt.Errorf("migration %d (%s): %w", m.Version, m.Name, err)
+		}
+
+		applied = append(applied, MigrationState{Version: m.Version, Name: m.Name, AppliedAt: &at, Notes: notes})
+	}
+
+	return applied, nil
+}
+
+func (d *DB) applyMigration(ctx context.Context, m migration) (time.Time, []string, error) {
+	tx, err := d.db.BeginTx(ctx, &sql.TxOptions{
+		Isolation: sql.LevelSerializable,
+		ReadOnly:  false,
+	})
+	if err != nil {
+		return time.Time{}, nil, err
+	}
+	defer tx.Rollback()
+	var notes []string
+	if m.Repair != nil {
+		notes, err = m.Repair(ctx, tx)
+		if err != nil {
+			return time.Time{}, nil, err
+		}
+	}
+	err = m.Up(ctx, tx)
+	if err != nil {
+		return time.Time{}, nil, err
+	}
+	at := time.Now().UTC()
+	_, err = tx.ExecContext(ctx, "INSERT INTO schema_migration (version, name, applied_at) VALUES (?, ?, ?)", m.Version, m.Name, at)
+	if err != nil {
+		return time.Time{}, nil, err
+	}
+	err = tx.Commit()
+	if err != nil {
+		return time.Time{}, nil, err
+	}
+	return at, notes, nil
+}
@@ -0,0 +1,365 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/gofrs/uuid"
+)
+
+// Markers around the matches in the snippets of search results.
+const (
+	HighlightStart = "\x02"
+	HighlightEnd   = "\x03"
+)
+
+// snippetWords is about how many words of a matching text a snippet shows.
+const snippetWords = 12
+
+// SearchQuery selects the lists and items a user can read whose name, text or
+// description contain every word of Text, a word matching any word that
+// starts with it. List and Owner narrow the search down to a list or to the
+// lists of a user, and Marked to items that are or are not marked, which
+// leaves lists out.
+type SearchQuery struct {
+	User   *uuid.UUID
+	Text   *string
+	List   *uuid.UUID
+	Owner  *uuid.UUID
+	Marked *bool
+
+	Offset int
+	Limit  int
+}
+
+// SearchResult is a list or, if Item is set, an item of the list that
+// matches a search, without their items or children. Snippet is an excerpt
+// of the matching text with the matches between HighlightStart and
+// HighlightEnd, and a higher Score means a better match.
+type SearchResult struct {
+	List    *TodoList
+	Item    *TodoItem
+	Snippet *string
+	Score   *float64
+}
+
+// indexList stores the name of a list in the search index.
+func indexList(ctx context.Context, tx *sqlTx, listId uuid.UUID) error {
+	var name string
+	err := tx.QueryRowContext(ctx, "SELECT name FROM list WHERE id = ?", listId).Scan(&name)
+	if err != nil {
+		return err
+	}
+	return indexDocument(ctx, tx, "list_id", listId, [3]string{name, "", ""})
+}
+
+// indexItem stores the text and description of an item in the search index.
+func indexItem(ctx context.Context, tx *sqlTx, itemId uuid.UUID) error {
+	var text, description string
+	err := tx.QueryRowContext(ctx, "SELECT text, COALESCE(description, '') FROM list_item WHERE id = ?", itemId).Scan(&text, &description)
+	if err != nil {
+		return err
+	}
+	return indexDocument(ctx, tx, "item_id", itemId, [3]string{"", text, description})
+}
+
+// indexDocument replaces the name, text and description of the search
+// document of a list or item, which column identifies. The full-text index of
+// SQLite is not kept up to date by the database, since it does not know what
+// was indexed before.
+func indexDocument(ctx context.Context, tx *sqlTx, column string, id uuid.UUID, fields [3]string) error {
+	var doc int64
+	var old [3]string
+	err := tx.QueryRowContext(ctx, "SELECT id, name, text, description FROM search_document WHERE "+column+" = ?", id).Scan(&doc, &old[0], &old[1], &old[2])
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		err = tx.QueryRowContext(ctx, "INSERT INTO search_document ("+column+", name, text, description) VALUES (?, ?, ?, ?) RETURNING id", id, fields[0], fields[1], fields[2]).Scan(&doc)
+		if err != nil {
+			return err
+		}
+	case err != nil:
+		return err
+	case old == fields:
+		return nil
+	default:
+		err = unindexDocument(ctx, tx, doc, old)
+		if err != nil {
+			return err
+		}
+		_, err = tx.ExecContext(ctx, "UPDATE search_document SET name = ?, text = ?, description = ? WHERE id = ?", fields[0], fields[1], fields[2], doc)
+		if err != nil {
+			return err
+		}
+	}
+	if tx.dialect != sqlite {
+		return nil
+	}
+	_, err = tx.ExecContext(ctx, "INSERT INTO search (rowid, name, text, description) VALUES (?, ?, ?, ?)", doc, fields[0], fields[1], fields[2])
+	return err
+}
+
+// unindexDocument removes what was indexed of a search document from the
+// full-text index.
+func unindexDocument(ctx context.Context, tx *sqlTx, doc int64, old [3]string) error {
+	if tx.dialect != sqlite {
+		return nil
+	}
+	_, err := tx.ExecContext(ctx, "INSERT INTO search (search, rowid, name, text, description) VALUES ('delete', ?, ?, ?, ?)", doc, old[0], old[1], old[2])
+	return err
+}
+
+// removeOrphanDocuments removes the search documents of lists and items that
+// no longer exist.
+func removeOrphanDocuments(ctx context.Context, tx *sqlTx) error {
+	rows, err := tx.QueryContext(ctx, `SELECT id, name, text, description FROM search_document AS s
+   WHERE (s.item_id IS NOT NULL AND NOT EXISTS (SELECT 1 FROM list_item WHERE id = s.item_id))
+   OR (s.list_id IS NOT NULL AND NOT EXISTS (SELECT 1 FROM list WHERE id = s.list_id))`)
+	if err != nil {
+		return err
+	}
+	type document struct {
+		id     int64
+		fields [3]string
+	}
+	var orphans []document
+	for rows.Next() {
+		var doc document
+		err = rows.Scan(&doc.id, &doc.fields[0], &doc.fields[1], &doc.fields[2])
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		orphans = append(orphans, doc)
+	}
+	rows.Close()
+	err = rows.Err()
+	if err != nil {
+		return err
+	}
+	for _, doc := range orphans {
+		err = unindexDocument(ctx, tx, doc.id, doc.fields)
+		if err != nil {
+			return err
+		}
+		_, err = tx.ExecContext(ctx, "DELETE FROM search_document WHERE id = ?", doc.id)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// searchTerms returns the lower case words of a search, split at anything
+// but letters and digits. The memory store splits texts the same way and
+// SQLite's unicode61 tokenizer nearly so, though it also folds diacritics.
+// PostgreSQL's simple parser does not: it keeps e-mail addresses, host names,
+// paths and decimal numbers whole, and hyphenated words both whole and in
+// parts, so that a word within an address or number only matches at its
+// start.
+func searchTerms(text string) []string {
+	text = strings.ToLower(text)
+	var terms []string
+	for _, span := range wordSpans(text) {
+		terms = append(terms, text[span[0]:span[1]])
+	}
+	return terms
+}
+
+// matchQuery returns the full-text query of the dialect that matches every
+// term as a prefix.
+func matchQuery(d *dialect, terms []string) string {
+	quoted := make([]string, len(terms))
+	for i, term := range terms {
+		if d == sqlite {
+			quoted[i] = `"` + strings.ReplaceAll(term, `"`, `""`) + `"*`
+		} else {
+			quoted[i] = "'" + strings.NewReplacer(`\`, `\\`, "'", "''").Replace(term) + "':*"
+		}
+	}
+	if d == sqlite {
+		return strings.Join(quoted, " ")
+	}
+	return strings.Join(quoted, " & ")
+}
+
+// Search returns a page of the lists and items matching a query, best
+// matches first, and how many match in all.
+func (d *DB) Search(ctx context.Context, query SearchQuery) ([]SearchResult, int, error) {
+	results := make([]SearchResult, 0)
+	terms := searchTerms(*query.Text)
+	if len(terms) == 0 {
+		return results, 0, nil
+	}
+	tx, err := d.db.BeginTx(ctx, &sql.TxOptions{
+		Isolation: sql.LevelSerializable,
+		ReadOnly:  true,
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	defer tx.Rollback()
+
+	// Lists and items are weighted by where they match: names most, then
+	// texts and descriptions
+	match := matchQuery(tx.dialect, terms)
+	var from, where, snippet, score string
+	var snippetArgs, scoreArgs []any
+	if tx.dialect == sqlite {
+		from = "search JOIN search_document AS s ON s.id = search.rowid"
+		where = "search MATCH ?"
+		snippet = "snippet(search, -1, ?, ?, '…', " + strconv.Itoa(snippetWords) + ")"
+		snippetArgs = []any{HighlightStart, HighlightEnd}
+		score = "-bm25(search, 10.0, 5.0, 1.0)"
+	} else {
+		const document = "s.name || ' ' || s.text || ' ' || s.description"
+		from = "search_document AS s"
+		where = "to_tsvector('simple', " + document + ") @@ to_tsquery('simple', ?)"
+		snippet = "ts_headline('simple', " + document + ", to_tsquery('simple', ?), ?)"
+		snippetArgs = []any{match, `StartSel="` + HighlightStart + `", StopSel="` + HighlightEnd + `", MaxWords=` + strconv.Itoa(snippetWords) + ", MinWords=4"}
+		score = "ts_rank(setweight(to_tsvector('simple', s.name), 'A') || setweight(to_tsvector('simple', s.text), 'B') || setweight(to_tsvector('simple', s.description), 'D'), to_tsquery('simple', ?))"
+		scoreArgs = []any{match}
+	}
+	from += `
+   LEFT JOIN list_item AS i ON i.id = s.item_id
+   JOIN list AS l ON l.id = COALESCE(i.list_id, s.list_id)
+   JOIN users AS u ON u.id = ?
+   LEFT JOIN list_member AS m ON m.list_id = l.id AND m.user_id = u.id`
+	where += " AND (l.owner_id = u.id OR m.user_id IS NOT NULL) AND l.deleted_at IS NULL AND i.deleted_at IS NULL"
+	args := []any{*query.User, match}
+	if query.List != nil {
+		where += " AND l.id = ?"
+		args = append(args, *query.List)
+	}
+	if query.Owner != nil {
+		where += " AND l.owner_id = ?"
+		args = append(args, *query.Owner)
+	}
+	if query.Marked != nil {
+		where += " AND i.marked = ?"
+		args = append(args, *query.Marked)
+	}
+
+	var total int
+	err = tx.QueryRowContext(ctx, "SELECT COUNT(*) FROM "+from+" WHERE "+where, args...).Scan(&total)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	selectArgs := append(append(snippetArgs, scoreArgs...), args...)
+	selectArgs = append(selectArgs, query.Limit, query.Offset)
+	rows, err := tx.QueryContext(ctx, "SELECT "+listColumns+", "+itemColumns+", "+snippet+", "+score+" AS score FROM "+from+" WHERE "+where+" ORDER BY score DESC, s.id LIMIT ? OFFSET ?", selectArgs...)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var list TodoList
+		var item TodoItem
+		var result SearchResult
+		dest := append(scanList(&list), scanItem(&item)...)
+		err = rows.Scan(append(dest, &result.Snippet, &result.Score)...)
+		if err != nil {
+			return nil, 0, err
+		}
+		result.List = &list
+		if item.ID != nil {
+			result.Item = &item
+		}
+		results = append(results, result)
+	}
+	err = rows.Err()
+	if err != nil {
+		return nil, 0, err
+	}
+	return results, total, nil
+}
+
+// searchWeights weigh the matches in the name, text and description of a
+// search document, like the ranking of the SQL databases.
+var searchWeights = [3]float64{10, 5, 1}
+
+// wordSpans returns where the words of a text start and end.
+func wordSpans(text string) [][2]int {
+	var spans [][2]int
+	start := -1
+	for i, r := range text {
+		word := unicode.IsLetter(r) || unicode.IsDigit(r)
+		switch {
+		case word && start < 0:
+			start = i
+		case !word && start >= 0:
+			spans = append(spans, [2]int{start, i})
+			start = -1
+		}
+	}
+	if start >= 0 {
+		spans = append(spans, [2]int{start, len(text)})
+	}
+	return spans
+}
+
+// matchDocument returns the score of a search document and the snippet of
+// its best matching field, or false if it does not contain every term.
+func matchDocument(fields [3]string, terms []string) (score float64, snippet string, ok bool) {
+	found := make([]bool, len(terms))
+	best := -1.0
+	for f, text := range fields {
+		spans := wordSpans(text)
+		var matches []int
+		for w, span := range spans {
+			word := strings.ToLower(text[span[0]:span[1]])
+			for t, term := range terms {
+				if strings.HasPrefix(word, term) {
+					found[t] = true
+					matches = append(matches, w)
+					break
+				}
+			}
+		}
+		weighted := searchWeights[f] * float64(len(matches))
+		score += weighted
+		if len(matches) > 0 && weighted > best {
+			best = weighted
+			snippet = highlight(text, spans, matches)
+		}
+	}
+	for _, f := range found {
+		if !f {
+			return 0, "", false
+		}
+	}
+	return score, snippet, true
+}
+
+// highlight returns an excerpt of about snippetWords words of a text around
+// its first match, with the matching words marked.
+func highlight(text string, spans [][2]int, matches []int) string {
+	first := max(matches[0]-snippetWords/4, 0)
+	last := min(first+snippetWords, len(spans)) - 1
+	var b strings.Builder
+	if first > 0 {
+		b.WriteString("…")
+	}
+	pos := spans[first][0]
+	for _, w := range matches {
+		if w < first || w > last {
+			continue
+		}
+		b.WriteString(text[pos:spans[w][0]])
+		b.WriteString(HighlightStart + text[spans[w][0]:spans[w][1]] + HighlightEnd)
+		pos = spans[w][1]
+	}
+	end := len(text)
+	if last < len(spans)-1 {
+		end = spans[last][1]
+	}
+	b.WriteString(text[pos:end])
+	if end < len(text) {
+		b.WriteString("…")
+	}
+	return b.String()
+}
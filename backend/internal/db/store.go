@@ -0,0 +1,115 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/gofrs/uuid"
+)
+
+// Store keeps the lists, their members and events, and the users and their
+// sessions. Its methods are documented on DB.
+type Store interface {
+	Atomically(ctx context.Context, fn func(ctx context.Context) error) error
+
+	AddTodoList(ctx context.Context, todo TodoList) error
+	GetTodoLists(ctx context.Context) ([]*TodoList, error)
+	GetTodoList(ctx context.Context, id uuid.UUID) (*TodoList, error)
+	RemoveTodoList(ctx context.Context, id uuid.UUID, version *int64) error
+	SetListFrozen(ctx context.Context, id uuid.UUID, frozen bool) error
+
+	AddTodoItem(ctx context.Context, listId uuid.UUID, todo TodoItem) (*TodoItem, error)
+	UpdateTodoItem(ctx context.Context, listId uuid.UUID, todo TodoItem) (*TodoItem, error)
+	UpdateItemText(ctx context.Context, listId uuid.UUID, itemId uuid.UUID, field string, text string, version *int64) (*TodoItem, error)
+	DeleteTodoItem(ctx context.Context, listId uuid.UUID, itemId uuid.UUID, version *int64) (*TodoItem, error)
+	MoveTodoItem(ctx context.Context, listId uuid.UUID, itemId uuid.UUID, to Move) (old *TodoItem, moved *TodoItem, err error)
+
+	GetDeletedLists(ctx context.Context, userId uuid.UUID) ([]*TodoList, error)
+	GetDeletedItems(ctx context.Context, listId uuid.UUID) ([]TodoItem, error)
+	RestoreTodoList(ctx context.Context, id uuid.UUID) (*TodoList, error)
+	RestoreTodoItem(ctx context.Context, listId uuid.UUID, itemId uuid.UUID) (*TodoItem, error)
+	PurgeDeleted(ctx context.Context, before time.Time) (int64, error)
+
+	GetListHistory(ctx context.Context, listId uuid.UUID) ([]Revision, error)
+	GetItemHistory(ctx context.Context, listId uuid.UUID, itemId uuid.UUID) ([]Revision, error)
+	GetRevision(ctx context.Context, id int64) (*Revision, error)
+	UndoRevision(ctx context.Context, id int64) (*Revision, error)
+	PurgeHistory(ctx context.Context, before time.Time) (int64, error)
+
+	Search(ctx context.Context, query SearchQuery) ([]SearchResult, int, error)
+
+	Sync(ctx context.Context, userId uuid.UUID, ops []Operation) ([]OperationResult, error)
+	RemoveOperations(ctx context.Context, before time.Time) (int64, error)
+
+	GetListAccess(ctx context.Context, listId uuid.UUID, userId uuid.UUID) (role string, frozen bool, err error)
+	GetListMembers(ctx context.Context, listId uuid.UUID) ([]Member, error)
+	GetMemberLists(ctx context.Context, userId uuid.UUID) ([]uuid.UUID, error)
+	SetListMember(ctx context.Context, member Member) (*Member, error)
+	UpdateListMember(ctx context.Context, member Member) (*Member, error)
+	RemoveListMember(ctx context.Context, listId uuid.UUID, userId uuid.UUID) error
+
+	AppendEvent(ctx context.Context, event Event) (int64, error)
+	LatestEventSeq(ctx context.Context) (int64, error)
+	EventsSince(ctx context.Context, seq int64, lists []uuid.UUID) ([]Event, error)
+	CompactEvents(ctx context.Context, before time.Time) (int64, error)
+
+	AddUser(ctx context.Context, user User) error
+	GetUserByName(ctx context.Context, name string) (*User, error)
+	AddSession(ctx context.Context, session Session) error
+	GetSessionUser(ctx context.Context, tokenHash string) (*User, error)
+	RemoveSession(ctx context.Context, tokenHash string) error
+	RemoveExpiredSessions(ctx context.Context, before time.Time) (int64, error)
+
+	Close(ctx context.Context) error
+}
+
+var (
+	_ Store = (*DB)(nil)
+	_ Store = (*Memory)(nil)
+)
+
+// Kinds of stores.
+const (
+	StoreSQLite   = "sqlite"
+	StorePostgres = "postgres"
+	StoreMemory   = "memory"
+)
+
+type Options struct {
+	// Store is the kind of store to open. If it is empty, it is chosen by
+	// the scheme of DSN: postgres:// and postgresql:// select PostgreSQL,
+	// memory: the in-memory store and anything else is an SQLite path.
+	Store string
+	DSN   string
+
+	// SkipMigrations opens the database without applying pending
+	// migrations, which is used to inspect a database before migrating it.
+	SkipMigrations bool
+}
+
+// storeOf returns the kind of store opt refers to.
+func storeOf(opt Options) string {
+	switch {
+	case opt.Store != "":
+		return opt.Store
+	case strings.HasPrefix(opt.DSN, "postgres://"), strings.HasPrefix(opt.DSN, "postgresql://"):
+		return StorePostgres
+	case strings.HasPrefix(opt.DSN, "memory:"):
+		return StoreMemory
+	}
+	return StoreSQLite
+}
+
+// Open opens the store of opt.
+func Open(ctx context.Context, opt Options) (Store, error) {
+	switch kind := storeOf(opt); kind {
+	case StoreSQLite, StorePostgres:
+		return NewDB(ctx, opt)
+	case StoreMemory:
+		return NewMemory(), nil
+	default:
+		return nil, fmt.Errorf("unknown store %q", kind)
+	}
+}
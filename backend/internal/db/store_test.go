@@ -0,0 +1,92 @@
+package db_test
+
+import (
+	"context"
+	"database/sql"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"testing"
+	"todolist/internal/db"
+
+	"github.com/stretchr/testify/require"
+)
+
+// forEachStore runs a test against an empty store of every kind. SQLite uses
+// the database at path. PostgreSQL is only tested if TODO_TEST_POSTGRES is
+// set to a postgres:// URL, in a schema of its own that is dropped afterwards.
+func forEachStore(t *testing.T, path string, test func(t *testing.T, d db.Store)) {
+	ctx := context.Background()
+
+	t.Run("sqlite", func(t *testing.T) {
+		os.Remove(path)
+		t.Cleanup(func() {
+			os.Remove(path)
+		})
+		d, err := db.NewDB(ctx, db.Options{DSN: path})
+		require.NoError(t, err)
+		defer d.Close(ctx)
+		test(t, d)
+	})
+
+	t.Run("memory", func(t *testing.T) {
+		d, err := db.Open(ctx, db.Options{DSN: "memory:"})
+		require.NoError(t, err)
+		defer d.Close(ctx)
+		test(t, d)
+	})
+
+	t.Run("postgres", func(t *testing.T) {
+		dsn := os.Getenv("TODO_TEST_POSTGRES")
+		if dsn == "" {
+			t.Skip("TODO_TEST_POSTGRES is not set")
+		}
+		schema := strings.ToLower(regexp.MustCompile(`\W`).ReplaceAllString(t.Name(), "_"))
+		conn, err := sql.Open("pgx", dsn)
+		require.NoError(t, err)
+		_, err = conn.ExecContext(ctx, "DROP SCHEMA IF EXISTS "+schema+" CASCADE")
+		require.NoError(t, err)
+		_, err = conn.ExecContext(ctx, "CREATE SCHEMA "+schema)
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			conn.ExecContext(ctx, "DROP SCHEMA "+schema+" CASCADE")
+			conn.Close()
+		})
+
+		u, err := url.Parse(dsn)
+		require.NoError(t, err)
+		query := u.Query()
+		query.Set("search_path", schema)
+		u.RawQuery = query.Encode()
+		d, err := db.NewDB(ctx, db.Options{DSN: u.String()})
+		require.NoError(t, err)
+		defer d.Close(ctx)
+		test(t, d)
+	})
+}
+
+func TestOpen(t *testing.T) {
+	const path = "/tmp/test-open.db"
+	os.Remove(path)
+	t.Cleanup(func() {
+		os.Remove(path)
+	})
+	ctx := context.Background()
+
+	d, err := db.Open(ctx, db.Options{DSN: "memory:"})
+	require.NoError(t, err)
+	require.IsType(t, &db.Memory{}, d)
+
+	d, err = db.Open(ctx, db.Options{DSN: path})
+	require.NoError(t, err)
+	require.IsType(t, &db.DB{}, d)
+	require.NoError(t, d.Close(ctx))
+
+	d, err = db.Open(ctx, db.Options{Store: db.StoreMemory, DSN: path})
+	require.NoError(t, err)
+	require.IsType(t, &db.Memory{}, d)
+
+	_, err = db.Open(ctx, db.Options{Store: "oracle"})
+	require.Error(t, err)
+}
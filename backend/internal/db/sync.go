@@ -0,0 +1,96 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/gofrs/uuid"
+)
+
+// Sync applies the operations of a user in order and in a single
+// transaction. Operations that fail with ErrNotFound, ErrConflict or
+// ErrVersionMismatch are reported in their result and do not prevent the
+// others from being applied, while any other error aborts the sync.
+// Operations that have been applied before are not applied again.
+func (d *DB) Sync(ctx context.Context, userId uuid.UUID, ops []Operation) ([]OperationResult, error) {
+	tx, err := d.db.BeginTx(ctx, &sql.TxOptions{
+		Isolation: sql.LevelSerializable,
+		ReadOnly:  false,
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	results := make([]OperationResult, len(ops))
+	for i, op := range ops {
+		var applied bool
+		err = tx.QueryRowContext(ctx, "SELECT EXISTS (SELECT 1 FROM sync_operation WHERE user_id = ? AND id = ?)", userId, *op.ID).Scan(&applied)
+		if err != nil {
+			return nil, err
+		}
+		if applied {
+			results[i].Duplicate = true
+			continue
+		}
+
+		// Failed operations are rolled back on their own
+		_, err = tx.ExecContext(ctx, "SAVEPOINT operation")
+		if err != nil {
+			return nil, err
+		}
+		results[i], err = applyOperation(ctx, tx, op)
+		if errors.Is(err, ErrNotFound) || errors.Is(err, ErrConflict) || errors.Is(err, ErrVersionMismatch) {
+			results[i].Err = err
+			_, err = tx.ExecContext(ctx, "ROLLBACK TO operation")
+		} else if err == nil {
+			_, err = tx.ExecContext(ctx, "INSERT INTO sync_operation (user_id, id, created_at) VALUES (?, ?, ?)", userId, *op.ID, time.Now().UTC())
+		}
+		if err != nil {
+			return nil, err
+		}
+		_, err = tx.ExecContext(ctx, "RELEASE operation")
+		if err != nil {
+			return nil, err
+		}
+	}
+	err = tx.Commit()
+	if err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+func applyOperation(ctx context.Context, tx *sqlTx, op Operation) (result OperationResult, err error) {
+	switch *op.Type {
+	case OpAddItem:
+		result.Item, err = addTodoItem(ctx, tx, *op.List, *op.Item)
+	case OpUpdateItem:
+		result.Old, err = getTodoItem(ctx, tx, *op.List, *op.Item.ID)
+		if err != nil {
+			return
+		}
+		result.Item, err = updateTodoItem(ctx, tx, *op.List, *op.Item)
+	case OpRemoveItem:
+		result.Old, err = deleteTodoItem(ctx, tx, *op.List, *op.Item.ID, op.Item.Version)
+	case OpMoveItem:
+		to := *op.Move
+		to.Version = op.Item.Version
+		result.Old, result.Item, err = moveTodoItem(ctx, tx, *op.List, *op.Item.ID, to)
+	default:
+		err = fmt.Errorf("unknown operation %q", *op.Type)
+	}
+	return
+}
+
+// RemoveOperations forgets the operations synced before the given time and
+// returns how many were removed.
+func (d *DB) RemoveOperations(ctx context.Context, before time.Time) (int64, error) {
+	result, err := d.db.ExecContext(ctx, "DELETE FROM sync_operation WHERE created_at < ?", before.UTC())
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
@@ -0,0 +1,270 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"slices"
+	"time"
+
+	"github.com/gofrs/uuid"
+)
+
+// GetDeletedLists returns the lists in the trash that a user owns, most
+// recently deleted first, with the items they had when they were deleted.
+func (d *DB) GetDeletedLists(ctx context.Context, userId uuid.UUID) ([]*TodoList, error) {
+	tx, err := d.db.BeginTx(ctx, &sql.TxOptions{
+		Isolation: sql.LevelSerializable,
+		ReadOnly:  true,
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	lists, err := getTodoLists(ctx, tx, "WHERE l.deleted_at IS NOT NULL AND l.owner_id = ?", userId)
+	if err != nil {
+		return nil, err
+	}
+	slices.SortStableFunc(lists, compareDeletedLists)
+	return lists, nil
+}
+
+// compareDeletedLists orders lists in the trash, most recently deleted first.
+func compareDeletedLists(a *TodoList, b *TodoList) int {
+	return b.DeletedAt.Compare(*a.DeletedAt)
+}
+
+// GetDeletedItems returns the items of a list that are in the trash, most
+// recently deleted first. Items are returned with the descendants that were
+// deleted together with them.
+func (d *DB) GetDeletedItems(ctx context.Context, listId uuid.UUID) ([]TodoItem, error) {
+	tx, err := d.db.BeginTx(ctx, &sql.TxOptions{
+		Isolation: sql.LevelSerializable,
+		ReadOnly:  true,
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	var exists bool
+	err = tx.QueryRowContext(ctx, "SELECT EXISTS (SELECT 1 FROM list WHERE id = ? AND deleted_at IS NULL)", listId).Scan(&exists)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, ErrNotFound
+	}
+	rows, err := tx.QueryContext(ctx, "SELECT "+itemColumns+" FROM list_item AS i WHERE i.list_id = ? AND i.deleted_at IS NOT NULL ORDER BY i.deleted_at DESC, i.position, i.id", listId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []TodoItem
+	for rows.Next() {
+		var item TodoItem
+		err = rows.Scan(scanItem(&item)...)
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+	}
+	err = rows.Err()
+	if err != nil {
+		return nil, err
+	}
+	return buildTrash(items), nil
+}
+
+// buildTrash arranges items in the trash into the trees they were deleted
+// as, so that an item deleted before its parent is a root of its own.
+func buildTrash(items []TodoItem) []TodoItem {
+	return buildTreeFunc(items, func(item TodoItem, parent TodoItem) bool {
+		return *parent.DeletedWith == *item.DeletedWith
+	})
+}
+
+// findTodoItem returns the item with the given ID in a tree of items, or nil.
+func findTodoItem(items []TodoItem, id uuid.UUID) *TodoItem {
+	for i := range items {
+		if *items[i].ID == id {
+			return &items[i]
+		}
+		found := findTodoItem(items[i].Children, id)
+		if found != nil {
+			return found
+		}
+	}
+	return nil
+}
+
+// RestoreTodoList takes a list out of the trash and returns it with its
+// items.
+func (d *DB) RestoreTodoList(ctx context.Context, id uuid.UUID) (*TodoList, error) {
+	tx, err := d.db.BeginTx(ctx, &sql.TxOptions{
+		Isolation: sql.LevelSerializable,
+		ReadOnly:  false,
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	list, err := restoreTodoList(ctx, tx, id)
+	if err != nil {
+		return nil, err
+	}
+	err = tx.Commit()
+	if err != nil {
+		return nil, err
+	}
+	return list, nil
+}
+
+func restoreTodoList(ctx context.Context, tx *sqlTx, id uuid.UUID) (*TodoList, error) {
+	list, err := getList(ctx, tx, id)
+	if err != nil {
+		return nil, err
+	}
+	if list.DeletedAt == nil {
+		return nil, ErrNotFound
+	}
+	_, err = tx.ExecContext(ctx, "UPDATE list SET deleted_at = NULL, version = version + 1 WHERE id = ?", id)
+	if err != nil {
+		return nil, err
+	}
+	lists, err := getTodoLists(ctx, tx, "WHERE l.id = ?", id)
+	if err != nil {
+		return nil, err
+	}
+	err = recordList(ctx, tx, RevisionRestoreList, id, nil, lists[0])
+	if err != nil {
+		return nil, err
+	}
+	return lists[0], nil
+}
+
+// RestoreTodoItem takes an item of a list out of the trash, together with
+// the descendants that were deleted with it, and returns it as stored, with
+// its children. An item whose parent is still in the trash is restored at
+// the top level of the list.
+func (d *DB) RestoreTodoItem(ctx context.Context, listId uuid.UUID, itemId uuid.UUID) (*TodoItem, error) {
+	tx, err := d.db.BeginTx(ctx, &sql.TxOptions{
+		Isolation: sql.LevelSerializable,
+		ReadOnly:  false,
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	item, err := restoreTodoItem(ctx, tx, listId, itemId)
+	if err != nil {
+		return nil, err
+	}
+	err = tx.Commit()
+	if err != nil {
+		return nil, err
+	}
+	return item, nil
+}
+
+func restoreTodoItem(ctx context.Context, tx *sqlTx, listId uuid.UUID, itemId uuid.UUID) (*TodoItem, error) {
+	var item TodoItem
+	err := tx.QueryRowContext(ctx, "SELECT "+itemColumns+" FROM list_item AS i JOIN list AS l ON l.id = i.list_id WHERE i.id = ? AND i.list_id = ? AND i.deleted_at IS NOT NULL AND l.deleted_at IS NULL", itemId, listId).Scan(scanItem(&item)...)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	if item.Parent != nil {
+		_, err = getTodoItem(ctx, tx, listId, *item.Parent)
+		if errors.Is(err, ErrNotFound) {
+			siblings, err := getSiblings(ctx, tx, listId, nil)
+			if err != nil {
+				return nil, err
+			}
+			position := int64(positionGap)
+			if len(siblings) > 0 {
+				position = siblings[len(siblings)-1].position + positionGap
+			}
+			_, err = tx.ExecContext(ctx, "UPDATE list_item SET parent_id = NULL, position = ? WHERE id = ?", position, itemId)
+			if err != nil {
+				return nil, err
+			}
+		} else if err != nil {
+			return nil, err
+		}
+	}
+	// Descendants deleted before the item stay in the trash
+	_, err = tx.ExecContext(ctx, `WITH RECURSIVE subtree(id) AS (
+   SELECT id FROM list_item WHERE parent_id = ?
+   UNION ALL
+   SELECT i.id FROM list_item AS i JOIN subtree AS s ON i.parent_id = s.id
+)
+UPDATE list_item SET deleted_at = NULL, deleted_with = NULL WHERE id IN (SELECT id FROM subtree) AND deleted_with = ?`, itemId, *item.DeletedWith)
+	if err != nil {
+		return nil, err
+	}
+	_, err = tx.ExecContext(ctx, "UPDATE list_item SET deleted_at = NULL, deleted_with = NULL, version = version + 1 WHERE id = ?", itemId)
+	if err != nil {
+		return nil, err
+	}
+	err = touchList(ctx, tx, listId)
+	if err != nil {
+		return nil, err
+	}
+	restored, err := getTodoItem(ctx, tx, listId, itemId)
+	if err != nil {
+		return nil, err
+	}
+	err = recordItem(ctx, tx, RevisionRestoreItem, listId, nil, nil, restored)
+	if err != nil {
+		return nil, err
+	}
+	lists, err := getTodoLists(ctx, tx, "WHERE l.id = ?", listId)
+	if err != nil {
+		return nil, err
+	}
+	return findTodoItem(lists[0].Items, itemId), nil
+}
+
+// PurgeDeleted removes the lists and items that were moved to the trash
+// before a point in time and returns how many were removed. Items removed
+// with their list or parent are only counted if they were in the trash
+// themselves.
+func (d *DB) PurgeDeleted(ctx context.Context, before time.Time) (int64, error) {
+	tx, err := d.db.BeginTx(ctx, &sql.TxOptions{
+		Isolation: sql.LevelSerializable,
+		ReadOnly:  false,
+	})
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	// Descendants and the items of lists are removed by the foreign keys
+	var items int64
+	err = tx.QueryRowContext(ctx, "SELECT COUNT(*) FROM list_item WHERE deleted_at < ?", before.UTC()).Scan(&items)
+	if err != nil {
+		return 0, err
+	}
+	_, err = tx.ExecContext(ctx, "DELETE FROM list_item WHERE deleted_at < ?", before.UTC())
+	if err != nil {
+		return 0, err
+	}
+	result, err := tx.ExecContext(ctx, "DELETE FROM list WHERE deleted_at < ?", before.UTC())
+	if err != nil {
+		return 0, err
+	}
+	lists, err := result.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	err = removeOrphanDocuments(ctx, tx)
+	if err != nil {
+		return 0, err
+	}
+	err = tx.Commit()
+	if err != nil {
+		return 0, err
+	}
+	return lists + items, nil
+}
@@ -1,18 +1,195 @@
 package db
 
 import (
+	"time"
+
 	"github.com/gofrs/uuid"
 )
 
+// Roles of users in a list, from least to most privileged. The owner of a
+// list is not a member, but is reported with RoleOwner.
+const (
+	RoleViewer = "viewer"
+	RoleEditor = "editor"
+	RoleAdmin  = "admin"
+	RoleOwner  = "owner"
+)
+
 type TodoList struct {
 	ID    *uuid.UUID
-	Owner *string
 	Name  *string
 	Items []TodoItem
+
+	// OwnerID is the user who owns the list, or nil if nobody does. Owner
+	// is the name of that user; it is read from the users and ignored
+	// when the list is added.
+	OwnerID *uuid.UUID
+	Owner   *string
+
+	// Frozen lists may only be changed by their owner.
+	Frozen *bool
+
+	// Position orders the lists. It is assigned when the list is added.
+	Position *int64
+
+	// Version is incremented whenever the list or one of its items changes.
+	Version *int64
+
+	// DeletedAt is when the list was moved to the trash, or nil.
+	DeletedAt *time.Time
 }
 
 type TodoItem struct {
-	ID     *uuid.UUID
-	Text   *string
-	Marked *bool
+	ID       *uuid.UUID
+	Parent   *uuid.UUID
+	Text     *string
+	Marked   *bool
+	Children []TodoItem
+
+	// Kind is empty for plain items, and Attributes holds the JSON encoded
+	// fields required by the kind.
+	Kind       *string
+	Attributes *string
+
+	// Description is markdown. UpdateTodoItem leaves it unchanged if nil.
+	Description *string
+
+	// CompletedAt is when the item was last marked and CompletedByID the
+	// user who marked it, or nil while the item is not marked. They are
+	// recorded by the store, which only takes CompletedByID from the item
+	// being marked. CompletedBy is the name of that user, read from the
+	// users.
+	CompletedAt   *time.Time
+	CompletedByID *uuid.UUID
+	CompletedBy   *string
+
+	// PriceAmount is in minor units of the ISO 4217 PriceCurrency.
+	PriceAmount   *int64
+	PriceCurrency *string
+
+	// Position orders the item among its siblings. It is assigned when the
+	// item is added and changed by MoveTodoItem.
+	Position *int64
+
+	// Version is incremented whenever the item changes. When given to
+	// UpdateTodoItem, it is the version the item is expected to have.
+	Version *int64
+
+	// DeletedAt is when the item was moved to the trash, or nil, and
+	// DeletedWith the item whose deletion moved it there, which is the
+	// item itself or one of its ancestors.
+	DeletedAt   *time.Time
+	DeletedWith *uuid.UUID
+}
+
+// Move is the destination of an item. List defaults to the item's current
+// list and a nil Parent moves the item to the top level. Before or After
+// name a sibling at the destination to place the item next to; without
+// either the item is placed last. If Version is set, the item must still
+// have that version.
+type Move struct {
+	List    *uuid.UUID
+	Parent  *uuid.UUID
+	Before  *uuid.UUID
+	After   *uuid.UUID
+	Version *int64
+}
+
+// Event is a change to a list as recorded in the event log. Seq increases
+// monotonically with every recorded event.
+type Event struct {
+	Seq       *int64
+	List      *uuid.UUID
+	Type      *string
+	Data      *string
+	CreatedAt *time.Time
+}
+
+type User struct {
+	ID           *uuid.UUID
+	Name         *string
+	PasswordHash *string
+	CreatedAt    *time.Time
+}
+
+// Session is a login of a user. Only a hash of the session token is stored.
+type Session struct {
+	TokenHash *string
+	User      *uuid.UUID
+	ExpiresAt *time.Time
+}
+
+// Member is a user a list has been shared with.
+type Member struct {
+	List *uuid.UUID
+	User *uuid.UUID
+	Name *string
+	Role *string
+}
+
+// Types of operations applied by Sync.
+const (
+	OpAddItem    = "add-item"
+	OpUpdateItem = "update-item"
+	OpRemoveItem = "remove-item"
+	OpMoveItem   = "move-item"
+)
+
+// Operation is a change made by a client, possibly while it was offline. ID
+// is chosen by the client and makes applying the operation idempotent. Item
+// holds the item to add or update, or the identity of the item to remove or
+// move, and its Version is the version the change was based on, if any.
+type Operation struct {
+	ID   *string
+	Type *string
+	List *uuid.UUID
+	Item *TodoItem
+	Move *Move
+}
+
+// OperationResult is the outcome of an operation. Err is nil if the operation
+// was applied, now or, if Duplicate is set, by an earlier sync. Old and Item
+// are the item before and after the operation, without children.
+type OperationResult struct {
+	Err       error
+	Duplicate bool
+	Old       *TodoItem
+	Item      *TodoItem
+}
+
+// Actions recorded in revisions. Changes to items use the names of the
+// operations applied by Sync.
+const (
+	RevisionAddList      = "add-list"
+	RevisionRemoveList   = "remove-list"
+	RevisionRestoreList  = "restore-list"
+	RevisionFreezeList   = "freeze-list"
+	RevisionUnfreezeList = "unfreeze-list"
+
+	RevisionAddItem     = OpAddItem
+	RevisionUpdateItem  = OpUpdateItem
+	RevisionUpdateText  = "update-text"
+	RevisionRemoveItem  = OpRemoveItem
+	RevisionMoveItem    = OpMoveItem
+	RevisionRestoreItem = "restore-item"
+)
+
+// Revision is a change to a list or, if Item is set, to one of its items.
+// FromList is the list an item was moved from to List. AuthorID is the user
+// who made the change, if it was made by one, and Author their name; Undoes
+// is the revision the change undid. Before and After hold the JSON encoded list or
+// item, without items or children, as it was before and after the change;
+// Before is nil for additions and restores and After for removals.
+type Revision struct {
+	ID        *int64
+	List      *uuid.UUID
+	FromList  *uuid.UUID
+	Item      *uuid.UUID
+	Action    *string
+	AuthorID  *uuid.UUID
+	Author    *string
+	CreatedAt *time.Time
+	Undoes    *int64
+	Before    *string
+	After     *string
 }
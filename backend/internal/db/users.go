@@ -0,0 +1,103 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/gofrs/uuid"
+)
+
+// AddUser adds a user. It returns ErrConflict if the name is taken.
+func (d *DB) AddUser(ctx context.Context, user User) error {
+	tx, err := d.db.BeginTx(ctx, &sql.TxOptions{
+		Isolation: sql.LevelSerializable,
+		ReadOnly:  false,
+	})
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	var taken bool
+	err = tx.QueryRowContext(ctx, "SELECT EXISTS (SELECT 1 FROM users WHERE name = ?)", *user.Name).Scan(&taken)
+	if err != nil {
+		return err
+	}
+	if taken {
+		return ErrConflict
+	}
+	createdAt := time.Now().UTC()
+	if user.CreatedAt != nil {
+		createdAt = user.CreatedAt.UTC()
+	}
+	_, err = tx.ExecContext(ctx, "INSERT INTO users (id, name, password_hash, created_at) VALUES (?, ?, ?, ?)", *user.ID, *user.Name, *user.PasswordHash, createdAt)
+	if err != nil {
+		return err
+	}
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// GetUserByName returns the user with the given name.
+func (d *DB) GetUserByName(ctx context.Context, name string) (*User, error) {
+	return d.getUser(ctx, "name = ?", name)
+}
+
+// GetUser returns the user with the given ID.
+func (d *DB) GetUser(ctx context.Context, id uuid.UUID) (*User, error) {
+	return d.getUser(ctx, "id = ?", id)
+}
+
+func (d *DB) getUser(ctx context.Context, where string, args ...any) (*User, error) {
+	var user User
+	err := d.db.QueryRowContext(ctx, "SELECT id, name, password_hash, created_at FROM users WHERE "+where, args...).Scan(&user.ID, &user.Name, &user.PasswordHash, &user.CreatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+// AddSession records a login.
+func (d *DB) AddSession(ctx context.Context, session Session) error {
+	_, err := d.db.ExecContext(ctx, "INSERT INTO session (token_hash, user_id, expires_at) VALUES (?, ?, ?)", *session.TokenHash, *session.User, session.ExpiresAt.UTC())
+	return err
+}
+
+// GetSessionUser returns the user logged in with the session, unless the
+// session has expired.
+func (d *DB) GetSessionUser(ctx context.Context, tokenHash string) (*User, error) {
+	var user User
+	err := d.db.QueryRowContext(ctx, `SELECT u.id, u.name, u.password_hash, u.created_at FROM session AS s
+   JOIN users AS u ON u.id = s.user_id
+   WHERE s.token_hash = ? AND s.expires_at > ?`, tokenHash, time.Now().UTC()).Scan(&user.ID, &user.Name, &user.PasswordHash, &user.CreatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+// RemoveSession ends a login.
+func (d *DB) RemoveSession(ctx context.Context, tokenHash string) error {
+	_, err := d.db.ExecContext(ctx, "DELETE FROM session WHERE token_hash = ?", tokenHash)
+	return err
+}
+
+// RemoveExpiredSessions removes the sessions that expired before a point in
+// time and returns how many were removed.
+func (d *DB) RemoveExpiredSessions(ctx context.Context, before time.Time) (int64, error) {
+	result, err := d.db.ExecContext(ctx, "DELETE FROM session WHERE expires_at <= ?", before.UTC())
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
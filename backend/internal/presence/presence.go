@@ -0,0 +1,126 @@
+// Package presence keeps track of where clients are, such as which item they
+// are editing, for a limited time. Nothing is persisted: clients have to
+// refresh their presence before it expires.
+package presence
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Key identifies the presence of a client in a topic, such as a list.
+type Key struct {
+	Topic  string
+	Client string
+}
+
+// Entry is the presence of a client. Data is opaque to the tracker.
+type Entry struct {
+	Key
+	Data    any
+	Expires time.Time
+}
+
+// Tracker holds presences until they expire or are removed.
+type Tracker struct {
+	ttl     time.Duration
+	leave   func(Entry)
+	lock    sync.Mutex
+	entries map[Key]Entry
+	topics  map[string]map[Key]struct{}
+}
+
+// New returns a tracker keeping presences for ttl after they were last set.
+// leave is called, without the tracker locked, for every presence that
+// expires.
+func New(ctx context.Context, ttl time.Duration, leave func(Entry)) *Tracker {
+	t := &Tracker{
+		ttl:     ttl,
+		leave:   leave,
+		entries: make(map[Key]Entry),
+		topics:  make(map[string]map[Key]struct{}),
+	}
+	go t.expire(ctx)
+	return t
+}
+
+// Set sets or refreshes the presence of a client and returns the entry.
+func (t *Tracker) Set(key Key, data any) Entry {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	entry := Entry{Key: key, Data: data, Expires: time.Now().Add(t.ttl)}
+	t.entries[key] = entry
+	keys, ok := t.topics[key.Topic]
+	if !ok {
+		keys = make(map[Key]struct{})
+		t.topics[key.Topic] = keys
+	}
+	keys[key] = struct{}{}
+	return entry
+}
+
+// Remove removes the presence of a client and reports whether it was present.
+func (t *Tracker) Remove(key Key) (Entry, bool) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	entry, ok := t.entries[key]
+	if ok {
+		t.remove(key)
+	}
+	return entry, ok
+}
+
+func (t *Tracker) remove(key Key) {
+	delete(t.entries, key)
+	delete(t.topics[key.Topic], key)
+	if len(t.topics[key.Topic]) == 0 {
+		delete(t.topics, key.Topic)
+	}
+}
+
+// Topic returns the presences in a topic.
+func (t *Tracker) Topic(topic string) []Entry {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	entries := make([]Entry, 0, len(t.topics[topic]))
+	for key := range t.topics[topic] {
+		entries = append(entries, t.entries[key])
+	}
+	return entries
+}
+
+// Expire removes the presences that have expired by now and calls leave for
+// each of them.
+func (t *Tracker) Expire(now time.Time) {
+	var expired []Entry
+	t.lock.Lock()
+	for key, entry := range t.entries {
+		if !entry.Expires.After(now) {
+			expired = append(expired, entry)
+			t.remove(key)
+		}
+	}
+	t.lock.Unlock()
+
+	for _, entry := range expired {
+		t.leave(entry)
+	}
+}
+
+func (t *Tracker) expire(ctx context.Context) {
+	ticker := time.NewTicker(max(t.ttl/4, 100*time.Millisecond))
+	defer ticker.Stop()
+
+	for {
+		select {
+		case now := <-ticker.C:
+			t.Expire(now)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,41 @@
+package presence_test
+
+import (
+	"context"
+	"testing"
+	"time"
+	"todolist/internal/presence"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestExpiry(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var left []presence.Entry
+	tracker := presence.New(ctx, time.Hour, func(entry presence.Entry) {
+		left = append(left, entry)
+	})
+
+	a := presence.Key{Topic: "list/a", Client: "alice"}
+	b := presence.Key{Topic: "list/a", Client: "bob"}
+	entry := tracker.Set(a, 1)
+	tracker.Set(b, 2)
+	require.Len(t, tracker.Topic("list/a"), 2)
+	require.Empty(t, tracker.Topic("list/b"))
+
+	_, ok := tracker.Remove(b)
+	require.True(t, ok)
+	_, ok = tracker.Remove(b)
+	require.False(t, ok)
+
+	// Removed presences do not expire
+	tracker.Expire(entry.Expires.Add(-time.Second))
+	require.Empty(t, left)
+	tracker.Expire(entry.Expires)
+	require.Len(t, left, 1)
+	require.Equal(t, a, left[0].Key)
+	require.Equal(t, 1, left[0].Data)
+	require.Empty(t, tracker.Topic("list/a"))
+}
@@ -0,0 +1,91 @@
+package sse
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// Policy decides what happens when an event is sent to a session whose queue
+// is full.
+type Policy int
+
+const (
+	// PolicyDisconnect ends the session. The client reconnects and is sent
+	// the events it missed.
+	PolicyDisconnect Policy = iota
+
+	// PolicyDropOldest drops the oldest queued event to make room. The
+	// client is sent a ResetEvent in place of the dropped events, after
+	// which it has to fetch the state again.
+	PolicyDropOldest
+
+	// PolicyCoalesce replaces a queued event that has the same key as the
+	// new event, and ends the session if there is none.
+	PolicyCoalesce
+)
+
+var policies = map[Policy]string{
+	PolicyDisconnect: "disconnect",
+	PolicyDropOldest: "drop-oldest",
+	PolicyCoalesce:   "coalesce",
+}
+
+func (p Policy) String() string {
+	return policies[p]
+}
+
+// ParsePolicy returns the policy with the given name.
+func ParsePolicy(name string) (Policy, error) {
+	for p, n := range policies {
+		if n == name {
+			return p, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown policy %q", name)
+}
+
+// Options configure how a server treats slow clients.
+type Options struct {
+	// QueueSize is the number of events that may be waiting to be written
+	// to a session before Policy applies.
+	QueueSize int
+	Policy    Policy
+
+	// WriteTimeout is how long writing an event to a client may take before
+	// the session is ended. Zero means no timeout.
+	WriteTimeout time.Duration
+
+	// Heartbeat is the interval of the comments sent to keep idle
+	// connections open through proxies. Zero disables heartbeats.
+	Heartbeat time.Duration
+
+	// Retry is sent to clients as the time to wait before reconnecting.
+	// Zero leaves it up to the client.
+	Retry time.Duration
+}
+
+// DefaultOptions are used by servers created with zero Options.
+var DefaultOptions = Options{
+	QueueSize:    64,
+	Policy:       PolicyDisconnect,
+	WriteTimeout: 10 * time.Second,
+	Heartbeat:    30 * time.Second,
+	Retry:        3 * time.Second,
+}
+
+// Stats are counters of how a server has treated its sessions.
+type Stats struct {
+	Sessions  int    `json:"sessions"`
+	Dropped   uint64 `json:"dropped"`
+	Coalesced uint64 `json:"coalesced"`
+	Evicted   uint64 `json:"evicted"`
+	TimedOut  uint64 `json:"timedout"`
+}
+
+type counters struct {
+	dropped   atomic.Uint64
+	coalesced atomic.Uint64
+	evicted   atomic.Uint64
+	timedOut  atomic.Uint64
+}
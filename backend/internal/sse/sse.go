@@ -6,114 +6,326 @@ import (
 	"fmt"
 	"log/slog"
 	"net/http"
+	"os"
 	"strings"
 	"sync"
+	"time"
 )
 
-type Session struct {
-	ctx    context.Context
-	cancel context.CancelCauseFunc
-	logger *slog.Logger
-	events chan []byte
-	writer http.ResponseWriter
+// Event is a single server sent event. ID is optional and, when set, is sent
+// back by the client as Last-Event-ID when it reconnects. Name is optional and
+// selects the event listeners of the client; unnamed events are messages.
+// Events with the same non-empty Key supersede each other and may be
+// coalesced.
+type Event struct {
+	ID   string
+	Name string
+	Key  string
+	Data []byte
 }
 
-func newSession(ctx context.Context, logger *slog.Logger, w http.ResponseWriter) (*Session, error) {
-	ctx, cancel := context.WithCancelCause(ctx)
+// ResetEvent is the name of the event that PolicyDropOldest sends in place of
+// the events it dropped. It has no ID, as the events that follow it do not
+// follow on from those before it.
+const ResetEvent = "reset"
+
+var resetEvent = Event{Name: ResetEvent, Data: []byte("{}")}
+
+var (
+	errClosed       = errors.New("client connection closed or lost")
+	errSlowConsumer = errors.New("client is not keeping up with events")
+)
+
+type Session struct {
+	principal string
 
-	closeNotifier, ok := w.(http.CloseNotifier)
-	if !ok {
-		return nil, errors.New("close notification not supported")
+	ctx      context.Context
+	cancel   context.CancelCauseFunc
+	logger   *slog.Logger
+	writer   http.ResponseWriter
+	options  Options
+	counters *counters
+
+	lock   sync.Mutex
+	queue  []Event
+	notify chan struct{}
+
+	// lost is set when events have been dropped from the queue since it
+	// was last dequeued.
+	lost bool
+}
+
+func newSession(ctx context.Context, logger *slog.Logger, w http.ResponseWriter, r *http.Request, options Options, counters *counters) (*Session, error) {
+	if _, ok := w.(http.Flusher); !ok {
+		return nil, errors.New("streaming not supported")
 	}
 
-	closeNotify := closeNotifier.CloseNotify()
+	ctx, cancel := context.WithCancelCause(ctx)
 
 	go func() {
-		<-closeNotify
-		cancel(errors.New("client connection closed or lost"))
+		select {
+		case <-r.Context().Done():
+			cancel(errClosed)
+		case <-ctx.Done():
+		}
 	}()
 
 	return &Session{
-		ctx:    ctx,
-		logger: logger,
-		cancel: cancel,
-		events: make(chan []byte),
-		writer: w,
+		ctx:      ctx,
+		logger:   logger,
+		cancel:   cancel,
+		writer:   w,
+		options:  options,
+		counters: counters,
+		queue:    make([]Event, 0, options.QueueSize),
+		notify:   make(chan struct{}, 1),
 	}, nil
 }
 
-func (s *Session) Send(data []byte) {
+// Send queues an event for the client without waiting for it to be written.
+// If the queue is full, the policy of the server applies.
+func (s *Session) Send(event Event) {
+	s.enqueue(event, true)
+}
+
+// Preload queues events regardless of the queue size. It is meant for the
+// events a client is sent when it connects, such as a snapshot.
+func (s *Session) Preload(events ...Event) {
+	for _, event := range events {
+		s.enqueue(event, false)
+	}
+}
+
+func (s *Session) enqueue(event Event, bounded bool) {
 	if s.ctx.Err() != nil {
 		return
 	}
 
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if bounded && len(s.queue) >= s.options.QueueSize {
+		switch s.options.Policy {
+		case PolicyDropOldest:
+			s.queue = s.queue[1:]
+			s.lost = true
+			s.counters.dropped.Add(1)
+		case PolicyCoalesce:
+			if !s.coalesce(event) {
+				s.evict()
+				return
+			}
+		default:
+			s.evict()
+			return
+		}
+	}
+
+	s.queue = append(s.queue, event)
+
 	select {
-	case s.events <- data:
-	case <-s.ctx.Done():
+	case s.notify <- struct{}{}:
+	default:
+	}
+}
+
+// coalesce removes a queued event superseded by the given event.
+func (s *Session) coalesce(event Event) bool {
+	if event.Key == "" {
+		return false
+	}
+	for i := range s.queue {
+		if s.queue[i].Key == event.Key {
+			s.queue = append(s.queue[:i], s.queue[i+1:]...)
+			s.counters.coalesced.Add(1)
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Session) evict() {
+	s.logger.Info("evicting slow session", "queued", len(s.queue))
+	s.counters.evicted.Add(1)
+	s.queue = nil
+	s.cancel(errSlowConsumer)
+}
+
+func (s *Session) dequeue() []Event {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	events := s.queue
+	if s.lost {
+		events = append([]Event{resetEvent}, events...)
+		s.lost = false
 	}
+	s.queue = make([]Event, 0, s.options.QueueSize)
+	return events
 }
 
 func (s *Session) dispatch(tearDown func()) {
 	defer tearDown()
+	controller := http.NewResponseController(s.writer)
+
+	fail := func(err error) {
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			s.counters.timedOut.Add(1)
+		}
+		s.logger.Debug("failed to write to session", "error", err)
+		s.cancel(err)
+	}
+
+	if s.options.Retry > 0 {
+		err := s.write(controller, fmt.Sprintf("retry: %d\n\n", s.options.Retry.Milliseconds()))
+		if err != nil {
+			fail(err)
+			return
+		}
+	}
+
+	// Heartbeats are only sent once nothing has been written for the
+	// heartbeat interval
+	var heartbeat <-chan time.Time
+	idle := func() {}
+	if s.options.Heartbeat > 0 {
+		timer := time.NewTimer(s.options.Heartbeat)
+		defer timer.Stop()
+		heartbeat = timer.C
+		idle = func() {
+			if !timer.Stop() {
+				select {
+				case <-timer.C:
+				default:
+				}
+			}
+			timer.Reset(s.options.Heartbeat)
+		}
+	}
+
 	for {
 		select {
-		case data := <-s.events:
-			message := fmt.Sprintf("data: %s\n\n", data)
-			s.logger.Debug(strings.Trim(message, "\n"))
-			_, err := fmt.Fprint(s.writer, message)
+		case <-s.notify:
+			for _, event := range s.dequeue() {
+				err := s.write(controller, event.String())
+				if err != nil {
+					fail(err)
+					return
+				}
+			}
+			idle()
+		case <-heartbeat:
+			err := s.write(controller, ": heartbeat\n\n")
 			if err != nil {
-				s.logger.Debug("failed to write to session", "error", err)
-				s.cancel(err)
+				fail(err)
 				return
 			}
-			s.writer.(http.Flusher).Flush()
+			idle()
 		case <-s.ctx.Done():
 			return
 		}
 	}
 }
 
+// String formats the event as it is sent to the client.
+func (e Event) String() string {
+	var message strings.Builder
+	if e.ID != "" {
+		fmt.Fprintf(&message, "id: %s\n", e.ID)
+	}
+	if e.Name != "" {
+		fmt.Fprintf(&message, "event: %s\n", e.Name)
+	}
+	fmt.Fprintf(&message, "data: %s\n\n", e.Data)
+	return message.String()
+}
+
+func (s *Session) write(controller *http.ResponseController, message string) error {
+	if s.options.WriteTimeout > 0 {
+		err := controller.SetWriteDeadline(time.Now().Add(s.options.WriteTimeout))
+		if err != nil && !errors.Is(err, http.ErrNotSupported) {
+			return err
+		}
+	}
+
+	s.logger.Debug(strings.Trim(message, "\n"))
+	_, err := fmt.Fprint(s.writer, message)
+	if err != nil {
+		return err
+	}
+	return controller.Flush()
+}
+
 // Wait waits until the client session has ended
 func (s *Session) Wait() {
 	<-s.ctx.Done()
 }
 
+// Server fans out published data to the sessions subscribed to a topic.
 type Server struct {
 	ctx      context.Context
 	logger   *slog.Logger
-	sessions []*Session
+	options  Options
+	counters counters
+	sessions map[*Session]map[string]struct{}
+	topics   map[string]map[*Session]struct{}
 	sync.RWMutex
 }
 
-func New(ctx context.Context, logger *slog.Logger) *Server {
+func New(ctx context.Context, logger *slog.Logger, options Options) *Server {
+	if options == (Options{}) {
+		options = DefaultOptions
+	}
+	if options.QueueSize < 1 {
+		options.QueueSize = 1
+	}
+
 	return &Server{
 		ctx:      ctx,
 		logger:   logger,
-		sessions: make([]*Session, 0),
+		options:  options,
+		sessions: make(map[*Session]map[string]struct{}),
+		topics:   make(map[string]map[*Session]struct{}),
 	}
 }
 
-func (s *Server) NewSession(w http.ResponseWriter, r *http.Request) (*Session, error) {
+// Stats returns the current session count and event counters.
+func (s *Server) Stats() Stats {
+	s.RLock()
+	defer s.RUnlock()
+
+	return Stats{
+		Sessions:  len(s.sessions),
+		Dropped:   s.counters.dropped.Load(),
+		Coalesced: s.counters.coalesced.Load(),
+		Evicted:   s.counters.evicted.Load(),
+		TimedOut:  s.counters.timedOut.Load(),
+	}
+}
+
+// NewSession starts a session of a principal, such as a user, subscribed to
+// the given topics.
+func (s *Server) NewSession(w http.ResponseWriter, r *http.Request, principal string, topics ...string) (*Session, error) {
 	s.Lock()
 	defer s.Unlock()
 
-	session, err := newSession(s.ctx, s.logger, w)
+	session, err := newSession(s.ctx, s.logger, w, r, s.options, &s.counters)
 	if err != nil {
 		return nil, err
 	}
-	s.sessions = append(s.sessions, session)
+	session.principal = principal
+	s.sessions[session] = make(map[string]struct{})
+	s.subscribe(session, topics...)
 
 	go session.dispatch(func() {
 		s.Lock()
 		defer s.Unlock()
 
-		for i := 0; i < len(s.sessions); i++ {
-			if session == s.sessions[i] {
-				s.sessions = append(s.sessions[:i], s.sessions[i+1:]...)
-				s.logger.Info("session", "count", len(s.sessions))
-				break
-			}
+		for topic := range s.sessions[session] {
+			s.unsubscribe(session, topic)
 		}
+		delete(s.sessions, session)
+		s.logger.Info("session", "count", len(s.sessions))
 	})
 
 	s.logger.Info("session", "count", len(s.sessions))
@@ -121,11 +333,80 @@ func (s *Server) NewSession(w http.ResponseWriter, r *http.Request) (*Session, e
 	return session, nil
 }
 
-func (s *Server) Broadcast(data []byte) {
+// Subscribe adds topics to a session.
+func (s *Server) Subscribe(session *Session, topics ...string) {
+	s.Lock()
+	defer s.Unlock()
+
+	if _, ok := s.sessions[session]; !ok {
+		return
+	}
+	s.subscribe(session, topics...)
+}
+
+func (s *Server) subscribe(session *Session, topics ...string) {
+	for _, topic := range topics {
+		sessions, ok := s.topics[topic]
+		if !ok {
+			sessions = make(map[*Session]struct{})
+			s.topics[topic] = sessions
+		}
+		sessions[session] = struct{}{}
+		s.sessions[session][topic] = struct{}{}
+	}
+}
+
+// Unsubscribe removes topics from a session.
+func (s *Server) Unsubscribe(session *Session, topics ...string) {
+	s.Lock()
+	defer s.Unlock()
+
+	for _, topic := range topics {
+		s.unsubscribe(session, topic)
+	}
+}
+
+func (s *Server) unsubscribe(session *Session, topic string) {
+	delete(s.sessions[session], topic)
+	delete(s.topics[topic], session)
+	if len(s.topics[topic]) == 0 {
+		delete(s.topics, topic)
+	}
+}
+
+// UnsubscribePrincipal removes topics from every session of a principal, for
+// instance when the principal is no longer allowed to receive them.
+func (s *Server) UnsubscribePrincipal(principal string, topics ...string) {
+	s.Lock()
+	defer s.Unlock()
+
+	for _, topic := range topics {
+		for session := range s.topics[topic] {
+			if session.principal == principal {
+				s.unsubscribe(session, topic)
+			}
+		}
+	}
+}
+
+// CloseTopic unsubscribes every session from a topic that will not be
+// published to again.
+func (s *Server) CloseTopic(topic string) {
+	s.Lock()
+	defer s.Unlock()
+
+	for session := range s.topics[topic] {
+		delete(s.sessions[session], topic)
+	}
+	delete(s.topics, topic)
+}
+
+// Publish sends an event to every session subscribed to the topic.
+func (s *Server) Publish(topic string, event Event) {
 	s.RLock()
 	defer s.RUnlock()
 
-	for _, session := range s.sessions {
-		session.Send(data)
+	for session := range s.topics[topic] {
+		session.Send(event)
 	}
 }
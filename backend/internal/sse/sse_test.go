@@ -0,0 +1,195 @@
+package sse
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func testSession(t *testing.T, policy Policy, counters *counters) *Session {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/events", nil)
+	session, err := newSession(context.Background(), logger, w, r, Options{QueueSize: 2, Policy: policy}, counters)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		session.cancel(nil)
+	})
+	return session
+}
+
+func ids(events []Event) []string {
+	var out []string
+	for _, event := range events {
+		out = append(out, event.ID)
+	}
+	return out
+}
+
+func TestSessionPolicies(t *testing.T) {
+	t.Run("disconnect", func(t *testing.T) {
+		var c counters
+		s := testSession(t, PolicyDisconnect, &c)
+		s.Send(Event{ID: "1"})
+		s.Send(Event{ID: "2"})
+		require.NoError(t, s.ctx.Err())
+		s.Send(Event{ID: "3"})
+		require.ErrorIs(t, context.Cause(s.ctx), errSlowConsumer)
+		require.Equal(t, uint64(1), c.evicted.Load())
+	})
+
+	t.Run("drop oldest", func(t *testing.T) {
+		var c counters
+		s := testSession(t, PolicyDropOldest, &c)
+		s.Send(Event{ID: "1"})
+		s.Send(Event{ID: "2"})
+		s.Send(Event{ID: "3"})
+		require.NoError(t, s.ctx.Err())
+		events := s.dequeue()
+		require.Equal(t, []string{"", "2", "3"}, ids(events))
+		require.Equal(t, ResetEvent, events[0].Name)
+		require.Equal(t, uint64(1), c.dropped.Load())
+
+		// Clients are reset once for the events dropped in the meantime
+		s.Send(Event{ID: "4"})
+		require.Equal(t, []string{"4"}, ids(s.dequeue()))
+		s.Send(Event{ID: "5"})
+		s.Send(Event{ID: "6"})
+		s.Send(Event{ID: "7"})
+		s.Send(Event{ID: "8"})
+		require.Equal(t, []string{"", "7", "8"}, ids(s.dequeue()))
+		require.Equal(t, uint64(3), c.dropped.Load())
+	})
+
+	t.Run("coalesce", func(t *testing.T) {
+		var c counters
+		s := testSession(t, PolicyCoalesce, &c)
+		s.Send(Event{ID: "1", Key: "a"})
+		s.Send(Event{ID: "2", Key: "b"})
+		s.Send(Event{ID: "3", Key: "a"})
+		require.NoError(t, s.ctx.Err())
+		require.Equal(t, []string{"2", "3"}, ids(s.dequeue()))
+		require.Equal(t, uint64(1), c.coalesced.Load())
+
+		s.Send(Event{ID: "4", Key: "a"})
+		s.Send(Event{ID: "5", Key: "b"})
+		s.Send(Event{ID: "6", Key: "c"})
+		require.ErrorIs(t, context.Cause(s.ctx), errSlowConsumer)
+	})
+
+	t.Run("preload", func(t *testing.T) {
+		var c counters
+		s := testSession(t, PolicyDisconnect, &c)
+		s.Preload(Event{ID: "1"}, Event{ID: "2"}, Event{ID: "3"})
+		require.NoError(t, s.ctx.Err())
+		require.Equal(t, []string{"1", "2", "3"}, ids(s.dequeue()))
+	})
+}
+
+// recorder is a response recorder that may be read while being written to.
+type recorder struct {
+	*httptest.ResponseRecorder
+	lock sync.Mutex
+}
+
+func (r *recorder) Write(data []byte) (int, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.ResponseRecorder.Write(data)
+}
+
+func (r *recorder) String() string {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.Body.String()
+}
+
+func TestDispatch(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	server := New(context.Background(), logger, Options{})
+	w := &recorder{ResponseRecorder: httptest.NewRecorder()}
+	r := httptest.NewRequest("GET", "/events", nil)
+
+	session, err := server.NewSession(w, r, "alice", "a")
+	require.NoError(t, err)
+	session.Preload(Event{ID: "1", Data: []byte(`{}`)})
+	server.Publish("a", Event{ID: "2", Name: "add-item", Data: []byte(`{"x":1}`)})
+	server.Publish("b", Event{ID: "3", Name: "add-item", Data: []byte(`{"x":2}`)})
+
+	const expected = "retry: 3000\n\nid: 1\ndata: {}\n\nid: 2\nevent: add-item\ndata: {\"x\":1}\n\n"
+	require.Eventually(t, func() bool {
+		return w.String() == expected
+	}, time.Second, time.Millisecond)
+	require.Equal(t, 1, server.Stats().Sessions)
+
+	session.cancel(nil)
+	require.Eventually(t, func() bool {
+		return server.Stats().Sessions == 0
+	}, time.Second, time.Millisecond)
+}
+
+func TestHeartbeat(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	server := New(context.Background(), logger, Options{QueueSize: 1, Heartbeat: time.Millisecond})
+	w := &recorder{ResponseRecorder: httptest.NewRecorder()}
+	r := httptest.NewRequest("GET", "/events", nil)
+
+	session, err := server.NewSession(w, r, "alice")
+	require.NoError(t, err)
+	defer session.cancel(nil)
+
+	require.Eventually(t, func() bool {
+		return strings.HasPrefix(w.String(), ": heartbeat\n\n: heartbeat\n\n")
+	}, time.Second, time.Millisecond)
+}
+
+func TestHeartbeatWhenIdle(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	server := New(context.Background(), logger, Options{QueueSize: 8, Heartbeat: 50 * time.Millisecond})
+	w := &recorder{ResponseRecorder: httptest.NewRecorder()}
+	r := httptest.NewRequest("GET", "/events", nil)
+
+	session, err := server.NewSession(w, r, "alice", "a")
+	require.NoError(t, err)
+	defer session.cancel(nil)
+
+	// A busy stream is not sent heartbeats
+	for range 20 {
+		server.Publish("a", Event{Data: []byte(`{}`)})
+		time.Sleep(10 * time.Millisecond)
+	}
+	require.NotContains(t, w.String(), ": heartbeat")
+
+	require.Eventually(t, func() bool {
+		return strings.HasSuffix(w.String(), ": heartbeat\n\n")
+	}, time.Second, time.Millisecond)
+}
+
+func TestUnsubscribePrincipal(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	server := New(context.Background(), logger, Options{})
+	r := httptest.NewRequest("GET", "/events", nil)
+
+	alice, err := server.NewSession(httptest.NewRecorder(), r, "alice", "a", "b")
+	require.NoError(t, err)
+	defer alice.cancel(nil)
+	bob, err := server.NewSession(httptest.NewRecorder(), r, "bob", "a")
+	require.NoError(t, err)
+	defer bob.cancel(nil)
+
+	server.UnsubscribePrincipal("alice", "a")
+
+	server.RLock()
+	defer server.RUnlock()
+	require.Len(t, server.topics["a"], 1)
+	require.Contains(t, server.topics["a"], bob)
+	require.Contains(t, server.topics["b"], alice)
+	require.NotContains(t, server.sessions[alice], "a")
+}